@@ -45,15 +45,29 @@ func readJSON(extraction *common.Extraction) ([]common.Sample, error) {
 		return nil, fmt.Errorf("error unmarshalling hashes.json file: %v", err)
 	}
 
-	for _, sample := range samples {
-		for i := range sample.Paths {
-			sample.Paths[i] = filepath.Join(extraction.Path, sample.Paths[i])
+	for i, sample := range samples {
+		// Paths in hashes.json are relative to the extraction, which makes them the paths of the
+		// samples inside the source.
+		samples[i].SourcePaths = append([]string{}, sample.Paths...)
+		for j := range sample.Paths {
+			sample.Paths[j] = filepath.Join(extraction.Path, sample.Paths[j])
 		}
 	}
 
 	return samples, nil
 }
 
+// fileInfo returns the size and mode of the first valid sample path.
+func fileInfo(sample common.Sample) (int64, uint32) {
+	for _, path := range sample.Paths {
+		if fi, err := os.Lstat(path); err == nil {
+			return fi.Size(), uint32(fi.Mode())
+		}
+	}
+
+	return 0, 0
+}
+
 // Save saves the cache to a local file.
 func Save(repoName, cacheDir string, cacheMap *sync.Map) error {
 	// TODO(mlegin): Compress the file before saving it to disk.
@@ -140,13 +154,20 @@ func Check(extraction *common.Extraction, cache *sync.Map) ([]common.Sample, err
 
 	var exports []common.Sample
 	for _, sample := range samples {
+		size, mode := fileInfo(sample)
 		newCacheEntry := &cpb.CacheEntry{
 			SourceId:   extraction.SourceID,
 			SourceHash: extraction.SourceSHA256,
+			Path:       sample.SourcePaths,
+			Size:       size,
+			Mode:       mode,
 		}
 		newExport := common.Sample{
-			Sha256: sample.Sha256,
-			Paths:  sample.Paths,
+			Sha256:      sample.Sha256,
+			Paths:       sample.Paths,
+			SourcePaths: sample.SourcePaths,
+			Size:        size,
+			Mode:        mode,
 		}
 
 		if sampleCache, ok := cache.Load(sample.Sha256); ok {
@@ -15,6 +15,8 @@
 package cache
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"sync"
 	"testing"
@@ -200,60 +202,138 @@ func TestCheck(t *testing.T) {
 
 	wantSamples := []common.Sample{
 		{
-			Sha256: "d5d66fe6a4559c59ad103ab40e01c4fc0df7eb8ba901d50e5ceae3909b2e0d61",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.09"},
-			Upload: true,
+			Sha256:      "d5d66fe6a4559c59ad103ab40e01c4fc0df7eb8ba901d50e5ceae3909b2e0d61",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.09"},
+			Upload:      true,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.09"},
 		},
 		{
-			Sha256: "4878dd6c7af7fecdf89832384d84ed93b78123e69e6a0097efac5320da2ac637",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.02"},
-			Upload: true,
+			Sha256:      "4878dd6c7af7fecdf89832384d84ed93b78123e69e6a0097efac5320da2ac637",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.02"},
+			Upload:      true,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.02"},
 		},
 		{
-			Sha256: "ca8a605cf72b21b89f9211af1550d7f943a2b844084241f60eddd9d6536c78ec",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.10"},
-			Upload: false,
+			Sha256:      "ca8a605cf72b21b89f9211af1550d7f943a2b844084241f60eddd9d6536c78ec",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.10"},
+			Upload:      false,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.10"},
 		},
 		{
-			Sha256: "4741b2746859cbe24f529a4f3108c2d8b4ea5f442f8a3743ff3543c76f369c90",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.01"},
-			Upload: false,
+			Sha256:      "4741b2746859cbe24f529a4f3108c2d8b4ea5f442f8a3743ff3543c76f369c90",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.01"},
+			Upload:      false,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.01"},
 		},
 		{
-			Sha256: "d889bcc21cffc076d6e9cf7e32d0dd801977141e6f71d4c96ae84e5f1765e71a",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.07"},
-			Upload: false,
+			Sha256:      "d889bcc21cffc076d6e9cf7e32d0dd801977141e6f71d4c96ae84e5f1765e71a",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.07"},
+			Upload:      false,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.07"},
 		},
 		{
-			Sha256: "00632850049f80763ada81ec0cacf015dbd67fb1b956ec2acb8aa862e511b3bc",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.04"},
-			Upload: true,
+			Sha256:      "00632850049f80763ada81ec0cacf015dbd67fb1b956ec2acb8aa862e511b3bc",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.04"},
+			Upload:      true,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.04"},
 		},
 		{
-			Sha256: "b1f8a81821e18bba696a52b5169524076f77bc588c02ab195f969df4e2650dce",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.03"},
-			Upload: false,
+			Sha256:      "b1f8a81821e18bba696a52b5169524076f77bc588c02ab195f969df4e2650dce",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.03"},
+			Upload:      false,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.03"},
 		},
 		{
-			Sha256: "8780622e75a9c1be4b30ae9e15d6d94249926aaa9139b7a563e42ee0eab70eea",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.05"},
-			Upload: false,
+			Sha256:      "8780622e75a9c1be4b30ae9e15d6d94249926aaa9139b7a563e42ee0eab70eea",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.05"},
+			Upload:      false,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.05"},
 		},
 		{
-			Sha256: "99962d9e62c15c73527ca72b4e5e85809d4254326800eb2c65b35339029e02d1",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.06"},
-			Upload: true,
+			Sha256:      "99962d9e62c15c73527ca72b4e5e85809d4254326800eb2c65b35339029e02d1",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.06"},
+			Upload:      true,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.06"},
 		},
 		{
-			Sha256: "e0a98ad618a3cef7f8754a2711322e398879f47e50ca491c75eca6ba476e421a",
-			Paths:  []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.08"},
-			Upload: false,
+			Sha256:      "e0a98ad618a3cef7f8754a2711322e398879f47e50ca491c75eca6ba476e421a",
+			Paths:       []string{"testdata/gLinuxTestRepo/20200227.00.00/export/file.08"},
+			Upload:      false,
+			SourcePaths: []string{"/gLinuxTestRepo/20200227.00.00/export/file.08"},
 		},
 	}
 
 	if !cmp.Equal(wantSamples, gotSamples) {
 		t.Errorf("Check() unexpected diff (-want/+got):\n%s", cmp.Diff(wantSamples, gotSamples))
 	}
+
+	wantEntry := &cpb.CacheEntry{
+		SourceId:   "20200227.00.00-desktop",
+		SourceHash: "6e0290d62f6db1779d6318df50209de8c9b93adb29b7dd46e7b563f044103b40",
+		Path:       []string{"/gLinuxTestRepo/20200227.00.00/export/file.09"},
+	}
+
+	gotEntries, ok := cacheMap.Load("d5d66fe6a4559c59ad103ab40e01c4fc0df7eb8ba901d50e5ceae3909b2e0d61")
+	if !ok {
+		t.Fatal("Check() did not add new sample to the cache")
+	}
+
+	if diff := cmp.Diff(wantEntry, gotEntries.(*cpb.Entries).GetEntries()[0], protocmp.Transform()); diff != "" {
+		t.Errorf("Check() unexpected cache entry diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestCheckFileInfo(t *testing.T) {
+	extraction := &common.Extraction{
+		SourceID:     "fileinfo",
+		RepoName:     "gLinux",
+		Path:         filepath.Join(testdataPath, "fileinfo"),
+		SourceSHA256: "6e0290d62f6db1779d6318df50209de8c9b93adb29b7dd46e7b563f044103b40",
+	}
+
+	// Git only keeps the executable bit, so permissions are set explicitly to not depend on umask.
+	for path, mode := range map[string]os.FileMode{"usr/bin/hashr": 0755, "etc/hashr.conf": 0644} {
+		if err := os.Chmod(filepath.Join(extraction.Path, path), mode); err != nil {
+			t.Fatalf("could not set mode of %s: %v", path, err)
+		}
+	}
+
+	var cacheMap sync.Map
+	gotSamples, err := Check(extraction, &cacheMap)
+	if err != nil {
+		t.Fatalf("unexpected error while checking cache: %v", err)
+	}
+
+	// Size and mode are taken from the first path that exists.
+	wantSamples := []common.Sample{
+		{
+			Sha256:      "a2ef7972a30ef8211da0af801b7c05b3bdbd5f399b597b62b29d7c9392a1bd6b",
+			Paths:       []string{"testdata/fileinfo/usr/bin/hashr"},
+			Upload:      true,
+			SourcePaths: []string{"/usr/bin/hashr"},
+			Size:        21,
+			Mode:        0755,
+		},
+		{
+			Sha256:      "38274f3023928e5575c0b900191dd627f903f54ae7b5c2cbe990cc2a6fa409dd",
+			Paths:       []string{"testdata/fileinfo/missing", "testdata/fileinfo/etc/hashr.conf"},
+			Upload:      true,
+			SourcePaths: []string{"/missing", "/etc/hashr.conf"},
+			Size:        8,
+			Mode:        0644,
+		},
+	}
+	if !cmp.Equal(wantSamples, gotSamples) {
+		t.Errorf("Check() unexpected diff (-want/+got):\n%s", cmp.Diff(wantSamples, gotSamples))
+	}
+
+	gotEntries, ok := cacheMap.Load("a2ef7972a30ef8211da0af801b7c05b3bdbd5f399b597b62b29d7c9392a1bd6b")
+	if !ok {
+		t.Fatal("Check() did not add new sample to the cache")
+	}
+	if entry := gotEntries.(*cpb.Entries).GetEntries()[0]; entry.GetSize() != 21 || entry.GetMode() != 0755 {
+		t.Errorf("Check() cache entry size = %d, mode = %o; want 21, 755", entry.GetSize(), entry.GetMode())
+	}
 }
 
 // cloneProtoMap clones a map[K]M where M must be a proto.Message type.
@@ -0,0 +1,333 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"github.com/google/hashr/core/hashr"
+	"github.com/google/hashr/migrations"
+	"github.com/google/hashr/samplestore"
+)
+
+const jobsUsage = `usage: hashr [flags] jobs <command>
+
+Commands:
+  list [-repo name] [-status status] [-since time] [-until time] [-error text] [-limit n] [-offset n]
+                                  List processing jobs matching given criteria.
+  show <quick_sha256>             Show details and history of a processing job.
+  history <quick_sha256>          Show the state transitions of a processing job.
+  reprocess <quick_sha256>...     Mark processing jobs for reprocessing.
+
+Times are given in RFC 3339 (2006-01-02T15:04:05Z) or date (2006-01-02) format.`
+
+const migrateUsage = `usage: hashr [flags] migrate [postgres|cloudspanner]
+
+Applies pending schema migrations to the PostgreSQL or Cloud Spanner database used for job storage
+and exporters. By default the database given by the storage flag is migrated.`
+
+const samplesUsage = `usage: hashr [flags] samples gc [-dry_run]
+
+Removes samples saved to the export_path sample store that are no longer referenced by any source
+manifest. With -dry_run, only reports what would be removed. Should not be run while hashR saves
+samples to the same store.`
+
+// runCommand runs hashR command given in the non-flag command-line arguments.
+func runCommand(ctx context.Context, args []string, w io.Writer) error {
+	if args[0] == "migrate" {
+		return migrateCommand(ctx, args[1:], w)
+	}
+	if args[0] == "samples" {
+		return samplesCommand(args[1:], w)
+	}
+
+	s, closeStorage, err := newStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	switch args[0] {
+	case "jobs":
+		return jobsCommand(ctx, s, args[1:], w)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// jobsCommand allows to inspect processing jobs stored in the job storage.
+func jobsCommand(ctx context.Context, s hashr.Storage, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing jobs command\n%s", jobsUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		filter, err := parseJobFilter(args[1:])
+		if err != nil {
+			return fmt.Errorf("%v\n%s", err, jobsUsage)
+		}
+
+		jobs, err := s.QueryJobs(ctx, filter)
+		if err != nil {
+			return fmt.Errorf("could not query jobs: %v", err)
+		}
+
+		return printJobs(w, jobs)
+	case "show":
+		if len(args) != 2 {
+			return fmt.Errorf("show command expects exactly one quick_sha256 argument\n%s", jobsUsage)
+		}
+
+		jobs, err := s.QueryJobs(ctx, &hashr.JobFilter{QuickSha256: args[1]})
+		if err != nil {
+			return fmt.Errorf("could not fetch job %s: %v", args[1], err)
+		}
+		if len(jobs) == 0 {
+			return fmt.Errorf("job %s not found", args[1])
+		}
+
+		events, err := s.FetchJobHistory(ctx, args[1])
+		if err != nil {
+			return fmt.Errorf("could not fetch history of job %s: %v", args[1], err)
+		}
+
+		if err := printJob(w, jobs[0]); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+
+		return printJobHistory(w, events)
+	case "reprocess":
+		if len(args) < 2 {
+			return fmt.Errorf("reprocess command expects at least one quick_sha256 argument\n%s", jobsUsage)
+		}
+
+		for _, qHash := range args[1:] {
+			if err := s.MarkForReprocessing(ctx, qHash); err != nil {
+				return fmt.Errorf("could not mark job %s for reprocessing: %v", qHash, err)
+			}
+			fmt.Fprintf(w, "%s marked for reprocessing\n", qHash)
+		}
+
+		return nil
+	case "history":
+		if len(args) != 2 {
+			return fmt.Errorf("history command expects exactly one quick_sha256 argument\n%s", jobsUsage)
+		}
+
+		events, err := s.FetchJobHistory(ctx, args[1])
+		if err != nil {
+			return fmt.Errorf("could not fetch history of job %s: %v", args[1], err)
+		}
+		if len(events) == 0 {
+			return fmt.Errorf("no history found for job %s", args[1])
+		}
+
+		return printJobHistory(w, events)
+	default:
+		return fmt.Errorf("unknown jobs command %q\n%s", args[0], jobsUsage)
+	}
+}
+
+// migrateCommand brings the database schema to the latest version.
+func migrateCommand(ctx context.Context, args []string, w io.Writer) error {
+	if len(args) > 1 {
+		return fmt.Errorf("migrate command expects at most one argument\n%s", migrateUsage)
+	}
+
+	backend := *jobStorage
+	if len(args) == 1 {
+		backend = args[0]
+	}
+
+	var version int
+	switch backend {
+	case "postgres":
+		psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+			*postgresHost, *postgresPort, *postgresUser, *postgresPassword, *postgresDBName)
+
+		db, err := sql.Open("postgres", psqlInfo)
+		if err != nil {
+			return fmt.Errorf("error initializing Postgres client: %v", err)
+		}
+		defer db.Close()
+
+		if version, err = migrations.MigratePostgres(ctx, db); err != nil {
+			return fmt.Errorf("error migrating Postgres database: %v", err)
+		}
+	case "cloudspanner":
+		spannerClient, err := spanner.NewClient(ctx, *spannerDBPath)
+		if err != nil {
+			return fmt.Errorf("error initializing Spanner client: %v", err)
+		}
+		defer spannerClient.Close()
+
+		adminClient, err := database.NewDatabaseAdminClient(ctx)
+		if err != nil {
+			return fmt.Errorf("error initializing Spanner admin client: %v", err)
+		}
+		defer adminClient.Close()
+
+		if version, err = migrations.MigrateSpanner(ctx, migrations.NewSpannerDatabase(spannerClient, adminClient, *spannerDBPath)); err != nil {
+			return fmt.Errorf("error migrating Cloud Spanner database: %v", err)
+		}
+	default:
+		return fmt.Errorf("migrations are supported only for postgres and cloudspanner, got %q\n%s", backend, migrateUsage)
+	}
+
+	fmt.Fprintf(w, "%s database schema is at version %d\n", backend, version)
+	return nil
+}
+
+// samplesCommand allows to maintain the local sample store used when export is set to false.
+func samplesCommand(args []string, w io.Writer) error {
+	if len(args) == 0 || args[0] != "gc" {
+		return fmt.Errorf("unknown or missing samples command\n%s", samplesUsage)
+	}
+
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	dryRun := fs.Bool("dry_run", false, "")
+	if err := fs.Parse(args[1:]); err != nil {
+		return fmt.Errorf("%v\n%s", err, samplesUsage)
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v\n%s", fs.Args(), samplesUsage)
+	}
+
+	store, err := samplestore.New(*exportPath, *exportCompress)
+	if err != nil {
+		return err
+	}
+
+	stats, err := store.GC(*dryRun)
+	if err != nil {
+		return fmt.Errorf("could not garbage collect sample store: %v", err)
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Fprintf(w, "%s %d unreferenced blobs and %d temporary files (%d bytes), %d samples are referenced\n", verb, stats.Removed, stats.TempFiles, stats.Freed, stats.Referenced)
+
+	return nil
+}
+
+// parseJobFilter parses arguments of the jobs list command.
+func parseJobFilter(args []string) (*hashr.JobFilter, error) {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	repo := fs.String("repo", "", "")
+	status := fs.String("status", "", "")
+	since := fs.String("since", "", "")
+	until := fs.String("until", "", "")
+	errorContains := fs.String("error", "", "")
+	limit := fs.Int("limit", 100, "")
+	offset := fs.Int("offset", 0, "")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if *limit < 0 || *offset < 0 {
+		return nil, fmt.Errorf("limit and offset must not be negative")
+	}
+
+	filter := &hashr.JobFilter{
+		Repo:          *repo,
+		Status:        *status,
+		ErrorContains: *errorContains,
+		Limit:         *limit,
+		Offset:        *offset,
+	}
+
+	var err error
+	if filter.ImportedAfter, err = parseTime(*since); err != nil {
+		return nil, fmt.Errorf("invalid -since value: %v", err)
+	}
+	if filter.ImportedBefore, err = parseTime(*until); err != nil {
+		return nil, fmt.Errorf("invalid -until value: %v", err)
+	}
+
+	return filter, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", value)
+}
+
+func printJobs(w io.Writer, jobs []*hashr.Job) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "QUICK_SHA256\tIMPORTED_AT\tREPO\tID\tSTATUS\tSAMPLES\tEXPORTED\tERROR")
+	for _, j := range jobs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", j.QuickSha256, time.Unix(j.ImportedAt, 0).UTC().Format(time.RFC3339), j.Repo, j.ID, j.Status, j.SampleCount, j.ExportCount, j.Error)
+	}
+
+	return tw.Flush()
+}
+
+func printJob(w io.Writer, j *hashr.Job) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Quick SHA256:\t%s\n", j.QuickSha256)
+	fmt.Fprintf(tw, "SHA256:\t%s\n", j.Sha256)
+	fmt.Fprintf(tw, "ID:\t%s\n", j.ID)
+	fmt.Fprintf(tw, "Repo:\t%s (%s)\n", j.Repo, j.RepoPath)
+	fmt.Fprintf(tw, "Location:\t%s\n", j.RemoteSourcePath)
+	fmt.Fprintf(tw, "Imported at:\t%s\n", time.Unix(j.ImportedAt, 0).UTC().Format(time.RFC3339))
+	fmt.Fprintf(tw, "Status:\t%s\n", j.Status)
+	fmt.Fprintf(tw, "Error:\t%s\n", j.Error)
+	if j.SignatureStatus != "" {
+		fmt.Fprintf(tw, "Signature:\t%s (%s)\n", j.SignatureStatus, j.SignatureDetails)
+	}
+	fmt.Fprintf(tw, "Durations:\tpreprocessing %v, processing %v, export %v\n", j.PreprocessingDuration, j.ProcessingDuration, j.ExportDuration)
+	fmt.Fprintf(tw, "Samples:\t%d extracted, %d exported\n", j.SampleCount, j.ExportCount)
+	for i, warning := range j.Warnings {
+		label := ""
+		if i == 0 {
+			label = "Warnings:"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", label, warning)
+	}
+
+	return tw.Flush()
+}
+
+func printJobHistory(w io.Writer, events []*hashr.JobEvent) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIMESTAMP\tSTATUS\tHOST\tVERSION\tERROR")
+	for _, e := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Timestamp.UTC().Format(time.RFC3339), e.Status, e.Host, e.Version, e.Error)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/hashr/core/hashr"
+)
+
+// fakeStorage holds jobs and their history in memory.
+type fakeStorage struct {
+	jobs   []*hashr.Job
+	events map[string][]*hashr.JobEvent
+}
+
+func (s *fakeStorage) UpdateJobs(ctx context.Context, qHash string, p *hashr.ProcessingSource) error {
+	return nil
+}
+
+func (s *fakeStorage) FetchJobs(ctx context.Context) (map[string]string, error) {
+	return nil, nil
+}
+
+func (s *fakeStorage) FetchJobHistory(ctx context.Context, qHash string) ([]*hashr.JobEvent, error) {
+	if qHash == "broken" {
+		return nil, errors.New("connection reset")
+	}
+	return s.events[qHash], nil
+}
+
+func (s *fakeStorage) QueryJobs(ctx context.Context, filter *hashr.JobFilter) ([]*hashr.Job, error) {
+	var jobs []*hashr.Job
+	for _, j := range s.jobs {
+		if filter.QuickSha256 == "" || filter.QuickSha256 == j.QuickSha256 {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
+func (s *fakeStorage) MarkForReprocessing(ctx context.Context, qHash string) error {
+	return nil
+}
+
+func TestJobsHistory(t *testing.T) {
+	created := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := &fakeStorage{events: map[string][]*hashr.JobEvent{
+		"07123e1f": {
+			{QuickSha256: "07123e1f", Timestamp: created, Status: "discovered", Version: "1.0", Host: "worker-1"},
+			{QuickSha256: "07123e1f", Timestamp: created.Add(time.Minute), Status: "failed", Error: "export failed", Version: "1.0", Host: "worker-1"},
+		},
+	}}
+
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "history",
+			args: []string{"history", "07123e1f"},
+			want: strings.Join([]string{
+				"TIMESTAMP             STATUS      HOST      VERSION  ERROR",
+				"2022-01-02T03:04:05Z  discovered  worker-1  1.0      ",
+				"2022-01-02T03:05:05Z  failed      worker-1  1.0      export failed",
+				"",
+			}, "\n"),
+		},
+		{name: "unknown job", args: []string{"history", "5c7a0f6e"}, wantErr: "no history found for job 5c7a0f6e"},
+		{name: "storage error", args: []string{"history", "broken"}, wantErr: "could not fetch history of job broken: connection reset"},
+		{name: "missing argument", args: []string{"history"}, wantErr: "history command expects exactly one quick_sha256 argument"},
+		{name: "too many arguments", args: []string{"history", "07123e1f", "5c7a0f6e"}, wantErr: "history command expects exactly one quick_sha256 argument"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := jobsCommand(context.Background(), s, tc.args, &b)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Fatalf("jobsCommand(%v) error = %v, want %q", tc.args, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected jobsCommand(%v) error: %v", tc.args, err)
+			}
+			if got := b.String(); got != tc.want {
+				t.Errorf("jobsCommand(%v) = %q, want %q", tc.args, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseJobFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		want    *hashr.JobFilter
+		wantErr string
+	}{
+		{name: "defaults", args: nil, want: &hashr.JobFilter{Limit: 100}},
+		{
+			name: "all flags",
+			args: []string{"-repo", "GCP", "-status", "failed", "-since", "2022-01-02", "-until", "2022-02-03T04:05:06Z", "-error", "timeout", "-limit", "10", "-offset", "20"},
+			want: &hashr.JobFilter{
+				Repo:           "GCP",
+				Status:         "failed",
+				ImportedAfter:  time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC),
+				ImportedBefore: time.Date(2022, 2, 3, 4, 5, 6, 0, time.UTC),
+				ErrorContains:  "timeout",
+				Limit:          10,
+				Offset:         20,
+			},
+		},
+		{name: "no limit", args: []string{"-limit", "0"}, want: &hashr.JobFilter{}},
+		{name: "negative limit", args: []string{"-limit", "-1"}, wantErr: "limit and offset must not be negative"},
+		{name: "negative offset", args: []string{"-offset", "-1"}, wantErr: "limit and offset must not be negative"},
+		{name: "invalid since", args: []string{"-since", "yesterday"}, wantErr: "invalid -since value"},
+		{name: "invalid until", args: []string{"-until", "2022-13-01"}, wantErr: "invalid -until value"},
+		{name: "unknown flag", args: []string{"-source", "GCP"}, wantErr: "flag provided but not defined: -source"},
+		{name: "positional argument", args: []string{"-repo", "GCP", "failed"}, wantErr: "unexpected arguments: [failed]"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseJobFilter(tc.args)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Fatalf("parseJobFilter(%v) error = %v, want %q", tc.args, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected parseJobFilter(%v) error: %v", tc.args, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("parseJobFilter(%v) unexpected diff (-want/+got):\n%s", tc.args, diff)
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "", want: time.Time{}},
+		{value: "2022-01-02", want: time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{value: "2022-01-02T03:04:05Z", want: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{value: "2022-01-02T03:04:05+02:00", want: time.Date(2022, 1, 2, 1, 4, 5, 0, time.UTC)},
+		{value: "2022-01-02 03:04:05", wantErr: true},
+		{value: "1641092645", wantErr: true},
+	} {
+		got, err := parseTime(tc.value)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("parseTime(%q) error = %v, want error %v", tc.value, err, tc.wantErr)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("parseTime(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestSamplesCommand(t *testing.T) {
+	// samples gc doesn't need job storage, so it works without the storage flag.
+	defer func(path, storage string) { *exportPath, *jobStorage = path, storage }(*exportPath, *jobStorage)
+	*exportPath, *jobStorage = t.TempDir(), ""
+
+	var b bytes.Buffer
+	if err := runCommand(context.Background(), []string{"samples", "gc", "-dry_run"}, &b); err != nil {
+		t.Fatalf("unexpected runCommand() error: %v", err)
+	}
+	if got, want := b.String(), "Would remove 0 unreferenced blobs and 0 temporary files (0 bytes), 0 samples are referenced\n"; got != want {
+		t.Errorf("runCommand() = %q, want %q", got, want)
+	}
+}
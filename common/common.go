@@ -15,11 +15,83 @@
 // Package common provides common data structures used in hashR.
 package common
 
+import (
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
 // Sample represent single file extracted from a given source.
 type Sample struct {
 	Sha256 string   `json:"sha256"`
 	Paths  []string `json:"paths"`
 	Upload bool     `json:"Upload"`
+	// SourcePaths holds paths of the sample inside the source it was extracted from.
+	SourcePaths []string `json:"source_paths,omitempty"`
+	// Size holds the size of the sample in bytes.
+	Size int64 `json:"size,omitempty"`
+	// Mode holds the file mode bits of the sample, as returned by os.FileMode.
+	Mode uint32 `json:"mode,omitempty"`
+	// Executable holds metadata of ELF, PE and Mach-O samples, it's nil for other files.
+	Executable *ExecutableMetadata `json:"executable,omitempty"`
+}
+
+// ExecutableMetadata holds metadata extracted from headers of an executable.
+type ExecutableMetadata struct {
+	// Format is one of ELF, PE or Mach-O.
+	Format       string `json:"format"`
+	Architecture string `json:"architecture"`
+	// BuildID holds GNU build ID of ELF files and UUID of Mach-O files.
+	BuildID string `json:"build_id,omitempty"`
+	// Soname holds SONAME of ELF shared objects and install name of Mach-O dynamic libraries.
+	Soname            string   `json:"soname,omitempty"`
+	ImportedLibraries []string `json:"imported_libraries,omitempty"`
+	// Fields below are taken from the version information resource of PE files.
+	CompanyName      string `json:"company_name,omitempty"`
+	ProductName      string `json:"product_name,omitempty"`
+	ProductVersion   string `json:"product_version,omitempty"`
+	FileVersion      string `json:"file_version,omitempty"`
+	FileDescription  string `json:"file_description,omitempty"`
+	OriginalFilename string `json:"original_filename,omitempty"`
+	// Signer holds subject of the certificate that signed Authenticode signature of PE files.
+	Signer string `json:"signer,omitempty"`
+	// SignatureStatus holds result of Authenticode signature verification of PE files, one of
+	// unsigned, valid, untrusted or invalid. SignatureError explains why a signature is not valid.
+	SignatureStatus string `json:"signature_status,omitempty"`
+	SignatureError  string `json:"signature_error,omitempty"`
+	// SignerChain holds subjects of certificates from the signer to the trusted root, it's only
+	// set for valid signatures.
+	SignerChain []string `json:"signer_chain,omitempty"`
+	// SigningTime holds time of the signature timestamp, if the signature is timestamped.
+	SigningTime *time.Time `json:"signing_time,omitempty"`
+	// ParseError explains which parts of the metadata could not be read from malformed headers,
+	// the rest of the metadata is still set.
+	ParseError string `json:"parse_error,omitempty"`
+}
+
+// SourceMetadata holds structured metadata of a source, such as a package name and version.
+type SourceMetadata struct {
+	Name         string `json:"name"`
+	Version      string `json:"version,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	// Maintainer holds the maintainer of deb packages and the vendor (or packager) of rpm packages.
+	Maintainer string `json:"maintainer,omitempty"`
+	// SourcePackage holds the name of the source package a binary package was built from.
+	SourcePackage string `json:"source_package,omitempty"`
+	License       string `json:"license,omitempty"`
+	// Files holds digests of regular files listed in the package manifest.
+	Files []FileDigest `json:"files,omitempty"`
+}
+
+// FileDigest holds a digest of a file listed in a package manifest.
+type FileDigest struct {
+	// Path holds the absolute path of the file once the package is installed.
+	Path string `json:"path"`
+	// Algorithm is one of md5, sha1, sha224, sha256, sha384 or sha512.
+	Algorithm string `json:"algorithm,omitempty"`
+	// Digest is empty for files listed without a digest, e.g. conffiles of deb packages.
+	Digest string `json:"digest,omitempty"`
 }
 
 // Extraction contains information about image_export.py extraction.
@@ -30,3 +102,41 @@ type Extraction struct {
 	Path         string
 	SourceSHA256 string
 }
+
+// AppendMissing appends values that are not yet present in a given slice, e.g. source IDs or
+// sample paths merged with already exported ones.
+func AppendMissing(existing []string, values ...string) []string {
+	merged := append([]string{}, existing...)
+	seen := make(map[string]bool)
+	for _, v := range existing {
+		seen[v] = true
+	}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			merged = append(merged, v)
+		}
+	}
+
+	return merged
+}
+
+// SamplePaths returns paths of the sample inside the source it was extracted from. Samples without
+// source paths fall back to the part of their local paths following the extraction directory.
+func SamplePaths(sample Sample) []string {
+	if len(sample.SourcePaths) > 0 {
+		return sample.SourcePaths
+	}
+
+	var paths []string
+	for _, path := range sample.Paths {
+		s := strings.Split(path, "/extracted/")
+		if len(s) < 2 {
+			glog.Warningf("sample path does not follow expected format: %s", path)
+			continue
+		}
+		paths = append(paths, s[len(s)-1])
+	}
+
+	return paths
+}
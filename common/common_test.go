@@ -0,0 +1,57 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSamplePaths(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		sample Sample
+		want   []string
+	}{
+		{
+			name:   "source paths",
+			sample: Sample{Paths: []string{"/tmp/hashr/extracted/bin/ls"}, SourcePaths: []string{"/usr/bin/ls"}},
+			want:   []string{"/usr/bin/ls"},
+		},
+		{
+			name:   "extracted paths",
+			sample: Sample{Paths: []string{"/tmp/hashr/extracted/bin/ls", "/tmp/hashr/ls", "/tmp/extracted/a/extracted/usr/bin/ls"}},
+			want:   []string{"bin/ls", "usr/bin/ls"},
+		},
+		{
+			name:   "no paths",
+			sample: Sample{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, SamplePaths(tc.sample)); diff != "" {
+				t.Errorf("SamplePaths() unexpected diff (-want/+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAppendMissing(t *testing.T) {
+	got := AppendMissing([]string{"a", "b"}, "b", "c", "c")
+	if want := []string{"a", "b", "c"}; !cmp.Equal(want, got) {
+		t.Errorf("AppendMissing() = %v, want %v", got, want)
+	}
+}
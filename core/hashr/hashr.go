@@ -19,7 +19,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
-	"encoding/json"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -33,8 +33,14 @@ import (
 	"github.com/golang/glog"
 	"github.com/google/hashr/cache"
 	"github.com/google/hashr/common"
+	"github.com/google/hashr/inspect"
+	"github.com/google/hashr/samplestore"
 )
 
+// Version contains hashR version, it's recorded in the processing job history. It can be set at
+// build time: -ldflags "-X github.com/google/hashr/core/hashr.Version=<version>".
+var Version = "dev"
+
 // Source represents data to be processed.
 type Source interface {
 	// ID returns non-unique ID for a given source.
@@ -58,6 +64,49 @@ type Source interface {
 	Description() string
 }
 
+// Signature verification statuses of sources.
+const (
+	// SignatureVerified is the status of a source with a signature verified against the keyring.
+	SignatureVerified = "verified"
+	// SignatureUnverified is the status of a source with a signature that could not be verified.
+	SignatureUnverified = "unverified"
+	// SignatureUnsigned is the status of a source without a signature.
+	SignatureUnsigned = "unsigned"
+)
+
+// SignedSource represents a source that verifies its signature while preprocessing.
+type SignedSource interface {
+	Source
+	// SignatureStatus returns the result of the signature verification done by Preprocess (or
+	// VerifySignature of SignatureVerifier) and details, such as the signer or the reason the
+	// verification failed. Empty status means that the verification is disabled.
+	SignatureStatus() (string, string)
+}
+
+// SignatureVerifier represents a signed source that verifies its signature separately from
+// Preprocess. VerifySignature is called before Preprocess, so sources rejected by the signature
+// policy are not fetched.
+type SignatureVerifier interface {
+	SignedSource
+	VerifySignature()
+}
+
+// MetadataSource represents a source that provides structured metadata, e.g. of a package.
+type MetadataSource interface {
+	Source
+	// Metadata returns the metadata read by Preprocess, nil if it's not available.
+	Metadata() *common.SourceMetadata
+}
+
+// ManifestSource represents a source that checks samples extracted from it against its own
+// manifest, e.g. file digests listed in a package.
+type ManifestSource interface {
+	Source
+	// CheckSamples returns warnings about extracted samples that don't match the manifest, it's
+	// called after the samples are extracted.
+	CheckSamples(samples []common.Sample) []string
+}
+
 // Importer represents importer instance that will be used to import data for processing.
 type Importer interface {
 	// DiscoverRepo returns slice of objects that satisfy Source interface.
@@ -77,8 +126,52 @@ type Processor interface {
 
 // Storage represents  storage that is used to store data about processed sources.
 type Storage interface {
+	// UpdateJobs updates the state of a processing job and appends a job event to its history.
 	UpdateJobs(ctx context.Context, qHash string, p *ProcessingSource) error
 	FetchJobs(ctx context.Context) (map[string]string, error)
+	// FetchJobHistory returns events of a given processing job, ordered from the oldest.
+	FetchJobHistory(ctx context.Context, qHash string) ([]*JobEvent, error)
+	// QueryJobs returns processing jobs matching a given filter, ordered from the most recently
+	// imported.
+	QueryJobs(ctx context.Context, filter *JobFilter) ([]*Job, error)
+	// MarkForReprocessing sets the status of a given processing job to reprocess.
+	MarkForReprocessing(ctx context.Context, qHash string) error
+}
+
+// JobFilter holds criteria used to query processing jobs. Empty fields are ignored.
+type JobFilter struct {
+	QuickSha256    string
+	Repo           string
+	Status         string
+	ImportedAfter  time.Time
+	ImportedBefore time.Time
+	// ErrorContains matches jobs with error text containing a given substring.
+	ErrorContains string
+	// Limit and Offset allow to page through the results. Limit of 0 returns all the jobs.
+	Limit  int
+	Offset int
+}
+
+// Job holds data related to a processing job stored in the job storage.
+type Job struct {
+	QuickSha256           string
+	ImportedAt            int64
+	ID                    string
+	Repo                  string
+	RepoPath              string
+	RemoteSourcePath      string
+	Sha256                string
+	Status                string
+	Error                 string
+	PreprocessingDuration time.Duration
+	ProcessingDuration    time.Duration
+	ExportDuration        time.Duration
+	SampleCount           int
+	ExportCount           int
+	SignatureStatus       string
+	SignatureDetails      string
+	// Warnings holds problems found while processing the source that didn't fail the job.
+	Warnings []string
 }
 
 // Exporter represents exporter instance that will be used to export extracted data.
@@ -89,6 +182,13 @@ type Exporter interface {
 	Name() string
 }
 
+// MetadataExporter represents an exporter that stores structured metadata of sources.
+type MetadataExporter interface {
+	Exporter
+	// ExportMetadata stores metadata of a source that was exported with Export.
+	ExportMetadata(ctx context.Context, sourceHash string, metadata *common.SourceMetadata) error
+}
+
 // HashR holds data related to running instance of HashR.
 type HashR struct {
 	Importers              []Importer
@@ -101,6 +201,9 @@ type HashR struct {
 	Dev                    bool
 	Export                 bool
 	ExportPath             string
+	CompressSamples        bool
+	AuthenticodeRoots      *x509.CertPool
+	SkipUnverifiedSources  bool
 	SourcesForReprocessing []string
 	cacheSaveCounter       int
 	wg                     sync.WaitGroup
@@ -124,6 +227,36 @@ type ProcessingSource struct {
 	SampleCount           int
 	ExportCount           int
 	Error                 string
+	SignatureStatus       string
+	SignatureDetails      string
+	Warnings              []string
+}
+
+// JobEvent holds data related to a single, immutable state transition of a processing job.
+type JobEvent struct {
+	QuickSha256 string
+	Status      string
+	Timestamp   time.Time
+	Error       string
+	Version     string
+	Host        string
+}
+
+// NewJobEvent returns a new event describing the current state of a given processing job.
+func NewJobEvent(qHash string, p *ProcessingSource) *JobEvent {
+	host, err := os.Hostname()
+	if err != nil {
+		glog.Warningf("could not get hostname: %v", err)
+	}
+
+	return &JobEvent{
+		QuickSha256: qHash,
+		Status:      string(p.Status),
+		Timestamp:   time.Now().UTC(),
+		Error:       p.Error,
+		Version:     Version,
+		Host:        host,
+	}
 }
 
 // Status is a type to store the status of a processing job.
@@ -136,9 +269,17 @@ const (
 	cached       = "cached"
 	exported     = "exported"
 	failed       = "failed"
-	reprocess    = "reprocess"
+	// skipped is the status of a processing job that was not processed due to the unverified
+	// sources policy.
+	skipped = "skipped"
+	// Reprocess is the status of a processing job that was marked for reprocessing.
+	Reprocess = "reprocess"
 )
 
+// errSkipped is returned for sources that should not be processed, e.g. due to the unverified
+// sources policy.
+var errSkipped = errors.New("skipping source")
+
 // New returns new instance of hashR.
 func New(importers []Importer, processor Processor, exporters []Exporter, storage Storage) *HashR {
 	return &HashR{Importers: importers, Processor: processor, Exporters: exporters, Storage: storage}
@@ -170,7 +311,7 @@ func (h *HashR) newSources(ctx context.Context, i Importer) ([]Source, error) {
 		// Check if the source was already processed or should be reprocessed.
 
 		status, processed := processedSources[qHash]
-		if !processed || contains(h.SourcesForReprocessing, qHash) || strings.EqualFold(status, reprocess) {
+		if !processed || contains(h.SourcesForReprocessing, qHash) || strings.EqualFold(status, Reprocess) {
 			newSources = append(newSources, source)
 		}
 	}
@@ -197,6 +338,15 @@ func (h *HashR) process(source Source, processor Processor) (*common.Extraction,
 
 	start := time.Now()
 
+	verifier, verifiesSignature := source.(SignatureVerifier)
+	if verifiesSignature {
+		glog.Infof("Verifying signature of %s", source.ID())
+		verifier.VerifySignature()
+		if err := h.checkSignature(qhash, source); err != nil {
+			return &common.Extraction{}, err
+		}
+	}
+
 	glog.Infof("Preprocessing %s", source.ID())
 	plasoInput, err := source.Preprocess()
 	if err != nil {
@@ -209,6 +359,13 @@ func (h *HashR) process(source Source, processor Processor) (*common.Extraction,
 	h.processingSourcesMutex.RLock()
 	h.processingSources[qhash].PreprocessingDuration = time.Since(start)
 	h.processingSourcesMutex.RUnlock()
+
+	if !verifiesSignature {
+		if err := h.checkSignature(qhash, source); err != nil {
+			return extraction, err
+		}
+	}
+
 	start = time.Now()
 	glog.Infof("Calculating SHA256 of %s", source.LocalPath())
 	extraction.SourceSHA256, err = sha256sum(source.LocalPath())
@@ -229,6 +386,31 @@ func (h *HashR) process(source Source, processor Processor) (*common.Extraction,
 	return extraction, nil
 }
 
+// checkSignature records the signature status of a given source and applies the policy for sources
+// with signatures that are missing or could not be verified.
+func (h *HashR) checkSignature(qhash string, source Source) error {
+	signedSource, ok := source.(SignedSource)
+	if !ok {
+		return nil
+	}
+
+	status, details := signedSource.SignatureStatus()
+	h.processingSourcesMutex.RLock()
+	h.processingSources[qhash].SignatureStatus = status
+	h.processingSources[qhash].SignatureDetails = details
+	h.processingSourcesMutex.RUnlock()
+
+	if status == "" || status == SignatureVerified {
+		return nil
+	}
+	if h.SkipUnverifiedSources {
+		return fmt.Errorf("%w with %s signature: %s", errSkipped, status, details)
+	}
+	glog.Warningf("%s: source signature is %s: %s", source.ID(), status, details)
+
+	return nil
+}
+
 func cleanupLocalStorage(path string) error {
 	glog.Infof("Deleting %s", path)
 
@@ -305,8 +487,13 @@ func (h *HashR) Run(ctx context.Context) error {
 }
 
 func (h *HashR) handleError(ctx context.Context, quickHash, extractionBaseDir string, processingSource *ProcessingSource, err error) {
-	glog.Errorf("%s: skipping source %s: %v", processingSource.Repo, processingSource.ID, err)
-	processingSource.Status = failed
+	if errors.Is(err, errSkipped) {
+		glog.Warningf("%s: %s: %v", processingSource.Repo, processingSource.ID, err)
+		processingSource.Status = skipped
+	} else {
+		glog.Errorf("%s: skipping source %s: %v", processingSource.Repo, processingSource.ID, err)
+		processingSource.Status = failed
+	}
 	processingSource.Error = err.Error()
 	h.processingSourcesMutex.RLock()
 	h.processingSources[quickHash].Error = err.Error()
@@ -370,6 +557,10 @@ func (h *HashR) processingWorker(ctx context.Context, newSources <-chan Source,
 
 		glog.Infof("Done checking cache for existing samples from %s", source.ID())
 
+		h.checkSamples(qHash, source, samples)
+
+		addExecutableMetadata(samples, h.AuthenticodeRoots)
+
 		h.processingSourcesMutex.RLock()
 		h.processingSources[qHash].Status = cached
 		processingSource = h.processingSources[qHash]
@@ -397,6 +588,9 @@ func (h *HashR) processingWorker(ctx context.Context, newSources <-chan Source,
 			for _, exporter := range h.Exporters {
 				glog.Infof("Exporting samples from %s with %s hash using %s exporter", source.ID(), extraction.SourceSHA256, exporter.Name())
 				err = exporter.Export(ctx, source.RepoName(), source.RepoPath(), extraction.SourceID, extraction.SourceSHA256, source.LocalPath(), source.Description(), samples)
+				if err == nil {
+					err = exportMetadata(ctx, exporter, source, extraction.SourceSHA256)
+				}
 				if err != nil {
 					errs = append(errs, err.Error())
 				}
@@ -450,58 +644,105 @@ func (h *HashR) processingWorker(ctx context.Context, newSources <-chan Source,
 	}
 }
 
-func (h *HashR) saveSamples(sourceImporter, sourceID, sourceHash string, samples []common.Sample) error {
-	var samplesOut []common.Sample
-	subDir := fmt.Sprintf("%s___%s___%s", sourceImporter, sourceID, sourceHash)
-	destDir := filepath.Join(h.ExportPath, subDir)
-	glog.Infof("Saving samples locally to %s", destDir)
+// checkSamples records warnings about samples that don't match the manifest of a given source.
+func (h *HashR) checkSamples(qhash string, source Source, samples []common.Sample) {
+	manifestSource, ok := source.(ManifestSource)
+	if !ok {
+		return
+	}
 
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return err
+	warnings := manifestSource.CheckSamples(samples)
+	if len(warnings) == 0 {
+		return
 	}
+	glog.Warningf("%s: extracted files don't match the source manifest: %s", source.ID(), strings.Join(warnings, "; "))
 
-	for _, sample := range samples {
-		if !sample.Upload {
-			samplesOut = append(samplesOut, common.Sample{Sha256: sample.Sha256, Upload: false})
-		} else {
-			if err := os.Mkdir(filepath.Join(destDir, sample.Sha256), 0755); err != nil {
-				return err
-			}
+	h.processingSourcesMutex.RLock()
+	h.processingSources[qhash].Warnings = warnings
+	h.processingSourcesMutex.RUnlock()
+}
 
-			var samplePath string
-			// If sample has more than one path associated with it, take the first that is valid.
-			for _, path := range sample.Paths {
-				if _, err := os.Stat(path); err == nil {
-					samplePath = path
-					break
-				}
-			}
+// exportMetadata passes structured metadata of a source to exporters that store it.
+func exportMetadata(ctx context.Context, exporter Exporter, source Source, sourceHash string) error {
+	metadataExporter, ok := exporter.(MetadataExporter)
+	if !ok {
+		return nil
+	}
+	metadataSource, ok := source.(MetadataSource)
+	if !ok {
+		return nil
+	}
+	metadata := metadataSource.Metadata()
+	if metadata == nil {
+		return nil
+	}
 
-			input, err := ioutil.ReadFile(samplePath)
-			if err != nil {
-				return err
-			}
+	if err := metadataExporter.ExportMetadata(ctx, sourceHash, metadata); err != nil {
+		return fmt.Errorf("could not export source metadata: %v", err)
+	}
 
-			destFile := filepath.Join(destDir, sample.Sha256, filepath.Base(samplePath))
+	return nil
+}
 
-			err = ioutil.WriteFile(destFile, input, 0755)
+// addExecutableMetadata sets metadata of executables among samples that will be uploaded. Failures
+// are only logged, as metadata is not essential for the export.
+func addExecutableMetadata(samples []common.Sample, roots *x509.CertPool) {
+	for i, sample := range samples {
+		if !sample.Upload {
+			continue
+		}
+		for _, path := range sample.Paths {
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			m, err := inspect.ExecutableMetadata(path, roots)
 			if err != nil {
-				return err
+				glog.Warningf("could not extract executable metadata from %s: %v", path, err)
 			}
-
-			samplesOut = append(samplesOut, common.Sample{Sha256: sample.Sha256, Paths: []string{destFile}, Upload: true})
+			samples[i].Executable = m
+			break
 		}
 	}
+}
 
-	jsonBytes, err := json.Marshal(samplesOut)
+// saveSamples stores samples in the local sample store at ExportPath and writes the manifest of
+// the source.
+func (h *HashR) saveSamples(sourceImporter, sourceID, sourceHash string, samples []common.Sample) error {
+	store, err := samplestore.New(h.ExportPath, h.CompressSamples)
 	if err != nil {
 		return err
 	}
+	glog.Infof("Saving samples locally to %s", h.ExportPath)
 
-	err = ioutil.WriteFile(filepath.Join(destDir, "samples.json"), jsonBytes, 0755)
-	if err != nil {
-		return err
+	var samplesOut []common.Sample
+	for _, sample := range samples {
+		if !sample.Upload {
+			samplesOut = append(samplesOut, common.Sample{Sha256: sample.Sha256, Upload: false, SourcePaths: sample.SourcePaths, Size: sample.Size, Mode: sample.Mode})
+			continue
+		}
+
+		var samplePath string
+		// If sample has more than one path associated with it, take the first that is valid.
+		for _, path := range sample.Paths {
+			if _, err := os.Stat(path); err == nil {
+				samplePath = path
+				break
+			}
+		}
+
+		blobPath, err := store.Put(sample.Sha256, samplePath)
+		if err != nil {
+			return err
+		}
+
+		samplesOut = append(samplesOut, common.Sample{Sha256: sample.Sha256, Paths: []string{blobPath}, Upload: true, SourcePaths: sample.SourcePaths, Size: sample.Size, Mode: sample.Mode, Executable: sample.Executable})
 	}
 
-	return nil
+	return store.WriteManifest(&samplestore.Manifest{
+		SourceImporter: sourceImporter,
+		SourceID:       sourceID,
+		SourceSHA256:   sourceHash,
+		CreatedAt:      time.Now().UTC(),
+		Samples:        samplesOut,
+	})
 }
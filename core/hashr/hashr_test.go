@@ -16,11 +16,13 @@ package hashr
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
 
 	"github.com/golang/glog"
+	"github.com/google/go-cmp/cmp"
 
 	"github.com/google/hashr/common"
 
@@ -118,6 +120,34 @@ func (s *testSource) Description() string {
 	return ""
 }
 
+type testSignedSource struct {
+	testSource
+	signatureStatus  string
+	signatureDetails string
+}
+
+func (s *testSignedSource) SignatureStatus() (string, string) {
+	return s.signatureStatus, s.signatureDetails
+}
+
+type testMetadataSource struct {
+	testSource
+	metadata *common.SourceMetadata
+}
+
+func (s *testMetadataSource) Metadata() *common.SourceMetadata {
+	return s.metadata
+}
+
+type testManifestSource struct {
+	testSource
+	warnings []string
+}
+
+func (s *testManifestSource) CheckSamples(samples []common.Sample) []string {
+	return s.warnings
+}
+
 type testProcessor struct {
 }
 
@@ -136,6 +166,120 @@ func (e *testExporter) Name() string {
 	return "testExporter"
 }
 
+type testMetadataExporter struct {
+	testExporter
+	metadata map[string]*common.SourceMetadata
+}
+
+func (e *testMetadataExporter) ExportMetadata(ctx context.Context, sourceHash string, metadata *common.SourceMetadata) error {
+	e.metadata[sourceHash] = metadata
+	return nil
+}
+
+func TestExportMetadata(t *testing.T) {
+	metadata := &common.SourceMetadata{Name: "hashr", Version: "1.0"}
+	for _, tc := range []struct {
+		name     string
+		exporter Exporter
+		source   Source
+		want     *common.SourceMetadata
+	}{
+		{name: "source with metadata", exporter: &testMetadataExporter{metadata: map[string]*common.SourceMetadata{}}, source: &testMetadataSource{metadata: metadata}, want: metadata},
+		{name: "source without metadata", exporter: &testMetadataExporter{metadata: map[string]*common.SourceMetadata{}}, source: &testMetadataSource{}},
+		{name: "source not providing metadata", exporter: &testMetadataExporter{metadata: map[string]*common.SourceMetadata{}}, source: &testSource{}},
+		{name: "exporter not storing metadata", exporter: &testExporter{}, source: &testMetadataSource{metadata: metadata}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := exportMetadata(context.Background(), tc.exporter, tc.source, "hash"); err != nil {
+				t.Fatalf("unexpected error while running exportMetadata(): %v", err)
+			}
+
+			if e, ok := tc.exporter.(*testMetadataExporter); ok && e.metadata["hash"] != tc.want {
+				t.Errorf("exportMetadata() exported %v, want %v", e.metadata["hash"], tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		source  Source
+		skip    bool
+		wantErr bool
+	}{
+		{name: "source without signature", source: &testSource{id: "001"}, skip: true},
+		{name: "verification disabled", source: &testSignedSource{testSource: testSource{id: "001"}}, skip: true},
+		{name: "verified", source: &testSignedSource{testSource: testSource{id: "001"}, signatureStatus: SignatureVerified, signatureDetails: "HashR"}, skip: true},
+		{name: "flag unverified", source: &testSignedSource{testSource: testSource{id: "001"}, signatureStatus: SignatureUnverified, signatureDetails: "invalid signature"}},
+		{name: "skip unverified", source: &testSignedSource{testSource: testSource{id: "001"}, signatureStatus: SignatureUnverified, signatureDetails: "invalid signature"}, skip: true, wantErr: true},
+		{name: "skip unsigned", source: &testSignedSource{testSource: testSource{id: "001"}, signatureStatus: SignatureUnsigned}, skip: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &HashR{SkipUnverifiedSources: tc.skip, processingSources: map[string]*ProcessingSource{"qhash": {}}}
+
+			err := h.checkSignature("qhash", tc.source)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("checkSignature() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil && !errors.Is(err, errSkipped) {
+				t.Errorf("checkSignature() error = %v, want errSkipped", err)
+			}
+
+			if s, ok := tc.source.(*testSignedSource); ok {
+				p := h.processingSources["qhash"]
+				if p.SignatureStatus != s.signatureStatus || p.SignatureDetails != s.signatureDetails {
+					t.Errorf("checkSignature() recorded %q, %q; want %q, %q", p.SignatureStatus, p.SignatureDetails, s.signatureStatus, s.signatureDetails)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleError(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		err        error
+		wantStatus status
+	}{
+		{name: "failed", err: errors.New("error while preprocessing"), wantStatus: failed},
+		{name: "skipped", err: fmt.Errorf("%w with unsigned signature: no signature found", errSkipped), wantStatus: skipped},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &ProcessingSource{Repo: "test", ID: "001", Status: discovered}
+			h := &HashR{Storage: &fakeStorage{}, processingSources: map[string]*ProcessingSource{"qhash": p}}
+
+			h.handleError(context.Background(), "qhash", "", p, tc.err)
+
+			if p.Status != tc.wantStatus || p.Error != tc.err.Error() {
+				t.Errorf("handleError() recorded %q, %q; want %q, %q", p.Status, p.Error, tc.wantStatus, tc.err.Error())
+			}
+		})
+	}
+}
+
+func TestCheckSamples(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		source Source
+		want   []string
+	}{
+		{name: "source without manifest", source: &testSource{id: "001"}},
+		{name: "matching samples", source: &testManifestSource{testSource: testSource{id: "001"}}},
+		{name: "mismatching samples", source: &testManifestSource{testSource: testSource{id: "001"}, warnings: []string{"/file.01: extracted, but not listed in the package"}}, want: []string{"/file.01: extracted, but not listed in the package"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &HashR{processingSources: map[string]*ProcessingSource{"qhash": {}}}
+
+			h.checkSamples("qhash", tc.source, nil)
+
+			if got := h.processingSources["qhash"].Warnings; !cmp.Equal(tc.want, got) {
+				t.Errorf("checkSamples() unexpected diff (-want/+got):\n%s", cmp.Diff(tc.want, got))
+			}
+		})
+	}
+}
+
 // TestRun requires Spanner emulator to be running: https://cloud.google.com/spanner/docs/emulator.
 func TestRun(t *testing.T) {
 	for _, tc := range []struct {
@@ -267,3 +411,18 @@ func (s *fakeStorage) UpdateJobs(ctx context.Context, qHash string, p *Processin
 func (s *fakeStorage) FetchJobs(ctx context.Context) (map[string]string, error) {
 	return make(map[string]string), nil
 }
+
+// FetchJobHistory returns no job events.
+func (s *fakeStorage) FetchJobHistory(ctx context.Context, qHash string) ([]*JobEvent, error) {
+	return nil, nil
+}
+
+// QueryJobs returns no jobs.
+func (s *fakeStorage) QueryJobs(ctx context.Context, filter *JobFilter) ([]*Job, error) {
+	return nil, nil
+}
+
+// MarkForReprocessing does nothing.
+func (s *fakeStorage) MarkForReprocessing(ctx context.Context, qHash string) error {
+	return nil
+}
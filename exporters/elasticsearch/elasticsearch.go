@@ -0,0 +1,415 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package elasticsearch provides functions required to export data to Elasticsearch or OpenSearch.
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/google/hashr/common"
+	"github.com/google/hashr/inspect"
+)
+
+const (
+	// Name contains name of the exporter.
+	Name = "elasticsearch"
+	// retryOnConflict is the number of times Elasticsearch retries an update of a document that was
+	// concurrently modified.
+	retryOnConflict = 3
+)
+
+// samplesScript merges paths of a sample with already indexed ones and records where the sample was
+// found. Provenance is kept per source, so paths of a sample are merged only within the entry of
+// the same source and source ID.
+const samplesScript = `if (ctx._source.paths == null) { ctx._source.paths = []; }
+for (p in params.paths) { if (!ctx._source.paths.contains(p)) { ctx._source.paths.add(p); } }
+if (ctx._source.sources == null) { ctx._source.sources = []; }
+def entry = null;
+for (s in ctx._source.sources) { if (s.source == params.source.source && s.source_id == params.source.source_id) { entry = s; break; } }
+if (entry == null) { ctx._source.sources.add(params.source); }
+else {
+  if (entry.paths == null) { entry.paths = []; }
+  for (p in params.source.paths) { if (!entry.paths.contains(p)) { entry.paths.add(p); } }
+}
+if (params.mime_type != null) { ctx._source.mime_type = params.mime_type; }`
+
+// sourcesScript merges IDs of a source with already indexed ones.
+const sourcesScript = `if (ctx._source.source_ids == null) { ctx._source.source_ids = []; }
+if (!ctx._source.source_ids.contains(params.source_id)) { ctx._source.source_ids.add(params.source_id); }
+ctx._source.sample_count = params.sample_count;`
+
+var samplesMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"sha256":    map[string]string{"type": "keyword"},
+		"size":      map[string]string{"type": "long"},
+		"mime_type": map[string]string{"type": "keyword"},
+		"paths":     map[string]string{"type": "keyword"},
+		"sources": map[string]interface{}{
+			"type": "nested",
+			"properties": map[string]interface{}{
+				"source":    map[string]string{"type": "keyword"},
+				"source_id": map[string]string{"type": "keyword"},
+				"repo":      map[string]string{"type": "keyword"},
+				"paths":     map[string]string{"type": "keyword"},
+			},
+		},
+	},
+}
+
+var sourcesMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"sha256":       map[string]string{"type": "keyword"},
+		"source_ids":   map[string]string{"type": "keyword"},
+		"source_path":  map[string]string{"type": "keyword"},
+		"description":  map[string]string{"type": "text"},
+		"repo_name":    map[string]string{"type": "keyword"},
+		"repo_path":    map[string]string{"type": "keyword"},
+		"sample_count": map[string]string{"type": "long"},
+	},
+}
+
+// Exporter is an instance of Elasticsearch Exporter.
+type Exporter struct {
+	client       *http.Client
+	url          string
+	samplesIndex string
+	sourcesIndex string
+	bulkSize     int
+	maxRetries   int
+	retryBackoff time.Duration
+}
+
+// Name returns exporter name.
+func (e *Exporter) Name() string {
+	return Name
+}
+
+// NewExporter creates new Elasticsearch exporter and index templates of the samples and sources
+// indices. Credentials can be passed as a part of the URL. Bulk requests contain at most bulkSize
+// actions, failed requests and actions are retried up to maxRetries times.
+func NewExporter(ctx context.Context, client *http.Client, url, samplesIndex, sourcesIndex string, bulkSize, maxRetries int) (*Exporter, error) {
+	if bulkSize < 1 {
+		return nil, fmt.Errorf("bulk size needs to be at least 1, got %d", bulkSize)
+	}
+	if maxRetries < 0 {
+		return nil, fmt.Errorf("max retries can't be negative, got %d", maxRetries)
+	}
+
+	e := &Exporter{
+		client:       client,
+		url:          strings.TrimSuffix(url, "/"),
+		samplesIndex: samplesIndex,
+		sourcesIndex: sourcesIndex,
+		bulkSize:     bulkSize,
+		maxRetries:   maxRetries,
+		retryBackoff: time.Second,
+	}
+
+	if err := e.putIndexTemplate(ctx, samplesIndex, samplesMappings); err != nil {
+		return nil, fmt.Errorf("could not create index template of %s: %v", samplesIndex, err)
+	}
+	if err := e.putIndexTemplate(ctx, sourcesIndex, sourcesMappings); err != nil {
+		return nil, fmt.Errorf("could not create index template of %s: %v", sourcesIndex, err)
+	}
+
+	return e, nil
+}
+
+// putIndexTemplate creates or updates the composable index template of a given index.
+func (e *Exporter) putIndexTemplate(ctx context.Context, index string, mappings map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"index_patterns": []string{index},
+		"template": map[string]interface{}{
+			"mappings": mappings,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/_index_template/%s", e.url, index), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, msg)
+	}
+
+	return nil
+}
+
+// action is a single bulk update action, consisting of the action metadata and the script.
+type action struct {
+	meta []byte
+	body []byte
+}
+
+// Export indexes samples and the source they were extracted from. Documents are updated with
+// scripts that merge paths and per-source provenance, so exporting the same source again doesn't
+// duplicate data.
+func (e *Exporter) Export(ctx context.Context, sourceRepoName, sourceRepoPath, sourceID, sourceHash, sourcePath, sourceDescription string, samples []common.Sample) error {
+	var actions []*action
+	for _, sample := range samples {
+		a, err := e.sampleAction(sample, sourceRepoName, sourceID, sourceHash)
+		if err != nil {
+			return fmt.Errorf("could not prepare sample %s: %v", sample.Sha256, err)
+		}
+		actions = append(actions, a)
+	}
+
+	a, err := newUpdateAction(e.sourcesIndex, sourceHash, sourcesScript,
+		map[string]interface{}{
+			"source_id":    sourceID,
+			"sample_count": len(samples),
+		},
+		map[string]interface{}{
+			"sha256":       sourceHash,
+			"source_ids":   []string{sourceID},
+			"source_path":  sourcePath,
+			"description":  sourceDescription,
+			"repo_name":    sourceRepoName,
+			"repo_path":    sourceRepoPath,
+			"sample_count": len(samples),
+		})
+	if err != nil {
+		return fmt.Errorf("could not prepare source %s: %v", sourceHash, err)
+	}
+	// Source is indexed last, so it's only present once all of its samples were indexed.
+	actions = append(actions, a)
+
+	for i := 0; i < len(actions); i += e.bulkSize {
+		end := i + e.bulkSize
+		if end > len(actions) {
+			end = len(actions)
+		}
+		if err := e.bulk(ctx, actions[i:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Exporter) sampleAction(sample common.Sample, sourceRepoName, sourceID, sourceHash string) (*action, error) {
+	paths := common.SamplePaths(sample)
+	if paths == nil {
+		paths = []string{}
+	}
+
+	size := sample.Size
+	var mimeType interface{}
+	// Samples that are not uploaded were already exported, mime type is only set for extracted ones.
+	if sample.Upload {
+		for _, path := range sample.Paths {
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			size = fi.Size()
+			fileType, err := inspect.IdentifyFile(path)
+			if err != nil {
+				glog.Warningf("Could not get file content type: %v", err)
+				break
+			}
+			mimeType = fileType.MIMEType
+			break
+		}
+	}
+
+	source := map[string]interface{}{
+		"source":    sourceHash,
+		"source_id": sourceID,
+		"repo":      sourceRepoName,
+		"paths":     paths,
+	}
+
+	doc := map[string]interface{}{
+		"sha256":  sample.Sha256,
+		"size":    size,
+		"paths":   paths,
+		"sources": []interface{}{source},
+	}
+	if mimeType != nil {
+		doc["mime_type"] = mimeType
+	}
+
+	return newUpdateAction(e.samplesIndex, sample.Sha256, samplesScript,
+		map[string]interface{}{
+			"paths":     paths,
+			"source":    source,
+			"mime_type": mimeType,
+		}, doc)
+}
+
+func newUpdateAction(index, id, script string, params, upsert map[string]interface{}) (*action, error) {
+	meta, err := json.Marshal(map[string]interface{}{
+		"update": map[string]interface{}{
+			"_index":            index,
+			"_id":               id,
+			"retry_on_conflict": retryOnConflict,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": script,
+			"params": params,
+		},
+		"upsert": upsert,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &action{meta: meta, body: body}, nil
+}
+
+// bulkResponse holds the parts of the _bulk API response that are needed to find failed actions.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string          `json:"_id"`
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk sends given actions to the _bulk API. Requests rejected due to load and actions that failed
+// with a retryable status are retried with a linear backoff.
+func (e *Exporter) bulk(ctx context.Context, actions []*action) error {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			glog.Warningf("Retrying %d bulk actions, attempt %d", len(actions), attempt)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * e.retryBackoff):
+			}
+		}
+
+		failed, err := e.sendBulk(ctx, actions)
+		if err == nil {
+			return nil
+		}
+		if failed == nil || attempt >= e.maxRetries {
+			return err
+		}
+		actions = failed
+	}
+}
+
+// sendBulk sends a single _bulk request. In case of an error it returns actions that can be
+// retried, nil if the error is permanent.
+func (e *Exporter) sendBulk(ctx context.Context, actions []*action) ([]*action, error) {
+	var body bytes.Buffer
+	for _, a := range actions {
+		body.Write(a.meta)
+		body.WriteByte('\n')
+		body.Write(a.body)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url+"/_bulk", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return actions, fmt.Errorf("bulk request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		err := fmt.Errorf("bulk request failed with status %s: %s", resp.Status, msg)
+		if retryable(resp.StatusCode) {
+			return actions, err
+		}
+		return nil, err
+	}
+
+	var br bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		return nil, fmt.Errorf("could not decode bulk response: %v", err)
+	}
+	if !br.Errors {
+		return nil, nil
+	}
+	if len(br.Items) != len(actions) {
+		return nil, fmt.Errorf("bulk response has %d items, expected %d", len(br.Items), len(actions))
+	}
+
+	var failed []*action
+	var errs []string
+	permanent := false
+	for i, item := range br.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status < 300 {
+				continue
+			}
+			errs = append(errs, fmt.Sprintf("%s: %d %s", result.ID, result.Status, result.Error))
+			if retryable(result.Status) {
+				failed = append(failed, actions[i])
+			} else {
+				permanent = true
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil, nil
+	}
+
+	err = fmt.Errorf("%d bulk actions failed: %s", len(errs), strings.Join(errs, "; "))
+	if permanent {
+		return nil, err
+	}
+
+	return failed, err
+}
+
+// retryable returns true if a given status signals that the request can succeed later.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
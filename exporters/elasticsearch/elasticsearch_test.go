@@ -0,0 +1,407 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elasticsearch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/hashr/common"
+)
+
+const sourceHash = "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+
+// fakeElasticsearch is a stand-in for the index template and _bulk APIs. Update scripts are
+// emulated in Go, documents are stored in memory.
+type fakeElasticsearch struct {
+	mu        sync.Mutex
+	templates map[string][]string
+	docs      map[string]map[string]map[string]interface{}
+	requests  int
+	// itemStatus returns status of a given bulk action, 0 means success.
+	itemStatus func(request int, id string) int
+	// requestStatus returns status of a given bulk request, 0 means success.
+	requestStatus func(request int) int
+}
+
+func newFakeElasticsearch() *fakeElasticsearch {
+	return &fakeElasticsearch{
+		templates: make(map[string][]string),
+		docs:      make(map[string]map[string]map[string]interface{}),
+	}
+}
+
+func (f *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_index_template/"):
+		var template struct {
+			IndexPatterns []string `json:"index_patterns"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.templates[strings.TrimPrefix(r.URL.Path, "/_index_template/")] = template.IndexPatterns
+		fmt.Fprint(w, `{"acknowledged": true}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+		f.bulk(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeElasticsearch) bulk(w http.ResponseWriter, r *http.Request) {
+	f.requests++
+	if f.requestStatus != nil {
+		if status := f.requestStatus(f.requests); status != 0 {
+			http.Error(w, "rejected", status)
+			return
+		}
+	}
+
+	if got := r.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		http.Error(w, "unexpected content type "+got, http.StatusBadRequest)
+		return
+	}
+
+	type item struct {
+		ID     string      `json:"_id"`
+		Status int         `json:"status"`
+		Error  interface{} `json:"error,omitempty"`
+	}
+	resp := struct {
+		Errors bool              `json:"errors"`
+		Items  []map[string]item `json:"items"`
+	}{}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		var meta struct {
+			Update struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			} `json:"update"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !scanner.Scan() {
+			http.Error(w, "missing action body", http.StatusBadRequest)
+			return
+		}
+		var body struct {
+			Script struct {
+				Params map[string]interface{} `json:"params"`
+			} `json:"script"`
+			Upsert map[string]interface{} `json:"upsert"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		index, id := meta.Update.Index, meta.Update.ID
+		if f.itemStatus != nil {
+			if status := f.itemStatus(f.requests, id); status != 0 {
+				resp.Errors = true
+				resp.Items = append(resp.Items, map[string]item{"update": {ID: id, Status: status, Error: "failed"}})
+				continue
+			}
+		}
+
+		if f.docs[index] == nil {
+			f.docs[index] = make(map[string]map[string]interface{})
+		}
+		doc, ok := f.docs[index][id]
+		if !ok {
+			f.docs[index][id] = body.Upsert
+		} else {
+			params := body.Script.Params
+			if paths, ok := params["paths"]; ok {
+				doc["paths"] = merge(doc["paths"], paths.([]interface{})...)
+				doc["sources"] = mergeSource(doc["sources"], params["source"].(map[string]interface{}))
+				if params["mime_type"] != nil {
+					doc["mime_type"] = params["mime_type"]
+				}
+			} else {
+				doc["source_ids"] = merge(doc["source_ids"], params["source_id"])
+				doc["sample_count"] = params["sample_count"]
+			}
+		}
+		resp.Items = append(resp.Items, map[string]item{"update": {ID: id, Status: http.StatusOK}})
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+func merge(existing interface{}, values ...interface{}) []interface{} {
+	merged, _ := existing.([]interface{})
+	for _, v := range values {
+		found := false
+		for _, e := range merged {
+			if e == v {
+				found = true
+			}
+		}
+		if !found {
+			merged = append(merged, v)
+		}
+	}
+
+	return merged
+}
+
+// mergeSource mirrors samplesScript: paths are merged into the entry with the same source and
+// source ID, or a new entry is added.
+func mergeSource(existing interface{}, source map[string]interface{}) []interface{} {
+	sources, _ := existing.([]interface{})
+	for _, s := range sources {
+		entry := s.(map[string]interface{})
+		if entry["source"] == source["source"] && entry["source_id"] == source["source_id"] {
+			entry["paths"] = merge(entry["paths"], source["paths"].([]interface{})...)
+			return sources
+		}
+	}
+
+	return append(sources, source)
+}
+
+func testExporter(t *testing.T, f *fakeElasticsearch, bulkSize, maxRetries int) *Exporter {
+	t.Helper()
+
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	e, err := NewExporter(context.Background(), server.Client(), server.URL, "hashr-samples", "hashr-sources", bulkSize, maxRetries)
+	if err != nil {
+		t.Fatalf("could not create Elasticsearch exporter: %v", err)
+	}
+	e.retryBackoff = 0
+
+	return e
+}
+
+var samples = []common.Sample{
+	{
+		Sha256:      "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+		Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+		SourcePaths: []string{"bin/ls"},
+		Upload:      true,
+	},
+	{
+		Sha256:      "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb",
+		Paths:       []string{filepath.Join("testdata/extraction", "file.02")},
+		SourcePaths: []string{"bin/cat", "usr/bin/cat"},
+		Upload:      true,
+	},
+	{
+		// Samples that are not uploaded were already exported from another source.
+		Sha256:      "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7",
+		SourcePaths: []string{"bin/cp"},
+		Size:        5120,
+	},
+}
+
+func TestNewExporter(t *testing.T) {
+	f := newFakeElasticsearch()
+	testExporter(t, f, 10, 0)
+
+	want := map[string][]string{
+		"hashr-samples": {"hashr-samples"},
+		"hashr-sources": {"hashr-sources"},
+	}
+	if diff := cmp.Diff(want, f.templates); diff != "" {
+		t.Errorf("NewExporter() unexpected index templates diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeElasticsearch()
+	e := testExporter(t, f, 2, 0)
+
+	if err := e.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", sourceHash, "/tmp/ubuntu.tar.gz", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	// Exporting the same source again should not duplicate the data.
+	moved := []common.Sample{{Sha256: samples[0].Sha256, SourcePaths: []string{"usr/bin/ls"}, Size: 8192}}
+	if err := e.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts-v2", sourceHash, "/tmp/ubuntu.tar.gz", "Official Ubuntu GCP image.", moved); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	// Paths found again under the same source ID are merged into the existing provenance entry.
+	if err := e.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", sourceHash, "/tmp/ubuntu.tar.gz", "Official Ubuntu GCP image.", moved); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	// 4 actions in batches of 2 in the first export, 2 actions in each of the others.
+	if f.requests != 4 {
+		t.Errorf("Export() sent %d bulk requests, want 4", f.requests)
+	}
+
+	wantSamples := map[string]map[string]interface{}{
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3": {
+			"sha256":    "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+			"size":      float64(8192),
+			"mime_type": "application/octet-stream",
+			"paths":     []interface{}{"bin/ls", "usr/bin/ls"},
+			"sources": []interface{}{
+				map[string]interface{}{"source": sourceHash, "source_id": "ubuntu-1604-lts", "repo": "GCP", "paths": []interface{}{"bin/ls", "usr/bin/ls"}},
+				map[string]interface{}{"source": sourceHash, "source_id": "ubuntu-1604-lts-v2", "repo": "GCP", "paths": []interface{}{"usr/bin/ls"}},
+			},
+		},
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb": {
+			"sha256":    "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb",
+			"size":      float64(7168),
+			"mime_type": "application/octet-stream",
+			"paths":     []interface{}{"bin/cat", "usr/bin/cat"},
+			"sources": []interface{}{
+				map[string]interface{}{"source": sourceHash, "source_id": "ubuntu-1604-lts", "repo": "GCP", "paths": []interface{}{"bin/cat", "usr/bin/cat"}},
+			},
+		},
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7": {
+			"sha256": "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7",
+			"size":   float64(5120),
+			"paths":  []interface{}{"bin/cp"},
+			"sources": []interface{}{
+				map[string]interface{}{"source": sourceHash, "source_id": "ubuntu-1604-lts", "repo": "GCP", "paths": []interface{}{"bin/cp"}},
+			},
+		},
+	}
+	if diff := cmp.Diff(wantSamples, f.docs["hashr-samples"]); diff != "" {
+		t.Errorf("Export() unexpected samples diff (-want/+got):\n%s", diff)
+	}
+
+	wantSources := map[string]map[string]interface{}{
+		sourceHash: {
+			"sha256":       sourceHash,
+			"source_ids":   []interface{}{"ubuntu-1604-lts", "ubuntu-1604-lts-v2"},
+			"source_path":  "/tmp/ubuntu.tar.gz",
+			"description":  "Official Ubuntu GCP image.",
+			"repo_name":    "GCP",
+			"repo_path":    "ubuntu",
+			"sample_count": float64(1),
+		},
+	}
+	if diff := cmp.Diff(wantSources, f.docs["hashr-sources"]); diff != "" {
+		t.Errorf("Export() unexpected sources diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestExportRetries(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeElasticsearch()
+	e := testExporter(t, f, 10, 2)
+
+	var retried []string
+	// The first request is rejected, in the second one a single action fails.
+	f.requestStatus = func(request int) int {
+		if request == 1 {
+			return http.StatusTooManyRequests
+		}
+		return 0
+	}
+	f.itemStatus = func(request int, id string) int {
+		if request == 3 {
+			retried = append(retried, id)
+		}
+		if request == 2 && id == samples[1].Sha256 {
+			return http.StatusTooManyRequests
+		}
+		return 0
+	}
+
+	if err := e.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", sourceHash, "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	if f.requests != 3 {
+		t.Errorf("Export() sent %d bulk requests, want 3", f.requests)
+	}
+	if diff := cmp.Diff([]string{samples[1].Sha256}, retried); diff != "" {
+		t.Errorf("Export() unexpected retried actions diff (-want/+got):\n%s", diff)
+	}
+
+	var ids []string
+	for id := range f.docs["hashr-samples"] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	want := []string{samples[1].Sha256, samples[2].Sha256, samples[0].Sha256}
+	if diff := cmp.Diff(want, ids); diff != "" {
+		t.Errorf("Export() unexpected samples diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name          string
+		requestStatus func(int) int
+		itemStatus    func(int, string) int
+		wantRequests  int
+	}{
+		{
+			name:          "retries exhausted",
+			requestStatus: func(int) int { return http.StatusServiceUnavailable },
+			wantRequests:  3,
+		},
+		{
+			name:          "permanent request error",
+			requestStatus: func(int) int { return http.StatusBadRequest },
+			wantRequests:  1,
+		},
+		{
+			name: "permanent action error",
+			itemStatus: func(_ int, id string) int {
+				if id == samples[0].Sha256 {
+					return http.StatusBadRequest
+				}
+				return 0
+			},
+			wantRequests: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeElasticsearch()
+			e := testExporter(t, f, 10, 2)
+			f.requestStatus, f.itemStatus = tc.requestStatus, tc.itemStatus
+
+			if err := e.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", sourceHash, "", "Official Ubuntu GCP image.", samples); err == nil {
+				t.Error("Export() succeeded, want error")
+			}
+			if f.requests != tc.wantRequests {
+				t.Errorf("Export() sent %d bulk requests, want %d", f.requests, tc.wantRequests)
+			}
+		})
+	}
+}
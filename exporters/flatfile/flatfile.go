@@ -0,0 +1,513 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flatfile provides functions required to export data to JSON Lines, CSV or Parquet files.
+package flatfile
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/google/hashr/common"
+	"github.com/google/hashr/inspect"
+
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/floor"
+	"github.com/fraugster/parquet-go/parquet"
+	"github.com/fraugster/parquet-go/parquetschema"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Name contains name of the exporter.
+	Name = "flatfile"
+
+	// Supported output formats.
+	FormatJSONL   = "jsonl"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+
+	// Supported compression methods. Parquet files are compressed internally, hence zstd is only
+	// available for JSONL and CSV files and snappy only for Parquet files.
+	CompressionNone   = "none"
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+
+	// partialSuffix is appended to the name of the file that is currently being written, the file
+	// is renamed once it's finalized. Files with this suffix were not finalized, e.g. because hashR
+	// was killed, and may be truncated.
+	partialSuffix = ".partial"
+
+	// maxRowGroupSize is the maximum size of a Parquet row group kept in memory before it's
+	// written to the file.
+	maxRowGroupSize = 64 * 1024 * 1024
+	// maxRowGroupRows is the maximum number of records in a Parquet row group, it limits row
+	// groups of small records that would otherwise take long to reach maxRowGroupSize.
+	maxRowGroupRows = 1000000
+)
+
+// Record holds data about a single sample <-> source pair.
+type Record struct {
+	SourceSha256 string   `json:"source_sha256" parquet:"source_sha256"`
+	SourceID     string   `json:"source_id" parquet:"source_id"`
+	RepoName     string   `json:"repo_name" parquet:"repo_name"`
+	RepoPath     string   `json:"repo_path" parquet:"repo_path"`
+	SampleSha256 string   `json:"sample_sha256" parquet:"sample_sha256"`
+	Paths        []string `json:"paths" parquet:"paths"`
+	Size         int64    `json:"size" parquet:"size"`
+	MimeType     string   `json:"mime_type" parquet:"mime_type"`
+}
+
+// csvHeader contains CSV column names, in the order of Record fields.
+var csvHeader = []string{"source_sha256", "source_id", "repo_name", "repo_path", "sample_sha256", "paths", "size", "mime_type"}
+
+const parquetSchema = `message hashr {
+	required binary source_sha256 (STRING);
+	required binary source_id (STRING);
+	required binary repo_name (STRING);
+	required binary repo_path (STRING);
+	required binary sample_sha256 (STRING);
+	required group paths (LIST) {
+		repeated group list {
+			required binary element (STRING);
+		}
+	}
+	required int64 size;
+	required binary mime_type (STRING);
+}`
+
+// Exporter is an instance of flat-file Exporter.
+type Exporter struct {
+	outputDir   string
+	format      string
+	compression string
+	maxFileSize int64
+	// prefix is shared by all files created by this exporter, so consecutive runs don't overwrite
+	// each other's files.
+	prefix string
+
+	mu     sync.Mutex
+	seq    int
+	file   *os.File
+	writer recordWriter
+}
+
+// Name returns exporter name.
+func (e *Exporter) Name() string {
+	return Name
+}
+
+// NewExporter creates new flat-file exporter that writes files to a given directory. Once a file
+// reaches maxFileSize bytes, new file is started. If maxFileSize is 0 all the records are written
+// to a single file.
+func NewExporter(outputDir, format, compression string, maxFileSize int64) (*Exporter, error) {
+	switch format {
+	case FormatJSONL, FormatCSV, FormatParquet:
+	default:
+		return nil, fmt.Errorf("unsupported format %q, supported formats: %s, %s, %s", format, FormatJSONL, FormatCSV, FormatParquet)
+	}
+
+	if compression == "" {
+		compression = CompressionNone
+	}
+	switch compression {
+	case CompressionNone, CompressionGzip:
+	case CompressionZstd:
+		if format == FormatParquet {
+			return nil, fmt.Errorf("%s compression is not supported for %s format", compression, format)
+		}
+	case CompressionSnappy:
+		if format != FormatParquet {
+			return nil, fmt.Errorf("%s compression is not supported for %s format", compression, format)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+
+	if maxFileSize < 0 {
+		return nil, fmt.Errorf("max file size can't be negative")
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create output directory: %v", err)
+	}
+
+	return &Exporter{
+		outputDir:   outputDir,
+		format:      format,
+		compression: compression,
+		maxFileSize: maxFileSize,
+		prefix:      fmt.Sprintf("hashr-%s", time.Now().UTC().Format("20060102T150405Z")),
+	}, nil
+}
+
+// Export writes one record for each of the extracted samples. Buffered JSON Lines and CSV data is
+// flushed at the end of each export, Parquet row groups are written once they are full.
+func (e *Exporter) Export(ctx context.Context, sourceRepoName, sourceRepoPath, sourceID, sourceHash, sourcePath, sourceDescription string, samples []common.Sample) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, sample := range samples {
+		if err := e.write(newRecord(sourceRepoName, sourceRepoPath, sourceID, sourceHash, sample)); err != nil {
+			return fmt.Errorf("could not write record of sample %s: %v", sample.Sha256, err)
+		}
+	}
+
+	if e.writer == nil {
+		return nil
+	}
+
+	if err := e.writer.Flush(); err != nil {
+		return fmt.Errorf("could not flush %s: %v", e.file.Name(), err)
+	}
+
+	return nil
+}
+
+// Close finalizes the file that is currently being written and removes its partial suffix.
+func (e *Exporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.closeFile()
+}
+
+func (e *Exporter) write(r *Record) error {
+	if e.writer == nil {
+		if err := e.openFile(); err != nil {
+			return err
+		}
+	}
+
+	if err := e.writer.Write(r); err != nil {
+		return err
+	}
+
+	if e.maxFileSize > 0 && e.writer.Size() >= e.maxFileSize {
+		return e.closeFile()
+	}
+
+	return nil
+}
+
+func (e *Exporter) openFile() error {
+	e.seq++
+	ext := e.format
+	switch e.compression {
+	case CompressionGzip:
+		if e.format != FormatParquet {
+			ext += ".gz"
+		}
+	case CompressionZstd:
+		ext += ".zst"
+	}
+	path := filepath.Join(e.outputDir, fmt.Sprintf("%s-%05d.%s", e.prefix, e.seq, ext))
+
+	file, err := os.OpenFile(path+partialSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", path, err)
+	}
+
+	var writer recordWriter
+	switch e.format {
+	case FormatParquet:
+		rowGroupSize := int64(maxRowGroupSize)
+		if e.maxFileSize > 0 && e.maxFileSize < rowGroupSize {
+			rowGroupSize = e.maxFileSize
+		}
+		writer, err = newParquetWriter(file, e.compression, rowGroupSize, maxRowGroupRows)
+	default:
+		cw := &countingWriter{w: file}
+		var c compressor
+		c, err = newCompressor(cw, e.compression)
+		if err != nil {
+			break
+		}
+		if e.format == FormatCSV {
+			writer, err = newCSVWriter(cw, c)
+		} else {
+			writer = newJSONLWriter(cw, c)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not initialize %s writer: %v", e.format, err)
+	}
+
+	glog.Infof("Writing %s records to %s", e.format, path)
+	e.file, e.writer = file, writer
+
+	return nil
+}
+
+func (e *Exporter) closeFile() error {
+	if e.writer == nil {
+		return nil
+	}
+
+	err := e.writer.Close()
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(e.file.Name(), strings.TrimSuffix(e.file.Name(), partialSuffix))
+	}
+	if err != nil {
+		err = fmt.Errorf("could not close %s: %v", e.file.Name(), err)
+	}
+	e.file, e.writer = nil, nil
+
+	return err
+}
+
+// newRecord creates a record of a given sample. Mime type is only detected if the sample is still
+// present on the local disk.
+func newRecord(sourceRepoName, sourceRepoPath, sourceID, sourceHash string, sample common.Sample) *Record {
+	r := &Record{
+		SourceSha256: sourceHash,
+		SourceID:     sourceID,
+		RepoName:     sourceRepoName,
+		RepoPath:     sourceRepoPath,
+		SampleSha256: sample.Sha256,
+		Paths:        common.SamplePaths(sample),
+		Size:         sample.Size,
+	}
+
+	if r.Paths == nil {
+		r.Paths = []string{}
+	}
+
+	// If sample has more than one path associated with it, take the first that is valid.
+	for _, path := range sample.Paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if r.Size == 0 {
+			r.Size = fi.Size()
+		}
+		fileType, err := inspect.IdentifyFile(path)
+		if err != nil {
+			glog.Warningf("Could not get file content type: %v", err)
+			break
+		}
+		r.MimeType = fileType.MIMEType
+		break
+	}
+
+	return r
+}
+
+// countingWriter counts bytes written to the underlying file.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// compressor compresses data of JSONL and CSV files.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newCompressor(w io.Writer, compression string) (compressor, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nopCompressor{w}, nil
+	}
+}
+
+type nopCompressor struct {
+	io.Writer
+}
+
+func (nopCompressor) Flush() error { return nil }
+func (nopCompressor) Close() error { return nil }
+
+// recordWriter writes records in a given format.
+type recordWriter interface {
+	Write(r *Record) error
+	// Flush writes buffered records to the file.
+	Flush() error
+	// Close flushes buffered records and finalizes the file.
+	Close() error
+	// Size returns the number of bytes written to the file, it's used to decide when to rotate
+	// files.
+	Size() int64
+}
+
+type jsonlWriter struct {
+	cw  *countingWriter
+	c   compressor
+	enc *json.Encoder
+}
+
+func newJSONLWriter(cw *countingWriter, c compressor) *jsonlWriter {
+	return &jsonlWriter{cw: cw, c: c, enc: json.NewEncoder(c)}
+}
+
+func (w *jsonlWriter) Write(r *Record) error {
+	return w.enc.Encode(r)
+}
+
+func (w *jsonlWriter) Flush() error {
+	return w.c.Flush()
+}
+
+func (w *jsonlWriter) Close() error {
+	return w.c.Close()
+}
+
+func (w *jsonlWriter) Size() int64 {
+	return w.cw.n
+}
+
+type csvWriter struct {
+	cw *countingWriter
+	c  compressor
+	w  *csv.Writer
+}
+
+func newCSVWriter(cw *countingWriter, c compressor) (*csvWriter, error) {
+	w := csv.NewWriter(c)
+	if err := w.Write(csvHeader); err != nil {
+		return nil, err
+	}
+
+	return &csvWriter{cw: cw, c: c, w: w}, nil
+}
+
+func (w *csvWriter) Write(r *Record) error {
+	// Sample paths can contain any character, they are stored as JSON array to keep them
+	// unambiguous.
+	paths, err := json.Marshal(r.Paths)
+	if err != nil {
+		return err
+	}
+
+	return w.w.Write([]string{r.SourceSha256, r.SourceID, r.RepoName, r.RepoPath, r.SampleSha256, string(paths), strconv.FormatInt(r.Size, 10), r.MimeType})
+}
+
+func (w *csvWriter) Flush() error {
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		return err
+	}
+
+	return w.c.Flush()
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		return err
+	}
+
+	return w.c.Close()
+}
+
+func (w *csvWriter) Size() int64 {
+	return w.cw.n
+}
+
+type parquetWriter struct {
+	fw *goparquet.FileWriter
+	w  *floor.Writer
+	// rows is the number of records in the current row group, maxRows is its limit.
+	rows    int
+	maxRows int
+}
+
+// newParquetWriter creates a Parquet writer, row groups are written to the file once they reach
+// a given size in bytes or a given number of records.
+func newParquetWriter(w io.Writer, compression string, rowGroupSize int64, maxRows int) (*parquetWriter, error) {
+	schemaDef, err := parquetschema.ParseSchemaDefinition(parquetSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := parquet.CompressionCodec_UNCOMPRESSED
+	switch compression {
+	case CompressionGzip:
+		codec = parquet.CompressionCodec_GZIP
+	case CompressionSnappy:
+		codec = parquet.CompressionCodec_SNAPPY
+	}
+
+	fw := goparquet.NewFileWriter(w,
+		goparquet.WithSchemaDefinition(schemaDef),
+		goparquet.WithCompressionCodec(codec),
+		goparquet.WithMaxRowGroupSize(rowGroupSize),
+		goparquet.WithCreator("hashr"),
+	)
+
+	return &parquetWriter{fw: fw, w: floor.NewWriter(fw), maxRows: maxRows}, nil
+}
+
+func (w *parquetWriter) Write(r *Record) error {
+	if err := w.w.Write(r); err != nil {
+		return err
+	}
+
+	// Row groups reaching the maximum size are written by the file writer.
+	if w.fw.CurrentRowGroupSize() == 0 {
+		w.rows = 0
+		return nil
+	}
+	w.rows++
+	if w.rows < w.maxRows {
+		return nil
+	}
+	w.rows = 0
+
+	return w.fw.FlushRowGroup()
+}
+
+// Flush does nothing, as writing a row group after each export would result in many small row
+// groups. Buffered records are written when the row group is full or the file is closed.
+func (w *parquetWriter) Flush() error {
+	return nil
+}
+
+func (w *parquetWriter) Close() error {
+	return w.fw.Close()
+}
+
+func (w *parquetWriter) Size() int64 {
+	return w.fw.CurrentFileSize()
+}
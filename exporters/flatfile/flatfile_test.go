@@ -0,0 +1,395 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flatfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/hashr/common"
+
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/floor"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const sourceHash = "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+
+var samples = []common.Sample{
+	{
+		Sha256:      "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+		Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+		SourcePaths: []string{"bin/ls"},
+		Upload:      true,
+	},
+	{
+		Sha256:      "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb",
+		Paths:       []string{filepath.Join("testdata/extraction", "file.02")},
+		SourcePaths: []string{"bin/cat", "usr/bin/cat"},
+		Upload:      true,
+	},
+	{
+		// Samples that are not uploaded were already exported from another source.
+		Sha256:      "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7",
+		SourcePaths: []string{"bin/cp"},
+		Size:        5120,
+	},
+}
+
+var wantRecords = []*Record{
+	{
+		SourceSha256: sourceHash,
+		SourceID:     "ubuntu-1604-lts",
+		RepoName:     "GCP",
+		RepoPath:     "ubuntu",
+		SampleSha256: "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+		Paths:        []string{"bin/ls"},
+		Size:         8192,
+		MimeType:     "application/octet-stream",
+	},
+	{
+		SourceSha256: sourceHash,
+		SourceID:     "ubuntu-1604-lts",
+		RepoName:     "GCP",
+		RepoPath:     "ubuntu",
+		SampleSha256: "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb",
+		Paths:        []string{"bin/cat", "usr/bin/cat"},
+		Size:         7168,
+		MimeType:     "application/octet-stream",
+	},
+	{
+		SourceSha256: sourceHash,
+		SourceID:     "ubuntu-1604-lts",
+		RepoName:     "GCP",
+		RepoPath:     "ubuntu",
+		SampleSha256: "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7",
+		Paths:        []string{"bin/cp"},
+		Size:         5120,
+	},
+}
+
+func TestNewExporter(t *testing.T) {
+	for _, tc := range []struct {
+		format      string
+		compression string
+		maxFileSize int64
+		wantErr     bool
+	}{
+		{format: FormatJSONL, compression: CompressionNone},
+		{format: FormatJSONL, compression: ""},
+		{format: FormatCSV, compression: CompressionZstd},
+		{format: FormatParquet, compression: CompressionSnappy},
+		{format: "xml", compression: CompressionNone, wantErr: true},
+		{format: FormatJSONL, compression: "lz4", wantErr: true},
+		{format: FormatJSONL, compression: CompressionSnappy, wantErr: true},
+		{format: FormatParquet, compression: CompressionZstd, wantErr: true},
+		{format: FormatCSV, compression: CompressionGzip, maxFileSize: -1, wantErr: true},
+	} {
+		_, err := NewExporter(t.TempDir(), tc.format, tc.compression, tc.maxFileSize)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("NewExporter(%q, %q, %d) = %v, want error: %v", tc.format, tc.compression, tc.maxFileSize, err, tc.wantErr)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	for _, tc := range []struct {
+		format      string
+		compression string
+		wantExt     string
+	}{
+		{format: FormatJSONL, compression: CompressionNone, wantExt: ".jsonl"},
+		{format: FormatJSONL, compression: CompressionGzip, wantExt: ".jsonl.gz"},
+		{format: FormatJSONL, compression: CompressionZstd, wantExt: ".jsonl.zst"},
+		{format: FormatCSV, compression: CompressionNone, wantExt: ".csv"},
+		{format: FormatCSV, compression: CompressionGzip, wantExt: ".csv.gz"},
+		{format: FormatParquet, compression: CompressionNone, wantExt: ".parquet"},
+		{format: FormatParquet, compression: CompressionSnappy, wantExt: ".parquet"},
+		{format: FormatParquet, compression: CompressionGzip, wantExt: ".parquet"},
+	} {
+		t.Run(fmt.Sprintf("%s-%s", tc.format, tc.compression), func(t *testing.T) {
+			outputDir := t.TempDir()
+			e, err := NewExporter(outputDir, tc.format, tc.compression, 0)
+			if err != nil {
+				t.Fatalf("could not create flat-file exporter: %v", err)
+			}
+
+			if err := e.Export(context.Background(), "GCP", "ubuntu", "ubuntu-1604-lts", sourceHash, "", "Official Ubuntu GCP image.", samples); err != nil {
+				t.Fatalf("unexpected error while running Export(): %v", err)
+			}
+			if err := e.Close(); err != nil {
+				t.Fatalf("unexpected error while running Close(): %v", err)
+			}
+
+			files := outputFiles(t, outputDir)
+			if len(files) != 1 {
+				t.Fatalf("Export() created %d files, want 1", len(files))
+			}
+			if !strings.HasSuffix(files[0], tc.wantExt) {
+				t.Errorf("Export() created %s, want %s extension", files[0], tc.wantExt)
+			}
+
+			if diff := cmp.Diff(wantRecords, readRecords(t, files[0])); diff != "" {
+				t.Errorf("Export() unexpected records diff (-want/+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExportRotation(t *testing.T) {
+	for _, format := range []string{FormatJSONL, FormatCSV, FormatParquet} {
+		t.Run(format, func(t *testing.T) {
+			outputDir := t.TempDir()
+			e, err := NewExporter(outputDir, format, CompressionNone, 1)
+			if err != nil {
+				t.Fatalf("could not create flat-file exporter: %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := e.Export(context.Background(), "GCP", "ubuntu", "ubuntu-1604-lts", sourceHash, "", "Official Ubuntu GCP image.", samples); err != nil {
+					t.Fatalf("unexpected error while running Export(): %v", err)
+				}
+			}
+			if err := e.Close(); err != nil {
+				t.Fatalf("unexpected error while running Close(): %v", err)
+			}
+
+			files := outputFiles(t, outputDir)
+			if len(files) < 2 {
+				t.Fatalf("Export() created %d files, want files to be rotated", len(files))
+			}
+
+			var got []*Record
+			for _, file := range files {
+				got = append(got, readRecords(t, file)...)
+			}
+			if diff := cmp.Diff(append(wantRecords, wantRecords...), got); diff != "" {
+				t.Errorf("Export() unexpected records diff (-want/+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExportPartialFile(t *testing.T) {
+	outputDir := t.TempDir()
+	e, err := NewExporter(outputDir, FormatParquet, CompressionNone, 0)
+	if err != nil {
+		t.Fatalf("could not create flat-file exporter: %v", err)
+	}
+
+	if err := e.Export(context.Background(), "GCP", "ubuntu", "ubuntu-1604-lts", sourceHash, "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	// The file is not finalized until the exporter is closed.
+	files := outputFiles(t, outputDir)
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".parquet"+partialSuffix) {
+		t.Fatalf("Export() created %v, want a single partial Parquet file", files)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("unexpected error while running Close(): %v", err)
+	}
+
+	files = outputFiles(t, outputDir)
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".parquet") {
+		t.Fatalf("Close() left %v, want a single Parquet file", files)
+	}
+	if diff := cmp.Diff(wantRecords, readRecords(t, files[0])); diff != "" {
+		t.Errorf("Close() unexpected records diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestExportParquetRowGroups(t *testing.T) {
+	outputDir := t.TempDir()
+	e, err := NewExporter(outputDir, FormatParquet, CompressionNone, 0)
+	if err != nil {
+		t.Fatalf("could not create flat-file exporter: %v", err)
+	}
+
+	// Records of multiple exports are written in a single row group.
+	for i := 0; i < 3; i++ {
+		if err := e.Export(context.Background(), "GCP", "ubuntu", "ubuntu-1604-lts", sourceHash, "", "Official Ubuntu GCP image.", samples); err != nil {
+			t.Fatalf("unexpected error while running Export(): %v", err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("unexpected error while running Close(): %v", err)
+	}
+
+	files := outputFiles(t, outputDir)
+	if len(files) != 1 {
+		t.Fatalf("Export() created %d files, want 1", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rowGroupCount(t, data); got != 1 {
+		t.Errorf("Export() wrote %d row groups, want 1", got)
+	}
+}
+
+func TestParquetWriterMaxRows(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newParquetWriter(&buf, CompressionNone, maxRowGroupSize, 2)
+	if err != nil {
+		t.Fatalf("could not create Parquet writer: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := w.Write(wantRecords[i%len(wantRecords)]); err != nil {
+			t.Fatalf("unexpected error while running Write(): %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error while running Close(): %v", err)
+	}
+
+	if got := rowGroupCount(t, buf.Bytes()); got != 3 {
+		t.Errorf("Parquet writer wrote %d row groups, want 3", got)
+	}
+}
+
+func rowGroupCount(t *testing.T, data []byte) int {
+	t.Helper()
+
+	fr, err := goparquet.NewFileReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("could not open Parquet file: %v", err)
+	}
+
+	return fr.RowGroupCount()
+}
+
+func outputFiles(t *testing.T, outputDir string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(outputDir, "hashr-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func readRecords(t *testing.T, path string) []*Record {
+	t.Helper()
+
+	if strings.HasSuffix(path, ".parquet") {
+		return readParquet(t, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch filepath.Ext(path) {
+	case ".gz":
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case ".zst":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	var records []*Record
+	if strings.Contains(path, ".csv") {
+		rows, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(csvHeader, rows[0]); diff != "" {
+			t.Errorf("unexpected CSV header diff (-want/+got):\n%s", diff)
+		}
+		for _, row := range rows[1:] {
+			record := &Record{SourceSha256: row[0], SourceID: row[1], RepoName: row[2], RepoPath: row[3], SampleSha256: row[4], MimeType: row[7]}
+			if err := json.Unmarshal([]byte(row[5]), &record.Paths); err != nil {
+				t.Fatal(err)
+			}
+			if record.Size, err = strconv.ParseInt(row[6], 10, 64); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+func readParquet(t *testing.T, path string) []*Record {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fr, err := goparquet.NewFileReader(f)
+	if err != nil {
+		t.Fatalf("could not open %s: %v", path, err)
+	}
+	r := floor.NewReader(fr)
+
+	var records []*Record
+	for r.Next() {
+		record := &Record{}
+		if err := r.Scan(record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
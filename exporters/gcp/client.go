@@ -0,0 +1,71 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+
+	"cloud.google.com/go/spanner"
+)
+
+// Client is the subset of Cloud Spanner client operations used by the exporter.
+type Client interface {
+	// ReadWriteTransaction runs a given function in a read-write transaction, writes are committed
+	// only if the function succeeds.
+	ReadWriteTransaction(ctx context.Context, f func(context.Context, Transaction) error) error
+}
+
+// Transaction is the subset of Cloud Spanner read-write transaction operations used by the
+// exporter.
+type Transaction interface {
+	// ReadRows reads given columns of the rows with given keys, missing rows are skipped.
+	ReadRows(ctx context.Context, table string, keys []spanner.Key, columns []string) ([]*spanner.Row, error)
+	// InsertOrUpdate buffers a write of a single row, which is applied when the transaction commits.
+	InsertOrUpdate(table string, columns []string, values []interface{}) error
+}
+
+// client implements Client using Cloud Spanner client.
+type client struct {
+	client *spanner.Client
+}
+
+func (c *client) ReadWriteTransaction(ctx context.Context, f func(context.Context, Transaction) error) error {
+	_, err := c.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		return f(ctx, &transaction{txn: txn})
+	})
+
+	return err
+}
+
+type transaction struct {
+	txn *spanner.ReadWriteTransaction
+}
+
+func (t *transaction) ReadRows(ctx context.Context, table string, keys []spanner.Key, columns []string) ([]*spanner.Row, error) {
+	var rows []*spanner.Row
+	err := t.txn.Read(ctx, table, spanner.KeySetFromKeys(keys...), columns).Do(func(row *spanner.Row) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (t *transaction) InsertOrUpdate(table string, columns []string, values []interface{}) error {
+	return t.txn.BufferWrite([]*spanner.Mutation{spanner.InsertOrUpdate(table, columns, values)})
+}
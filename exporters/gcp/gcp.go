@@ -1,41 +1,44 @@
 package gcp
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
-	"os/exec"
 	"strings"
 	"sync"
 
 	"cloud.google.com/go/spanner"
-	"github.com/golang/glog"
 	"github.com/google/hashr/common"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/storage/v1"
-	"google.golang.org/grpc/codes"
+	"github.com/google/hashr/inspect"
+	"github.com/google/hashr/payloads"
 )
 
 const (
 	// Name contains name of the exporter.
 	Name = "GCP"
+	// batchSize is the number of samples committed in a single transaction. Each sample results in
+	// at most 28 column writes (samples, payloads, executables and samples_sources) plus foreign key
+	// and index entries, which keeps commits well within the Spanner limit of mutations per commit.
+	batchSize = 500
 )
 
 // Exporter is an instance of GCP Exporter.
 type Exporter struct {
-	spannerClient  *spanner.Client
-	storageClient  *storage.Service
-	GCSBucket      string
+	spannerClient  Client
+	payloadStore   payloads.Store
 	uploadPayloads bool
 	workerCount    int
-	wg             sync.WaitGroup
 }
 
-// NewExporter creates new GCP exporter.
-func NewExporter(spannerClient *spanner.Client, storageClient *storage.Service, GCSBucket string, uploadPayloads bool, workerCount int) (*Exporter, error) {
-	return &Exporter{spannerClient: spannerClient, storageClient: storageClient, GCSBucket: GCSBucket, uploadPayloads: uploadPayloads, workerCount: workerCount}, nil
+// NewExporter creates new GCP exporter. Payloads are uploaded to a given payload store, usually
+// a GCS bucket.
+func NewExporter(spannerClient *spanner.Client, payloadStore payloads.Store, uploadPayloads bool, workerCount int) (*Exporter, error) {
+	if uploadPayloads && payloadStore == nil {
+		return nil, fmt.Errorf("payload store is needed to upload payloads")
+	}
+
+	return &Exporter{spannerClient: &client{client: spannerClient}, payloadStore: payloadStore, uploadPayloads: uploadPayloads, workerCount: workerCount}, nil
 }
 
 // Name returns exporter name.
@@ -43,16 +46,53 @@ func (e *Exporter) Name() string {
 	return Name
 }
 
-// Export exports extracted data to GCP (Spanner + GCS).
+// sampleRow holds data of a single sample that will be exported.
+type sampleRow struct {
+	sha256 string
+	size   int64
+	// extracted is set if the sample was extracted from the source and its metadata is known.
+	extracted  bool
+	mimeType   string
+	fileOutput string
+	// location holds the location of the payload in the payload store.
+	location string
+	// sourcePaths holds paths of the sample inside the source.
+	sourcePaths []string
+	// executable holds metadata of executables, it's nil for other samples.
+	executable *common.ExecutableMetadata
+}
+
+type sampleResult struct {
+	sha256 string
+	row    *sampleRow
+	err    error
+}
+
+// Export exports extracted data to GCP (Spanner + payload store). Sample metadata is gathered by concurrent
+// workers and committed to Spanner in batches. Samples that could not be exported are reported in
+// the returned error.
 func (e *Exporter) Export(ctx context.Context, sourceRepoName, sourceRepoPath, sourceID, sourceHash, sourcePath, sourceDescription string, samples []common.Sample) error {
 	if err := e.insertSource(ctx, sourceHash, sourceID, sourcePath, sourceRepoName, sourceRepoPath, sourceDescription); err != nil {
 		return fmt.Errorf("could not upload source data: %v", err)
 	}
 
-	jobs := make(chan common.Sample, len(samples))
-	for w := 1; w <= e.workerCount; w++ {
-		e.wg.Add(1)
-		go e.worker(ctx, sourceHash, jobs)
+	workerCount := e.workerCount
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	jobs := make(chan common.Sample)
+	results := make(chan sampleResult)
+	var wg sync.WaitGroup
+	for w := 1; w <= workerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sample := range jobs {
+				row, err := e.newSampleRow(ctx, sample)
+				results <- sampleResult{sha256: sample.Sha256, row: row, err: err}
+			}
+		}()
 	}
 
 	go func() {
@@ -61,76 +101,62 @@ func (e *Exporter) Export(ctx context.Context, sourceRepoName, sourceRepoPath, s
 		}
 		close(jobs)
 	}()
-	e.wg.Wait()
 
-	return nil
-}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-func (e *Exporter) worker(ctx context.Context, sourceHash string, samples <-chan common.Sample) {
-	defer e.wg.Done()
-	for sample := range samples {
-		if err := e.insertSample(ctx, sample); err != nil {
-			glog.Errorf("skipping %s, could not insert sample data: %v", sample.Sha256, err)
-			continue
-		}
-
-		if err := e.insertRelationship(ctx, sample, sourceHash); err != nil {
-			glog.Errorf("skipping %s, could not insert source <-> sample relationship: %v", sample.Sha256, err)
-			continue
+	var errs []string
+	var failed int
+	batch := make([]*sampleRow, 0, batchSize)
+	commit := func() {
+		if err := e.exportBatch(ctx, sourceHash, batch); err != nil {
+			failed += len(batch)
+			errs = append(errs, fmt.Sprintf("batch of %d samples: %v", len(batch), err))
 		}
+		batch = batch[:0]
 	}
-}
 
-func (e *Exporter) insertRelationship(ctx context.Context, sample common.Sample, sourceSha256 string) error {
-	var paths, existingPaths []string
-
-	for _, path := range sample.Paths {
-		s := strings.Split(path, "/extracted/")
-		if len(s) < 2 {
-			glog.Warningf("sample path does not follow expected format: %s", path)
+	for result := range results {
+		if result.err != nil {
+			failed++
+			errs = append(errs, fmt.Sprintf("%s: %v", result.sha256, result.err))
 			continue
 		}
-		paths = append(paths, strings.TrimPrefix(strings.TrimPrefix(s[len(s)-1], "mnt"), "export"))
-	}
-
-	sql := spanner.Statement{
-		SQL: `SELECT sample_paths FROM samples_sources WHERE sample_sha256 = @sha256`,
-		Params: map[string]interface{}{
-			"sha256": sample.Sha256,
-		},
-	}
 
-	iter := e.spannerClient.Single().Query(ctx, sql)
-	defer iter.Stop()
-	row, err := iter.Next()
-	if err != iterator.Done {
-		if err := row.Columns(&existingPaths); err != nil {
-			return err
+		batch = append(batch, result.row)
+		if len(batch) == batchSize {
+			commit()
 		}
 	}
-	if err != iterator.Done && err != nil {
-		return err
+	if len(batch) > 0 {
+		commit()
 	}
 
-	_, err = e.spannerClient.Apply(ctx, []*spanner.Mutation{
-		spanner.InsertOrUpdate("samples_sources",
-			[]string{
-				"sample_sha256",
-				"source_sha256",
-				"sample_paths"},
-			[]interface{}{
-				sample.Sha256,
-				sourceSha256,
-				append(existingPaths, paths...),
-			})})
-	if err != nil {
-		return fmt.Errorf("failed to insert data %v", err)
+	if len(errs) > 0 {
+		return fmt.Errorf("could not export %d samples: %s", failed, strings.Join(errs, "; "))
 	}
 
 	return nil
 }
 
-func (e *Exporter) insertSample(ctx context.Context, sample common.Sample) error {
+// newSampleRow gathers data of a given sample that is needed for the export and uploads its
+// payload to the payload store, if enabled.
+func (e *Exporter) newSampleRow(ctx context.Context, sample common.Sample) (*sampleRow, error) {
+	row := &sampleRow{sha256: sample.Sha256, size: sample.Size, sourcePaths: sample.SourcePaths}
+	if len(row.sourcePaths) == 0 {
+		for _, path := range common.SamplePaths(sample) {
+			row.sourcePaths = append(row.sourcePaths, strings.TrimPrefix(strings.TrimPrefix(path, "mnt"), "export"))
+		}
+	}
+
+	// Samples that are not uploaded were already exported, only the relationship with the source
+	// needs to be recorded.
+	if !sample.Upload {
+		return row, nil
+	}
+
 	var samplePath string
 	var fi os.FileInfo
 	var err error
@@ -142,105 +168,154 @@ func (e *Exporter) insertSample(ctx context.Context, sample common.Sample) error
 		}
 	}
 
-	file, err := os.Open(samplePath)
-	if err != nil {
-		return fmt.Errorf("could not open %v", samplePath)
+	if fi == nil {
+		return nil, fmt.Errorf("could not open %v", sample.Paths)
 	}
-	defer file.Close()
+	row.extracted = true
+	row.size = fi.Size()
 
-	mimeType, err := getFileContentType(file)
+	fileType, err := inspect.IdentifyFile(samplePath)
 	if err != nil {
-		glog.Warningf("Could not get file content type: %v", err)
+		return nil, fmt.Errorf("could not identify type of %v: %v", samplePath, err)
 	}
+	row.mimeType = fileType.MIMEType
+	row.fileOutput = fileType.Description
+	row.executable = sample.Executable
 
-	fileOutput, err := fileCmdOutput(samplePath)
-	if err != nil {
-		glog.Warningf("Could not get file cmd output: %v", err)
+	if e.uploadPayloads {
+		row.location, err = e.payloadStore.Put(ctx, sample.Sha256, samplePath)
+		if err != nil {
+			return nil, fmt.Errorf("error uploading payload to %s store: %v", e.payloadStore.Name(), err)
+		}
 	}
 
-	fileOutput = strings.TrimPrefix(fileOutput, fmt.Sprintf("%s%s", samplePath, ":"))
-	_, err = e.spannerClient.Apply(ctx, []*spanner.Mutation{
-		spanner.Insert("samples",
-			[]string{
-				"sha256",
-				"mimetype",
-				"file_output",
-				"size"},
-			[]interface{}{
-				sample.Sha256,
-				mimeType,
-				fileOutput,
-				fi.Size(),
-			})})
-	if spanner.ErrCode(err) != codes.AlreadyExists && err != nil {
-		return fmt.Errorf("failed to insert data %v", err)
+	return row, nil
+}
+
+// exportBatch writes a given batch of samples, their payload locations and their relationship with
+// the source in a single read-write transaction.
+func (e *Exporter) exportBatch(ctx context.Context, sourceHash string, rows []*sampleRow) error {
+	// Samples with the same hash are merged, so that each row is written once.
+	var unique []*sampleRow
+	seen := make(map[string]*sampleRow)
+	for _, row := range rows {
+		if r, ok := seen[row.sha256]; ok {
+			r.sourcePaths = append(r.sourcePaths, row.sourcePaths...)
+			continue
+		}
+		seen[row.sha256] = row
+		unique = append(unique, row)
 	}
 
-	if e.uploadPayloads && sample.Upload {
-		fmt.Println(samplePath)
-		file, err := os.Open(samplePath)
-		if err != nil {
-			return fmt.Errorf("error while opening file: %v", err)
+	return e.spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn Transaction) error {
+		sampleKeys := make([]spanner.Key, 0, len(unique))
+		relationshipKeys := make([]spanner.Key, 0, len(unique))
+		for _, row := range unique {
+			sampleKeys = append(sampleKeys, spanner.Key{row.sha256})
+			relationshipKeys = append(relationshipKeys, spanner.Key{row.sha256, sourceHash})
 		}
 
-		fi, err := file.Stat()
+		existingSamples := make(map[string]bool)
+		rows, err := txn.ReadRows(ctx, "samples", sampleKeys, []string{"sha256"})
 		if err != nil {
-			return fmt.Errorf("error while opening file: %v", err)
+			return fmt.Errorf("could not read samples: %v", err)
 		}
-
-		fmt.Println(fi.Size())
-
-		name := fmt.Sprintf("%s/%s", strings.ToUpper(sample.Sha256[0:2]), strings.ToUpper(sample.Sha256))
-		object := &storage.Object{
-			Name: name,
+		for _, r := range rows {
+			var sha256 string
+			if err := r.Columns(&sha256); err != nil {
+				return err
+			}
+			existingSamples[sha256] = true
 		}
 
-		_, err = e.storageClient.Objects.Insert(e.GCSBucket, object).Media(file).Do()
+		existingPaths := make(map[string][]string)
+		rows, err = txn.ReadRows(ctx, "samples_sources", relationshipKeys, []string{"sample_sha256", "sample_paths"})
 		if err != nil {
-			return fmt.Errorf("error uploading data to GCS: %v", err)
+			return fmt.Errorf("could not read source <-> sample relationships: %v", err)
+		}
+		for _, r := range rows {
+			var sha256 string
+			var paths []string
+			if err := r.Columns(&sha256, &paths); err != nil {
+				return err
+			}
+			existingPaths[sha256] = paths
 		}
 
-		_, err = e.spannerClient.Apply(ctx, []*spanner.Mutation{
-			spanner.Insert("payloads",
-				[]string{
-					"sha256",
-					"gcs_path"},
-				[]interface{}{
-					sample.Sha256,
-					fmt.Sprintf("gs://%s/%s", e.GCSBucket, name),
-				})})
-		if spanner.ErrCode(err) != codes.AlreadyExists && err != nil {
-			return fmt.Errorf("failed to insert data %v", err)
+		for _, row := range unique {
+			switch {
+			case row.extracted:
+				if err := txn.InsertOrUpdate("samples", []string{"sha256", "mimetype", "file_output", "size"}, []interface{}{row.sha256, row.mimeType, row.fileOutput, row.size}); err != nil {
+					return err
+				}
+			case !existingSamples[row.sha256]:
+				// Metadata of samples that were not extracted is unknown, they are only inserted to
+				// satisfy the foreign key.
+				if err := txn.InsertOrUpdate("samples", []string{"sha256", "size"}, []interface{}{row.sha256, row.size}); err != nil {
+					return err
+				}
+			}
+
+			if m := row.executable; m != nil {
+				var signingTime spanner.NullTime
+				if m.SigningTime != nil {
+					signingTime = spanner.NullTime{Time: *m.SigningTime, Valid: true}
+				}
+				if err := txn.InsertOrUpdate("executables",
+					[]string{"sha256", "format", "architecture", "build_id", "soname", "imported_libraries", "company_name", "product_name", "product_version", "file_version", "file_description", "original_filename", "signer", "signature_status", "signature_error", "signer_chain", "signing_time", "parse_error"},
+					[]interface{}{row.sha256, m.Format, m.Architecture, m.BuildID, m.Soname, m.ImportedLibraries, m.CompanyName, m.ProductName, m.ProductVersion, m.FileVersion, m.FileDescription, m.OriginalFilename, m.Signer, m.SignatureStatus, m.SignatureError, m.SignerChain, signingTime, m.ParseError}); err != nil {
+					return err
+				}
+			}
+
+			if row.location != "" {
+				columns, values := []string{"sha256", "location"}, []interface{}{row.sha256, row.location}
+				// gcs_path is kept for readers that predate the location column.
+				if strings.HasPrefix(row.location, "gs://") {
+					columns, values = append(columns, "gcs_path"), append(values, row.location)
+				}
+				if err := txn.InsertOrUpdate("payloads", columns, values); err != nil {
+					return err
+				}
+			}
+
+			if err := txn.InsertOrUpdate("samples_sources", []string{"sample_sha256", "source_sha256", "sample_paths"}, []interface{}{row.sha256, sourceHash, common.AppendMissing(existingPaths[row.sha256], row.sourcePaths...)}); err != nil {
+				return err
+			}
 		}
-	}
 
-	return nil
+		return nil
+	})
 }
 
-func (e *Exporter) insertSource(ctx context.Context, sourceHash, sourceID, sourcePath, sourceRepoName, sourceRepoPath, sourceDescription string) error {
-	var sourceIDs []string
-
-	sql := spanner.Statement{
-		SQL: `SELECT source_id FROM sources WHERE sha256 = @sha256`,
-		Params: map[string]interface{}{
-			"sha256": sourceHash,
-		},
+// ExportMetadata stores structured metadata of an exported source, e.g. package name, version and
+// file digests, as JSON in the metadata column of the sources table.
+func (e *Exporter) ExportMetadata(ctx context.Context, sourceHash string, metadata *common.SourceMetadata) error {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("could not marshal source metadata: %v", err)
 	}
 
-	iter := e.spannerClient.Single().Query(ctx, sql)
-	defer iter.Stop()
-	row, err := iter.Next()
-	if err != iterator.Done {
-		if err := row.Columns(&sourceIDs); err != nil {
+	return e.spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn Transaction) error {
+		return txn.InsertOrUpdate("sources", []string{"sha256", "metadata"}, []interface{}{sourceHash, string(metadataJSON)})
+	})
+}
+
+// insertSource inserts the source or appends the source ID to already existing one.
+func (e *Exporter) insertSource(ctx context.Context, sourceHash, sourceID, sourcePath, sourceRepoName, sourceRepoPath, sourceDescription string) error {
+	return e.spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn Transaction) error {
+		var sourceIDs []string
+		rows, err := txn.ReadRows(ctx, "sources", []spanner.Key{{sourceHash}}, []string{"source_id"})
+		if err != nil {
 			return err
 		}
-	}
-	if err != iterator.Done && err != nil {
-		return err
-	}
+		if len(rows) > 0 {
+			if err := rows[0].Columns(&sourceIDs); err != nil {
+				return err
+			}
+		}
 
-	_, err = e.spannerClient.Apply(ctx, []*spanner.Mutation{
-		spanner.InsertOrUpdate("sources",
+		return txn.InsertOrUpdate("sources",
 			[]string{
 				"sha256",
 				"source_id",
@@ -250,44 +325,11 @@ func (e *Exporter) insertSource(ctx context.Context, sourceHash, sourceID, sourc
 				"repo_path"},
 			[]interface{}{
 				sourceHash,
-				append(sourceIDs, sourceID),
+				common.AppendMissing(sourceIDs, sourceID),
 				sourcePath,
 				sourceDescription,
 				sourceRepoName,
 				sourceRepoPath,
-			})})
-	if err != nil {
-		return fmt.Errorf("failed to insert data %v", err)
-	}
-
-	return nil
-}
-
-func getFileContentType(out *os.File) (string, error) {
-
-	// Only the first 512 bytes are used to check the content type.
-	buffer := make([]byte, 512)
-
-	_, err := out.Read(buffer)
-	if err != nil {
-		return "", err
-	}
-
-	contentType := http.DetectContentType(buffer)
-
-	return contentType, nil
-}
-
-func fileCmdOutput(filepath string) (string, error) {
-	cmd := exec.Command("/usr/bin/file", filepath)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("error while executing %s: %v\nStdout: %v\nStderr: %v", "/usr/bin/file", err, stdout.String(), stderr.String())
-	}
-
-	return strings.TrimSuffix(stdout.String(), "\n"), nil
+			})
+	})
 }
@@ -2,11 +2,19 @@ package gcp
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/golang/glog"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/hashr/common"
+	"github.com/google/hashr/payloads"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -31,7 +39,8 @@ const (
 	payloadsTable = `
 	CREATE TABLE payloads (
 		sha256 STRING(100),
-		gcs_path STRING(200)
+		gcs_path STRING(200),
+		location STRING(MAX)
 	) PRIMARY KEY(sha256)`
 
 	sourcesTable = `
@@ -51,6 +60,29 @@ const (
 		CONSTRAINT FK_Sample FOREIGN KEY (sample_sha256) REFERENCES samples (sha256),
 		CONSTRAINT FK_Source FOREIGN KEY (source_sha256) REFERENCES sources (sha256),
 	)  PRIMARY KEY (sample_sha256, source_sha256)`
+
+	executablesTable = `
+	CREATE TABLE executables (
+		sha256 STRING(100),
+		format STRING(MAX),
+		architecture STRING(MAX),
+		build_id STRING(MAX),
+		soname STRING(MAX),
+		imported_libraries ARRAY<STRING(MAX)>,
+		company_name STRING(MAX),
+		product_name STRING(MAX),
+		product_version STRING(MAX),
+		file_version STRING(MAX),
+		file_description STRING(MAX),
+		original_filename STRING(MAX),
+		signer STRING(MAX),
+		signature_status STRING(20),
+		signature_error STRING(MAX),
+		signer_chain ARRAY<STRING(MAX)>,
+		signing_time TIMESTAMP,
+		parse_error STRING(MAX),
+		CONSTRAINT FK_ExecutableSample FOREIGN KEY (sha256) REFERENCES samples (sha256),
+	) PRIMARY KEY(sha256)`
 )
 
 func TestExport(t *testing.T) {
@@ -96,7 +128,7 @@ func TestExport(t *testing.T) {
 	op2, err := databaseAdmin.CreateDatabase(ctx, &dbadminpb.CreateDatabaseRequest{
 		Parent:          "projects/hashr/instances/hashr",
 		CreateStatement: "CREATE DATABASE hashr",
-		ExtraStatements: []string{samplesTable, sourcesTable, payloadsTable, samplesSourcesTable},
+		ExtraStatements: []string{samplesTable, sourcesTable, payloadsTable, samplesSourcesTable, executablesTable},
 	})
 	if err != nil {
 		glog.Fatalf("error creating test DB %v: %v", dbURI, err)
@@ -110,7 +142,7 @@ func TestExport(t *testing.T) {
 		glog.Fatalf("error creating Spanner client %v: %v", dbURI, err)
 	}
 
-	exporter, err := NewExporter(spannerClient, nil, "gcs-bucket", false, 10)
+	exporter, err := NewExporter(spannerClient, nil, false, 10)
 	if err != nil {
 		glog.Fatalf("error creating Cloud Spanner exporter: %v", err)
 	}
@@ -138,3 +170,346 @@ func TestExport(t *testing.T) {
 	}
 
 }
+
+// fakeClient keeps Spanner tables in memory, so that the exporter can be tested without the Cloud
+// Spanner emulator. Writes of a transaction are applied only if the transaction succeeds.
+type fakeClient struct {
+	mu     sync.Mutex
+	tables map[string]map[string]map[string]interface{}
+	// failOn makes transactions writing to a given table fail.
+	failOn string
+}
+
+var fakeKeyColumns = map[string][]string{
+	"samples":         {"sha256"},
+	"payloads":        {"sha256"},
+	"sources":         {"sha256"},
+	"samples_sources": {"sample_sha256", "source_sha256"},
+	"executables":     {"sha256"},
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{tables: make(map[string]map[string]map[string]interface{})}
+}
+
+type fakeWrite struct {
+	table  string
+	values map[string]interface{}
+}
+
+type fakeTransaction struct {
+	client *fakeClient
+	writes []fakeWrite
+}
+
+func (c *fakeClient) ReadWriteTransaction(ctx context.Context, f func(context.Context, Transaction) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txn := &fakeTransaction{client: c}
+	if err := f(ctx, txn); err != nil {
+		return err
+	}
+
+	for _, w := range txn.writes {
+		if w.table == c.failOn {
+			return errors.New("transaction aborted")
+		}
+	}
+
+	for _, w := range txn.writes {
+		if c.tables[w.table] == nil {
+			c.tables[w.table] = make(map[string]map[string]interface{})
+		}
+		key := fakeKey(w.table, w.values)
+		row := c.tables[w.table][key]
+		if row == nil {
+			row = make(map[string]interface{})
+			c.tables[w.table][key] = row
+		}
+		for column, value := range w.values {
+			row[column] = value
+		}
+	}
+
+	return nil
+}
+
+func fakeKey(table string, values map[string]interface{}) string {
+	var key spanner.Key
+	for _, column := range fakeKeyColumns[table] {
+		key = append(key, values[column])
+	}
+	return key.String()
+}
+
+func (t *fakeTransaction) ReadRows(ctx context.Context, table string, keys []spanner.Key, columns []string) ([]*spanner.Row, error) {
+	var rows []*spanner.Row
+	for _, key := range keys {
+		row, ok := t.client.tables[table][key.String()]
+		if !ok {
+			continue
+		}
+
+		var values []interface{}
+		for _, column := range columns {
+			values = append(values, row[column])
+		}
+		r, err := spanner.NewRow(columns, values)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+
+	return rows, nil
+}
+
+func (t *fakeTransaction) InsertOrUpdate(table string, columns []string, values []interface{}) error {
+	row := make(map[string]interface{})
+	for i, column := range columns {
+		row[column] = values[i]
+	}
+	t.writes = append(t.writes, fakeWrite{table: table, values: row})
+	return nil
+}
+
+func TestExportFake(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	exporter := &Exporter{spannerClient: client, workerCount: 4}
+
+	samples := []common.Sample{
+		{
+			Sha256: "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+			Paths:  []string{filepath.Join("testdata/extraction", "file.01")},
+			Upload: true,
+		},
+		{
+			Sha256:      "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.02")},
+			SourcePaths: []string{"bin/cat", "usr/bin/cat"},
+			Upload:      true,
+		},
+		{
+			// Samples that are not uploaded were already exported from another source.
+			Sha256:      "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7",
+			SourcePaths: []string{"bin/cp"},
+			Size:        5120,
+		},
+	}
+
+	if err := exporter.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+
+	// Exporting the same source under a different ID should not duplicate the data.
+	if err := exporter.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts-v2", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples[1:]); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+
+	source := client.tables["sources"][spanner.Key{"07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"}.String()]
+	if diff := cmp.Diff([]string{"ubuntu-1604-lts", "ubuntu-1604-lts-v2"}, source["source_id"]); diff != "" {
+		t.Errorf("Export() unexpected source_id diff (-want/+got):\n%s", diff)
+	}
+
+	gotSizes := make(map[string]interface{})
+	for _, row := range client.tables["samples"] {
+		gotSizes[row["sha256"].(string)] = row["size"]
+	}
+	wantSizes := map[string]interface{}{
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3": int64(8192),
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb": int64(7168),
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7": int64(5120),
+	}
+	if diff := cmp.Diff(wantSizes, gotSizes); diff != "" {
+		t.Errorf("Export() unexpected samples diff (-want/+got):\n%s", diff)
+	}
+
+	gotPaths := make(map[string][]string)
+	for _, row := range client.tables["samples_sources"] {
+		gotPaths[row["sample_sha256"].(string)] = row["sample_paths"].([]string)
+	}
+	wantPaths := map[string][]string{
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3": nil,
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb": {"bin/cat", "usr/bin/cat"},
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7": {"bin/cp"},
+	}
+	if diff := cmp.Diff(wantPaths, gotPaths, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("Export() unexpected samples_sources diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestExportMetadataFake(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	exporter := &Exporter{spannerClient: client, workerCount: 4}
+	sourceHash := "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+
+	if err := exporter.Export(ctx, "rpm", "testdata", "ubuntu-desktop.rpm", sourceHash, "", "Package: testdata 1.0-1 (noarch)", nil); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+	metadata := &common.SourceMetadata{Name: "testdata", Version: "1.0-1", Architecture: "noarch"}
+	if err := exporter.ExportMetadata(ctx, sourceHash, metadata); err != nil {
+		t.Fatalf("unexpected error while running ExportMetadata() = %v", err)
+	}
+
+	source := client.tables["sources"][spanner.Key{sourceHash}.String()]
+	if got, want := source["metadata"], `{"name":"testdata","version":"1.0-1","architecture":"noarch"}`; got != want {
+		t.Errorf("ExportMetadata() stored metadata %v, want %v", got, want)
+	}
+	if got, want := source["source_description"], "Package: testdata 1.0-1 (noarch)"; got != want {
+		t.Errorf("ExportMetadata() changed source_description to %v, want %v", got, want)
+	}
+}
+
+func TestExportPayloadStore(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	root := t.TempDir()
+	store, err := payloads.NewLocalStore(root)
+	if err != nil {
+		t.Fatalf("could not create local payload store: %v", err)
+	}
+	exporter := &Exporter{spannerClient: client, payloadStore: store, uploadPayloads: true, workerCount: 2}
+
+	samples := []common.Sample{
+		{
+			Sha256:      "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+			SourcePaths: []string{"bin/ls"},
+			Upload:      true,
+		},
+		{
+			// Payloads of samples that are not uploaded were already stored.
+			Sha256:      "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7",
+			SourcePaths: []string{"bin/cp"},
+			Size:        5120,
+		},
+	}
+
+	if err := exporter.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+
+	want := map[string]map[string]interface{}{
+		spanner.Key{"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3"}.String(): {
+			"sha256":   "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+			"location": "file://" + filepath.ToSlash(filepath.Join(root, "A6", "A665A45920422F9D417E4867EFDC4FB8A04A1F3FFF1FA07E998E86F7F7A27AE3")),
+		},
+	}
+	if diff := cmp.Diff(want, client.tables["payloads"]); diff != "" {
+		t.Errorf("Export() unexpected payloads diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestExportExecutables(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	exporter := &Exporter{spannerClient: client, workerCount: 2}
+
+	samples := []common.Sample{
+		{
+			Sha256:      "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+			SourcePaths: []string{"usr/lib/libhashr.so.1"},
+			Upload:      true,
+			Executable: &common.ExecutableMetadata{
+				Format:            "ELF",
+				Architecture:      "x86-64",
+				BuildID:           "4f47148ea1e45370e7819a216dd3c730764c85c2",
+				Soname:            "libhashr.so.1",
+				ImportedLibraries: []string{"libc.so.6"},
+			},
+		},
+		{
+			Sha256:      "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.02")},
+			SourcePaths: []string{"etc/passwd"},
+			Upload:      true,
+		},
+	}
+
+	if err := exporter.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+
+	want := map[string]map[string]interface{}{
+		spanner.Key{"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3"}.String(): {
+			"sha256":             "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+			"format":             "ELF",
+			"architecture":       "x86-64",
+			"build_id":           "4f47148ea1e45370e7819a216dd3c730764c85c2",
+			"soname":             "libhashr.so.1",
+			"imported_libraries": []string{"libc.so.6"},
+			"company_name":       "",
+			"product_name":       "",
+			"product_version":    "",
+			"file_version":       "",
+			"file_description":   "",
+			"original_filename":  "",
+			"signer":             "",
+			"signature_status":   "",
+			"signature_error":    "",
+			"signer_chain":       []string(nil),
+			"signing_time":       spanner.NullTime{},
+			"parse_error":        "",
+		},
+	}
+	if diff := cmp.Diff(want, client.tables["executables"]); diff != "" {
+		t.Errorf("Export() unexpected executables diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestExportBatches(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	exporter := &Exporter{spannerClient: client, workerCount: 10}
+
+	var samples []common.Sample
+	for i := 0; i < 2*batchSize+10; i++ {
+		samples = append(samples, common.Sample{Sha256: fmt.Sprintf("%064x", i), SourcePaths: []string{fmt.Sprintf("bin/%d", i)}, Size: int64(i)})
+	}
+
+	if err := exporter.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+
+	if got, want := len(client.tables["samples_sources"]), len(samples); got != want {
+		t.Errorf("Export() exported %d relationships, want %d", got, want)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	client.failOn = "samples_sources"
+	exporter := &Exporter{spannerClient: client, workerCount: 2}
+
+	samples := []common.Sample{
+		{Sha256: "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", SourcePaths: []string{"bin/ls"}},
+		{Sha256: "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", Paths: []string{"testdata/extraction/missing"}, Upload: true},
+	}
+
+	err := exporter.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples)
+	if err == nil {
+		t.Fatal("expected error while exporting samples")
+	}
+
+	// Both the missing file and the failed batch should be reported.
+	for _, want := range []string{"could not export 2 samples", "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb: could not open", "transaction aborted"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Export() error %q does not contain %q", err, want)
+		}
+	}
+
+	// Nothing from the failed transaction should be committed.
+	var tables []string
+	for table := range client.tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	if diff := cmp.Diff([]string{"sources"}, tables); diff != "" {
+		t.Errorf("Export() unexpected tables diff (-want/+got):\n%s", diff)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hashlookup
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+)
+
+const (
+	// dcsoModulus and dcsoGenerator are used to derive k fingerprints from a single FNV-1 hash.
+	dcsoModulus   = uint64(18446744073709551557)
+	dcsoGenerator = uint64(18446744073709550147)
+	// dcsoHeader marks the versioned file format, the lower bits hold the format version.
+	dcsoHeader = uint64(0xFFFFFFFF00000000) | 1
+)
+
+// dcsoFilter is a Bloom filter in the format used by github.com/DCSO/bloom and its Python
+// counterpart flor, which are used to publish CIRCL hashlookup filters.
+type dcsoFilter struct {
+	bv []uint64
+	// n is the expected number of elements and p the false positive rate the filter was sized for.
+	n uint64
+	p float64
+	// k is the number of hash functions, m the number of bits and count the number of elements
+	// added to the filter.
+	k     uint64
+	m     uint64
+	count uint64
+}
+
+func newDCSOFilter(n uint64, p float64) *dcsoFilter {
+	m := uint64(math.Abs(math.Ceil(float64(n) * math.Log(p) / math.Pow(math.Log(2), 2))))
+	k := uint64(math.Ceil(math.Log(2) * float64(m) / float64(n)))
+
+	return &dcsoFilter{
+		bv: make([]uint64, (m+63)/64),
+		n:  n,
+		p:  p,
+		k:  k,
+		m:  m,
+	}
+}
+
+func (f *dcsoFilter) fingerprint(value []byte) []uint64 {
+	h := fnv.New64()
+	h.Write(value)
+	hn := h.Sum64() % dcsoModulus
+
+	fingerprint := make([]uint64, f.k)
+	for i := range fingerprint {
+		// Multiplication is expected to overflow, the same way as in the reference implementation.
+		hn = (hn * dcsoGenerator) % dcsoModulus
+		fingerprint[i] = hn % f.m
+	}
+
+	return fingerprint
+}
+
+func (f *dcsoFilter) add(value []byte) {
+	for _, bit := range f.fingerprint(value) {
+		f.bv[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+func (f *dcsoFilter) check(value []byte) bool {
+	for _, bit := range f.fingerprint(value) {
+		if f.bv[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeTo writes the filter in little-endian byte order: header, n, p, k, m, number of elements,
+// followed by the bit vector. The filter doesn't carry any additional data.
+func (f *dcsoFilter) writeTo(w io.Writer) (int64, error) {
+	values := []uint64{dcsoHeader, f.n, math.Float64bits(f.p), f.k, f.m, f.count}
+	values = append(values, f.bv...)
+
+	buf := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(buf[8*i:], v)
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
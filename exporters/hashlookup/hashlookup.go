@@ -0,0 +1,408 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hashlookup provides functions required to export data in the format consumed by CIRCL
+// hashlookup, together with Bloom filters of all the exported hashes.
+package hashlookup
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bits-and-blooms/bloom/v3"
+	"github.com/golang/glog"
+
+	"github.com/google/hashr/common"
+
+	// Blank import below is needed for the SQL driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// Name contains name of the exporter.
+	Name = "hashlookup"
+	// RecordsFile is the name of the file holding hashlookup JSON records, one per line.
+	RecordsFile = "hashlookup.jsonl"
+	// DCSOBloomFile is the name of the Bloom filter file in DCSO bloom format.
+	DCSOBloomFile = "hashlookup.bloom"
+	// GoBloomFile is the name of the Bloom filter file in github.com/bits-and-blooms/bloom format.
+	GoBloomFile = "hashlookup.gobloom"
+	// source is the value of the source field of exported records.
+	source = "hashr"
+)
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS files (
+		sha256 VARCHAR PRIMARY KEY,
+		sha1 VARCHAR NOT NULL,
+		md5 VARCHAR NOT NULL,
+		crc32 VARCHAR NOT NULL,
+		file_size INT NOT NULL,
+		file_name TEXT,
+		db TEXT,
+		insert_timestamp INT
+	)`,
+	`CREATE TABLE IF NOT EXISTS parents (
+		file_sha256 VARCHAR NOT NULL REFERENCES files(sha256),
+		sha256 VARCHAR NOT NULL,
+		package_name TEXT NOT NULL,
+		package_description TEXT,
+		repo_path TEXT,
+		PRIMARY KEY (file_sha256, sha256, package_name)
+	)`,
+}
+
+// Record is a hashlookup record of a single file. Hashes are in upper-case hex encoding.
+type Record struct {
+	SHA256          string    `json:"SHA-256"`
+	SHA1            string    `json:"SHA-1"`
+	MD5             string    `json:"MD5"`
+	CRC32           string    `json:"CRC32"`
+	FileName        string    `json:"FileName"`
+	FileSize        string    `json:"FileSize"`
+	DB              string    `json:"db"`
+	Source          string    `json:"source"`
+	InsertTimestamp string    `json:"insert-timestamp"`
+	ParentTotal     int       `json:"hashlookup:parent-total"`
+	Parents         []*Parent `json:"parents"`
+}
+
+// Parent describes the source a file was extracted from.
+type Parent struct {
+	SHA256             string `json:"SHA-256"`
+	PackageName        string `json:"PackageName"`
+	PackageDescription string `json:"PackageDescription,omitempty"`
+	RepoPath           string `json:"RepoPath,omitempty"`
+}
+
+// Exporter is an instance of hashlookup Exporter.
+type Exporter struct {
+	sqlDB             *sql.DB
+	outputDir         string
+	falsePositiveRate float64
+	mu                sync.Mutex
+}
+
+// Name returns exporter name.
+func (e *Exporter) Name() string {
+	return Name
+}
+
+// NewExporter creates new hashlookup exporter. SQLite database keeps hashes and parents of all the
+// exported files, so the output files cover previous runs and samples that were not extracted
+// again.
+func NewExporter(sqlDB *sql.DB, outputDir string, falsePositiveRate float64) (*Exporter, error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("false positive rate needs to be between 0 and 1, got %v", falsePositiveRate)
+	}
+
+	// SQLite allows only a single writer, concurrent exports will wait for each other.
+	sqlDB.SetMaxOpenConns(1)
+
+	for _, stmt := range schema {
+		if _, err := sqlDB.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("error while creating database schema: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create output directory: %v", err)
+	}
+
+	return &Exporter{sqlDB: sqlDB, outputDir: outputDir, falsePositiveRate: falsePositiveRate}, nil
+}
+
+// fileHashes holds hashes that hashlookup needs in addition to SHA-256, in upper-case hex encoding.
+type fileHashes struct {
+	sha1  string
+	md5   string
+	crc32 string
+	size  int64
+}
+
+// Export stores hashes of the extracted samples together with the given source as their parent.
+// Output files are written by Close.
+func (e *Exporter) Export(ctx context.Context, sourceRepoName, sourceRepoPath, sourceID, sourceHash, sourcePath, sourceDescription string, samples []common.Sample) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tx, err := e.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	timestamp := time.Now().Unix()
+
+	var skipped int
+	for _, sample := range samples {
+		hashes, err := sampleHashes(ctx, tx, sample)
+		if err != nil {
+			return fmt.Errorf("could not hash sample %s: %v", sample.Sha256, err)
+		}
+		if hashes == nil {
+			skipped++
+			continue
+		}
+
+		fileSha256 := strings.ToUpper(sample.Sha256)
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO files (sha256, sha1, md5, crc32, file_size, file_name, db, insert_timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (sha256) DO NOTHING`, fileSha256, hashes.sha1, hashes.md5, hashes.crc32, hashes.size, fileName(sample), sourceRepoName, timestamp)
+		if err != nil {
+			return fmt.Errorf("could not insert file %s: %v", sample.Sha256, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO parents (file_sha256, sha256, package_name, package_description, repo_path)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (file_sha256, sha256, package_name) DO NOTHING`, fileSha256, strings.ToUpper(sourceHash), sourceID, sourceDescription, sourceRepoPath)
+		if err != nil {
+			return fmt.Errorf("could not insert parent of file %s: %v", sample.Sha256, err)
+		}
+	}
+
+	if skipped > 0 {
+		glog.Warningf("Skipped %d samples from %s, they could not be opened and were not exported before", skipped, sourceID)
+	}
+
+	return tx.Commit()
+}
+
+// Close writes the records file and Bloom filters of SHA-256, SHA-1 and MD5 hashes of all the files
+// exported so far.
+func (e *Exporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ctx := context.Background()
+	if err := e.writeRecords(ctx); err != nil {
+		return fmt.Errorf("could not write records: %v", err)
+	}
+
+	return e.writeBloomFilters(ctx)
+}
+
+// writeRecords writes one record per exported file, listing all the sources the file was exported
+// from as its parents.
+func (e *Exporter) writeRecords(ctx context.Context) error {
+	rows, err := e.sqlDB.QueryContext(ctx, `
+	SELECT f.sha256, f.sha1, f.md5, f.crc32, f.file_size, f.file_name, f.db, f.insert_timestamp, p.sha256, p.package_name, p.package_description, p.repo_path
+	FROM files f LEFT JOIN parents p ON p.file_sha256 = f.sha256
+	ORDER BY f.sha256, p.sha256, p.package_name`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return writeFile(filepath.Join(e.outputDir, RecordsFile), func(w io.Writer) (int64, error) {
+		enc := json.NewEncoder(w)
+		var r *Record
+		for rows.Next() {
+			var hashes fileHashes
+			var fileSha256 string
+			var name, db, parentSha256, packageName, packageDescription, repoPath sql.NullString
+			var timestamp sql.NullInt64
+			if err := rows.Scan(&fileSha256, &hashes.sha1, &hashes.md5, &hashes.crc32, &hashes.size, &name, &db, &timestamp, &parentSha256, &packageName, &packageDescription, &repoPath); err != nil {
+				return 0, err
+			}
+
+			if r == nil || r.SHA256 != fileSha256 {
+				if r != nil {
+					if err := enc.Encode(r); err != nil {
+						return 0, err
+					}
+				}
+				r = &Record{
+					SHA256:          fileSha256,
+					SHA1:            hashes.sha1,
+					MD5:             hashes.md5,
+					CRC32:           hashes.crc32,
+					FileName:        name.String,
+					FileSize:        strconv.FormatInt(hashes.size, 10),
+					DB:              db.String,
+					Source:          source,
+					InsertTimestamp: strconv.FormatInt(timestamp.Int64, 10),
+					Parents:         []*Parent{},
+				}
+			}
+
+			if parentSha256.Valid {
+				r.Parents = append(r.Parents, &Parent{
+					SHA256:             parentSha256.String,
+					PackageName:        packageName.String,
+					PackageDescription: packageDescription.String,
+					RepoPath:           repoPath.String,
+				})
+				r.ParentTotal = len(r.Parents)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		if r != nil {
+			if err := enc.Encode(r); err != nil {
+				return 0, err
+			}
+		}
+
+		return 0, nil
+	})
+}
+
+// writeBloomFilters writes the Bloom filter files. Both filters contain upper-case hex encoded
+// hashes, the same way as the filters published by CIRCL hashlookup.
+func (e *Exporter) writeBloomFilters(ctx context.Context) error {
+	var count uint64
+	if err := e.sqlDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM files`).Scan(&count); err != nil {
+		return fmt.Errorf("could not count files: %v", err)
+	}
+	// Every file contributes three hashes.
+	n := count * 3
+	if n == 0 {
+		n = 1
+	}
+
+	dcso := newDCSOFilter(n, e.falsePositiveRate)
+	goBloom := bloom.NewWithEstimates(uint(n), e.falsePositiveRate)
+
+	rows, err := e.sqlDB.QueryContext(ctx, `SELECT sha256, sha1, md5 FROM files`)
+	if err != nil {
+		return fmt.Errorf("could not read files: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		hashes := make([]string, 3)
+		if err := rows.Scan(&hashes[0], &hashes[1], &hashes[2]); err != nil {
+			return err
+		}
+		for _, h := range hashes {
+			dcso.add([]byte(h))
+			goBloom.AddString(h)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := writeFile(filepath.Join(e.outputDir, DCSOBloomFile), dcso.writeTo); err != nil {
+		return fmt.Errorf("could not write DCSO Bloom filter: %v", err)
+	}
+
+	if err := writeFile(filepath.Join(e.outputDir, GoBloomFile), goBloom.WriteTo); err != nil {
+		return fmt.Errorf("could not write Go Bloom filter: %v", err)
+	}
+
+	glog.Infof("Wrote Bloom filters of %d files to %s", count, e.outputDir)
+
+	return nil
+}
+
+// writeFile writes a file using a temporary file, so readers never see a partially written one.
+func writeFile(path string, write func(io.Writer) (int64, error)) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if _, err := write(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// sampleHashes calculates hashes of the extracted sample. Hashes of samples that were not uploaded
+// (i.e. they were already exported) are taken from the database, if there are none the sample is
+// hashed as well. nil is returned if such a sample can't be opened.
+func sampleHashes(ctx context.Context, tx *sql.Tx, sample common.Sample) (*fileHashes, error) {
+	if !sample.Upload {
+		hashes := &fileHashes{}
+		err := tx.QueryRowContext(ctx, `SELECT sha1, md5, crc32, file_size FROM files WHERE sha256 = $1`, strings.ToUpper(sample.Sha256)).Scan(&hashes.sha1, &hashes.md5, &hashes.crc32, &hashes.size)
+		switch err {
+		case nil:
+			return hashes, nil
+		case sql.ErrNoRows:
+		default:
+			return nil, err
+		}
+	}
+
+	var file *os.File
+	var err error
+	// If sample has more than one path associated with it, take the first that is valid.
+	for _, p := range sample.Paths {
+		if file, err = os.Open(p); err == nil {
+			break
+		}
+	}
+	if file == nil {
+		if !sample.Upload {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not open any of %v", sample.Paths)
+	}
+	defer file.Close()
+
+	sha1Hash, md5Hash, crc32Hash := sha1.New(), md5.New(), crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(sha1Hash, md5Hash, crc32Hash), file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileHashes{
+		sha1:  strings.ToUpper(hex.EncodeToString(sha1Hash.Sum(nil))),
+		md5:   strings.ToUpper(hex.EncodeToString(md5Hash.Sum(nil))),
+		crc32: strings.ToUpper(hex.EncodeToString(crc32Hash.Sum(nil))),
+		size:  size,
+	}, nil
+}
+
+// fileName returns the first path of the sample inside the source, prefixed with "./" as in
+// hashlookup records.
+func fileName(sample common.Sample) string {
+	paths := common.SamplePaths(sample)
+	if len(paths) == 0 {
+		return ""
+	}
+
+	return "./" + strings.TrimPrefix(strings.ReplaceAll(paths[0], "\\", "/"), "/")
+}
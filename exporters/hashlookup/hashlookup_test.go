@@ -0,0 +1,321 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hashlookup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bits-and-blooms/bloom/v3"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/hashr/common"
+)
+
+func testExporter(t *testing.T) (*Exporter, string) {
+	t.Helper()
+
+	outputDir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(outputDir, "hashlookup.db"))
+	if err != nil {
+		t.Fatalf("could not open SQLite database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	e, err := NewExporter(db, outputDir, 0.001)
+	if err != nil {
+		t.Fatalf("could not create hashlookup exporter: %v", err)
+	}
+
+	return e, outputDir
+}
+
+func readRecords(t *testing.T, path string) []*Record {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []*Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+func TestNewExporter(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "hashlookup.db"))
+	if err != nil {
+		t.Fatalf("could not open SQLite database: %v", err)
+	}
+	defer db.Close()
+
+	for _, p := range []float64{0, 1, -0.1} {
+		if _, err := NewExporter(db, t.TempDir(), p); err == nil {
+			t.Errorf("NewExporter() with false positive rate %v succeeded, want error", p)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	e, outputDir := testExporter(t)
+
+	samples := []common.Sample{
+		{
+			Sha256:      "c2e7f7d23b30766c2d55e847b349d0540f4847b263ee15521dc72023846884ea",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+			SourcePaths: []string{"/usr/bin/ls"},
+			Upload:      true,
+		},
+		{
+			Sha256:      "a74bb803c7ff5bd875867fc3f4ceabb6fbe888eea6361b876111cb8060fe7e8c",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.02")},
+			SourcePaths: []string{"bin/cat", "usr/bin/cat"},
+			Upload:      true,
+		},
+	}
+
+	if err := e.Export(ctx, "GCP", "ubuntu-os-cloud", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	// Samples that were not uploaded reuse hashes of already exported files, unknown ones are hashed
+	// and skipped if they can't be opened.
+	samples = []common.Sample{
+		{
+			Sha256:      "c2e7f7d23b30766c2d55e847b349d0540f4847b263ee15521dc72023846884ea",
+			SourcePaths: []string{"/bin/ls"},
+		},
+		{
+			Sha256:      "2789f4b90b038d57e592d01e0cd13a98b398cc7a524c3e8a7faaaaaf59893e7d",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.03")},
+			SourcePaths: []string{"/bin/cp"},
+		},
+		{
+			Sha256:      "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb",
+			SourcePaths: []string{"/bin/mv"},
+		},
+	}
+
+	if err := e.Export(ctx, "GCP", "ubuntu-os-cloud", "ubuntu-1804-lts", "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	// Exporting the same source again doesn't duplicate parents.
+	if err := e.Export(ctx, "GCP", "ubuntu-os-cloud", "ubuntu-1804-lts", "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("unexpected error while running Close(): %v", err)
+	}
+
+	parent1604 := &Parent{
+		SHA256:             "07123E1F482356C415F684407A3B8723E10B2CBBC0B8FCD6282C49D37C9C1ABC",
+		PackageName:        "ubuntu-1604-lts",
+		PackageDescription: "Official Ubuntu GCP image.",
+		RepoPath:           "ubuntu-os-cloud",
+	}
+	parent1804 := &Parent{
+		SHA256:             "5C7A0F6E38F86F4DB12130E5CA9F734F4DEF519B9A884EE8EA9FC45F9626C6FB",
+		PackageName:        "ubuntu-1804-lts",
+		PackageDescription: "Official Ubuntu GCP image.",
+		RepoPath:           "ubuntu-os-cloud",
+	}
+	// Records are sorted by SHA-256 and list all the sources of a given file as its parents.
+	want := []*Record{
+		{
+			SHA256:      "2789F4B90B038D57E592D01E0CD13A98B398CC7A524C3E8A7FAAAAAF59893E7D",
+			SHA1:        "B99C74B9A365033C73B498E790CBE36B7619C0CF",
+			MD5:         "C64BA76110A6FDFA4B3724539CF9047C",
+			CRC32:       "83A03817",
+			FileName:    "./bin/cp",
+			FileSize:    "5120",
+			DB:          "GCP",
+			Source:      "hashr",
+			ParentTotal: 1,
+			Parents:     []*Parent{parent1804},
+		},
+		{
+			SHA256:      "A74BB803C7FF5BD875867FC3F4CEABB6FBE888EEA6361B876111CB8060FE7E8C",
+			SHA1:        "0E46B1C7A17270E5F86DCB45B2EF8DB5C74DF593",
+			MD5:         "FC13736B46D304672F2B92D7E9822F74",
+			CRC32:       "1B8D26C8",
+			FileName:    "./bin/cat",
+			FileSize:    "7168",
+			DB:          "GCP",
+			Source:      "hashr",
+			ParentTotal: 1,
+			Parents:     []*Parent{parent1604},
+		},
+		{
+			SHA256:      "C2E7F7D23B30766C2D55E847B349D0540F4847B263EE15521DC72023846884EA",
+			SHA1:        "7F0BD545694DF51C6D512CDBC00069B64855104A",
+			MD5:         "33B17214B33F53859254A7DC7A8A2A40",
+			CRC32:       "58E3BFFA",
+			FileName:    "./usr/bin/ls",
+			FileSize:    "8192",
+			DB:          "GCP",
+			Source:      "hashr",
+			ParentTotal: 2,
+			Parents:     []*Parent{parent1604, parent1804},
+		},
+	}
+
+	got := readRecords(t, filepath.Join(outputDir, RecordsFile))
+	for _, r := range got {
+		if r.InsertTimestamp == "" || r.InsertTimestamp == "0" {
+			t.Errorf("record of %s has no insert timestamp", r.SHA256)
+		}
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(Record{}, "InsertTimestamp")); diff != "" {
+		t.Errorf("Close() unexpected records diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	e, outputDir := testExporter(t)
+
+	samples := []common.Sample{
+		{
+			Sha256:      "c2e7f7d23b30766c2d55e847b349d0540f4847b263ee15521dc72023846884ea",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+			SourcePaths: []string{"/usr/bin/ls"},
+			Upload:      true,
+		},
+	}
+
+	if err := e.Export(ctx, "GCP", "ubuntu-os-cloud", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("unexpected error while running Close(): %v", err)
+	}
+
+	known := []string{
+		"C2E7F7D23B30766C2D55E847B349D0540F4847B263EE15521DC72023846884EA",
+		"7F0BD545694DF51C6D512CDBC00069B64855104A",
+		"33B17214B33F53859254A7DC7A8A2A40",
+	}
+	unknown := "A74BB803C7FF5BD875867FC3F4CEABB6FBE888EEA6361B876111CB8060FE7E8C"
+
+	f, err := os.Open(filepath.Join(outputDir, GoBloomFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	goBloom := &bloom.BloomFilter{}
+	if _, err := goBloom.ReadFrom(f); err != nil {
+		t.Fatalf("could not read Go Bloom filter: %v", err)
+	}
+	for _, h := range known {
+		if !goBloom.TestString(h) {
+			t.Errorf("Go Bloom filter does not contain %s", h)
+		}
+	}
+	if goBloom.TestString(unknown) {
+		t.Errorf("Go Bloom filter unexpectedly contains %s", unknown)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, DCSOBloomFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcso := readDCSOFilter(t, data)
+	if dcso.n != 3 || dcso.p != 0.001 || dcso.count != 3 {
+		t.Errorf("DCSO Bloom filter has n = %d, p = %v, count = %d, want 3, 0.001, 3", dcso.n, dcso.p, dcso.count)
+	}
+	for _, h := range known {
+		if !dcso.check([]byte(h)) {
+			t.Errorf("DCSO Bloom filter does not contain %s", h)
+		}
+	}
+	if dcso.check([]byte(unknown)) {
+		t.Errorf("DCSO Bloom filter unexpectedly contains %s", unknown)
+	}
+}
+
+func TestDCSOFilterGolden(t *testing.T) {
+	// testdata/dcso.bloom pins the file layout and bit positions produced by this implementation.
+	// It was not generated with the reference DCSO bloom tool, the file should be replaced by one
+	// created by that tool from the same hashes, with n = 3 and p = 0.01.
+	want, err := os.ReadFile("testdata/dcso.bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newDCSOFilter(3, 0.01)
+	for _, h := range []string{
+		"C2E7F7D23B30766C2D55E847B349D0540F4847B263EE15521DC72023846884EA",
+		"7F0BD545694DF51C6D512CDBC00069B64855104A",
+		"33B17214B33F53859254A7DC7A8A2A40",
+	} {
+		f.add([]byte(h))
+	}
+
+	var got bytes.Buffer
+	if _, err := f.writeTo(&got); err != nil {
+		t.Fatalf("unexpected error while writing DCSO Bloom filter: %v", err)
+	}
+	if diff := cmp.Diff(want, got.Bytes()); diff != "" {
+		t.Errorf("writeTo() unexpected diff (-want/+got):\n%s", diff)
+	}
+}
+
+func readDCSOFilter(t *testing.T, data []byte) *dcsoFilter {
+	t.Helper()
+
+	if len(data) < 48 || len(data)%8 != 0 {
+		t.Fatalf("DCSO Bloom filter has unexpected size %d", len(data))
+	}
+
+	values := make([]uint64, len(data)/8)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+	if values[0] != dcsoHeader {
+		t.Fatalf("DCSO Bloom filter has unexpected header %x", values[0])
+	}
+
+	f := &dcsoFilter{n: values[1], p: math.Float64frombits(values[2]), k: values[3], m: values[4], count: values[5], bv: values[6:]}
+	if want := (f.m + 63) / 64; uint64(len(f.bv)) != want {
+		t.Fatalf("DCSO Bloom filter has %d words, want %d", len(f.bv), want)
+	}
+
+	return f
+}
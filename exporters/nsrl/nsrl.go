@@ -0,0 +1,302 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nsrl provides functions required to export data to a SQLite database following the NSRL
+// RDSv3 schema, which can be used as a custom RDS by existing tooling.
+package nsrl
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/google/hashr/common"
+	"github.com/google/hashr/core/hashr"
+
+	// Blank import below is needed for the SQL driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// Name contains name of the exporter.
+	Name = "nsrl"
+	// language is used for all the packages, hashR doesn't know the language of a source.
+	language = "Unknown"
+)
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS MFG (
+		manufacturer_id INTEGER PRIMARY KEY,
+		name VARCHAR NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS OS (
+		operating_system_id INTEGER PRIMARY KEY,
+		name VARCHAR NOT NULL,
+		version VARCHAR NOT NULL,
+		manufacturer_id INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS PKG (
+		package_id INTEGER PRIMARY KEY,
+		name VARCHAR NOT NULL,
+		version VARCHAR NOT NULL,
+		operating_system_id INTEGER NOT NULL,
+		manufacturer_id INTEGER NOT NULL,
+		language VARCHAR NOT NULL,
+		application_type VARCHAR NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS FILE (
+		sha256 VARCHAR NOT NULL,
+		sha1 VARCHAR NOT NULL,
+		md5 VARCHAR NOT NULL,
+		crc32 VARCHAR NOT NULL,
+		file_name VARCHAR NOT NULL,
+		file_size INTEGER NOT NULL,
+		package_id INTEGER NOT NULL,
+		PRIMARY KEY (sha256, package_id, file_name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS VERSION (
+		version VARCHAR UNIQUE NOT NULL,
+		build_set VARCHAR NOT NULL,
+		build_date TIMESTAMP NOT NULL,
+		release_date TIMESTAMP NOT NULL,
+		description VARCHAR NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS FILE_sha1_idx ON FILE (sha1)`,
+	`CREATE INDEX IF NOT EXISTS FILE_md5_idx ON FILE (md5)`,
+	`CREATE INDEX IF NOT EXISTS FILE_package_id_idx ON FILE (package_id)`,
+}
+
+// Exporter is an instance of NSRL RDSv3 Exporter.
+type Exporter struct {
+	sqlDB *sql.DB
+}
+
+// Name returns exporter name.
+func (e *Exporter) Name() string {
+	return Name
+}
+
+// NewExporter creates new NSRL RDSv3 exporter and all the necessary tables, if they don't exist.
+func NewExporter(sqlDB *sql.DB) (*Exporter, error) {
+	// SQLite allows only a single writer, concurrent exports will wait for each other.
+	sqlDB.SetMaxOpenConns(1)
+
+	for _, stmt := range schema {
+		if _, err := sqlDB.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("error while creating database schema: %v", err)
+		}
+	}
+
+	return &Exporter{sqlDB: sqlDB}, nil
+}
+
+// fileHashes holds hashes that RDS needs in addition to SHA-256, in upper-case hex encoding.
+type fileHashes struct {
+	sha1  string
+	md5   string
+	crc32 string
+	size  int64
+}
+
+// Export exports extracted data to NSRL RDSv3 database. Repository is mapped to MFG and OS entries,
+// source is mapped to a PKG entry and every path of a sample is mapped to a FILE entry. Data of a
+// given source is exported in a single transaction.
+func (e *Exporter) Export(ctx context.Context, sourceRepoName, sourceRepoPath, sourceID, sourceHash, sourcePath, sourceDescription string, samples []common.Sample) error {
+	tx, err := e.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	packageID, err := insertPackage(ctx, tx, sourceRepoName, sourceRepoPath, sourceID, sourceHash, sourceDescription)
+	if err != nil {
+		return fmt.Errorf("could not insert package data: %v", err)
+	}
+
+	// Exporting the same source again replaces its files.
+	if _, err := tx.ExecContext(ctx, `DELETE FROM FILE WHERE package_id = $1`, packageID); err != nil {
+		return fmt.Errorf("could not delete existing files: %v", err)
+	}
+
+	var skipped int
+	for _, sample := range samples {
+		hashes, err := sampleHashes(ctx, tx, sample)
+		if err != nil {
+			return fmt.Errorf("could not hash sample %s: %v", sample.Sha256, err)
+		}
+		if hashes == nil {
+			skipped++
+			continue
+		}
+
+		for _, fileName := range fileNames(sample) {
+			_, err := tx.ExecContext(ctx, `
+			INSERT INTO FILE (sha256, sha1, md5, crc32, file_name, file_size, package_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT DO NOTHING`, strings.ToUpper(sample.Sha256), hashes.sha1, hashes.md5, hashes.crc32, fileName, hashes.size, packageID)
+			if err != nil {
+				return fmt.Errorf("could not insert file %s: %v", sample.Sha256, err)
+			}
+		}
+	}
+
+	if skipped > 0 {
+		glog.Warningf("Skipped %d samples from %s, they were not extracted and are not present in the RDS database", skipped, sourceID)
+	}
+
+	if err := updateVersion(ctx, tx); err != nil {
+		return fmt.Errorf("could not update version: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// insertPackage returns ID of the package of a given source, creating the package and its
+// manufacturer and operating system entries if needed.
+func insertPackage(ctx context.Context, tx *sql.Tx, repoName, repoPath, sourceID, sourceHash, sourceDescription string) (int64, error) {
+	mfgID, err := selectOrInsert(ctx, tx,
+		`SELECT manufacturer_id FROM MFG WHERE name = $1`, []interface{}{repoName},
+		`INSERT INTO MFG (name) VALUES ($1)`, repoName)
+	if err != nil {
+		return 0, err
+	}
+
+	osID, err := selectOrInsert(ctx, tx,
+		`SELECT operating_system_id FROM OS WHERE name = $1 AND version = $2 AND manufacturer_id = $3`, []interface{}{repoName, repoPath, mfgID},
+		`INSERT INTO OS (name, version, manufacturer_id) VALUES ($1, $2, $3)`, repoName, repoPath, mfgID)
+	if err != nil {
+		return 0, err
+	}
+
+	packageID, err := selectOrInsert(ctx, tx,
+		`SELECT package_id FROM PKG WHERE name = $1 AND version = $2`, []interface{}{sourceID, sourceHash},
+		`INSERT INTO PKG (name, version, operating_system_id, manufacturer_id, language, application_type) VALUES ($1, $2, $3, $4, $5, $6)`,
+		sourceID, sourceHash, osID, mfgID, language, sourceDescription)
+	if err != nil {
+		return 0, err
+	}
+
+	return packageID, nil
+}
+
+// selectOrInsert returns ID of the row returned by a given query, or inserts a new row if there
+// isn't any.
+func selectOrInsert(ctx context.Context, tx *sql.Tx, query string, queryArgs []interface{}, insert string, insertArgs ...interface{}) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, query, queryArgs...).Scan(&id)
+	switch err {
+	case nil:
+		return id, nil
+	case sql.ErrNoRows:
+	default:
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, insert, insertArgs...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// sampleHashes calculates hashes of the extracted sample. Hashes of samples that were not uploaded
+// (i.e. they were already exported) are taken from the existing FILE entries, if there are none the
+// sample is hashed as well. nil is returned if such a sample can't be opened.
+func sampleHashes(ctx context.Context, tx *sql.Tx, sample common.Sample) (*fileHashes, error) {
+	if !sample.Upload {
+		hashes := &fileHashes{}
+		err := tx.QueryRowContext(ctx, `SELECT sha1, md5, crc32, file_size FROM FILE WHERE sha256 = $1 LIMIT 1`, strings.ToUpper(sample.Sha256)).Scan(&hashes.sha1, &hashes.md5, &hashes.crc32, &hashes.size)
+		switch err {
+		case nil:
+			return hashes, nil
+		case sql.ErrNoRows:
+		default:
+			return nil, err
+		}
+	}
+
+	var file *os.File
+	var err error
+	// If sample has more than one path associated with it, take the first that is valid.
+	for _, p := range sample.Paths {
+		if file, err = os.Open(p); err == nil {
+			break
+		}
+	}
+	if file == nil {
+		if !sample.Upload {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not open any of %v", sample.Paths)
+	}
+	defer file.Close()
+
+	sha1Hash, md5Hash, crc32Hash := sha1.New(), md5.New(), crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(sha1Hash, md5Hash, crc32Hash), file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileHashes{
+		sha1:  strings.ToUpper(hex.EncodeToString(sha1Hash.Sum(nil))),
+		md5:   strings.ToUpper(hex.EncodeToString(md5Hash.Sum(nil))),
+		crc32: strings.ToUpper(hex.EncodeToString(crc32Hash.Sum(nil))),
+		size:  size,
+	}, nil
+}
+
+// fileNames returns unique base names of the sample inside the source.
+func fileNames(sample common.Sample) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, p := range common.SamplePaths(sample) {
+		name := path.Base(strings.ReplaceAll(p, "\\", "/"))
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		// RDS requires a file name, the hash is used if the path is not known.
+		names = append(names, strings.ToUpper(sample.Sha256))
+	}
+
+	return names
+}
+
+// updateVersion records the time of the last export in the VERSION table.
+func updateVersion(ctx context.Context, tx *sql.Tx) error {
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM VERSION`); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO VERSION (version, build_set, build_date, release_date, description)
+	VALUES ($1, $2, $3, $4, $5)`, now.Format("2006.01.02"), "hashR", now, now, fmt.Sprintf("Custom RDS built by hashR %s", hashr.Version))
+
+	return err
+}
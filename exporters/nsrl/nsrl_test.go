@@ -0,0 +1,176 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nsrl
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/hashr/common"
+)
+
+func testExporter(t *testing.T) (*Exporter, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "rds.db"))
+	if err != nil {
+		t.Fatalf("could not open SQLite database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	e, err := NewExporter(db)
+	if err != nil {
+		t.Fatalf("could not create NSRL exporter: %v", err)
+	}
+
+	return e, db
+}
+
+type fileRow struct {
+	SHA256, SHA1, MD5, CRC32, FileName string
+	FileSize, PackageID                int64
+}
+
+func fileRows(t *testing.T, db *sql.DB) []fileRow {
+	t.Helper()
+
+	rows, err := db.Query(`SELECT sha256, sha1, md5, crc32, file_name, file_size, package_id FROM FILE ORDER BY package_id, sha256, file_name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var files []fileRow
+	for rows.Next() {
+		var f fileRow
+		if err := rows.Scan(&f.SHA256, &f.SHA1, &f.MD5, &f.CRC32, &f.FileName, &f.FileSize, &f.PackageID); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	return files
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	e, db := testExporter(t)
+
+	samples := []common.Sample{
+		{
+			Sha256:      "c2e7f7d23b30766c2d55e847b349d0540f4847b263ee15521dc72023846884ea",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+			SourcePaths: []string{"/usr/bin/ls"},
+			Upload:      true,
+		},
+		{
+			Sha256:      "a74bb803c7ff5bd875867fc3f4ceabb6fbe888eea6361b876111cb8060fe7e8c",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.02")},
+			SourcePaths: []string{"/bin/cat", "/usr/bin/cat", "/usr/bin/concatenate"},
+			Upload:      true,
+		},
+	}
+
+	if err := e.Export(ctx, "GCP", "ubuntu-os-cloud", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	// Samples that were not uploaded reuse hashes of existing FILE entries, unknown ones are hashed
+	// and skipped if they can't be opened.
+	samples = []common.Sample{
+		{
+			Sha256:      "c2e7f7d23b30766c2d55e847b349d0540f4847b263ee15521dc72023846884ea",
+			SourcePaths: []string{"/bin/ls"},
+		},
+		{
+			Sha256:      "2789f4b90b038d57e592d01e0cd13a98b398cc7a524c3e8a7faaaaaf59893e7d",
+			Paths:       []string{filepath.Join("testdata/extraction", "missing"), filepath.Join("testdata/extraction", "file.03")},
+			SourcePaths: []string{"/bin/cp"},
+		},
+		{
+			Sha256:      "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb",
+			SourcePaths: []string{"/bin/mv"},
+		},
+	}
+
+	if err := e.Export(ctx, "GCP", "ubuntu-os-cloud", "ubuntu-1804-lts", "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	want := []fileRow{
+		{"A74BB803C7FF5BD875867FC3F4CEABB6FBE888EEA6361B876111CB8060FE7E8C", "0E46B1C7A17270E5F86DCB45B2EF8DB5C74DF593", "FC13736B46D304672F2B92D7E9822F74", "1B8D26C8", "cat", 7168, 1},
+		{"A74BB803C7FF5BD875867FC3F4CEABB6FBE888EEA6361B876111CB8060FE7E8C", "0E46B1C7A17270E5F86DCB45B2EF8DB5C74DF593", "FC13736B46D304672F2B92D7E9822F74", "1B8D26C8", "concatenate", 7168, 1},
+		{"C2E7F7D23B30766C2D55E847B349D0540F4847B263EE15521DC72023846884EA", "7F0BD545694DF51C6D512CDBC00069B64855104A", "33B17214B33F53859254A7DC7A8A2A40", "58E3BFFA", "ls", 8192, 1},
+		{"2789F4B90B038D57E592D01E0CD13A98B398CC7A524C3E8A7FAAAAAF59893E7D", "B99C74B9A365033C73B498E790CBE36B7619C0CF", "C64BA76110A6FDFA4B3724539CF9047C", "83A03817", "cp", 5120, 2},
+		{"C2E7F7D23B30766C2D55E847B349D0540F4847B263EE15521DC72023846884EA", "7F0BD545694DF51C6D512CDBC00069B64855104A", "33B17214B33F53859254A7DC7A8A2A40", "58E3BFFA", "ls", 8192, 2},
+	}
+	if diff := cmp.Diff(want, fileRows(t, db)); diff != "" {
+		t.Errorf("Export() unexpected FILE diff (-want/+got):\n%s", diff)
+	}
+
+	var mfgCount, osCount int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM MFG`).Scan(&mfgCount); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM OS`).Scan(&osCount); err != nil {
+		t.Fatal(err)
+	}
+	if mfgCount != 1 || osCount != 1 {
+		t.Errorf("Export() created %d MFG and %d OS entries, want 1 and 1", mfgCount, osCount)
+	}
+
+	var name, version, applicationType string
+	if err := db.QueryRow(`SELECT name, version, application_type FROM PKG WHERE package_id = 2`).Scan(&name, &version, &applicationType); err != nil {
+		t.Fatal(err)
+	}
+	if name != "ubuntu-1804-lts" || version != "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb" || applicationType != "Official Ubuntu GCP image." {
+		t.Errorf("Export() created unexpected PKG entry: %s, %s, %s", name, version, applicationType)
+	}
+
+	var versions int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM VERSION`).Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions != 1 {
+		t.Errorf("VERSION table has %d rows, want 1", versions)
+	}
+}
+
+func TestExportReplacesFiles(t *testing.T) {
+	ctx := context.Background()
+	e, db := testExporter(t)
+
+	samples := []common.Sample{
+		{
+			Sha256:      "c2e7f7d23b30766c2d55e847b349d0540f4847b263ee15521dc72023846884ea",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+			SourcePaths: []string{"/usr/bin/ls"},
+			Upload:      true,
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := e.Export(ctx, "GCP", "ubuntu-os-cloud", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+			t.Fatalf("unexpected error while running Export(): %v", err)
+		}
+	}
+
+	if got := len(fileRows(t, db)); got != 1 {
+		t.Errorf("FILE table has %d rows after exporting the same source twice, want 1", got)
+	}
+}
@@ -16,18 +16,17 @@
 package postgres
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
-	"os/exec"
 	"strings"
 
-	"github.com/golang/glog"
-
 	"github.com/google/hashr/common"
+	"github.com/google/hashr/inspect"
+	"github.com/google/hashr/migrations"
+	"github.com/google/hashr/payloads"
 
 	"github.com/lib/pq"
 )
@@ -35,12 +34,19 @@ import (
 const (
 	// Name contains name of the exporter.
 	Name = "postgres"
+	// batchSize is the number of samples exported in a single transaction. Each sample uses at most
+	// 18 parameters in a single statement (executables), which keeps statements well below the
+	// PostgreSQL limit of 65535 parameters.
+	batchSize = 1000
 )
 
 // Exporter is an instance of Postgres Exporter.
 type Exporter struct {
 	sqlDB          *sql.DB
 	uploadPayloads bool
+	// payloadStore holds payloads, if it's nil payloads are stored in the payloads table.
+	payloadStore payloads.Store
+	batchSize    int
 }
 
 // Name returns exporter name.
@@ -48,334 +54,246 @@ func (e *Exporter) Name() string {
 	return Name
 }
 
-// NewExporter creates new Postregre exporter and all the necessary tables, if they don't exist.
-func NewExporter(sqlDB *sql.DB, uploadPayloads bool) (*Exporter, error) {
-	// Check if the "samples" table exists.
-	exists, err := tableExists(sqlDB, "samples")
-	if err != nil {
-		return nil, fmt.Errorf("error while checking if samples table exists: %v", err)
-	}
-
-	if !exists {
-		sql := `CREATE TABLE samples (
-				sha256 VARCHAR(100)  PRIMARY KEY,
-				mimetype text,
-				file_output  text,
-				size INT
-		  )`
-		_, err = sqlDB.Exec(sql)
-		if err != nil {
-			return nil, fmt.Errorf("error while creating samples table: %v", err)
-		}
-	}
-
-	// Check if the "payloads" table exists.
-	exists, err = tableExists(sqlDB, "payloads")
-	if err != nil {
-		return nil, fmt.Errorf("error while checking if payloads table exists: %v", err)
-	}
-
-	if !exists {
-		sql := `CREATE TABLE payloads (
-				sha256 VARCHAR(100)  PRIMARY KEY,
-				payload bytea
-		  )`
-		_, err = sqlDB.Exec(sql)
-		if err != nil {
-			return nil, fmt.Errorf("error while creating payloads table: %v", err)
-		}
-	}
-
-	// Check if the "sources" table exists.
-	exists, err = tableExists(sqlDB, "sources")
-	if err != nil {
-		return nil, fmt.Errorf("error while checking if sources table exists: %v", err)
-	}
-
-	if !exists {
-		sql := `CREATE TABLE sources (
-			sha256 VARCHAR(100)  PRIMARY KEY,
-			sourceID  text[],
-			sourcePath  text,
-			sourceDescription text,
-			repoName text,
-			repoPath text
-		  )`
-		_, err = sqlDB.Exec(sql)
-		if err != nil {
-			return nil, fmt.Errorf("error while creating sources table: %v", err)
-		}
-	}
-
-	// Check if the "samples_sources" table exists.
-	exists, err = tableExists(sqlDB, "samples_sources")
-	if err != nil {
-		return nil, fmt.Errorf("error while checking if samples_sources table exists: %v", err)
+// NewExporter creates new Postregre exporter and migrates the database schema to the latest version.
+// If payloadStore is set, payloads are uploaded to it and only their location is stored in the
+// database.
+func NewExporter(sqlDB *sql.DB, uploadPayloads bool, payloadStore payloads.Store) (*Exporter, error) {
+	if _, err := migrations.MigratePostgres(context.Background(), sqlDB); err != nil {
+		return nil, fmt.Errorf("error while migrating database schema: %v", err)
 	}
 
-	if !exists {
-		sql := `CREATE TABLE samples_sources (
-			sample_sha256 VARCHAR(100) REFERENCES samples(sha256) NOT NULL,
-			source_sha256 VARCHAR(100) REFERENCES sources(sha256) NOT NULL,
-			sample_paths text[],
-			PRIMARY KEY (sample_sha256, source_sha256)
-		  )`
-		_, err = sqlDB.Exec(sql)
-		if err != nil {
-			return nil, fmt.Errorf("error while creating samples_sources table: %v", err)
-		}
-	}
+	return &Exporter{sqlDB: sqlDB, uploadPayloads: uploadPayloads, payloadStore: payloadStore, batchSize: batchSize}, nil
+}
 
-	return &Exporter{sqlDB: sqlDB, uploadPayloads: uploadPayloads}, nil
+// sampleRow holds data of a single sample that will be exported.
+type sampleRow struct {
+	sha256     string
+	size       int64
+	mimeType   sql.NullString
+	fileOutput sql.NullString
+	// localPath is the path of the extracted sample, empty if the sample was not extracted (e.g. it
+	// was already exported from another source).
+	localPath string
+	// location holds the location of the payload in the payload store.
+	location string
+	// sourcePaths holds paths of the sample inside the source.
+	sourcePaths []string
+	// executable holds metadata of executable samples.
+	executable *common.ExecutableMetadata
 }
 
-// Export exports extracted data to PostgreSQL instance.
+// Export exports extracted data to PostgreSQL instance. Samples are exported in batches, each in
+// a separate transaction. Samples that could not be exported are reported in the returned error.
 func (e *Exporter) Export(ctx context.Context, sourceRepoName, sourceRepoPath, sourceID, sourceHash, sourcePath, sourceDescription string, samples []common.Sample) error {
-	if err := e.insertSource(sourceHash, sourceID, sourcePath, sourceRepoName, sourceRepoPath, sourceDescription); err != nil {
+	if err := e.insertSource(ctx, sourceHash, sourceID, sourcePath, sourceRepoName, sourceRepoPath, sourceDescription); err != nil {
 		return fmt.Errorf("could not upload source data: %v", err)
 	}
 
+	var errs []string
+	var failed int
+	rows := make([]*sampleRow, 0, len(samples))
+	seen := make(map[string]*sampleRow)
 	for _, sample := range samples {
-		exists, err := e.sampleExists(sample.Sha256)
+		row, err := newSampleRow(sample)
 		if err != nil {
-			glog.Errorf("skipping %s, could not check if sample was already uploaded: %v", sample.Sha256, err)
+			failed++
+			errs = append(errs, fmt.Sprintf("%s: %v", sample.Sha256, err))
 			continue
 		}
 
-		if !exists {
-			if err := e.insertSample(sample, e.uploadPayloads); err != nil {
-				glog.Errorf("skipping %s, could not insert sample data: %v", sample.Sha256, err)
+		if e.uploadPayloads && e.payloadStore != nil && row.localPath != "" {
+			row.location, err = e.payloadStore.Put(ctx, row.sha256, row.localPath)
+			if err != nil {
+				failed++
+				errs = append(errs, fmt.Sprintf("%s: could not upload payload: %v", sample.Sha256, err))
 				continue
 			}
 		}
 
-		if err := e.insertRelationship(sample, sourceHash); err != nil {
-			glog.Errorf("skipping %s, could not insert source <-> sample relationship: %v", sample.Sha256, err)
+		// Multi-row INSERT ... ON CONFLICT DO UPDATE can't affect the same row twice.
+		if r, ok := seen[row.sha256]; ok {
+			r.sourcePaths = append(r.sourcePaths, row.sourcePaths...)
 			continue
 		}
+		seen[row.sha256] = row
+		rows = append(rows, row)
 	}
 
-	return nil
-}
+	for start := 0; start < len(rows); start += e.batchSize {
+		end := start + e.batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
 
-func (e *Exporter) sampleExists(sha256 string) (bool, error) {
-	sqlStatement := `SELECT sha256 FROM samples WHERE sha256=$1;`
-	var quickSha256 string
-	row := e.sqlDB.QueryRow(sqlStatement, sha256)
-	switch err := row.Scan(&quickSha256); err {
-	case sql.ErrNoRows:
-		return false, nil
-	case nil:
-		return true, nil
-	default:
-		return false, err
+		if err := e.exportBatch(ctx, sourceHash, rows[start:end]); err != nil {
+			failed += end - start
+			errs = append(errs, fmt.Sprintf("batch of %d samples: %v", end-start, err))
+		}
 	}
-}
 
-func (e *Exporter) relationshipExists(sourceSha256, sampleSha256 string) (bool, error) {
-	sqlStatement := `
-	SELECT sample_sha256,source_sha256 
-	FROM samples_sources 
-	WHERE sample_sha256=$1 AND source_sha256=$2;`
-	row := e.sqlDB.QueryRow(sqlStatement, sampleSha256, sourceSha256)
-	switch err := row.Scan(&sampleSha256, &sourceSha256); err {
-	case sql.ErrNoRows:
-		return false, nil
-	case nil:
-		return true, nil
-	default:
-		return false, err
+	if len(errs) > 0 {
+		return fmt.Errorf("could not export %d samples: %s", failed, strings.Join(errs, "; "))
 	}
-}
 
-func (e *Exporter) sourceExists(sha256 string) (bool, error) {
-	sqlStatement := `
-	SELECT sha256 
-	FROM sources 
-	WHERE sha256=$1;`
-	var quickSha256 string
-	row := e.sqlDB.QueryRow(sqlStatement, sha256)
-	switch err := row.Scan(&quickSha256); err {
-	case sql.ErrNoRows:
-		return false, nil
-	case nil:
-		return true, nil
-	default:
-		return false, err
-	}
+	return nil
 }
 
-func (e *Exporter) insertSample(sample common.Sample, uploadPayload bool) error {
-	sqlSamples := `
-	INSERT INTO samples (sha256, size, mimetype, file_output)
-	VALUES ($1, $2, $3, $4)`
+// newSampleRow gathers data of a given sample that is needed for the export.
+func newSampleRow(sample common.Sample) (*sampleRow, error) {
+	row := &sampleRow{sha256: sample.Sha256, size: sample.Size, sourcePaths: common.SamplePaths(sample), executable: sample.Executable}
+
+	// Samples that are not uploaded were already exported, only the relationship with the source
+	// needs to be recorded.
+	if !sample.Upload {
+		return row, nil
+	}
 
-	var samplePath string
 	var fi os.FileInfo
 	var err error
 	// If sample has more than one path associated with it, take the first that is valid.
 	for _, path := range sample.Paths {
 		if fi, err = os.Stat(path); err == nil {
-			samplePath = path
+			row.localPath = path
 			break
 		}
 	}
 
-	file, err := os.Open(samplePath)
-	if err != nil {
-		return fmt.Errorf("could not open %v", samplePath)
-	}
-	defer file.Close()
-
-	mimeType, err := getFileContentType(file)
-	if err != nil {
-		glog.Warningf("Could not get file content type: %v", err)
+	if fi == nil {
+		return nil, fmt.Errorf("could not open %v", sample.Paths)
 	}
+	row.size = fi.Size()
 
-	fileOutput, err := fileCmdOutput(samplePath)
+	fileType, err := inspect.IdentifyFile(row.localPath)
 	if err != nil {
-		glog.Warningf("Could not get file cmd output: %v", err)
-	}
-
-	fileOutput = strings.TrimPrefix(fileOutput, fmt.Sprintf("%s%s", samplePath, ":"))
-
-	_, err = e.sqlDB.Exec(sqlSamples, sample.Sha256, int(fi.Size()), mimeType, fileOutput)
-	if err != nil {
-		return fmt.Errorf("could not execute SQL: %v", err)
-	}
-
-	if uploadPayload {
-		data, err := os.ReadFile(samplePath)
-		if err != nil {
-			return fmt.Errorf("error while opening file: %v", err)
-		}
-
-		sqlPayloads := `
-		INSERT INTO payloads (sha256, payload)
-		VALUES ($1, $2)`
-
-		_, err = e.sqlDB.Exec(sqlPayloads, sample.Sha256, data)
-		if err != nil {
-			return fmt.Errorf("could not execute SQL: %v", err)
-		}
+		return nil, fmt.Errorf("could not identify type of %v: %v", row.localPath, err)
 	}
+	row.mimeType = sql.NullString{String: fileType.MIMEType, Valid: true}
+	row.fileOutput = sql.NullString{String: fileType.Description, Valid: true}
 
-	return nil
+	return row, nil
 }
 
-func (e *Exporter) insertSource(sourceHash, sourceID, sourcePath, sourceRepoName, sourceRepoPath, sourceDescription string) error {
-	exists, err := e.sourceExists(sourceHash)
+// exportBatch exports a given batch of samples and their relationship with the source in a single
+// transaction.
+func (e *Exporter) exportBatch(ctx context.Context, sourceHash string, rows []*sampleRow) error {
+	tx, err := e.sqlDB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	var sql string
-	if !exists {
-		sql = `
-		INSERT INTO sources (sha256, sourceID, sourcePath, repoName, repoPath, sourceDescription)
-		VALUES ($1, $2, $3, $4, $5, $6)`
+	values := make([][]interface{}, 0, len(rows))
+	for _, row := range rows {
+		values = append(values, []interface{}{row.sha256, row.size, row.mimeType, row.fileOutput})
+	}
+	// Samples that were not extracted are only inserted if missing, to satisfy the foreign key.
+	if err := insertRows(ctx, tx, `INSERT INTO samples (sha256, size, mimetype, file_output)`, `ON CONFLICT (sha256) DO NOTHING`, values); err != nil {
+		return fmt.Errorf("could not insert samples: %v", err)
+	}
 
-		_, err = e.sqlDB.Exec(sql, sourceHash, pq.Array([]string{sourceID}), sourcePath, sourceRepoName, sourceRepoPath, sourceDescription)
-		if err != nil {
-			return err
+	values = values[:0]
+	for _, row := range rows {
+		if m := row.executable; m != nil {
+			values = append(values, []interface{}{row.sha256, m.Format, m.Architecture, m.BuildID, m.Soname, pq.Array(m.ImportedLibraries), m.CompanyName, m.ProductName, m.ProductVersion, m.FileVersion, m.FileDescription, m.OriginalFilename, m.Signer, m.SignatureStatus, m.SignatureError, pq.Array(m.SignerChain), m.SigningTime, m.ParseError})
 		}
-	} else {
-		sql = `UPDATE sources set sourceID = array_append(sourceID, $1) WHERE sha256 = $2`
-		_, err = e.sqlDB.Exec(sql, sourceID, sourceHash)
-		if err != nil {
-			return err
+	}
+	if len(values) > 0 {
+		if err := insertRows(ctx, tx, `INSERT INTO executables (sha256, format, architecture, build_id, soname, imported_libraries, company_name, product_name, product_version, file_version, file_description, original_filename, signer, signature_status, signature_error, signer_chain, signing_time, parse_error)`, `ON CONFLICT (sha256) DO NOTHING`, values); err != nil {
+			return fmt.Errorf("could not insert executable metadata: %v", err)
 		}
 	}
 
-	return nil
-}
-
-func (e *Exporter) insertRelationship(sample common.Sample, sourceSha256 string) error {
-	exists, err := e.relationshipExists(sourceSha256, sample.Sha256)
-	if err != nil {
-		return err
-	}
+	switch {
+	case e.uploadPayloads && e.payloadStore != nil:
+		// Payloads were already uploaded, only their location is recorded.
+		values = values[:0]
+		for _, row := range rows {
+			if row.location != "" {
+				values = append(values, []interface{}{row.sha256, row.location})
+			}
+		}
+		if len(values) > 0 {
+			if err := insertRows(ctx, tx, `INSERT INTO payloads (sha256, location)`, `ON CONFLICT (sha256) DO UPDATE SET location = EXCLUDED.location`, values); err != nil {
+				return fmt.Errorf("could not insert payload locations: %v", err)
+			}
+		}
+	case e.uploadPayloads:
+		// Payloads are inserted one by one to avoid keeping the content of the whole batch in memory.
+		for _, row := range rows {
+			if row.localPath == "" {
+				continue
+			}
 
-	var paths []string
+			data, err := os.ReadFile(row.localPath)
+			if err != nil {
+				return fmt.Errorf("error while opening file: %v", err)
+			}
 
-	for _, path := range sample.Paths {
-		s := strings.Split(path, "/extracted/")
-		if len(s) < 2 {
-			glog.Warningf("sample path does not follow expected format: %s", path)
-			continue
+			if _, err := tx.ExecContext(ctx, `INSERT INTO payloads (sha256, payload) VALUES ($1, $2) ON CONFLICT (sha256) DO NOTHING`, row.sha256, data); err != nil {
+				return fmt.Errorf("could not insert payload of %s: %v", row.sha256, err)
+			}
 		}
-		paths = append(paths, s[len(s)-1])
 	}
 
-	if !exists {
-		sql := `
-		INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths)
-		VALUES ($1, $2, $3)`
-
-		_, err = e.sqlDB.Exec(sql, sample.Sha256, sourceSha256, pq.Array(paths))
-		if err != nil {
-			return err
-		}
-	} else {
-		sql := `
-		UPDATE samples_sources set sample_paths =  array_cat(sample_paths, $1) 
-		WHERE sample_sha256 = $2 AND source_sha256 = $3
-		`
-		_, err = e.sqlDB.Exec(sql, pq.Array(paths), sample.Sha256, sourceSha256)
-		if err != nil {
-			return err
-		}
-		// UPDATE users SET topics = array_cat(topics, '{cats,mice}');
+	values = values[:0]
+	for _, row := range rows {
+		values = append(values, []interface{}{row.sha256, sourceHash, pq.Array(row.sourcePaths)})
+	}
+	if err := insertRows(ctx, tx, `INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths)`, `ON CONFLICT (sample_sha256, source_sha256) DO UPDATE SET sample_paths = ARRAY(SELECT DISTINCT unnest(samples_sources.sample_paths || EXCLUDED.sample_paths))`, values); err != nil {
+		return fmt.Errorf("could not insert source <-> sample relationships: %v", err)
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func getFileContentType(out *os.File) (string, error) {
-
-	// Only the first 512 bytes are used to check the content type.
-	buffer := make([]byte, 512)
-
-	_, err := out.Read(buffer)
-	if err != nil {
-		return "", err
+// insertRows executes a multi-row INSERT statement. Query holds the statement up to the VALUES
+// keyword and suffix holds the rest of it, e.g. ON CONFLICT clause.
+func insertRows(ctx context.Context, tx *sql.Tx, query, suffix string, rows [][]interface{}) error {
+	var b strings.Builder
+	var args []interface{}
+	b.WriteString(query)
+	b.WriteString(" VALUES ")
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for j, v := range row {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			args = append(args, v)
+			fmt.Fprintf(&b, "$%d", len(args))
+		}
+		b.WriteString(")")
 	}
+	b.WriteString(" ")
+	b.WriteString(suffix)
 
-	contentType := http.DetectContentType(buffer)
-
-	return contentType, nil
+	_, err := tx.ExecContext(ctx, b.String(), args...)
+	return err
 }
 
-func fileCmdOutput(filepath string) (string, error) {
-	cmd := exec.Command("/usr/bin/file", filepath)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
+// ExportMetadata stores structured metadata of an exported source, e.g. package name, version and
+// file digests, in the metadata column of the sources table.
+func (e *Exporter) ExportMetadata(ctx context.Context, sourceHash string, metadata *common.SourceMetadata) error {
+	metadataJSON, err := json.Marshal(metadata)
 	if err != nil {
-		return "", fmt.Errorf("error while executing %s: %v\nStdout: %v\nStderr: %v", "/usr/bin/file", err, stdout.String(), stderr.String())
+		return fmt.Errorf("could not marshal source metadata: %v", err)
 	}
 
-	return strings.TrimSuffix(stdout.String(), "\n"), nil
+	_, err = e.sqlDB.ExecContext(ctx, `UPDATE sources SET metadata = $1 WHERE sha256 = $2`, string(metadataJSON), sourceHash)
+	return err
 }
 
-func tableExists(db *sql.DB, tableName string) (bool, error) {
-	// Query to check if the table exists in PostgreSQL
-	query := `
-        SELECT EXISTS (
-            SELECT 1
-            FROM   information_schema.tables
-            WHERE  table_name=$1
-        );
-    `
-
-	var exists bool
-
-	err := db.QueryRow(query, tableName).Scan(&exists)
-	if err != nil {
-		return false, err
-	}
+// insertSource inserts the source or appends the source ID to already existing one.
+func (e *Exporter) insertSource(ctx context.Context, sourceHash, sourceID, sourcePath, sourceRepoName, sourceRepoPath, sourceDescription string) error {
+	sql := `
+	INSERT INTO sources (sha256, sourceID, sourcePath, repoName, repoPath, sourceDescription)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (sha256) DO UPDATE SET sourceID = array_append(sources.sourceID, $7)
+	WHERE NOT $7 = ANY(sources.sourceID)`
 
-	return exists, nil
+	_, err := e.sqlDB.ExecContext(ctx, sql, sourceHash, pq.Array([]string{sourceID}), sourcePath, sourceRepoName, sourceRepoPath, sourceDescription, sourceID)
+	return err
 }
@@ -16,12 +16,18 @@ package postgres
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/hashr/common"
+	"github.com/google/hashr/migrations"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
@@ -33,33 +39,31 @@ func TestExport(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectQuery(`SELECT EXISTS ( SELECT 1 FROM information_schema.tables WHERE table_name=$1 );`).WithArgs("samples").WillReturnRows(mock.NewRows([]string{"t"}).AddRow("t"))
-	mock.ExpectQuery(`SELECT EXISTS ( SELECT 1 FROM information_schema.tables WHERE table_name=$1 );`).WithArgs("payloads").WillReturnRows(mock.NewRows([]string{"t"}).AddRow("t"))
-	mock.ExpectQuery(`SELECT EXISTS ( SELECT 1 FROM information_schema.tables WHERE table_name=$1 );`).WithArgs("sources").WillReturnRows(mock.NewRows([]string{"t"}).AddRow("t"))
-	mock.ExpectQuery(`SELECT EXISTS ( SELECT 1 FROM information_schema.tables WHERE table_name=$1 );`).WithArgs("samples_sources").WillReturnRows(mock.NewRows([]string{"t"}).AddRow("t"))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations ( version INT PRIMARY KEY, description text, applied_at TIMESTAMPTZ NOT NULL DEFAULT now() )`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).WillReturnRows(mock.NewRows([]string{"version"}).AddRow(migrations.LatestVersion()))
+	mock.ExpectCommit()
 
-	postgresExporter, err := NewExporter(db, false)
+	postgresExporter, err := NewExporter(db, false, nil)
 	if err != nil {
 		t.Fatalf("could not create Postgres exporter: %v", err)
 	}
 
-	mock.ExpectQuery(`SELECT sha256 FROM sources WHERE sha256=$1;`).WithArgs("07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc").WillReturnRows(mock.NewRows([]string{"sha256"}))
-	mock.ExpectExec(`INSERT INTO sources (sha256, sourceID, sourcePath, repoName, repoPath, sourceDescription) VALUES ($1, $2, $3, $4, $5, $6)`).WithArgs("07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"ubuntu-1604-lts"}`, "", "GCP", "ubuntu", "Official Ubuntu GCP image.").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO sources (sha256, sourceID, sourcePath, repoName, repoPath, sourceDescription) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (sha256) DO UPDATE SET sourceID = array_append(sources.sourceID, $7) WHERE NOT $7 = ANY(sources.sourceID)`).WithArgs("07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"ubuntu-1604-lts"}`, "", "GCP", "ubuntu", "Official Ubuntu GCP image.", "ubuntu-1604-lts").WillReturnResult(sqlmock.NewResult(1, 1))
 
-	mock.ExpectQuery(`SELECT sha256 FROM samples WHERE sha256=$1;`).WithArgs("a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3").WillReturnRows(mock.NewRows([]string{"sha256"}))
-	mock.ExpectExec(`INSERT INTO samples (sha256, size, mimetype, file_output) VALUES ($1, $2, $3, $4)`).WithArgs("a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", 8192, "application/octet-stream", " data").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectQuery("SELECT sample_sha256,source_sha256 FROM samples_sources WHERE sample_sha256=$1 AND source_sha256=$2;").WithArgs("a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc").WillReturnRows(mock.NewRows([]string{"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"}))
-	mock.ExpectExec(`INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths) VALUES ($1, $2, $3)`).WithArgs("a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.01"}`).WillReturnResult(sqlmock.NewResult(1, 1))
-
-	mock.ExpectQuery(`SELECT sha256 FROM samples WHERE sha256=$1;`).WithArgs("5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb").WillReturnRows(mock.NewRows([]string{"sha256"}))
-	mock.ExpectExec(`INSERT INTO samples (sha256, size, mimetype, file_output) VALUES ($1, $2, $3, $4)`).WithArgs("5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", 7168, "application/octet-stream", " data").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectQuery("SELECT sample_sha256,source_sha256 FROM samples_sources WHERE sample_sha256=$1 AND source_sha256=$2;").WithArgs("5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc").WillReturnRows(mock.NewRows([]string{"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"}))
-	mock.ExpectExec(`INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths) VALUES ($1, $2, $3)`).WithArgs("5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.02"}`).WillReturnResult(sqlmock.NewResult(1, 1))
-
-	mock.ExpectQuery(`SELECT sha256 FROM samples WHERE sha256=$1;`).WithArgs("9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7").WillReturnRows(mock.NewRows([]string{"sha256"}))
-	mock.ExpectExec(`INSERT INTO samples (sha256, size, mimetype, file_output) VALUES ($1, $2, $3, $4)`).WithArgs("9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", 5120, "application/octet-stream", " data").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectQuery("SELECT sample_sha256,source_sha256 FROM samples_sources WHERE sample_sha256=$1 AND source_sha256=$2;").WithArgs("9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc").WillReturnRows(mock.NewRows([]string{"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"}))
-	mock.ExpectExec(`INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths) VALUES ($1, $2, $3)`).WithArgs("9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.03"}`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO samples (sha256, size, mimetype, file_output) VALUES ($1, $2, $3, $4), ($5, $6, $7, $8), ($9, $10, $11, $12) ON CONFLICT (sha256) DO NOTHING`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", 8192, "application/octet-stream", "data",
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", 7168, "application/octet-stream", "data",
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", 5120, "application/octet-stream", "data",
+	).WillReturnResult(sqlmock.NewResult(3, 3))
+	mock.ExpectExec(`INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths) VALUES ($1, $2, $3), ($4, $5, $6), ($7, $8, $9) ON CONFLICT (sample_sha256, source_sha256) DO UPDATE SET sample_paths = ARRAY(SELECT DISTINCT unnest(samples_sources.sample_paths || EXCLUDED.sample_paths))`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.01"}`,
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.02"}`,
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.03"}`,
+	).WillReturnResult(sqlmock.NewResult(3, 3))
+	mock.ExpectCommit()
 
 	tempDir := "/tmp/extracted/"
 	if err := os.MkdirAll(tempDir, 0777); err != nil {
@@ -104,4 +108,267 @@ func TestExport(t *testing.T) {
 	if err := postgresExporter.Export(context.Background(), "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
 		t.Fatalf("unexpected error while running Export() = %v", err)
 	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExportMetadata(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("could not open a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	metadata := &common.SourceMetadata{
+		Name:         "testdata",
+		Version:      "1.0-1",
+		Architecture: "noarch",
+		Files:        []common.FileDigest{{Path: "/file.01", Algorithm: "sha256", Digest: "c2e7f7d23b30766c2d55e847b349d0540f4847b263ee15521dc72023846884ea"}},
+	}
+	mock.ExpectExec(`UPDATE sources SET metadata = $1 WHERE sha256 = $2`).WithArgs(`{"name":"testdata","version":"1.0-1","architecture":"noarch","files":[{"path":"/file.01","algorithm":"sha256","digest":"c2e7f7d23b30766c2d55e847b349d0540f4847b263ee15521dc72023846884ea"}]}`, "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	postgresExporter := &Exporter{sqlDB: db}
+	if err := postgresExporter.ExportMetadata(context.Background(), "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", metadata); err != nil {
+		t.Fatalf("unexpected error while running ExportMetadata() = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExportBatches(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("could not open a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	postgresExporter := &Exporter{sqlDB: db, batchSize: 2}
+
+	// Samples that are not uploaded were already exported, only their relationship with the source
+	// is recorded.
+	samples := []common.Sample{
+		{Sha256: "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", SourcePaths: []string{"bin/ls"}, Size: 8192},
+		{Sha256: "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", SourcePaths: []string{"bin/cat", "usr/bin/cat"}, Size: 7168},
+		{Sha256: "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", SourcePaths: []string{"bin/cp"}, Size: 5120},
+	}
+
+	mock.ExpectExec(`INSERT INTO sources (sha256, sourceID, sourcePath, repoName, repoPath, sourceDescription) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (sha256) DO UPDATE SET sourceID = array_append(sources.sourceID, $7) WHERE NOT $7 = ANY(sources.sourceID)`).WithArgs("07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"ubuntu-1604-lts"}`, "", "GCP", "ubuntu", "Official Ubuntu GCP image.", "ubuntu-1604-lts").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO samples (sha256, size, mimetype, file_output) VALUES ($1, $2, $3, $4), ($5, $6, $7, $8) ON CONFLICT (sha256) DO NOTHING`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", 8192, nil, nil,
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", 7168, nil, nil,
+	).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths) VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT (sample_sha256, source_sha256) DO UPDATE SET sample_paths = ARRAY(SELECT DISTINCT unnest(samples_sources.sample_paths || EXCLUDED.sample_paths))`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"bin/ls"}`,
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"bin/cat","usr/bin/cat"}`,
+	).WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectCommit()
+
+	// Failure of the second batch should roll back its transaction and be reported.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO samples (sha256, size, mimetype, file_output) VALUES ($1, $2, $3, $4) ON CONFLICT (sha256) DO NOTHING`).WithArgs(
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", 5120, nil, nil,
+	).WillReturnError(errors.New("connection reset by peer"))
+	mock.ExpectRollback()
+
+	err = postgresExporter.Export(context.Background(), "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples)
+	if err == nil {
+		t.Fatal("expected error while exporting failing batch")
+	}
+	if !strings.Contains(err.Error(), "could not export 1 samples") {
+		t.Errorf("Export() returned unexpected error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExportExecutables(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("could not open a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	postgresExporter := &Exporter{sqlDB: db, batchSize: batchSize}
+
+	signingTime := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	samples := []common.Sample{
+		{
+			Sha256:      "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+			SourcePaths: []string{"Windows/System32/hashrtest.exe"},
+			Upload:      true,
+			Executable: &common.ExecutableMetadata{
+				Format:            "PE",
+				Architecture:      "x86-64",
+				ImportedLibraries: []string{"KERNEL32.dll"},
+				ProductName:       "HashR",
+				Signer:            "CN=HashR Test Signer,O=HashR",
+				SignatureStatus:   "valid",
+				SignerChain:       []string{"CN=HashR Test Signer,O=HashR", "CN=HashR Test Root,O=HashR"},
+				SigningTime:       &signingTime,
+			},
+		},
+		{Sha256: "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", SourcePaths: []string{"bin/cp"}, Size: 5120},
+	}
+
+	mock.ExpectExec(`INSERT INTO sources (sha256, sourceID, sourcePath, repoName, repoPath, sourceDescription) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (sha256) DO UPDATE SET sourceID = array_append(sources.sourceID, $7) WHERE NOT $7 = ANY(sources.sourceID)`).WithArgs("07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"ubuntu-1604-lts"}`, "", "GCP", "ubuntu", "Official Ubuntu GCP image.", "ubuntu-1604-lts").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO samples (sha256, size, mimetype, file_output) VALUES ($1, $2, $3, $4), ($5, $6, $7, $8) ON CONFLICT (sha256) DO NOTHING`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", 8192, "application/octet-stream", "data",
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", 5120, nil, nil,
+	).WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectExec(`INSERT INTO executables (sha256, format, architecture, build_id, soname, imported_libraries, company_name, product_name, product_version, file_version, file_description, original_filename, signer, signature_status, signature_error, signer_chain, signing_time, parse_error) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18) ON CONFLICT (sha256) DO NOTHING`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "PE", "x86-64", "", "", `{"KERNEL32.dll"}`, "", "HashR", "", "", "", "", "CN=HashR Test Signer,O=HashR",
+		"valid", "", `{"CN=HashR Test Signer,O=HashR","CN=HashR Test Root,O=HashR"}`, signingTime, "",
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths) VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT (sample_sha256, source_sha256) DO UPDATE SET sample_paths = ARRAY(SELECT DISTINCT unnest(samples_sources.sample_paths || EXCLUDED.sample_paths))`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"Windows/System32/hashrtest.exe"}`,
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"bin/cp"}`,
+	).WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectCommit()
+
+	if err := postgresExporter.Export(context.Background(), "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExportPayloads(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("could not open a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	postgresExporter := &Exporter{sqlDB: db, uploadPayloads: true, batchSize: batchSize}
+
+	payload, err := os.ReadFile("testdata/extraction/file.01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := []common.Sample{
+		{Sha256: "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", Paths: []string{"testdata/extraction/file.01"}, SourcePaths: []string{"file.01"}, Upload: true},
+		{Sha256: "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", SourcePaths: []string{"file.02"}, Size: 7168},
+	}
+
+	mock.ExpectExec(`INSERT INTO sources (sha256, sourceID, sourcePath, repoName, repoPath, sourceDescription) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (sha256) DO UPDATE SET sourceID = array_append(sources.sourceID, $7) WHERE NOT $7 = ANY(sources.sourceID)`).WithArgs("07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"ubuntu-1604-lts"}`, "", "GCP", "ubuntu", "Official Ubuntu GCP image.", "ubuntu-1604-lts").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO samples (sha256, size, mimetype, file_output) VALUES ($1, $2, $3, $4), ($5, $6, $7, $8) ON CONFLICT (sha256) DO NOTHING`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", 8192, "application/octet-stream", sqlmock.AnyArg(),
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", 7168, nil, nil,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	// Only the payload of the extracted sample is uploaded.
+	mock.ExpectExec(`INSERT INTO payloads (sha256, payload) VALUES ($1, $2) ON CONFLICT (sha256) DO NOTHING`).WithArgs("a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", payload).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths) VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT (sample_sha256, source_sha256) DO UPDATE SET sample_paths = ARRAY(SELECT DISTINCT unnest(samples_sources.sample_paths || EXCLUDED.sample_paths))`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.01"}`,
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.02"}`,
+	).WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectCommit()
+
+	if err := postgresExporter.Export(context.Background(), "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// fakeStore records uploaded payloads.
+type fakeStore struct {
+	paths map[string]string
+}
+
+func (s *fakeStore) Name() string {
+	return "fake"
+}
+
+func (s *fakeStore) Put(ctx context.Context, sha256, path string) (string, error) {
+	s.paths[sha256] = path
+	return "file:///payloads/" + sha256, nil
+}
+
+func TestExportPayloadStore(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("could not open a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	store := &fakeStore{paths: make(map[string]string)}
+	postgresExporter := &Exporter{sqlDB: db, uploadPayloads: true, payloadStore: store, batchSize: batchSize}
+
+	samples := []common.Sample{
+		{Sha256: "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", Paths: []string{"testdata/extraction/file.01"}, SourcePaths: []string{"file.01"}, Upload: true},
+		{Sha256: "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", SourcePaths: []string{"file.02"}, Size: 7168},
+	}
+
+	mock.ExpectExec(`INSERT INTO sources (sha256, sourceID, sourcePath, repoName, repoPath, sourceDescription) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (sha256) DO UPDATE SET sourceID = array_append(sources.sourceID, $7) WHERE NOT $7 = ANY(sources.sourceID)`).WithArgs("07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"ubuntu-1604-lts"}`, "", "GCP", "ubuntu", "Official Ubuntu GCP image.", "ubuntu-1604-lts").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO samples (sha256, size, mimetype, file_output) VALUES ($1, $2, $3, $4), ($5, $6, $7, $8) ON CONFLICT (sha256) DO NOTHING`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", 8192, "application/octet-stream", sqlmock.AnyArg(),
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", 7168, nil, nil,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	// Only the location of the extracted sample is recorded.
+	mock.ExpectExec(`INSERT INTO payloads (sha256, location) VALUES ($1, $2) ON CONFLICT (sha256) DO UPDATE SET location = EXCLUDED.location`).WithArgs("a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "file:///payloads/a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths) VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT (sample_sha256, source_sha256) DO UPDATE SET sample_paths = ARRAY(SELECT DISTINCT unnest(samples_sources.sample_paths || EXCLUDED.sample_paths))`).WithArgs(
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.01"}`,
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", `{"file.02"}`,
+	).WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectCommit()
+
+	if err := postgresExporter.Export(context.Background(), "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	want := map[string]string{"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3": "testdata/extraction/file.01"}
+	if diff := cmp.Diff(want, store.paths); diff != "" {
+		t.Errorf("Export() unexpected uploads diff (-want/+got):\n%s", diff)
+	}
+}
+
+func BenchmarkExportBatch(b *testing.B) {
+	for _, size := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherFunc(func(string, string) error { return nil })))
+			if err != nil {
+				b.Fatalf("could not open a stub database connection: %v", err)
+			}
+			defer db.Close()
+
+			e := &Exporter{sqlDB: db, batchSize: batchSize}
+			rows := make([]*sampleRow, size)
+			for i := range rows {
+				rows[i] = &sampleRow{sha256: fmt.Sprintf("%064x", i), size: int64(i), sourcePaths: []string{fmt.Sprintf("bin/%d", i)}}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				mock.ExpectBegin()
+				mock.ExpectExec("").WillReturnResult(sqlmock.NewResult(0, int64(size)))
+				mock.ExpectExec("").WillReturnResult(sqlmock.NewResult(0, int64(size)))
+				mock.ExpectCommit()
+				b.StartTimer()
+
+				if err := e.exportBatch(context.Background(), "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", rows); err != nil {
+					b.Fatalf("unexpected error while running exportBatch(): %v", err)
+				}
+			}
+		})
+	}
 }
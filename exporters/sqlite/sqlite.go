@@ -0,0 +1,337 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite provides functions required to export data to a self-contained SQLite database.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/hashr/common"
+	"github.com/google/hashr/core/hashr"
+	"github.com/google/hashr/inspect"
+
+	// Blank import below is needed for the SQL driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// Name contains name of the exporter.
+	Name = "sqlite"
+	// schemaVersion is the version of the database schema, recorded in the metadata table.
+	schemaVersion = "1"
+)
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS samples (
+		sha256 VARCHAR(100) PRIMARY KEY,
+		mimetype TEXT,
+		file_output TEXT,
+		size INT
+	)`,
+	`CREATE TABLE IF NOT EXISTS payloads (
+		sha256 VARCHAR(100) PRIMARY KEY,
+		payload BLOB
+	)`,
+	`CREATE TABLE IF NOT EXISTS sources (
+		sha256 VARCHAR(100) PRIMARY KEY,
+		sourceID TEXT,
+		sourcePath TEXT,
+		sourceDescription TEXT,
+		repoName TEXT,
+		repoPath TEXT,
+		metadata TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS samples_sources (
+		sample_sha256 VARCHAR(100) NOT NULL REFERENCES samples(sha256),
+		source_sha256 VARCHAR(100) NOT NULL REFERENCES sources(sha256),
+		sample_paths TEXT,
+		PRIMARY KEY (sample_sha256, source_sha256)
+	)`,
+	// The primary key of samples_sources allows to look up sources of a given sample, the index
+	// below allows to look up samples of a given source.
+	`CREATE INDEX IF NOT EXISTS samples_sources_source_sha256_idx ON samples_sources (source_sha256)`,
+	`CREATE TABLE IF NOT EXISTS metadata (
+		key TEXT PRIMARY KEY,
+		value TEXT
+	)`,
+}
+
+// Exporter is an instance of SQLite Exporter.
+type Exporter struct {
+	sqlDB          *sql.DB
+	uploadPayloads bool
+}
+
+// Name returns exporter name.
+func (e *Exporter) Name() string {
+	return Name
+}
+
+// NewExporter creates new SQLite exporter and all the necessary tables, if they don't exist.
+func NewExporter(sqlDB *sql.DB, uploadPayloads bool) (*Exporter, error) {
+	// SQLite allows only a single writer, concurrent exports will wait for each other.
+	sqlDB.SetMaxOpenConns(1)
+
+	for _, stmt := range schema {
+		if _, err := sqlDB.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("error while creating database schema: %v", err)
+		}
+	}
+
+	if _, err := sqlDB.Exec(`INSERT INTO metadata (key, value) VALUES ('schema_version', $1) ON CONFLICT (key) DO UPDATE SET value = excluded.value`, schemaVersion); err != nil {
+		return nil, fmt.Errorf("error while initializing metadata: %v", err)
+	}
+
+	return &Exporter{sqlDB: sqlDB, uploadPayloads: uploadPayloads}, nil
+}
+
+// Export exports extracted data to SQLite database. Data of a given source is exported in a single
+// transaction, so the database never contains partially exported sources.
+func (e *Exporter) Export(ctx context.Context, sourceRepoName, sourceRepoPath, sourceID, sourceHash, sourcePath, sourceDescription string, samples []common.Sample) error {
+	tx, err := e.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertSource(ctx, tx, sourceHash, sourceID, sourcePath, sourceRepoName, sourceRepoPath, sourceDescription); err != nil {
+		return fmt.Errorf("could not insert source data: %v", err)
+	}
+
+	for _, sample := range samples {
+		if err := e.insertSample(ctx, tx, sample); err != nil {
+			return fmt.Errorf("could not insert sample %s: %v", sample.Sha256, err)
+		}
+
+		if err := insertRelationship(ctx, tx, sample, sourceHash); err != nil {
+			return fmt.Errorf("could not insert source <-> sample relationship of %s: %v", sample.Sha256, err)
+		}
+	}
+
+	if err := updateMetadata(ctx, tx); err != nil {
+		return fmt.Errorf("could not update metadata: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// ExportMetadata stores structured metadata of an exported source, e.g. package name, version and
+// file digests, as JSON in the metadata column of the sources table.
+func (e *Exporter) ExportMetadata(ctx context.Context, sourceHash string, metadata *common.SourceMetadata) error {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("could not marshal source metadata: %v", err)
+	}
+
+	_, err = e.sqlDB.ExecContext(ctx, `UPDATE sources SET metadata = $1 WHERE sha256 = $2`, string(metadataJSON), sourceHash)
+	return err
+}
+
+// insertSource inserts the source or appends the source ID to already existing one.
+func insertSource(ctx context.Context, tx *sql.Tx, sourceHash, sourceID, sourcePath, sourceRepoName, sourceRepoPath, sourceDescription string) error {
+	var sourceIDs []string
+	var existing string
+	err := tx.QueryRowContext(ctx, `SELECT sourceID FROM sources WHERE sha256 = $1`, sourceHash).Scan(&existing)
+	switch err {
+	case sql.ErrNoRows:
+	case nil:
+		if err := json.Unmarshal([]byte(existing), &sourceIDs); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	sourceIDsJSON, err := json.Marshal(common.AppendMissing(sourceIDs, sourceID))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO sources (sha256, sourceID, sourcePath, repoName, repoPath, sourceDescription)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (sha256) DO UPDATE SET sourceID = excluded.sourceID`, sourceHash, string(sourceIDsJSON), sourcePath, sourceRepoName, sourceRepoPath, sourceDescription)
+
+	return err
+}
+
+func (e *Exporter) insertSample(ctx context.Context, tx *sql.Tx, sample common.Sample) error {
+	// Samples that are not uploaded were already exported, they are only inserted if missing.
+	if !sample.Upload {
+		_, err := tx.ExecContext(ctx, `INSERT INTO samples (sha256, size) VALUES ($1, $2) ON CONFLICT (sha256) DO NOTHING`, sample.Sha256, sample.Size)
+		return err
+	}
+
+	var samplePath string
+	var fi os.FileInfo
+	var err error
+	// If sample has more than one path associated with it, take the first that is valid.
+	for _, path := range sample.Paths {
+		if fi, err = os.Stat(path); err == nil {
+			samplePath = path
+			break
+		}
+	}
+
+	if fi == nil {
+		return fmt.Errorf("could not open %v", sample.Paths)
+	}
+
+	fileType, err := inspect.IdentifyFile(samplePath)
+	if err != nil {
+		return fmt.Errorf("could not identify type of %v: %v", samplePath, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO samples (sha256, size, mimetype, file_output)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (sha256) DO UPDATE SET size = excluded.size, mimetype = excluded.mimetype, file_output = excluded.file_output`, sample.Sha256, fi.Size(), fileType.MIMEType, fileType.Description)
+	if err != nil {
+		return err
+	}
+
+	if e.uploadPayloads {
+		data, err := os.ReadFile(samplePath)
+		if err != nil {
+			return fmt.Errorf("error while opening file: %v", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO payloads (sha256, payload) VALUES ($1, $2) ON CONFLICT (sha256) DO NOTHING`, sample.Sha256, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertRelationship inserts the source <-> sample relationship or merges sample paths with
+// already existing one.
+func insertRelationship(ctx context.Context, tx *sql.Tx, sample common.Sample, sourceSha256 string) error {
+	paths := common.SamplePaths(sample)
+
+	var existingPaths []string
+	var existing string
+	err := tx.QueryRowContext(ctx, `SELECT sample_paths FROM samples_sources WHERE sample_sha256 = $1 AND source_sha256 = $2`, sample.Sha256, sourceSha256).Scan(&existing)
+	switch err {
+	case sql.ErrNoRows:
+	case nil:
+		if err := json.Unmarshal([]byte(existing), &existingPaths); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	pathsJSON, err := json.Marshal(common.AppendMissing(existingPaths, paths...))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO samples_sources (sample_sha256, source_sha256, sample_paths)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (sample_sha256, source_sha256) DO UPDATE SET sample_paths = excluded.sample_paths`, sample.Sha256, sourceSha256, string(pathsJSON))
+
+	return err
+}
+
+// Close records the list of exported sources in the metadata table. The list is written once, as
+// rewriting it after each export would take time proportional to the number of sources.
+func (e *Exporter) Close() error {
+	ctx := context.Background()
+	tx, err := e.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sourcesJSON, err := sourceList(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("could not list exported sources: %v", err)
+	}
+	if err := setMetadata(ctx, tx, "sources", sourcesJSON); err != nil {
+		return fmt.Errorf("could not update metadata: %v", err)
+	}
+	if err := updateMetadata(ctx, tx); err != nil {
+		return fmt.Errorf("could not update metadata: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// sourceInfo is an entry of the source list stored in the metadata table.
+type sourceInfo struct {
+	Sha256   string   `json:"sha256"`
+	IDs      []string `json:"ids"`
+	RepoName string   `json:"repo_name"`
+	RepoPath string   `json:"repo_path"`
+}
+
+// sourceList returns the JSON encoded list of sources stored in the sources table.
+func sourceList(ctx context.Context, tx *sql.Tx) (string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT sha256, sourceID, repoName, repoPath FROM sources ORDER BY sha256`)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	sources := []sourceInfo{}
+	for rows.Next() {
+		var s sourceInfo
+		var ids string
+		if err := rows.Scan(&s.Sha256, &ids, &s.RepoName, &s.RepoPath); err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal([]byte(ids), &s.IDs); err != nil {
+			return "", err
+		}
+		sources = append(sources, s)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	sourcesJSON, err := json.Marshal(sources)
+	if err != nil {
+		return "", err
+	}
+
+	return string(sourcesJSON), nil
+}
+
+// updateMetadata records the build time and hashR version.
+func updateMetadata(ctx context.Context, tx *sql.Tx) error {
+	for key, value := range map[string]string{
+		"build_time":    time.Now().UTC().Format(time.RFC3339),
+		"hashr_version": hashr.Version,
+	} {
+		if err := setMetadata(ctx, tx, key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setMetadata sets the value of a given key in the metadata table.
+func setMetadata(ctx context.Context, tx *sql.Tx, key, value string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO metadata (key, value) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
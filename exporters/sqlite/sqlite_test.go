@@ -0,0 +1,220 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/hashr/common"
+)
+
+func testExporter(t *testing.T, uploadPayloads bool) (*Exporter, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "hashr.db"))
+	if err != nil {
+		t.Fatalf("could not open SQLite database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	e, err := NewExporter(db, uploadPayloads)
+	if err != nil {
+		t.Fatalf("could not create SQLite exporter: %v", err)
+	}
+
+	return e, db
+}
+
+func TestNewExporter(t *testing.T) {
+	_, db := testExporter(t, false)
+
+	// Creating the exporter a second time should not fail on the existing schema.
+	if _, err := NewExporter(db, false); err != nil {
+		t.Fatalf("unexpected error while re-creating SQLite exporter: %v", err)
+	}
+
+	var version string
+	if err := db.QueryRow(`SELECT value FROM metadata WHERE key = 'schema_version'`).Scan(&version); err != nil {
+		t.Fatalf("could not read schema version: %v", err)
+	}
+	if version != schemaVersion {
+		t.Errorf("unexpected schema version %s, want %s", version, schemaVersion)
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	e, db := testExporter(t, true)
+
+	samples := []common.Sample{
+		{
+			Sha256:      "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.01")},
+			SourcePaths: []string{"bin/ls"},
+			Upload:      true,
+		},
+		{
+			Sha256:      "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb",
+			Paths:       []string{filepath.Join("testdata/extraction", "file.02")},
+			SourcePaths: []string{"bin/cat", "usr/bin/cat"},
+			Upload:      true,
+		},
+		{
+			// Samples that are not uploaded were already exported from another source.
+			Sha256:      "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7",
+			SourcePaths: []string{"bin/cp"},
+			Size:        5120,
+		},
+	}
+
+	if err := e.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	// Exporting the same source again should not duplicate the data.
+	if err := e.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts-v2", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err != nil {
+		t.Fatalf("unexpected error while running Export(): %v", err)
+	}
+
+	gotSizes := make(map[string]int64)
+	rows, err := db.Query(`SELECT sha256, size FROM samples`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sha256 string
+		var size int64
+		if err := rows.Scan(&sha256, &size); err != nil {
+			t.Fatal(err)
+		}
+		gotSizes[sha256] = size
+	}
+
+	wantSizes := map[string]int64{
+		"a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3": 8192,
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb": 7168,
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7": 5120,
+	}
+	if diff := cmp.Diff(wantSizes, gotSizes); diff != "" {
+		t.Errorf("Export() unexpected samples diff (-want/+got):\n%s", diff)
+	}
+
+	var paths string
+	if err := db.QueryRow(`SELECT sample_paths FROM samples_sources WHERE sample_sha256 = $1`, "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb").Scan(&paths); err != nil {
+		t.Fatal(err)
+	}
+	if want := `["bin/cat","usr/bin/cat"]`; paths != want {
+		t.Errorf("Export() stored sample paths %s, want %s", paths, want)
+	}
+
+	var payload []byte
+	if err := db.QueryRow(`SELECT payload FROM payloads WHERE sha256 = $1`, "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3").Scan(&payload); err != nil {
+		t.Fatal(err)
+	}
+	wantPayload, err := os.ReadFile("testdata/extraction/file.01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantPayload, payload); diff != "" {
+		t.Errorf("Export() unexpected payload diff (-want/+got):\n%s", diff)
+	}
+
+	var buildTime string
+	if err := db.QueryRow(`SELECT value FROM metadata WHERE key = 'build_time'`).Scan(&buildTime); err != nil {
+		t.Fatal(err)
+	}
+	if buildTime == "" {
+		t.Error("Export() did not record build time")
+	}
+
+	// Exported sources are listed in the metadata table when the exporter is closed.
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM metadata WHERE key = 'sources'`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Export() listed exported sources in the metadata table before Close()")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("unexpected error while running Close(): %v", err)
+	}
+	var sources string
+	if err := db.QueryRow(`SELECT value FROM metadata WHERE key = 'sources'`).Scan(&sources); err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"sha256":"07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc","ids":["ubuntu-1604-lts","ubuntu-1604-lts-v2"],"repo_name":"GCP","repo_path":"ubuntu"}]`; sources != want {
+		t.Errorf("Close() stored sources %s, want %s", sources, want)
+	}
+
+	var sourceIDs, repoName, repoPath string
+	if err := db.QueryRow(`SELECT sourceID, repoName, repoPath FROM sources WHERE sha256 = $1`, "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc").Scan(&sourceIDs, &repoName, &repoPath); err != nil {
+		t.Fatal(err)
+	}
+	if want := `["ubuntu-1604-lts","ubuntu-1604-lts-v2"]`; sourceIDs != want || repoName != "GCP" || repoPath != "ubuntu" {
+		t.Errorf("Export() source = (%s, %s, %s), want (%s, GCP, ubuntu)", sourceIDs, repoName, repoPath, want)
+	}
+}
+
+func TestExportRollback(t *testing.T) {
+	ctx := context.Background()
+	e, db := testExporter(t, false)
+
+	samples := []common.Sample{
+		{Sha256: "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", SourcePaths: []string{"bin/ls"}},
+		{Sha256: "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", Paths: []string{"testdata/extraction/missing"}, Upload: true},
+	}
+
+	if err := e.Export(ctx, "GCP", "ubuntu", "ubuntu-1604-lts", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", "", "Official Ubuntu GCP image.", samples); err == nil {
+		t.Fatal("expected error while exporting missing sample")
+	}
+
+	// Nothing from the failed export should be stored.
+	for _, table := range []string{"sources", "samples", "samples_sources"} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("%s table has %d rows after failed export, want 0", table, count)
+		}
+	}
+}
+
+func TestExportMetadata(t *testing.T) {
+	e, db := testExporter(t, false)
+	ctx := context.Background()
+	sourceHash := "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+
+	if err := e.Export(ctx, "deb", "testdata", "hello.deb", sourceHash, "", "Package: hello 2.10-2 (amd64)", nil); err != nil {
+		t.Fatalf("unexpected error while running Export() = %v", err)
+	}
+	if err := e.ExportMetadata(ctx, sourceHash, &common.SourceMetadata{Name: "hello", Version: "2.10-2", Architecture: "amd64"}); err != nil {
+		t.Fatalf("unexpected error while running ExportMetadata() = %v", err)
+	}
+
+	var version string
+	if err := db.QueryRow(`SELECT json_extract(metadata, '$.version') FROM sources WHERE sha256 = $1`, sourceHash).Scan(&version); err != nil {
+		t.Fatalf("could not read source metadata: %v", err)
+	}
+	if version != "2.10-2" {
+		t.Errorf("ExportMetadata() stored version %s, want 2.10-2", version)
+	}
+}
@@ -16,31 +16,46 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
 	"strings"
 
 	"cloud.google.com/go/spanner"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/golang/glog"
 	"github.com/google/hashr/core/hashr"
+	elasticsearchExporter "github.com/google/hashr/exporters/elasticsearch"
+	flatfileExporter "github.com/google/hashr/exporters/flatfile"
 	gcpExporter "github.com/google/hashr/exporters/gcp"
+	hashlookupExporter "github.com/google/hashr/exporters/hashlookup"
+	nsrlExporter "github.com/google/hashr/exporters/nsrl"
 	postgresExporter "github.com/google/hashr/exporters/postgres"
+	sqliteExporter "github.com/google/hashr/exporters/sqlite"
+	"github.com/google/hashr/importers/apk"
+	importerCommon "github.com/google/hashr/importers/common"
 	"github.com/google/hashr/importers/deb"
 	"github.com/google/hashr/importers/gcp"
 	"github.com/google/hashr/importers/gcr"
 	"github.com/google/hashr/importers/iso9660"
+	"github.com/google/hashr/importers/pacman"
 	"github.com/google/hashr/importers/rpm"
 	"github.com/google/hashr/importers/targz"
 	"github.com/google/hashr/importers/windows"
 	"github.com/google/hashr/importers/wsus"
 	"github.com/google/hashr/importers/zip"
+	"github.com/google/hashr/payloads"
 	"github.com/google/hashr/processors/local"
 	"github.com/google/hashr/storage/cloudspanner"
 	"github.com/google/hashr/storage/postgres"
+	"github.com/google/hashr/storage/sqlite"
 	"golang.org/x/oauth2/google"
 
 	"google.golang.org/api/cloudbuild/v1"
@@ -52,17 +67,26 @@ import (
 
 var (
 	processingWorkerCount  = flag.Int("processing_worker_count", 2, "Number of processing workers.")
-	importersToRun         = flag.String("importers", strings.Join([]string{}, ","), fmt.Sprintf("Importers to be run: %s,%s,%s,%s,%s,%s,%s,%s,%s", gcp.RepoName, targz.RepoName, windows.RepoName, wsus.RepoName, deb.RepoName, rpm.RepoName, zip.RepoName, gcr.RepoName, iso9660.RepoName))
-	exportersToRun         = flag.String("exporters", strings.Join([]string{}, ","), fmt.Sprintf("Exporters to be run: %s,%s", gcpExporter.Name, postgresExporter.Name))
-	jobStorage             = flag.String("storage", "", "Storage that should be used for storing data about processing jobs, can have one of the two values: postgres, cloudspanner")
+	importersToRun         = flag.String("importers", strings.Join([]string{}, ","), fmt.Sprintf("Importers to be run: %s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s", gcp.RepoName, targz.RepoName, windows.RepoName, wsus.RepoName, deb.RepoName, deb.AptRepoName, rpm.RepoName, rpm.YumRepoName, apk.RepoName, pacman.RepoName, zip.RepoName, gcr.RepoName, iso9660.RepoName))
+	exportersToRun         = flag.String("exporters", strings.Join([]string{}, ","), fmt.Sprintf("Exporters to be run: %s,%s,%s,%s,%s,%s,%s", gcpExporter.Name, postgresExporter.Name, sqliteExporter.Name, nsrlExporter.Name, flatfileExporter.Name, hashlookupExporter.Name, elasticsearchExporter.Name))
+	jobStorage             = flag.String("storage", "", "Storage that should be used for storing data about processing jobs, can have one of the three values: postgres, cloudspanner, sqlite")
 	cacheDir               = flag.String("cache_dir", "/tmp/", "Path to cache dir used to store local cache.")
 	export                 = flag.Bool("export", true, "Whether to export samples, otherwise, they'll be saved to disk")
 	exportPath             = flag.String("export_path", "/tmp/hashr-uploads", "If export is set to false, this is the folder where samples will be saved.")
+	exportCompress         = flag.Bool("export_compress", false, "If export is set to false, whether samples saved to export_path are compressed with zstd.")
+	authenticodeRoots      = flag.String("authenticode_roots", "", "Path to a PEM file with root certificates trusted for Authenticode signatures of PE files, system roots are used if not set.")
+	unverifiedSources      = flag.String("unverified_sources", "flag", "How to handle deb, apt, rpm, yum, targz and gcr sources with missing or unverified signatures: flag (process them and record the signature status) or skip.")
 	reprocess              = flag.String("reprocess", "", "Sha256 of sources that should be reprocessed")
 	spannerDBPath          = flag.String("spanner_db_path", "", "Path to spanner DB.")
 	uploadPayloads         = flag.Bool("upload_payloads", false, "If true the content of the files will be uploaded using defined exporters.")
 	gcpExporterWorkerCount = flag.Int("gcp_exporter_worker_count", 100, "Number of workers/goroutines that will be used to upload data to Cloud Spanner.")
-	gcpExporterGCSbucket   = flag.String("gcp_exporter_gcs_bucket", "", "Name of the GCS bucket which will be used by GCP exporter to store exported samples.")
+	gcpExporterGCSbucket   = flag.String("gcp_exporter_gcs_bucket", "", "Name of the GCS bucket which will be used by GCP exporter to store exported samples, if payload_store is not set.")
+	payloadStore           = flag.String("payload_store", "", "Store used by Postgres and GCP exporters for uploaded payloads: gcs, s3, local. If not set, GCP exporter uses gcp_exporter_gcs_bucket and Postgres exporter stores payloads in the database.")
+
+	// Payload store flags
+	payloadStoreBucket     = flag.String("payload_store_bucket", "", "Name of the GCS or S3 bucket used by the payload store.")
+	payloadStoreS3Endpoint = flag.String("payload_store_s3_endpoint", "", "Endpoint of an S3 compatible service (e.g. http://localhost:9000 for MinIO), AWS S3 is used if not set.")
+	payloadStoreLocalPath  = flag.String("payload_store_local_path", "/tmp/hashr-payloads", "Path to the directory used by the local payload store.")
 
 	// Postgres DB flags
 	postgresHost     = flag.String("postgres_host", "localhost", "PostgreSQL instance address.")
@@ -70,6 +94,27 @@ var (
 	postgresUser     = flag.String("postgres_user", "hashr", "PostgresSQL user.")
 	postgresPassword = flag.String("postgres_password", "hashr", "PostgresSQL password.")
 	postgresDBName   = flag.String("postgres_db", "hashr", "PostgresSQL database.")
+	// SQLite flags
+	sqliteDBPath = flag.String("sqlite_db_path", "/tmp/hashr.db", "Path to SQLite database file.")
+	// SQLite exporter flags
+	sqliteExporterDBPath = flag.String("sqlite_exporter_db_path", "/tmp/hashr-export.db", "Path to SQLite database file that will be created by SQLite exporter.")
+	// NSRL exporter flags
+	nsrlExporterDBPath = flag.String("nsrl_exporter_db_path", "/tmp/hashr-rds.db", "Path to NSRL RDSv3 SQLite database file that will be created by NSRL exporter.")
+	// Flat-file exporter flags
+	flatfileExporterDir         = flag.String("flatfile_exporter_dir", "/tmp/hashr-export", "Path to the directory where flat-file exporter will write its files.")
+	flatfileExporterFormat      = flag.String("flatfile_exporter_format", flatfileExporter.FormatJSONL, "Format of the files written by flat-file exporter: jsonl, csv, parquet")
+	flatfileExporterCompression = flag.String("flatfile_exporter_compression", flatfileExporter.CompressionNone, "Compression of the files written by flat-file exporter: none, gzip, zstd (jsonl and csv only), snappy (parquet only)")
+	flatfileExporterMaxFileSize = flag.Int64("flatfile_exporter_max_file_size", 1<<30, "Size in bytes after which flat-file exporter starts a new file, 0 disables rotation.")
+	// hashlookup exporter flags
+	hashlookupExporterDBPath            = flag.String("hashlookup_exporter_db_path", "/tmp/hashr-hashlookup.db", "Path to SQLite database file used by hashlookup exporter to keep hashes and parents of exported files.")
+	hashlookupExporterDir               = flag.String("hashlookup_exporter_dir", "/tmp/hashr-hashlookup", "Path to the directory where hashlookup exporter will write records and Bloom filters.")
+	hashlookupExporterFalsePositiveRate = flag.Float64("hashlookup_exporter_false_positive_rate", 0.001, "False positive rate of the Bloom filters written by hashlookup exporter.")
+	// Elasticsearch exporter flags
+	elasticsearchExporterURL          = flag.String("elasticsearch_exporter_url", "http://localhost:9200", "Elasticsearch or OpenSearch URL, credentials can be passed as a part of the URL.")
+	elasticsearchExporterSamplesIndex = flag.String("elasticsearch_exporter_samples_index", "hashr-samples", "Name of the index that will hold samples.")
+	elasticsearchExporterSourcesIndex = flag.String("elasticsearch_exporter_sources_index", "hashr-sources", "Name of the index that will hold sources.")
+	elasticsearchExporterBulkSize     = flag.Int("elasticsearch_exporter_bulk_size", 500, "Maximum number of actions in a single bulk request.")
+	elasticsearchExporterMaxRetries   = flag.Int("elasticsearch_exporter_max_retries", 3, "Number of times failed bulk requests and actions are retried.")
 	// WSUS importer flags
 	wsusGCSbucket = flag.String("wsus_repo_gcs_bucket", "", "Name of the GCS bucket containing WSUS packages")
 	// GCP importer flags
@@ -80,15 +125,33 @@ var (
 	windowsRepoPath = flag.String("windows_iso_repo_path", "", "Path to Windows ISO repository.")
 	// tarGz importer flags
 	tarGzRepoPath = flag.String("targz_repo_path", "", "Path to TarGz repository.")
+	tarGzKeyring  = flag.String("targz_keyring", "", "Comma separated list of OpenPGP keyring files used to verify signatures of .tar.gz files stored in .tar.gz.sig files, verification is disabled if not set.")
 	// deb importer flags
 	debRepoPath = flag.String("deb_repo_path", "", "Path to Deb repository.")
+	debKeyring  = flag.String("deb_keyring", "", "Comma separated list of OpenPGP keyring files used to verify debsig signatures of .deb files and signatures of InRelease and Release files, verification is disabled if not set.")
+	// apt importer flags
+	aptRepoPath      = flag.String("apt_repo_path", "", "Path or file://, http:// or https:// URL of APT repository mirror, the directory holding dists/ and pool/, e.g. http://deb.debian.org/debian.")
+	aptSuites        = flag.String("apt_suites", "", "Comma separated list of APT repository suites, e.g. bookworm,bookworm-updates.")
+	aptComponents    = flag.String("apt_components", "", "Comma separated list of APT repository components, all components listed in the release are used if not set.")
+	aptArchitectures = flag.String("apt_architectures", "", "Comma separated list of APT repository architectures, all architectures listed in the release are used if not set.")
+	aptKeyring       = flag.String("apt_keyring", "", "Comma separated list of OpenPGP keyring files used to verify signatures of InRelease and Release files of APT repository, verification is disabled if not set.")
 	// rpm importer flags
 	rpmRepoPath = flag.String("rpm_repo_path", "", "Path to RPM repository.")
+	rpmKeyring  = flag.String("rpm_keyring", "", "Comma separated list of OpenPGP keyring files used to verify header signatures of .rpm files, verification is disabled if not set.")
+	// yum importer flags
+	yumRepoPath = flag.String("yum_repo_path", "", "Path or file://, http:// or https:// URL of YUM/DNF repository mirror, the directory holding repodata/.")
+	yumKeyring  = flag.String("yum_keyring", "", "Comma separated list of OpenPGP keyring files used to verify header signatures of .rpm files downloaded from YUM/DNF repository, verification is disabled if not set.")
+	// apk importer flags
+	apkRepoPath = flag.String("apk_repo_path", "", "Path to apk repository or path or file://, http:// or https:// URL of apk repository mirror, the directory holding APKINDEX.tar.gz.")
+
+	// pacman importer flags
+	pacmanRepoPath = flag.String("pacman_repo_path", "", "Path to pacman repository or repository mirror holding .pkg.tar.zst and .pkg.tar.xz packages and <repo>.db databases.")
 	// zip importer flags
 	zipRepoPath       = flag.String("zip_repo_path", "", "Path to Zip repository.")
 	zipFileExtensions = flag.String("zip_file_exts", "zip", "Comma-separated list of files to treat as Zip files")
 	// GCR importer flags
-	gcrRepos = flag.String("gcr_repos", "", "Comma separated list of GCR (Google Container Registry) repos.")
+	gcrRepos      = flag.String("gcr_repos", "", "Comma separated list of GCR (Google Container Registry) repos.")
+	gcrCosignKeys = flag.String("gcr_cosign_keys", "", "Comma separated list of PEM encoded public keys used to verify cosign signatures of images, verification is disabled if not set.")
 	// iso importer flags
 	isoRepoPath = flag.String("iso_repo_path", "", "Path to ISO9660 repository.")
 
@@ -102,11 +165,31 @@ var (
 func main() {
 	ctx := context.Background()
 	flag.Parse()
-	var importers []hashr.Importer
 
-	if !(*jobStorage == "postgres" || *jobStorage == "cloudspanner") {
-		glog.Exit("storage flag needs to have one of the two values: postgres, cloudspanner")
+	// Commands only need job storage (e.g. jobs) or none at all (e.g. samples gc), importers and
+	// exporters are not initialized.
+	if flag.NArg() > 0 {
+		if err := runCommand(ctx, flag.Args(), os.Stdout); err != nil {
+			glog.Exit(err)
+		}
+		return
+	}
+
+	if err := run(ctx); err != nil {
+		glog.Exit(err)
 	}
+}
+
+// run initializes importers, exporters and job storage and processes the sources. Errors are
+// returned rather than handled with glog.Exit, so deferred calls finalizing exporters (e.g. Bloom
+// filters or Parquet files) and closing databases run on every exit path.
+func run(ctx context.Context) error {
+	// Job storage is initialized after importers and exporters, but the flag is checked upfront.
+	if !(*jobStorage == "postgres" || *jobStorage == "cloudspanner" || *jobStorage == "sqlite") {
+		return errors.New("storage flag needs to have one of the three values: postgres, cloudspanner, sqlite")
+	}
+
+	var importers []hashr.Importer
 
 	// Initialize importers.
 	for _, importerName := range strings.Split(*importersToRun, ",") {
@@ -114,67 +197,102 @@ func main() {
 		case windows.RepoName:
 			r, err := windows.NewRepo(ctx, *windowsRepoPath)
 			if err != nil {
-				glog.Exitf("Could not initialize Windows ISO repository: %v", err)
+				return fmt.Errorf("could not initialize Windows ISO repository: %v", err)
 			}
 			importers = append(importers, r)
 		case wsus.RepoName:
 			s, err := storage.NewService(ctx)
 			if err != nil {
-				glog.Exitf("Could not initialize GCP Storage client: %v", err)
+				return fmt.Errorf("could not initialize GCP Storage client: %v", err)
 			}
 			r, err := wsus.NewRepo(ctx, s, *wsusGCSbucket)
 			if err != nil {
-				glog.Exitf("Could not initialize WSUS importer: %v", err)
+				return fmt.Errorf("could not initialize WSUS importer: %v", err)
 			}
 			importers = append(importers, r)
 		case gcp.RepoName:
 			computeClient, err := compute.NewService(ctx)
 			if err != nil {
-				glog.Exitf("Could not initialize GCP Compute client: %v", err)
+				return fmt.Errorf("could not initialize GCP Compute client: %v", err)
 			}
 
 			storageClient, err := storage.NewService(ctx)
 			if err != nil {
-				glog.Exitf("Could not initialize GCP Storage client: %v", err)
+				return fmt.Errorf("could not initialize GCP Storage client: %v", err)
 			}
 
 			cloudBuildClient, err := cloudbuild.NewService(ctx)
 			if err != nil {
-				glog.Exitf("Could not initialize GCP Cloud Build client: %v", err)
+				return fmt.Errorf("could not initialize GCP Cloud Build client: %v", err)
 			}
 			for _, gcpProject := range strings.Split(*gcpProjects, ",") {
 				r, err := gcp.NewRepo(ctx, computeClient, storageClient, cloudBuildClient, gcpProject, *hashrGCPProject, *hashrGCSBucket)
 				if err != nil {
-					glog.Exit(err)
+					return err
 				}
 				importers = append(importers, r)
 			}
 		case targz.RepoName:
-			importers = append(importers, targz.NewRepo(*tarGzRepoPath))
+			keyring, err := loadKeyring(*tarGzKeyring)
+			if err != nil {
+				return err
+			}
+			importers = append(importers, targz.NewRepo(*tarGzRepoPath, keyring))
 		case iso9660.RepoName:
 			importers = append(importers, iso9660.NewRepo(*isoRepoPath))
 		case deb.RepoName:
-			importers = append(importers, deb.NewRepo(*debRepoPath))
+			keyring, err := loadKeyring(*debKeyring)
+			if err != nil {
+				return err
+			}
+			importers = append(importers, deb.NewRepo(*debRepoPath, keyring))
+		case deb.AptRepoName:
+			keyring, err := loadKeyring(*aptKeyring)
+			if err != nil {
+				return err
+			}
+			importers = append(importers, deb.NewAptRepo(*aptRepoPath, splitList(*aptSuites), splitList(*aptComponents), splitList(*aptArchitectures), keyring))
 		case rpm.RepoName:
-			importers = append(importers, rpm.NewRepo(*rpmRepoPath))
+			keyring, err := loadKeyring(*rpmKeyring)
+			if err != nil {
+				return err
+			}
+			importers = append(importers, rpm.NewRepo(*rpmRepoPath, keyring))
+		case rpm.YumRepoName:
+			keyring, err := loadKeyring(*yumKeyring)
+			if err != nil {
+				return err
+			}
+			importers = append(importers, rpm.NewYumRepo(*yumRepoPath, keyring))
+		case apk.RepoName:
+			importers = append(importers, apk.NewRepo(*apkRepoPath))
+		case pacman.RepoName:
+			importers = append(importers, pacman.NewRepo(*pacmanRepoPath))
 		case zip.RepoName:
 			importers = append(importers, zip.NewRepo(*zipRepoPath, *zipFileExtensions))
 		case gcr.RepoName:
 			tokenSource, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
 			if err != nil {
-				glog.Exit(err)
+				return err
+			}
+			var keys []*gcr.PublicKey
+			if *gcrCosignKeys != "" {
+				keys, err = gcr.LoadPublicKeys(strings.Split(*gcrCosignKeys, ",")...)
+				if err != nil {
+					return fmt.Errorf("error loading cosign public keys: %v", err)
+				}
 			}
 			for _, gcrRepo := range strings.Split(*gcrRepos, ",") {
-				r, err := gcr.NewRepo(ctx, tokenSource, gcrRepo)
+				r, err := gcr.NewRepo(ctx, tokenSource, gcrRepo, keys)
 				if err != nil {
-					glog.Exit(err)
+					return err
 				}
 				importers = append(importers, r)
 			}
 		case awsImporter.RepoName, strings.ToLower(awsImporter.RepoName):
 			awsConfig, err := config.LoadDefaultConfig(context.TODO())
 			if err != nil {
-				glog.Exit(err)
+				return err
 			}
 
 			ec2Client := ec2.NewFromConfig(awsConfig)
@@ -184,7 +302,7 @@ func main() {
 			for _, osfilter := range strings.Split(*awsOsFilter, ",") {
 				r, err := awsImporter.NewRepo(ctx, ec2Client, s3Client, *awsBucket, *awsSSHUser, osfilter, osarchs)
 				if err != nil {
-					glog.Exit(err)
+					return err
 				}
 				importers = append(importers, r)
 			}
@@ -201,40 +319,216 @@ func main() {
 
 			db, err := sql.Open("postgres", psqlInfo)
 			if err != nil {
-				glog.Exitf("Error initializing Postgres client: %v", err)
+				return fmt.Errorf("error initializing Postgres client: %v", err)
 			}
 			defer db.Close()
 
-			postgresExporter, err := postgresExporter.NewExporter(db, *uploadPayloads)
+			store, err := newPayloadStore(ctx)
 			if err != nil {
-				glog.Exitf("Error initializing Postgres exporter: %v", err)
+				return fmt.Errorf("error initializing payload store: %v", err)
+			}
+
+			postgresExporter, err := postgresExporter.NewExporter(db, *uploadPayloads, store)
+			if err != nil {
+				return fmt.Errorf("error initializing Postgres exporter: %v", err)
 			}
 			exporters = append(exporters, postgresExporter)
 		case gcpExporter.Name:
 			spannerClient, err := spanner.NewClient(ctx, *spannerDBPath)
 			if err != nil {
-				glog.Exitf("Error initializing Spanner client: %v", err)
+				return fmt.Errorf("error initializing Spanner client: %v", err)
 			}
 
-			storageClient, err := storage.NewService(ctx)
+			store, err := newPayloadStore(ctx)
 			if err != nil {
-				glog.Exitf("Could not initialize GCP Storage client: %v", err)
+				return fmt.Errorf("error initializing payload store: %v", err)
+			}
+			if store == nil && *uploadPayloads {
+				storageClient, err := storage.NewService(ctx)
+				if err != nil {
+					return fmt.Errorf("could not initialize GCP Storage client: %v", err)
+				}
+
+				store, err = payloads.NewGCSStore(storageClient, *gcpExporterGCSbucket)
+				if err != nil {
+					return fmt.Errorf("error initializing payload store: %v", err)
+				}
 			}
 
-			gceExporter, err := gcpExporter.NewExporter(spannerClient, storageClient, *gcpExporterGCSbucket, *uploadPayloads, *gcpExporterWorkerCount)
+			gceExporter, err := gcpExporter.NewExporter(spannerClient, store, *uploadPayloads, *gcpExporterWorkerCount)
 			if err != nil {
-				glog.Exitf("Error initializing Postgres exporter: %v", err)
+				return fmt.Errorf("error initializing Postgres exporter: %v", err)
 			}
 			exporters = append(exporters, gceExporter)
+		case sqliteExporter.Name:
+			db, err := sql.Open("sqlite3", *sqliteExporterDBPath)
+			if err != nil {
+				return fmt.Errorf("error initializing SQLite client: %v", err)
+			}
+			defer db.Close()
+
+			sqliteExporter, err := sqliteExporter.NewExporter(db, *uploadPayloads)
+			if err != nil {
+				return fmt.Errorf("error initializing SQLite exporter: %v", err)
+			}
+			defer func() {
+				if err := sqliteExporter.Close(); err != nil {
+					glog.Errorf("Error writing SQLite exporter metadata: %v", err)
+				}
+			}()
+			exporters = append(exporters, sqliteExporter)
+		case nsrlExporter.Name:
+			db, err := sql.Open("sqlite3", *nsrlExporterDBPath)
+			if err != nil {
+				return fmt.Errorf("error initializing SQLite client: %v", err)
+			}
+			defer db.Close()
+
+			nsrlExporter, err := nsrlExporter.NewExporter(db)
+			if err != nil {
+				return fmt.Errorf("error initializing NSRL exporter: %v", err)
+			}
+			exporters = append(exporters, nsrlExporter)
+		case flatfileExporter.Name:
+			flatfileExporter, err := flatfileExporter.NewExporter(*flatfileExporterDir, *flatfileExporterFormat, *flatfileExporterCompression, *flatfileExporterMaxFileSize)
+			if err != nil {
+				return fmt.Errorf("error initializing flat-file exporter: %v", err)
+			}
+			defer func() {
+				if err := flatfileExporter.Close(); err != nil {
+					glog.Errorf("Error closing flat-file exporter: %v", err)
+				}
+			}()
+			exporters = append(exporters, flatfileExporter)
+		case hashlookupExporter.Name:
+			db, err := sql.Open("sqlite3", *hashlookupExporterDBPath)
+			if err != nil {
+				return fmt.Errorf("error initializing SQLite client: %v", err)
+			}
+			defer db.Close()
+
+			hashlookupExporter, err := hashlookupExporter.NewExporter(db, *hashlookupExporterDir, *hashlookupExporterFalsePositiveRate)
+			if err != nil {
+				return fmt.Errorf("error initializing hashlookup exporter: %v", err)
+			}
+			defer func() {
+				if err := hashlookupExporter.Close(); err != nil {
+					glog.Errorf("Error writing hashlookup files: %v", err)
+				}
+			}()
+			exporters = append(exporters, hashlookupExporter)
+		case elasticsearchExporter.Name:
+			elasticsearchExporter, err := elasticsearchExporter.NewExporter(ctx, http.DefaultClient, *elasticsearchExporterURL, *elasticsearchExporterSamplesIndex, *elasticsearchExporterSourcesIndex, *elasticsearchExporterBulkSize, *elasticsearchExporterMaxRetries)
+			if err != nil {
+				return fmt.Errorf("error initializing Elasticsearch exporter: %v", err)
+			}
+			exporters = append(exporters, elasticsearchExporter)
 		}
 	}
 
 	if len(exporters) == 0 && *export {
-		glog.Exit("You need to specify at least one exporter.")
+		return errors.New("you need to specify at least one exporter")
 	}
 
 	// Initialize job storage.
-	var s hashr.Storage
+	s, closeStorage, err := newStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	hdb := hashr.New(importers, local.New(), exporters, s)
+
+	hdb.ProcessingWorkerCount = *processingWorkerCount
+	hdb.CacheDir = *cacheDir
+	hdb.Export = *export
+	hdb.ExportPath = *exportPath
+	hdb.CompressSamples = *exportCompress
+	if *authenticodeRoots != "" {
+		hdb.AuthenticodeRoots, err = loadCertPool(*authenticodeRoots)
+		if err != nil {
+			return fmt.Errorf("error loading Authenticode roots: %v", err)
+		}
+	}
+	switch *unverifiedSources {
+	case "flag":
+	case "skip":
+		hdb.SkipUnverifiedSources = true
+	default:
+		return fmt.Errorf("unknown unverified_sources value: %s", *unverifiedSources)
+	}
+	hdb.SourcesForReprocessing = strings.Split(*reprocess, ",")
+
+	return hdb.Run(ctx)
+}
+
+// loadCertPool loads certificates from a given PEM file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// loadKeyring loads OpenPGP keys from given comma separated keyring files, nil is returned if no
+// files are given.
+func loadKeyring(paths string) (openpgp.EntityList, error) {
+	if paths == "" {
+		return nil, nil
+	}
+
+	keyring, err := importerCommon.LoadKeyring(strings.Split(paths, ",")...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading OpenPGP keyring: %v", err)
+	}
+
+	return keyring, nil
+}
+
+// splitList splits a comma separated flag value, nil is returned for empty values.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+// newPayloadStore initializes payload store selected with the payload_store flag, nil is returned
+// if the flag is not set.
+func newPayloadStore(ctx context.Context) (payloads.Store, error) {
+	switch *payloadStore {
+	case "":
+		return nil, nil
+	case payloads.GCSStoreName:
+		storageClient, err := storage.NewService(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize GCP Storage client: %v", err)
+		}
+		return payloads.NewGCSStore(storageClient, *payloadStoreBucket)
+	case payloads.S3StoreName:
+		awsConfig, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return payloads.NewS3Store(payloads.NewS3Client(awsConfig, *payloadStoreS3Endpoint), *payloadStoreBucket)
+	case payloads.LocalStoreName:
+		return payloads.NewLocalStore(*payloadStoreLocalPath)
+	}
+
+	return nil, fmt.Errorf("payload_store flag needs to have one of the three values: %s, %s, %s", payloads.GCSStoreName, payloads.S3StoreName, payloads.LocalStoreName)
+}
+
+// newStorage initializes job storage selected with the storage flag. Returned function closes
+// the underlying database client.
+func newStorage(ctx context.Context) (hashr.Storage, func(), error) {
 	switch *jobStorage {
 	case "postgres":
 		psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
@@ -242,37 +536,40 @@ func main() {
 
 		db, err := sql.Open("postgres", psqlInfo)
 		if err != nil {
-			glog.Exitf("Error initializing Postgres client: %v", err)
+			return nil, nil, fmt.Errorf("error initializing Postgres client: %v", err)
 		}
-		defer db.Close()
 
-		s, err = postgres.NewStorage(db)
+		s, err := postgres.NewStorage(db)
 		if err != nil {
-			glog.Exitf("Error initializing Postgres storage: %v", err)
+			db.Close()
+			return nil, nil, fmt.Errorf("error initializing Postgres storage: %v", err)
 		}
+		return s, func() { db.Close() }, nil
 	case "cloudspanner":
 		spannerClient, err := spanner.NewClient(ctx, *spannerDBPath)
 		if err != nil {
-			glog.Exitf("Error initializing Spanner client: %v", err)
+			return nil, nil, fmt.Errorf("error initializing Spanner client: %v", err)
 		}
 
-		s, err = cloudspanner.NewStorage(ctx, spannerClient)
+		s, err := cloudspanner.NewStorage(ctx, spannerClient)
 		if err != nil {
-			glog.Exitf("Error initializing Postgres storage: %v", err)
+			spannerClient.Close()
+			return nil, nil, fmt.Errorf("error initializing Cloud Spanner storage: %v", err)
+		}
+		return s, spannerClient.Close, nil
+	case "sqlite":
+		db, err := sql.Open("sqlite3", *sqliteDBPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error initializing SQLite client: %v", err)
 		}
-	default:
-		glog.Exit("storage flag needs to have one of the two values: postgres, cloudspanner")
-	}
-
-	hdb := hashr.New(importers, local.New(), exporters, s)
-
-	hdb.ProcessingWorkerCount = *processingWorkerCount
-	hdb.CacheDir = *cacheDir
-	hdb.Export = *export
-	hdb.ExportPath = *exportPath
-	hdb.SourcesForReprocessing = strings.Split(*reprocess, ",")
 
-	if err := hdb.Run(ctx); err != nil {
-		glog.Exit(err)
+		s, err := sqlite.NewStorage(db)
+		if err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("error initializing SQLite storage: %v", err)
+		}
+		return s, func() { db.Close() }, nil
+	default:
+		return nil, nil, errors.New("storage flag needs to have one of the three values: postgres, cloudspanner, sqlite")
 	}
 }
@@ -0,0 +1,460 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apk implements Alpine apk package importer.
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+
+	hashrCommon "github.com/google/hashr/common"
+	"github.com/google/hashr/core/hashr"
+	"github.com/google/hashr/importers/common"
+)
+
+const (
+	// RepoName contains the repository name.
+	RepoName  = "apk"
+	chunkSize = 1024 * 1024 * 10 // 10MB
+	// indexName is the name of the index of apk repositories.
+	indexName = "APKINDEX.tar.gz"
+	// checksumRecord is the PAX record holding SHA1 digests of files in the data segment.
+	checksumRecord = "APK-TOOLS.checksum.SHA1"
+)
+
+// Archive holds data related to apk archive.
+type Archive struct {
+	filename        string
+	remotePath      string
+	localPath       string
+	quickSha256hash string
+	repoPath        string
+	// indexChecksum is the checksum of the control segment listed in APKINDEX, the copied archive
+	// must match it.
+	indexChecksum string
+	metadata      *hashrCommon.SourceMetadata
+	extractionDir string
+}
+
+// hashingReader passes data read from the underlying reader to a hash. It implements
+// io.ByteReader, so gzip reader doesn't read past the end of a gzip stream.
+type hashingReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+func (r *hashingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+// extractAPK extracts the data segment of a given .apk file and returns package metadata read from
+// .PKGINFO together with the SHA1 digest of the control segment. The .apk file is a concatenation
+// of gzip streams: optional signature segment, control segment with .PKGINFO and data segment.
+func extractAPK(apkPath, outputFolder string) (*hashrCommon.SourceMetadata, []byte, error) {
+	if _, err := os.Stat(outputFolder); os.IsNotExist(err) {
+		if err2 := os.MkdirAll(outputFolder, 0755); err2 != nil {
+			return nil, nil, fmt.Errorf("error while creating target directory: %v", err2)
+		}
+	}
+
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open apk file: %v", err)
+	}
+	defer f.Close()
+
+	r := &hashingReader{r: bufio.NewReader(f)}
+	dataHash := sha256.New()
+	var pkgInfo common.PkgInfo
+	var controlSum []byte
+	var files []hashrCommon.FileDigest
+	for {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			break
+		}
+
+		// Segments preceding the data segment are hashed separately.
+		segmentHash := sha1.New()
+		r.h = segmentHash
+		if pkgInfo != nil {
+			r.h = dataHash
+		}
+
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read apk segment: %v", err)
+		}
+		gz.Multistream(false)
+		tr := tar.NewReader(gz)
+
+		if pkgInfo != nil {
+			err = common.ExtractTar(tr, outputFolder, func(header *tar.Header) bool {
+				if digest := header.PAXRecords[checksumRecord]; header.Typeflag == tar.TypeReg && digest != "" {
+					files = append(files, hashrCommon.FileDigest{Path: path.Join("/", header.Name), Algorithm: "sha1", Digest: strings.ToLower(digest)})
+				}
+				return true
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("error while unpacking apk data segment: %v", err)
+			}
+		} else {
+			if pkgInfo, err = readControlSegment(tr); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		// Tar archives of the signature and control segments are not terminated, the rest of the
+		// stream has to be read to reach the next one.
+		if _, err := io.Copy(io.Discard, gz); err != nil {
+			return nil, nil, fmt.Errorf("failed to read apk segment: %v", err)
+		}
+		if pkgInfo != nil && controlSum == nil {
+			controlSum = segmentHash.Sum(nil)
+		}
+	}
+	if pkgInfo == nil {
+		return nil, nil, errors.New(".PKGINFO not found")
+	}
+
+	// datahash holds SHA256 digest of the data segment.
+	if want := pkgInfo.Get("datahash"); want != "" {
+		if got := fmt.Sprintf("%x", dataHash.Sum(nil)); got != want {
+			return nil, nil, fmt.Errorf("SHA256 digest %s of data segment does not match %s listed in .PKGINFO", got, want)
+		}
+	}
+
+	metadata := &hashrCommon.SourceMetadata{
+		Name:          pkgInfo.Get("pkgname"),
+		Version:       pkgInfo.Get("pkgver"),
+		Architecture:  pkgInfo.Get("arch"),
+		Maintainer:    pkgInfo.Get("maintainer"),
+		SourcePackage: pkgInfo.Get("origin"),
+		License:       pkgInfo.Get("license"),
+		Files:         files,
+	}
+
+	return metadata, controlSum, nil
+}
+
+// readControlSegment returns fields of .PKGINFO, if it's present in a given segment. Signature
+// segment holds only .SIGN.* files and nil is returned for it.
+func readControlSegment(tr *tar.Reader) (common.PkgInfo, error) {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read apk control segment: %v", err)
+		}
+		if path.Clean(header.Name) == ".PKGINFO" {
+			return common.ParsePkgInfo(tr)
+		}
+	}
+}
+
+// Preprocess extracts the data segment of an .apk file and reads its metadata.
+func (a *Archive) Preprocess() (string, error) {
+	var err error
+	a.localPath, err = common.CopyToLocal(a.remotePath, a.ID())
+	if err != nil {
+		return "", fmt.Errorf("error while copying %s to local file system: %v", a.remotePath, err)
+	}
+
+	baseDir, _ := filepath.Split(a.localPath)
+	a.extractionDir = filepath.Join(baseDir, "extracted")
+
+	metadata, controlSum, err := extractAPK(a.localPath, a.extractionDir)
+	if err != nil {
+		return "", err
+	}
+	// Checksums in APKINDEX are SHA1 digests of the control segment, prefixed with Q1.
+	if a.indexChecksum != "" {
+		if got := "Q1" + base64.StdEncoding.EncodeToString(controlSum); got != a.indexChecksum {
+			return "", fmt.Errorf("control segment checksum %s does not match %s listed in %s", got, a.indexChecksum, indexName)
+		}
+	}
+	a.metadata = metadata
+
+	return a.extractionDir, nil
+}
+
+// ID returns non-unique apk Archive ID.
+func (a *Archive) ID() string {
+	return a.filename
+}
+
+// RepoName returns repository name.
+func (a *Archive) RepoName() string {
+	return RepoName
+}
+
+// RepoPath returns repository path.
+func (a *Archive) RepoPath() string {
+	return a.repoPath
+}
+
+// LocalPath returns local path to an apk Archive .apk file.
+func (a *Archive) LocalPath() string {
+	return a.localPath
+}
+
+// RemotePath returns non-local path to an apk Archive .apk file.
+func (a *Archive) RemotePath() string {
+	return a.remotePath
+}
+
+// Description provides additional description for an .apk file.
+func (a *Archive) Description() string {
+	return common.PackageDescription(a.metadata)
+}
+
+// Metadata returns package metadata read from .PKGINFO.
+func (a *Archive) Metadata() *hashrCommon.SourceMetadata {
+	return a.metadata
+}
+
+// CheckSamples compares samples extracted from the .apk file with SHA1 digests stored in the data
+// segment.
+func (a *Archive) CheckSamples(samples []hashrCommon.Sample) []string {
+	if a.metadata == nil || len(a.metadata.Files) == 0 {
+		return nil
+	}
+
+	return common.CheckManifest(a.metadata.Files, samples, a.extractionDir)
+}
+
+// QuickSHA256Hash calculates sha256 hash of .apk file.
+func (a *Archive) QuickSHA256Hash() (string, error) {
+	// Check if the quick hash was already calculated.
+	if a.quickSha256hash != "" {
+		return a.quickSha256hash, nil
+	}
+
+	f, err := os.Open(a.remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// Check if the file is smaller than 20MB, if so hash the whole file.
+	if fileInfo.Size() < int64(chunkSize*2) {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		a.quickSha256hash = fmt.Sprintf("%x", h.Sum(nil))
+		return a.quickSha256hash, nil
+	}
+
+	header := make([]byte, chunkSize)
+	_, err = f.Read(header)
+	if err != nil {
+		return "", err
+	}
+
+	footer := make([]byte, chunkSize)
+	_, err = f.ReadAt(footer, fileInfo.Size()-int64(chunkSize))
+	if err != nil {
+		return "", err
+	}
+
+	a.quickSha256hash = fmt.Sprintf("%x", sha256.Sum256(append(header, footer...)))
+	return a.quickSha256hash, nil
+}
+
+// NewRepo returns new instance of apk repository. The location is a local path with .apk files or
+// a local path or a file://, http:// or https:// URL of a mirror directory holding APKINDEX.tar.gz,
+// e.g. https://dl-cdn.alpinelinux.org/alpine/v3.19/main/x86_64.
+func NewRepo(location string) *Repo {
+	return &Repo{location: location}
+}
+
+// Repo holds data related to an apk repository.
+type Repo struct {
+	location string
+	files    []string
+	Archives []*Archive
+}
+
+// RepoName returns repository name.
+func (r *Repo) RepoName() string {
+	return RepoName
+}
+
+// RepoPath returns repository path.
+func (r *Repo) RepoPath() string {
+	return r.location
+}
+
+// DiscoverRepo reads packages listed in APKINDEX.tar.gz of the repository or, if there is no
+// index, traverses the repository and looks for .apk files.
+func (r *Repo) DiscoverRepo() ([]hashr.Source, error) {
+	index, err := common.ReadLocation(common.JoinLocation(r.location, indexName))
+	switch {
+	case err == nil:
+		if err := r.discoverIndex(index); err != nil {
+			return nil, fmt.Errorf("error while reading %s: %v", indexName, err)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		if err := filepath.Walk(r.location, walk(&r.files)); err != nil {
+			return nil, err
+		}
+		for _, file := range r.files {
+			r.Archives = append(r.Archives, &Archive{filename: filepath.Base(file), remotePath: file, repoPath: r.location})
+		}
+	default:
+		return nil, fmt.Errorf("error while reading %s: %v", indexName, err)
+	}
+
+	var sources []hashr.Source
+	for _, Archive := range r.Archives {
+		sources = append(sources, Archive)
+	}
+
+	return sources, nil
+}
+
+// discoverIndex adds archives listed in a given APKINDEX.tar.gz. Quick hashes of the archives are
+// based on their checksums listed in the index, so only archives that were not processed yet are
+// copied.
+func (r *Repo) discoverIndex(data []byte) error {
+	// The signature segment and the index segment form a single tar stream.
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("APKINDEX not found")
+		}
+		if err != nil {
+			return err
+		}
+		if path.Clean(header.Name) != "APKINDEX" {
+			continue
+		}
+
+		entries, err := parseIndex(tr)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e["P"] == "" || e["V"] == "" || e["C"] == "" {
+				continue
+			}
+			// Package names and versions form the path and the ID of the source.
+			if !validIndexValue(e["P"]) || !validIndexValue(e["V"]) {
+				glog.Warningf("Skipping APKINDEX entry with invalid package name or version: %q %q", e["P"], e["V"])
+				continue
+			}
+			filename := fmt.Sprintf("%s-%s.apk", e["P"], e["V"])
+			r.Archives = append(r.Archives, &Archive{
+				filename:        filename,
+				remotePath:      common.JoinLocation(r.location, filename),
+				repoPath:        r.location,
+				quickSha256hash: fmt.Sprintf("%x", sha256.Sum256([]byte(e["C"]))),
+				indexChecksum:   e["C"],
+			})
+		}
+		return nil
+	}
+}
+
+// validIndexValue returns true if a given value from APKINDEX can be used as a part of a file name.
+func validIndexValue(v string) bool {
+	return !strings.ContainsAny(v, `/\`) && !common.ContainsDotDot(v)
+}
+
+// parseIndex parses APKINDEX file, which consists of blank line separated entries with "K:value"
+// lines.
+func parseIndex(r io.Reader) ([]map[string]string, error) {
+	var entries []map[string]string
+	var entry map[string]string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			entry = nil
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed APKINDEX line: %q", line)
+		}
+		if entry == nil {
+			entry = make(map[string]string)
+			entries = append(entries, entry)
+		}
+		entry[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func walk(files *[]string) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			glog.Errorf("Could not open %s: %v", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(info.Name(), ".apk") {
+			*files = append(*files, path)
+		}
+
+		return nil
+	}
+}
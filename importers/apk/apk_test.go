@@ -0,0 +1,262 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	hashrCommon "github.com/google/hashr/common"
+)
+
+type tarEntry struct {
+	name    string
+	content string
+	pax     map[string]string
+}
+
+// gzipTar returns a gzip stream with a tar archive holding given entries. Tar archives of the
+// signature and control segments of .apk files are not terminated.
+func gzipTar(t *testing.T, entries []tarEntry, terminate bool) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg, PAXRecords: e.pax}
+		if e.pax != nil {
+			header.Format = tar.FormatPAX
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("could not write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("could not write tar entry: %v", err)
+		}
+	}
+	if terminate {
+		if err := tw.Close(); err != nil {
+			t.Fatalf("could not close tar writer: %v", err)
+		}
+	} else if err := tw.Flush(); err != nil {
+		t.Fatalf("could not flush tar writer: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("could not close gzip writer: %v", err)
+	}
+
+	return b.Bytes()
+}
+
+// writeAPK writes an .apk file with given data files and returns the checksum of its control
+// segment in the format used by APKINDEX.
+func writeAPK(t *testing.T, path, name, version string, files map[string]string, datahash string) string {
+	t.Helper()
+
+	var entries []tarEntry
+	for _, file := range []string{"bin/busybox", "etc/motd", "../escape"} {
+		if content, ok := files[file]; ok {
+			entries = append(entries, tarEntry{name: file, content: content, pax: map[string]string{checksumRecord: fmt.Sprintf("%x", sha1.Sum([]byte(content)))}})
+		}
+	}
+	data := gzipTar(t, entries, true)
+	if datahash == "" {
+		datahash = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+
+	pkgInfo := fmt.Sprintf("# Generated by abuild\npkgname = %s\npkgver = %s\npkgdesc = HashR test package\narch = x86_64\nmaintainer = Example <noreply@example.com>\nlicense = GPL-2.0-only\norigin = busybox\ndepend = so:libc.musl-x86_64.so.1\ndepend = musl\ndatahash = %s\n", name, version, datahash)
+	control := gzipTar(t, []tarEntry{{name: ".PKGINFO", content: pkgInfo}, {name: ".post-install", content: "#!/bin/sh\n"}}, false)
+	signature := gzipTar(t, []tarEntry{{name: ".SIGN.RSA.test.rsa.pub", content: "signature"}}, false)
+
+	if err := os.WriteFile(path, append(append(signature, control...), data...), 0644); err != nil {
+		t.Fatalf("could not write apk file: %v", err)
+	}
+
+	sum := sha1.Sum(control)
+	return "Q1" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestPreprocess(t *testing.T) {
+	files := map[string]string{"bin/busybox": "busybox", "etc/motd": "Welcome to Alpine!", "../escape": "escape"}
+	repoPath := t.TempDir()
+	writeAPK(t, filepath.Join(repoPath, "busybox-1.36.1-r15.apk"), "busybox", "1.36.1-r15", files, "")
+
+	sources, err := NewRepo(repoPath).DiscoverRepo()
+	if err != nil {
+		t.Fatalf("unexpected error while discovering repo: %v", err)
+	}
+	if len(sources) != 1 {
+		t.Fatalf("DiscoverRepo() returned %d sources, want 1", len(sources))
+	}
+	archive := sources[0].(*Archive)
+
+	extractionDir, err := archive.Preprocess()
+	if err != nil {
+		t.Fatalf("unexpected Preprocess() error: %v", err)
+	}
+
+	var samples []hashrCommon.Sample
+	got := make(map[string]string)
+	err = filepath.Walk(filepath.Dir(extractionDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || path == archive.LocalPath() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(extractionDir, path)
+		if err != nil {
+			return err
+		}
+		got[rel] = string(data)
+		samples = append(samples, hashrCommon.Sample{Sha256: fmt.Sprintf("%x", sha256.Sum256(data)), Paths: []string{path}, SourcePaths: []string{strings.TrimPrefix(path, "/")}})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not walk extraction directory: %v", err)
+	}
+
+	// Control files and files with paths leading outside of the extraction directory are not
+	// extracted.
+	want := map[string]string{"bin/busybox": "busybox", "etc/motd": "Welcome to Alpine!"}
+	if !cmp.Equal(want, got) {
+		t.Errorf("Preprocess() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+	}
+
+	wantMetadata := &hashrCommon.SourceMetadata{
+		Name:          "busybox",
+		Version:       "1.36.1-r15",
+		Architecture:  "x86_64",
+		Maintainer:    "Example <noreply@example.com>",
+		SourcePackage: "busybox",
+		License:       "GPL-2.0-only",
+		Files: []hashrCommon.FileDigest{
+			{Path: "/bin/busybox", Algorithm: "sha1", Digest: fmt.Sprintf("%x", sha1.Sum([]byte("busybox")))},
+			{Path: "/etc/motd", Algorithm: "sha1", Digest: fmt.Sprintf("%x", sha1.Sum([]byte("Welcome to Alpine!")))},
+			{Path: "/escape", Algorithm: "sha1", Digest: fmt.Sprintf("%x", sha1.Sum([]byte("escape")))},
+		},
+	}
+	if diff := cmp.Diff(wantMetadata, archive.Metadata()); diff != "" {
+		t.Errorf("Metadata() unexpected diff (-want/+got):\n%s", diff)
+	}
+
+	if got, want := archive.Description(), "Package: busybox 1.36.1-r15 (x86_64), Maintainer: Example <noreply@example.com>, Source: busybox, License: GPL-2.0-only"; got != want {
+		t.Errorf("Description() = %q, want %q", got, want)
+	}
+
+	if got, want := archive.CheckSamples(samples), []string{"/escape: listed in the package, but not extracted"}; !cmp.Equal(want, got) {
+		t.Errorf("CheckSamples() = %v, want %v", got, want)
+	}
+}
+
+func TestPreprocessModifiedData(t *testing.T) {
+	repoPath := t.TempDir()
+	writeAPK(t, filepath.Join(repoPath, "busybox-1.36.1-r15.apk"), "busybox", "1.36.1-r15", map[string]string{"bin/busybox": "busybox"}, fmt.Sprintf("%x", sha256.Sum256(nil)))
+
+	archive := &Archive{filename: "busybox-1.36.1-r15.apk", remotePath: filepath.Join(repoPath, "busybox-1.36.1-r15.apk"), repoPath: repoPath}
+	if _, err := archive.Preprocess(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Preprocess() error = %v, want data segment digest mismatch", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	mirror := t.TempDir()
+	checksum := writeAPK(t, filepath.Join(mirror, "busybox-1.36.1-r15.apk"), "busybox", "1.36.1-r15", map[string]string{"bin/busybox": "busybox"}, "")
+	writeAPK(t, filepath.Join(mirror, "musl-1.2.4-r2.apk"), "musl", "1.2.4-r2", map[string]string{"etc/motd": "musl"}, "")
+
+	// musl package doesn't match the checksum listed in the index, entries with path separators or
+	// ".." in package names or versions are skipped.
+	index := fmt.Sprintf("C:%s\nP:busybox\nV:1.36.1-r15\nA:x86_64\nS:1000\n\nC:Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=\nP:musl\nV:1.2.4-r2\nA:x86_64\n\n", checksum) +
+		"C:Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=\nP:../../escape\nV:1.0-r0\n\n" +
+		"C:Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=\nP:sub/escape\nV:1.0-r0\n\n" +
+		"C:Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=\nP:escape\nV:..\\1.0-r0\n\n" +
+		"C:Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=\nP:..\nV:1.0-r0\n\n"
+	indexData := append(gzipTar(t, []tarEntry{{name: ".SIGN.RSA.test.rsa.pub", content: "signature"}}, false), gzipTar(t, []tarEntry{{name: "DESCRIPTION", content: "v3.19"}, {name: "APKINDEX", content: index}}, true)...)
+	if err := os.WriteFile(filepath.Join(mirror, indexName), indexData, 0644); err != nil {
+		t.Fatalf("could not write index: %v", err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(mirror)))
+	defer server.Close()
+
+	for _, location := range []string{server.URL, mirror} {
+		sources, err := NewRepo(location).DiscoverRepo()
+		if err != nil {
+			t.Fatalf("unexpected error while discovering repo: %v", err)
+		}
+
+		type discovered struct {
+			RemotePath, QuickHash string
+		}
+		got := make(map[string]discovered)
+		for _, source := range sources {
+			quickHash, err := source.QuickSHA256Hash()
+			if err != nil {
+				t.Fatalf("unexpected QuickSHA256Hash() error: %v", err)
+			}
+			got[source.ID()] = discovered{source.RemotePath(), quickHash}
+
+			_, err = source.Preprocess()
+			if source.ID() == "musl-1.2.4-r2.apk" {
+				if err == nil || !strings.Contains(err.Error(), "does not match") {
+					t.Errorf("Preprocess() of %s error = %v, want checksum mismatch", source.ID(), err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected Preprocess() error: %v", err)
+			}
+		}
+
+		remotePath := func(name string) string {
+			if location == mirror {
+				return filepath.Join(mirror, name)
+			}
+			return location + "/" + name
+		}
+		want := map[string]discovered{
+			"busybox-1.36.1-r15.apk": {remotePath("busybox-1.36.1-r15.apk"), fmt.Sprintf("%x", sha256.Sum256([]byte(checksum)))},
+			"musl-1.2.4-r2.apk":      {remotePath("musl-1.2.4-r2.apk"), fmt.Sprintf("%x", sha256.Sum256([]byte("Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=")))},
+		}
+		if !cmp.Equal(want, got) {
+			t.Errorf("DiscoverRepo() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+		}
+	}
+}
+
+func TestRepoFunctions(t *testing.T) {
+	repoPath := "/tmp/apk-repo"
+	repo := NewRepo(repoPath)
+
+	if repo.RepoName() != RepoName {
+		t.Errorf("RepoName() = %s; want = %s", repo.RepoName(), RepoName)
+	}
+
+	if repo.RepoPath() != repoPath {
+		t.Errorf("RepoPath() = %s; want = %s", repo.RepoPath(), repoPath)
+	}
+}
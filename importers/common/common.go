@@ -53,6 +53,13 @@ func ExtractTarGz(tarGzPath, outputFolder string) error {
 
 	glog.Infof("Extracting %s to %s", tarGzPath, outputFolder)
 
+	return ExtractTar(tarReader, outputFolder, nil)
+}
+
+// ExtractTar extracts regular files from a tar archive to given output folder. Entries with paths
+// leading outside of the output folder are skipped, as are links and special files. If include is
+// not nil, only entries for which it returns true are extracted.
+func ExtractTar(tarReader *tar.Reader, outputFolder string, include func(header *tar.Header) bool) error {
 	for {
 		header, err := tarReader.Next()
 
@@ -63,11 +70,19 @@ func ExtractTarGz(tarGzPath, outputFolder string) error {
 			return err
 		}
 
-		if containsDotDot(header.Name) {
+		if include != nil && !include(header) {
+			continue
+		}
+
+		if ContainsDotDot(header.Name) {
 			glog.Warningf("not extracting %s, potential path traversal", header.Name)
 			continue
 		}
 		destEntry := filepath.Join(outputFolder, header.Name)
+		if rel, err := filepath.Rel(outputFolder, destEntry); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			glog.Warningf("not extracting %s, potential path traversal", header.Name)
+			continue
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -82,22 +97,23 @@ func ExtractTarGz(tarGzPath, outputFolder string) error {
 					return fmt.Errorf("error while creating destination directory: %v", err)
 				}
 			}
-			
+
 			destFile, err := os.Create(destEntry)
 			if err != nil {
 				return fmt.Errorf("error while creating destination file: %v", err)
 			}
 
 			_, err = io.Copy(destFile, tarReader)
+			destFile.Close()
 			if err != nil {
 				return fmt.Errorf("error while extracting destination file: %v", err)
 			}
-			destFile.Close()
 		}
 	}
 }
 
-func containsDotDot(v string) bool {
+// ContainsDotDot returns true if a given slash or backslash separated path has a ".." element.
+func ContainsDotDot(v string) bool {
 	if !strings.Contains(v, "..") {
 		return false
 	}
@@ -121,19 +137,21 @@ func LocalTempDir(sourceID string) (string, error) {
 	return tempDir, nil
 }
 
-// CopyToLocal copies a source to a local file system.
+// CopyToLocal copies a source to a local file system. The remote path can also be a file://,
+// http:// or https:// URL.
 func CopyToLocal(remotePath, sourceID string) (string, error) {
 	tempDir, err := LocalTempDir(sourceID)
 	if err != nil {
 		return "", err
 	}
 
-	sourceFile, err := os.Open(remotePath)
+	sourceFile, err := OpenLocation(remotePath)
 	if err != nil {
 		return "", err
 	}
+	defer sourceFile.Close()
 
-	destPath := path.Join(tempDir, filepath.Base(remotePath))
+	destPath := path.Join(tempDir, locationBase(remotePath))
 	destFile, err := os.Create(destPath)
 	if err != nil {
 		return destPath, err
@@ -15,6 +15,8 @@
 package common
 
 import (
+	"archive/tar"
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
@@ -257,6 +259,54 @@ func sha256sum(path string) ([32]byte, error) {
 	return sha256.Sum256(data), nil
 }
 
+func TestExtractTar(t *testing.T) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, h := range []*tar.Header{
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/hello", Typeflag: tar.TypeReg, Mode: 0755, Size: 5},
+		{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "/etc/hello", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "usr/bin/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("could not write tar header: %v", err)
+		}
+		if h.Size > 0 {
+			tw.Write([]byte("hello"))
+		}
+	}
+	tw.Close()
+
+	tempDir := t.TempDir()
+	outputFolder := filepath.Join(tempDir, "extracted")
+	err := ExtractTar(tar.NewReader(&b), outputFolder, func(header *tar.Header) bool {
+		return header.Name != ".PKGINFO"
+	})
+	if err != nil {
+		t.Fatalf("unexpected ExtractTar() error: %v", err)
+	}
+
+	var got []string
+	err = filepath.Walk(tempDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(tempDir, path)
+		got = append(got, rel)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("could not walk output folder: %v", err)
+	}
+
+	want := []string{"extracted/etc/hello", "extracted/usr/bin/hello"}
+	if !cmp.Equal(want, got) {
+		t.Errorf("ExtractTar() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+	}
+}
+
 func TestCopyToLocal(t *testing.T) {
 	tarGzPath := "testdata/targz/dir1/laptop.tar.gz"
 	out, err := CopyToLocal(tarGzPath, "laptop")
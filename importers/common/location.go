@@ -0,0 +1,124 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// httpClient is used to fetch files from HTTP(S) repository mirrors. The timeout covers reading
+// the whole response, so it's long enough to download large packages, while unresponsive servers
+// fail quickly due to the transport timeouts.
+var httpClient = &http.Client{
+	Timeout: 30 * time.Minute,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+// isURL returns true if a given location is a file://, http:// or https:// URL.
+func isURL(location string) bool {
+	for _, scheme := range []string{"file://", "http://", "https://"} {
+		if strings.HasPrefix(location, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinLocation joins a local path or a URL of a repository mirror with a given relative path.
+func JoinLocation(location string, elem ...string) string {
+	if !isURL(location) {
+		return filepath.Join(append([]string{location}, elem...)...)
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return strings.TrimSuffix(location, "/") + "/" + path.Join(elem...)
+	}
+	u.Path = path.Join(append([]string{u.Path}, elem...)...)
+
+	return u.String()
+}
+
+// OpenLocation opens a file given by a local path or a file://, http:// or https:// URL. Errors
+// for files that don't exist wrap fs.ErrNotExist.
+func OpenLocation(location string) (io.ReadCloser, error) {
+	if !isURL(location) {
+		return os.Open(location)
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "file" {
+		return os.Open(u.Path)
+	}
+
+	resp, err := httpClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", location, fs.ErrNotExist)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: unexpected HTTP status: %s", location, resp.Status)
+	}
+}
+
+// ReadLocation returns the content of a file given by a local path or a file://, http:// or
+// https:// URL.
+func ReadLocation(location string) ([]byte, error) {
+	r, err := OpenLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// locationBase returns the last element of a local path or a URL path.
+func locationBase(location string) string {
+	if !isURL(location) {
+		return filepath.Base(location)
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return path.Base(location)
+	}
+
+	return path.Base(u.Path)
+}
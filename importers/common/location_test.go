@@ -0,0 +1,82 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJoinLocation(t *testing.T) {
+	for _, tc := range []struct {
+		location string
+		elem     []string
+		want     string
+	}{
+		{location: "/srv/mirror", elem: []string{"dists", "stable", "InRelease"}, want: "/srv/mirror/dists/stable/InRelease"},
+		{location: "file:///srv/mirror/", elem: []string{"pool/main/h/hello/hello_2.10-2_amd64.deb"}, want: "file:///srv/mirror/pool/main/h/hello/hello_2.10-2_amd64.deb"},
+		{location: "http://deb.debian.org/debian", elem: []string{"dists", "bookworm", "Release"}, want: "http://deb.debian.org/debian/dists/bookworm/Release"},
+	} {
+		if got := JoinLocation(tc.location, tc.elem...); got != tc.want {
+			t.Errorf("JoinLocation(%q, %q) = %q, want %q", tc.location, tc.elem, got, tc.want)
+		}
+	}
+}
+
+func TestReadLocation(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "Release"), []byte("Suite: stable\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	for _, location := range []string{dir, "file://" + dir, server.URL} {
+		got, err := ReadLocation(JoinLocation(location, "Release"))
+		if err != nil {
+			t.Fatalf("unexpected ReadLocation() error: %v", err)
+		}
+		if string(got) != "Suite: stable\n" {
+			t.Errorf("ReadLocation(%q) = %q, want %q", location, got, "Suite: stable\n")
+		}
+
+		if _, err := ReadLocation(JoinLocation(location, "InRelease")); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("ReadLocation(%q) error = %v, want fs.ErrNotExist", JoinLocation(location, "InRelease"), err)
+		}
+	}
+}
+
+func TestReadLocationTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	defaultClient := httpClient
+	httpClient = &http.Client{Timeout: 100 * time.Millisecond}
+	defer func() { httpClient = defaultClient }()
+
+	if _, err := ReadLocation(JoinLocation(server.URL, "Release")); err == nil {
+		t.Errorf("ReadLocation() from unresponsive server returned no error")
+	}
+}
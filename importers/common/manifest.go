@@ -0,0 +1,154 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	hashrCommon "github.com/google/hashr/common"
+)
+
+// maxManifestWarnings limits the number of warnings reported for a single package, the rest is
+// only counted.
+const maxManifestWarnings = 50
+
+// digestFuncs maps names of digest algorithms to their implementations. "sha" is used for SHA1 by
+// older YUM repositories.
+var digestFuncs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha":    sha1.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// CheckManifest compares samples extracted from a package with files listed in its manifest and
+// returns warnings about files with mismatching digests, listed files that were not extracted and
+// extracted files that are not listed. extractionDir is the directory the package was extracted to
+// by Preprocess, paths of samples in hashes.json include it.
+//
+// SHA256 digests are compared with hashes.json directly, digests using other algorithms are
+// calculated from the exported samples.
+func CheckManifest(files []hashrCommon.FileDigest, samples []hashrCommon.Sample, extractionDir string) []string {
+	prefix := strings.Trim(filepath.ToSlash(extractionDir), "/") + "/"
+
+	type extractedFile struct {
+		sample    hashrCommon.Sample
+		localPath string
+	}
+	extracted := make(map[string]extractedFile)
+	for _, sample := range samples {
+		for i, sourcePath := range sample.SourcePaths {
+			packagePath := sourcePath
+			if idx := strings.Index(sourcePath, prefix); idx != -1 {
+				packagePath = sourcePath[idx+len(prefix):]
+			}
+			var localPath string
+			if i < len(sample.Paths) {
+				localPath = sample.Paths[i]
+			}
+			extracted[path.Join("/", packagePath)] = extractedFile{sample: sample, localPath: localPath}
+		}
+	}
+
+	var warnings []string
+	listed := make(map[string]bool)
+	for _, f := range files {
+		listed[f.Path] = true
+		e, ok := extracted[f.Path]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("%s: listed in the package, but not extracted", f.Path))
+			continue
+		}
+		if f.Digest == "" {
+			continue
+		}
+
+		digest, err := fileDigest(f.Algorithm, e.sample.Sha256, e.localPath)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: could not calculate %s digest: %v", f.Path, f.Algorithm, err))
+			continue
+		}
+		if !strings.EqualFold(digest, f.Digest) {
+			warnings = append(warnings, fmt.Sprintf("%s: %s digest %s does not match %s listed in the package", f.Path, f.Algorithm, digest, f.Digest))
+		}
+	}
+
+	var extra []string
+	for p := range extracted {
+		if !listed[p] {
+			extra = append(extra, p)
+		}
+	}
+	sort.Strings(extra)
+	for _, p := range extra {
+		warnings = append(warnings, fmt.Sprintf("%s: extracted, but not listed in the package", p))
+	}
+
+	if len(warnings) > maxManifestWarnings {
+		more := len(warnings) - maxManifestWarnings
+		warnings = append(warnings[:maxManifestWarnings], fmt.Sprintf("%d more files don't match the package manifest", more))
+	}
+
+	return warnings
+}
+
+// fileDigest returns the digest of a sample using a given algorithm.
+func fileDigest(algorithm, sha256Digest, localPath string) (string, error) {
+	if algorithm == "sha256" {
+		return sha256Digest, nil
+	}
+
+	if _, ok := digestFuncs[algorithm]; !ok {
+		return "", fmt.Errorf("unsupported digest algorithm")
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return Digest(algorithm, f)
+}
+
+// Digest returns the hex encoded digest of data read from a given reader using a given algorithm,
+// e.g. md5, sha1 or sha256.
+func Digest(algorithm string, r io.Reader) (string, error) {
+	newHash, ok := digestFuncs[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported digest algorithm: %s", algorithm)
+	}
+
+	h := newHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
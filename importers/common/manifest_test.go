@@ -0,0 +1,123 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	hashrCommon "github.com/google/hashr/common"
+)
+
+func TestCheckManifest(t *testing.T) {
+	tempDir := t.TempDir()
+	localPath := filepath.Join(tempDir, "file.02")
+	if err := os.WriteFile(localPath, []byte("hashr"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	extractionDir := "/tmp/hashr/1234/extracted"
+	sample := func(sha256 string, name string) hashrCommon.Sample {
+		return hashrCommon.Sample{
+			Sha256:      sha256,
+			Paths:       []string{localPath},
+			SourcePaths: []string{fmt.Sprintf("tmp/hashr/1234/extracted/%s", name)},
+		}
+	}
+	samples := []hashrCommon.Sample{
+		sample("sha256-01", "usr/bin/file.01"),
+		sample("sha256-02", "etc/file.02"),
+		sample("sha256-03", "usr/bin/file.03"),
+		sample("sha256-04", "usr/share/file.04"),
+	}
+
+	for _, tc := range []struct {
+		name  string
+		files []hashrCommon.FileDigest
+		want  []string
+	}{
+		{
+			name: "match",
+			files: []hashrCommon.FileDigest{
+				{Path: "/usr/bin/file.01", Algorithm: "sha256", Digest: "sha256-01"},
+				{Path: "/etc/file.02", Algorithm: "md5", Digest: "036F437F8595059DA365311A71723C68"},
+				{Path: "/usr/bin/file.03", Algorithm: "sha256", Digest: "sha256-03"},
+				{Path: "/usr/share/file.04"},
+			},
+		},
+		{
+			name: "mismatch",
+			files: []hashrCommon.FileDigest{
+				{Path: "/usr/bin/file.01", Algorithm: "sha256", Digest: "sha256-05"},
+				{Path: "/etc/file.02", Algorithm: "md5", Digest: "d41d8cd98f00b204e9800998ecf8427e"},
+				{Path: "/usr/bin/file.03", Algorithm: "sha256", Digest: "sha256-03"},
+				{Path: "/usr/share/file.04", Algorithm: "sha256", Digest: "sha256-04"},
+			},
+			want: []string{
+				"/usr/bin/file.01: sha256 digest sha256-01 does not match sha256-05 listed in the package",
+				"/etc/file.02: md5 digest 036f437f8595059da365311a71723c68 does not match d41d8cd98f00b204e9800998ecf8427e listed in the package",
+			},
+		},
+		{
+			name: "missing and extra",
+			files: []hashrCommon.FileDigest{
+				{Path: "/usr/bin/file.01", Algorithm: "sha256", Digest: "sha256-01"},
+				{Path: "/usr/bin/file.05", Algorithm: "sha256", Digest: "sha256-05"},
+			},
+			want: []string{
+				"/usr/bin/file.05: listed in the package, but not extracted",
+				"/etc/file.02: extracted, but not listed in the package",
+				"/usr/bin/file.03: extracted, but not listed in the package",
+				"/usr/share/file.04: extracted, but not listed in the package",
+			},
+		},
+		{
+			name: "unsupported algorithm",
+			files: []hashrCommon.FileDigest{
+				{Path: "/usr/bin/file.01", Algorithm: "sha256", Digest: "sha256-01"},
+				{Path: "/etc/file.02", Algorithm: "crc32", Digest: "0"},
+				{Path: "/usr/bin/file.03", Algorithm: "sha256", Digest: "sha256-03"},
+				{Path: "/usr/share/file.04", Algorithm: "sha256", Digest: "sha256-04"},
+			},
+			want: []string{"/etc/file.02: could not calculate crc32 digest: unsupported digest algorithm"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := CheckManifest(tc.files, samples, extractionDir)
+			if !cmp.Equal(tc.want, got) {
+				t.Errorf("CheckManifest() unexpected diff (-want/+got):\n%s", cmp.Diff(tc.want, got))
+			}
+		})
+	}
+}
+
+func TestCheckManifestLimit(t *testing.T) {
+	var files []hashrCommon.FileDigest
+	for i := 0; i < maxManifestWarnings+10; i++ {
+		files = append(files, hashrCommon.FileDigest{Path: fmt.Sprintf("/file.%02d", i), Algorithm: "sha256", Digest: "sha256"})
+	}
+
+	got := CheckManifest(files, nil, "/tmp/hashr/1234/extracted")
+	if len(got) != maxManifestWarnings+1 {
+		t.Fatalf("CheckManifest() returned %d warnings, want %d", len(got), maxManifestWarnings+1)
+	}
+	if want := "10 more files don't match the package manifest"; got[maxManifestWarnings] != want {
+		t.Errorf("CheckManifest() last warning = %q, want %q", got[maxManifestWarnings], want)
+	}
+}
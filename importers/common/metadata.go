@@ -0,0 +1,97 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	hashrCommon "github.com/google/hashr/common"
+)
+
+// PackageDescription returns a source description for given package metadata. File digests are
+// not part of the description.
+func PackageDescription(m *hashrCommon.SourceMetadata) string {
+	if m == nil {
+		return ""
+	}
+
+	pkg := strings.TrimSpace(strings.Join([]string{m.Name, m.Version}, " "))
+	if m.Architecture != "" {
+		pkg = fmt.Sprintf("%s (%s)", pkg, m.Architecture)
+	}
+
+	parts := []string{fmt.Sprintf("Package: %s", pkg)}
+	for _, field := range []struct{ name, value string }{
+		{"Maintainer", m.Maintainer},
+		{"Source", m.SourcePackage},
+		{"License", m.License},
+	} {
+		if field.value != "" {
+			parts = append(parts, fmt.Sprintf("%s: %s", field.name, field.value))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// JoinDescriptions joins non-empty parts of a source description.
+func JoinDescriptions(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+
+	return strings.Join(nonEmpty, ", ")
+}
+
+// PkgInfo holds fields of .PKGINFO file of apk and pacman packages. Repeated fields, e.g. depend,
+// have multiple values.
+type PkgInfo map[string][]string
+
+// Get returns the first value of a given field.
+func (p PkgInfo) Get(key string) string {
+	if values := p[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// ParsePkgInfo parses .PKGINFO file, which consists of "key = value" lines and comments.
+func ParsePkgInfo(r io.Reader) (PkgInfo, error) {
+	fields := make(PkgInfo)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed .PKGINFO line: %q", line)
+		}
+		key := strings.TrimSpace(parts[0])
+		fields[key] = append(fields[key], strings.TrimSpace(parts[1]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read .PKGINFO: %v", err)
+	}
+
+	return fields, nil
+}
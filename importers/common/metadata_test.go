@@ -0,0 +1,70 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	hashrCommon "github.com/google/hashr/common"
+)
+
+func TestPackageDescription(t *testing.T) {
+	for _, tc := range []struct {
+		metadata *hashrCommon.SourceMetadata
+		want     string
+	}{
+		{metadata: nil, want: ""},
+		{
+			metadata: &hashrCommon.SourceMetadata{Name: "coreutils", Version: "8.32-4.1", Architecture: "amd64", Maintainer: "Michael Stone <mstone@debian.org>", SourcePackage: "coreutils", License: "GPL-3+"},
+			want:     "Package: coreutils 8.32-4.1 (amd64), Maintainer: Michael Stone <mstone@debian.org>, Source: coreutils, License: GPL-3+",
+		},
+		{
+			metadata: &hashrCommon.SourceMetadata{Name: "testdata", Version: "1.0-1", Files: []hashrCommon.FileDigest{{Path: "/file.01", Algorithm: "md5", Digest: "d41d8cd98f00b204e9800998ecf8427e"}}},
+			want:     "Package: testdata 1.0-1",
+		},
+	} {
+		if got := PackageDescription(tc.metadata); got != tc.want {
+			t.Errorf("PackageDescription(%v) = %q, want %q", tc.metadata, got, tc.want)
+		}
+	}
+}
+
+func TestJoinDescriptions(t *testing.T) {
+	if got, want := JoinDescriptions("Package: testdata 1.0-1", "", "OpenPGP signature: unsigned"), "Package: testdata 1.0-1, OpenPGP signature: unsigned"; got != want {
+		t.Errorf("JoinDescriptions() = %q, want %q", got, want)
+	}
+}
+
+func TestParsePkgInfo(t *testing.T) {
+	got, err := ParsePkgInfo(strings.NewReader("# Generated by makepkg\npkgname = acl\npkgver = 2.3.1-3\nlicense = LGPL\nlicense = GPL\n\nbuilddate = 1680000000\n"))
+	if err != nil {
+		t.Fatalf("unexpected ParsePkgInfo() error: %v", err)
+	}
+
+	want := PkgInfo{"pkgname": {"acl"}, "pkgver": {"2.3.1-3"}, "license": {"LGPL", "GPL"}, "builddate": {"1680000000"}}
+	if !cmp.Equal(want, got) {
+		t.Errorf("ParsePkgInfo() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+	}
+	if got.Get("license") != "LGPL" || got.Get("url") != "" {
+		t.Errorf("Get() = %q, %q; want %q, %q", got.Get("license"), got.Get("url"), "LGPL", "")
+	}
+
+	if _, err := ParsePkgInfo(strings.NewReader("pkgname acl\n")); err == nil {
+		t.Error("ParsePkgInfo() expected error for malformed line")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+
+	"github.com/google/hashr/core/hashr"
+)
+
+// LoadKeyring reads OpenPGP public keys from given armored or binary keyring files.
+func LoadKeyring(paths ...string) (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read keyring %s: %v", path, err)
+		}
+
+		var keys openpgp.EntityList
+		if isArmored(data) {
+			keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		} else {
+			keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse keyring %s: %v", path, err)
+		}
+		keyring = append(keyring, keys...)
+	}
+
+	return keyring, nil
+}
+
+// CheckDetachedSignature verifies an armored or binary detached OpenPGP signature of the signed
+// data and returns the signing key.
+func CheckDetachedSignature(keyring openpgp.EntityList, signed io.Reader, signature []byte) (*openpgp.Entity, error) {
+	if isArmored(signature) {
+		block, err := armor.Decode(bytes.NewReader(signature))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode armored signature: %v", err)
+		}
+		return openpgp.CheckDetachedSignature(keyring, signed, block.Body, nil)
+	}
+
+	return openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(signature), nil)
+}
+
+// VerifyDetachedSignature verifies a file against a detached OpenPGP signature stored in sigPath
+// and returns the signature status and details, either the signer or the reason the verification
+// failed.
+func VerifyDetachedSignature(keyring openpgp.EntityList, path, sigPath string) (string, string) {
+	if sigPath == "" {
+		return hashr.SignatureUnsigned, "no detached signature found"
+	}
+
+	signature, err := os.ReadFile(sigPath)
+	if err != nil {
+		return hashr.SignatureUnverified, fmt.Sprintf("could not read signature: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return hashr.SignatureUnverified, fmt.Sprintf("could not open signed file: %v", err)
+	}
+	defer f.Close()
+
+	signer, err := CheckDetachedSignature(keyring, f, signature)
+	if err != nil {
+		return hashr.SignatureUnverified, SignatureError(err)
+	}
+
+	return hashr.SignatureVerified, SignerName(signer)
+}
+
+// SignatureError describes the reason OpenPGP signature verification failed.
+func SignatureError(err error) string {
+	if errors.Is(err, pgperrors.ErrUnknownIssuer) {
+		return "signed with a key that is not in the keyring"
+	}
+	return fmt.Sprintf("invalid signature: %v", err)
+}
+
+// SignerName returns the primary identity of a given key, or its key ID if it has no identities.
+func SignerName(e *openpgp.Entity) string {
+	if e == nil {
+		return ""
+	}
+
+	var names []string
+	for name, identity := range e.Identities {
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("key %X", e.PrimaryKey.KeyId)
+	}
+
+	// Identities are stored in a map, sorting keeps the name stable between runs.
+	min := names[0]
+	for _, name := range names[1:] {
+		if name < min {
+			min = name
+		}
+	}
+	return min
+}
+
+// SignatureDescription returns a source description for a given signature status and details.
+func SignatureDescription(status, details string) string {
+	if status == "" {
+		return ""
+	}
+	if details == "" {
+		return fmt.Sprintf("OpenPGP signature: %s", status)
+	}
+	return fmt.Sprintf("OpenPGP signature: %s (%s)", status, details)
+}
+
+func isArmored(data []byte) bool {
+	return strings.HasPrefix(string(bytes.TrimSpace(data)), "-----BEGIN PGP")
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+
+	"github.com/google/hashr/core/hashr"
+)
+
+func testKey(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+
+	key, err := openpgp.NewEntity(name, "", strings.ToLower(name)+"@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate OpenPGP key: %v", err)
+	}
+
+	return key
+}
+
+func writeFile(t *testing.T, path string, data []byte) string {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("could not write %s: %v", path, err)
+	}
+
+	return path
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir := t.TempDir()
+	signer, other := testKey(t, "Signer"), testKey(t, "Other")
+
+	var binary bytes.Buffer
+	if err := signer.Serialize(&binary); err != nil {
+		t.Fatalf("could not serialize key: %v", err)
+	}
+
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("could not create armored writer: %v", err)
+	}
+	if err := other.Serialize(w); err != nil {
+		t.Fatalf("could not serialize key: %v", err)
+	}
+	w.Close()
+
+	keyring, err := LoadKeyring(writeFile(t, filepath.Join(dir, "signer.gpg"), binary.Bytes()), writeFile(t, filepath.Join(dir, "other.asc"), armored.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error while running LoadKeyring(): %v", err)
+	}
+
+	var names []string
+	for _, key := range keyring {
+		names = append(names, SignerName(key))
+	}
+	if got, want := strings.Join(names, ","), "Signer <signer@example.com>,Other <other@example.com>"; got != want {
+		t.Errorf("LoadKeyring() returned keys %s, want %s", got, want)
+	}
+
+	if _, err := LoadKeyring(writeFile(t, filepath.Join(dir, "invalid.gpg"), []byte("not a keyring"))); err == nil {
+		t.Error("LoadKeyring() expected error for invalid keyring")
+	}
+}
+
+func TestVerifyDetachedSignature(t *testing.T) {
+	dir := t.TempDir()
+	signer, other := testKey(t, "Signer"), testKey(t, "Other")
+	data := []byte("hashr test archive")
+	path := writeFile(t, filepath.Join(dir, "archive.tar.gz"), data)
+	tampered := writeFile(t, filepath.Join(dir, "tampered.tar.gz"), append(data, '!'))
+
+	var binary, armored bytes.Buffer
+	if err := openpgp.DetachSign(&binary, signer, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("could not sign data: %v", err)
+	}
+	if err := openpgp.ArmoredDetachSign(&armored, signer, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("could not sign data: %v", err)
+	}
+	binarySig := writeFile(t, filepath.Join(dir, "archive.tar.gz.sig"), binary.Bytes())
+	armoredSig := writeFile(t, filepath.Join(dir, "archive.tar.gz.asc"), armored.Bytes())
+
+	for _, tc := range []struct {
+		name        string
+		keyring     openpgp.EntityList
+		path        string
+		sigPath     string
+		wantStatus  string
+		wantDetails string
+	}{
+		{
+			name:        "binary signature",
+			keyring:     openpgp.EntityList{signer},
+			path:        path,
+			sigPath:     binarySig,
+			wantStatus:  hashr.SignatureVerified,
+			wantDetails: "Signer <signer@example.com>",
+		},
+		{
+			name:        "armored signature",
+			keyring:     openpgp.EntityList{other, signer},
+			path:        path,
+			sigPath:     armoredSig,
+			wantStatus:  hashr.SignatureVerified,
+			wantDetails: "Signer <signer@example.com>",
+		},
+		{
+			name:        "unknown key",
+			keyring:     openpgp.EntityList{other},
+			path:        path,
+			sigPath:     binarySig,
+			wantStatus:  hashr.SignatureUnverified,
+			wantDetails: "signed with a key that is not in the keyring",
+		},
+		{
+			name:        "modified file",
+			keyring:     openpgp.EntityList{signer},
+			path:        tampered,
+			sigPath:     binarySig,
+			wantStatus:  hashr.SignatureUnverified,
+			wantDetails: "invalid signature: openpgp: invalid signature: RSA verification failure",
+		},
+		{
+			name:        "no signature",
+			keyring:     openpgp.EntityList{signer},
+			path:        path,
+			wantStatus:  hashr.SignatureUnsigned,
+			wantDetails: "no detached signature found",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, details := VerifyDetachedSignature(tc.keyring, tc.path, tc.sigPath)
+			if status != tc.wantStatus || details != tc.wantDetails {
+				t.Errorf("VerifyDetachedSignature() = %q, %q; want %q, %q", status, details, tc.wantStatus, tc.wantDetails)
+			}
+		})
+	}
+}
+
+func TestSignatureDescription(t *testing.T) {
+	for _, tc := range []struct {
+		status, details, want string
+	}{
+		{status: "", details: "", want: ""},
+		{status: hashr.SignatureVerified, details: "Signer <signer@example.com>", want: "OpenPGP signature: verified (Signer <signer@example.com>)"},
+		{status: hashr.SignatureUnsigned, details: "", want: "OpenPGP signature: unsigned"},
+	} {
+		if got := SignatureDescription(tc.status, tc.details); got != tc.want {
+			t.Errorf("SignatureDescription(%q, %q) = %q, want %q", tc.status, tc.details, got, tc.want)
+		}
+	}
+}
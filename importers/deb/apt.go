@@ -0,0 +1,227 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/golang/glog"
+
+	"github.com/google/hashr/core/hashr"
+	"github.com/google/hashr/importers/common"
+)
+
+// AptRepoName contains the APT repository name.
+const AptRepoName = "apt"
+
+// packagesIndexExtensions lists extensions of Packages indexes in the order of preference.
+var packagesIndexExtensions = []string{".xz", ".gz", ""}
+
+// AptRepo holds data related to an APT repository mirror, e.g. a Debian or Ubuntu mirror.
+type AptRepo struct {
+	location      string
+	suites        []string
+	components    []string
+	architectures []string
+	keyring       openpgp.EntityList
+	Archives      []*Archive
+}
+
+// NewAptRepo returns new instance of APT repository. The location is a local path or a file://,
+// http:// or https:// URL of the directory holding dists/ and pool/. Packages are discovered in
+// Packages indexes of given suites, components and architectures, all components and
+// architectures listed in the release are used if they're not set. Releases are verified against
+// a given keyring, nil keyring disables the verification.
+func NewAptRepo(location string, suites, components, architectures []string, keyring openpgp.EntityList) *AptRepo {
+	return &AptRepo{location: location, suites: suites, components: components, architectures: architectures, keyring: keyring}
+}
+
+// RepoName returns repository name.
+func (r *AptRepo) RepoName() string {
+	return AptRepoName
+}
+
+// RepoPath returns repository path.
+func (r *AptRepo) RepoPath() string {
+	return r.location
+}
+
+// DiscoverRepo reads Packages indexes of the repository. Quick hashes of the archives are their
+// SHA256 digests listed in the indexes, so only archives that were not processed yet are
+// downloaded.
+func (r *AptRepo) DiscoverRepo() ([]hashr.Source, error) {
+	if len(r.suites) == 0 {
+		return nil, errors.New("no suites set")
+	}
+
+	archives := make(map[string]*Archive)
+	for _, suite := range r.suites {
+		if err := r.discoverSuite(suite, archives); err != nil {
+			glog.Warningf("Skipping suite %s: %v", suite, err)
+		}
+	}
+
+	var keys []string
+	for key := range archives {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sources []hashr.Source
+	for _, key := range keys {
+		r.Archives = append(r.Archives, archives[key])
+		sources = append(sources, archives[key])
+	}
+
+	return sources, nil
+}
+
+// discoverSuite adds archives listed in Packages indexes of a given suite to the archives map,
+// keyed by the package name, version and architecture.
+func (r *AptRepo) discoverSuite(suite string, archives map[string]*Archive) error {
+	content, entry, err := r.fetchRelease(suite)
+	if err != nil {
+		return err
+	}
+
+	paragraphs, err := parseControl(bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("could not parse release: %v", err)
+	}
+	if len(paragraphs) == 0 {
+		return errors.New("release is empty")
+	}
+	release := paragraphs[0]
+
+	indexes := make(map[string]string)
+	for _, line := range strings.Split(release["SHA256"], "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			indexes[fields[2]] = fields[0]
+		}
+	}
+
+	components := r.components
+	if len(components) == 0 {
+		components = strings.Fields(release["Components"])
+	}
+	architectures := r.architectures
+	if len(architectures) == 0 {
+		architectures = strings.Fields(release["Architectures"])
+	}
+
+	for _, component := range components {
+		for _, architecture := range architectures {
+			name := path.Join(component, "binary-"+architecture, "Packages")
+			packages, err := r.fetchPackagesIndex(suite, name, indexes)
+			if err != nil {
+				glog.Warningf("Skipping %s Packages index of suite %s: %v", name, suite, err)
+				continue
+			}
+
+			for _, p := range packages {
+				if p["Filename"] == "" || p["SHA256"] == "" || p["Package"] == "" {
+					continue
+				}
+				if common.ContainsDotDot(p["Filename"]) {
+					glog.Warningf("Skipping %s package listed in suite %s with path outside of the repository: %s", p["Package"], suite, p["Filename"])
+					continue
+				}
+				key := fmt.Sprintf("%s_%s_%s", p["Package"], p["Version"], p["Architecture"])
+				if _, ok := archives[key]; ok {
+					continue
+				}
+
+				archive := &Archive{
+					filename:        path.Base(p["Filename"]),
+					remotePath:      common.JoinLocation(r.location, p["Filename"]),
+					repoPath:        r.location,
+					repoName:        AptRepoName,
+					quickSha256hash: p["SHA256"],
+					indexSha256:     p["SHA256"],
+					keyring:         r.keyring,
+				}
+				if entry != nil {
+					archive.release = &packageEntry{sha256: p["SHA256"], release: entry.release, signer: entry.signer, err: entry.err}
+				}
+				archives[key] = archive
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchRelease returns the content of InRelease or, if the suite doesn't have it, Release file of a
+// given suite. If the keyring is set, the returned entry holds the result of the release signature
+// verification, it's nil for releases that are not signed.
+func (r *AptRepo) fetchRelease(suite string) ([]byte, *packageEntry, error) {
+	location := common.JoinLocation(r.location, "dists", suite, "InRelease")
+	data, err := common.ReadLocation(location)
+	var signature []byte
+	if errors.Is(err, fs.ErrNotExist) {
+		location = common.JoinLocation(r.location, "dists", suite, "Release")
+		if data, err = common.ReadLocation(location); err != nil {
+			return nil, nil, err
+		}
+
+		signature, err = common.ReadLocation(location + ".gpg")
+		if errors.Is(err, fs.ErrNotExist) {
+			return data, nil, nil
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content, signer, verificationErr, err := checkRelease(data, signature, r.keyring)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.keyring == nil {
+		return content, nil, nil
+	}
+
+	return content, &packageEntry{release: location, signer: signer, err: verificationErr}, nil
+}
+
+// fetchPackagesIndex returns paragraphs of a given Packages index of a suite. The index is checked
+// against its SHA256 digest listed in the release, compressed indexes are preferred.
+func (r *AptRepo) fetchPackagesIndex(suite, name string, indexes map[string]string) ([]map[string]string, error) {
+	for _, ext := range packagesIndexExtensions {
+		digest, ok := indexes[name+ext]
+		if !ok {
+			continue
+		}
+
+		data, err := common.ReadLocation(common.JoinLocation(r.location, "dists", suite, name+ext))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return decodePackagesIndex(name+ext, data, digest)
+	}
+
+	return nil, errors.New("index is not listed in the release or not found")
+}
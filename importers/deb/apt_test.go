@@ -0,0 +1,247 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/google/go-cmp/cmp"
+	"github.com/ulikunitz/xz"
+)
+
+type aptPackage struct {
+	name, version, arch string
+}
+
+func (p aptPackage) filename() string {
+	return fmt.Sprintf("pool/main/%s/%s/%s_%s_%s.deb", p.name[:1], p.name, p.name, p.version, p.arch)
+}
+
+// writeAptMirror writes an APT mirror with stable suite, signed with a given key, and updates
+// suite without a signature. Digest of broken package listed in the stable suite doesn't match the
+// package, escape package listed in the updates suite has a path outside of the mirror.
+func writeAptMirror(t *testing.T, signer *openpgp.Entity) string {
+	t.Helper()
+
+	mirror := t.TempDir()
+	debs := make(map[aptPackage][]byte)
+	for _, p := range []aptPackage{{"hello", "2.10-2", "amd64"}, {"hello-doc", "2.10-2", "all"}, {"broken", "1.0", "amd64"}} {
+		path := filepath.Join(mirror, p.filename())
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("could not create pool directory: %v", err)
+		}
+		control := map[string]string{"./control": fmt.Sprintf("Package: %s\nVersion: %s\nArchitecture: %s\nMaintainer: Example <noreply@example.com>\nDescription: HashR test package\n", p.name, p.version, p.arch)}
+		data := map[string]string{"./usr/share/doc/" + p.name + "/README": p.name}
+		writeAr(t, path, []string{"debian-binary", "control.tar.gz", "data.tar.gz"}, map[string][]byte{
+			"debian-binary":  []byte("2.0\n"),
+			"control.tar.gz": tarGz(t, []string{"./control"}, control),
+			"data.tar.gz":    tarGz(t, []string{"./usr/share/doc/" + p.name + "/README"}, data),
+		})
+		deb, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("could not read test package: %v", err)
+		}
+		debs[p] = deb
+	}
+
+	packages := func(pkgs ...aptPackage) []byte {
+		var b bytes.Buffer
+		for _, p := range pkgs {
+			digest := sha256.Sum256(debs[p])
+			if p.name == "broken" {
+				digest = sha256.Sum256(nil)
+			}
+			fmt.Fprintf(&b, "Package: %s\nVersion: %s\nArchitecture: %s\nFilename: %s\nSize: %d\nSHA256: %x\nDescription: HashR test package\n\n", p.name, p.version, p.arch, p.filename(), len(debs[p]), digest)
+		}
+		return b.Bytes()
+	}
+	writeIndexes := func(suite string, indexes map[string][]byte) string {
+		var release strings.Builder
+		fmt.Fprintf(&release, "Origin: HashR\nSuite: %s\nComponents: main\nArchitectures: amd64 arm64\nSHA256:\n", suite)
+		for name, data := range indexes {
+			path := filepath.Join(mirror, "dists", suite, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatalf("could not create dists directory: %v", err)
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatalf("could not write Packages index: %v", err)
+			}
+			fmt.Fprintf(&release, " %x %d %s\n", sha256.Sum256(data), len(data), name)
+		}
+		return release.String()
+	}
+
+	// Stable suite has clearsigned InRelease, the compressed index is preferred over the plain one.
+	var compressed bytes.Buffer
+	xw, err := xz.NewWriter(&compressed)
+	if err != nil {
+		t.Fatalf("could not create xz writer: %v", err)
+	}
+	xw.Write(packages(aptPackage{"hello", "2.10-2", "amd64"}, aptPackage{"hello-doc", "2.10-2", "all"}, aptPackage{"broken", "1.0", "amd64"}))
+	xw.Close()
+	release := writeIndexes("stable", map[string][]byte{
+		"main/binary-amd64/Packages.xz": compressed.Bytes(),
+		"main/binary-amd64/Packages":    []byte("Package: plain\nFilename: pool/main/p/plain/plain_1.0_amd64.deb\nSHA256: 00\n"),
+		"main/binary-arm64/Packages":    packages(aptPackage{"hello-doc", "2.10-2", "all"}),
+	})
+	var inRelease bytes.Buffer
+	w, err := clearsign.Encode(&inRelease, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatalf("could not create clearsigned writer: %v", err)
+	}
+	w.Write([]byte(release))
+	w.Close()
+	if err := os.WriteFile(filepath.Join(mirror, "dists", "stable", "InRelease"), inRelease.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write InRelease: %v", err)
+	}
+
+	// Updates suite has unsigned Release, hello package is also listed in stable suite and escape
+	// package points outside of the mirror.
+	release = writeIndexes("updates", map[string][]byte{
+		"main/binary-amd64/Packages": append(packages(aptPackage{"hello", "2.10-2", "amd64"}), []byte("Package: escape\nVersion: 1.0\nArchitecture: amd64\nFilename: pool/../../escape_1.0_amd64.deb\nSHA256: 00\n")...),
+	})
+	if err := os.WriteFile(filepath.Join(mirror, "dists", "updates", "Release"), []byte(release), 0644); err != nil {
+		t.Fatalf("could not write Release: %v", err)
+	}
+
+	return mirror
+}
+
+func TestAptDiscoverRepo(t *testing.T) {
+	signer, err := openpgp.NewEntity("Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate OpenPGP key: %v", err)
+	}
+	mirror := writeAptMirror(t, signer)
+	server := httptest.NewServer(http.FileServer(http.Dir(mirror)))
+	defer server.Close()
+
+	for _, location := range []string{server.URL, mirror, "file://" + mirror} {
+		t.Run(location, func(t *testing.T) {
+			repo := NewAptRepo(location, []string{"stable", "updates", "missing"}, nil, []string{"amd64"}, nil)
+			if repo.RepoName() != AptRepoName {
+				t.Errorf("RepoName() = %s; want = %s", repo.RepoName(), AptRepoName)
+			}
+
+			sources, err := repo.DiscoverRepo()
+			if err != nil {
+				t.Fatalf("unexpected error while discovering repo: %v", err)
+			}
+
+			type discovered struct {
+				RepoName, RemotePath, QuickHash string
+			}
+			got := make(map[string]discovered)
+			for _, source := range sources {
+				quickHash, err := source.QuickSHA256Hash()
+				if err != nil {
+					t.Fatalf("unexpected QuickSHA256Hash() error: %v", err)
+				}
+				got[source.ID()] = discovered{source.RepoName(), source.RemotePath(), quickHash}
+			}
+
+			want := make(map[string]discovered)
+			for _, p := range []aptPackage{{"hello", "2.10-2", "amd64"}, {"hello-doc", "2.10-2", "all"}, {"broken", "1.0", "amd64"}} {
+				data, err := os.ReadFile(filepath.Join(mirror, p.filename()))
+				if err != nil {
+					t.Fatalf("could not read test package: %v", err)
+				}
+				digest := sha256.Sum256(data)
+				if p.name == "broken" {
+					digest = sha256.Sum256(nil)
+				}
+				remotePath := filepath.Join(mirror, p.filename())
+				if location != mirror {
+					remotePath = location + "/" + p.filename()
+				}
+				want[filepath.Base(p.filename())] = discovered{AptRepoName, remotePath, fmt.Sprintf("%x", digest)}
+			}
+			if !cmp.Equal(want, got) {
+				t.Errorf("DiscoverRepo() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+			}
+		})
+	}
+}
+
+func TestAptPreprocess(t *testing.T) {
+	signer, err := openpgp.NewEntity("Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate OpenPGP key: %v", err)
+	}
+	mirror := writeAptMirror(t, signer)
+	server := httptest.NewServer(http.FileServer(http.Dir(mirror)))
+	defer server.Close()
+
+	// Only hello package is listed in updates suite, which is not signed.
+	for _, tc := range []struct {
+		suite   string
+		want    map[string]string
+		wantErr map[string]bool
+	}{
+		{
+			suite: "stable",
+			want: map[string]string{
+				"hello_2.10-2_amd64.deb":   fmt.Sprintf("Package: hello 2.10-2 (amd64), Maintainer: Example <noreply@example.com>, Source: hello, OpenPGP signature: verified (listed in %s/dists/stable/InRelease signed by Signer <signer@example.com>)", server.URL),
+				"hello-doc_2.10-2_all.deb": fmt.Sprintf("Package: hello-doc 2.10-2 (all), Maintainer: Example <noreply@example.com>, Source: hello-doc, OpenPGP signature: verified (listed in %s/dists/stable/InRelease signed by Signer <signer@example.com>)", server.URL),
+			},
+			wantErr: map[string]bool{"broken_1.0_amd64.deb": true},
+		},
+		{
+			suite: "updates",
+			want: map[string]string{
+				"hello_2.10-2_amd64.deb": "Package: hello 2.10-2 (amd64), Maintainer: Example <noreply@example.com>, Source: hello, OpenPGP signature: unsigned (no debsig signature found and not listed in a signed release)",
+			},
+		},
+	} {
+		t.Run(tc.suite, func(t *testing.T) {
+			sources, err := NewAptRepo(server.URL, []string{tc.suite}, []string{"main"}, []string{"amd64"}, openpgp.EntityList{signer}).DiscoverRepo()
+			if err != nil {
+				t.Fatalf("unexpected error while discovering repo: %v", err)
+			}
+
+			got := make(map[string]string)
+			for _, source := range sources {
+				extractionDir, err := source.Preprocess()
+				if tc.wantErr[source.ID()] {
+					if err == nil || !strings.Contains(err.Error(), "does not match") {
+						t.Errorf("Preprocess() of %s error = %v, want digest mismatch", source.ID(), err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("unexpected Preprocess() error: %v", err)
+				}
+				if _, err := os.Stat(filepath.Join(extractionDir, "usr", "share", "doc")); err != nil {
+					t.Errorf("Preprocess() did not extract %s: %v", source.ID(), err)
+				}
+				got[source.ID()] = source.Description()
+			}
+
+			if !cmp.Equal(tc.want, got) {
+				t.Errorf("Description() unexpected diff (-want/+got):\n%s", cmp.Diff(tc.want, got))
+			}
+		})
+	}
+}
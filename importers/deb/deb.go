@@ -24,8 +24,10 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/golang/glog"
 
+	hashrCommon "github.com/google/hashr/common"
 	"github.com/google/hashr/core/hashr"
 	"github.com/google/hashr/importers/common"
 
@@ -40,11 +42,24 @@ const (
 
 // Archive holds data related to deb archive.
 type Archive struct {
-	filename        string
-	remotePath      string
-	localPath       string
-	quickSha256hash string
-	repoPath        string
+	filename         string
+	remotePath       string
+	localPath        string
+	quickSha256hash  string
+	repoPath         string
+	keyring          openpgp.EntityList
+	release          *packageEntry
+	signatureStatus  string
+	signatureDetails string
+	metadata         *hashrCommon.SourceMetadata
+	extractionDir    string
+	// repoName is set for archives discovered in APT repositories.
+	repoName string
+	// indexSha256 is the SHA256 digest listed in the Packages index the archive was discovered in,
+	// the copied archive must match it.
+	indexSha256 string
+	// sha256 is the SHA256 digest of the copied archive, it's calculated once when needed.
+	sha256 string
 }
 
 func isSubElem(parent, sub string) (bool, error) {
@@ -141,7 +156,96 @@ func extractDeb(debPath, outputFolder string) error {
 	return nil
 }
 
-// Preprocess extracts the contents of a .deb file.
+// verifyDebsig verifies the debsig origin signature of a given .deb file, which covers the
+// debian-binary, control and data members. The last return value is false if the package has no
+// origin signature.
+func verifyDebsig(debPath string, keyring openpgp.EntityList) (string, string, bool) {
+	fd, err := os.Open(debPath)
+	if err != nil {
+		return hashr.SignatureUnverified, fmt.Sprintf("failed to open deb file: %v", err), true
+	}
+	defer fd.Close()
+
+	ar, err := deb.LoadAr(fd)
+	if err != nil {
+		return hashr.SignatureUnverified, fmt.Sprintf("failed to parse deb file: %v", err), true
+	}
+
+	var signed []io.Reader
+	var signature []byte
+	for {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return hashr.SignatureUnverified, fmt.Sprintf("failed to parse deb file: %v", err), true
+		}
+		name := strings.TrimSuffix(entry.Name, "/")
+		switch {
+		case name == "_gpgorigin":
+			if signature, err = io.ReadAll(entry.Data); err != nil {
+				return hashr.SignatureUnverified, fmt.Sprintf("could not read signature: %v", err), true
+			}
+		case name == "debian-binary", strings.HasPrefix(name, "control.tar"), strings.HasPrefix(name, "data.tar"):
+			signed = append(signed, entry.Data)
+		}
+	}
+	if signature == nil {
+		return "", "", false
+	}
+
+	signer, err := common.CheckDetachedSignature(keyring, io.MultiReader(signed...), signature)
+	if err != nil {
+		return hashr.SignatureUnverified, common.SignatureError(err), true
+	}
+
+	return hashr.SignatureVerified, common.SignerName(signer), true
+}
+
+// verify checks the debsig signature of the .deb file or, if it has none, its SHA256 digest
+// listed in a Packages index of a signed release.
+func (a *Archive) verify() (string, string) {
+	if status, details, ok := verifyDebsig(a.localPath, a.keyring); ok {
+		return status, details
+	}
+
+	if a.release == nil {
+		return hashr.SignatureUnsigned, "no debsig signature found and not listed in a signed release"
+	}
+	if a.release.err != "" {
+		return hashr.SignatureUnverified, fmt.Sprintf("%s: %s", a.release.release, a.release.err)
+	}
+
+	digest, err := a.digest()
+	if err != nil {
+		return hashr.SignatureUnverified, fmt.Sprintf("failed to read deb file: %v", err)
+	}
+	if digest != a.release.sha256 {
+		return hashr.SignatureUnverified, fmt.Sprintf("SHA256 digest %s does not match %s listed in %s", digest, a.release.sha256, a.release.release)
+	}
+
+	return hashr.SignatureVerified, fmt.Sprintf("listed in %s signed by %s", a.release.release, a.release.signer)
+}
+
+// digest returns the SHA256 digest of the copied .deb file.
+func (a *Archive) digest() (string, error) {
+	if a.sha256 != "" {
+		return a.sha256, nil
+	}
+
+	f, err := os.Open(a.localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	a.sha256, err = common.Digest("sha256", f)
+	return a.sha256, err
+}
+
+// Preprocess extracts the contents of a .deb file and verifies its signature, if the keyring is
+// set.
 func (a *Archive) Preprocess() (string, error) {
 	var err error
 	a.localPath, err = common.CopyToLocal(a.remotePath, a.ID())
@@ -149,14 +253,32 @@ func (a *Archive) Preprocess() (string, error) {
 		return "", fmt.Errorf("error while copying %s to local file system: %v", a.remotePath, err)
 	}
 
+	if a.indexSha256 != "" {
+		digest, err := a.digest()
+		if err != nil {
+			return "", fmt.Errorf("failed to read deb file: %v", err)
+		}
+		if digest != a.indexSha256 {
+			return "", fmt.Errorf("SHA256 digest %s does not match %s listed in the Packages index", digest, a.indexSha256)
+		}
+	}
+
+	if a.keyring != nil {
+		a.signatureStatus, a.signatureDetails = a.verify()
+	}
+
 	baseDir, _ := filepath.Split(a.localPath)
-	extractionDir := filepath.Join(baseDir, "extracted")
+	a.extractionDir = filepath.Join(baseDir, "extracted")
 
-	if err := extractDeb(a.localPath, extractionDir); err != nil {
+	if err := extractDeb(a.localPath, a.extractionDir); err != nil {
 		return "", err
 	}
 
-	return extractionDir, nil
+	if a.metadata, err = readMetadata(a.localPath, a.extractionDir); err != nil {
+		glog.Warningf("Could not read metadata of %s: %v", a.ID(), err)
+	}
+
+	return a.extractionDir, nil
 }
 
 // ID returns non-unique deb Archive ID.
@@ -166,6 +288,9 @@ func (a *Archive) ID() string {
 
 // RepoName returns repository name.
 func (a *Archive) RepoName() string {
+	if a.repoName != "" {
+		return a.repoName
+	}
 	return RepoName
 }
 
@@ -186,7 +311,27 @@ func (a *Archive) RemotePath() string {
 
 // Description provides additional description for a .deb file.
 func (a *Archive) Description() string {
-	return ""
+	return common.JoinDescriptions(common.PackageDescription(a.metadata), common.SignatureDescription(a.signatureStatus, a.signatureDetails))
+}
+
+// Metadata returns package metadata read from the control archive.
+func (a *Archive) Metadata() *hashrCommon.SourceMetadata {
+	return a.metadata
+}
+
+// CheckSamples compares samples extracted from the .deb file with md5sums and conffiles of the
+// package. Packages without md5sums are not checked.
+func (a *Archive) CheckSamples(samples []hashrCommon.Sample) []string {
+	if a.metadata == nil || len(a.metadata.Files) == 0 {
+		return nil
+	}
+
+	return common.CheckManifest(a.metadata.Files, samples, a.extractionDir)
+}
+
+// SignatureStatus returns the result of .deb signature verification.
+func (a *Archive) SignatureStatus() (string, string) {
+	return a.signatureStatus, a.signatureDetails
 }
 
 // QuickSHA256Hash calculates sha256 hash of .deb file.
@@ -233,14 +378,16 @@ func (a *Archive) QuickSHA256Hash() (string, error) {
 	return a.quickSha256hash, nil
 }
 
-// NewRepo returns new instance of deb repository.
-func NewRepo(path string) *Repo {
-	return &Repo{location: path}
+// NewRepo returns new instance of deb repository. Archives are verified against a given keyring,
+// nil keyring disables the verification.
+func NewRepo(path string, keyring openpgp.EntityList) *Repo {
+	return &Repo{location: path, keyring: keyring}
 }
 
 // Repo holds data related to a deb repository.
 type Repo struct {
 	location string
+	keyring  openpgp.EntityList
 	files    []string
 	Archives []*Archive
 }
@@ -262,11 +409,20 @@ func (r *Repo) DiscoverRepo() ([]hashr.Source, error) {
 		return nil, err
 	}
 
+	var packages map[string]*packageEntry
+	if r.keyring != nil {
+		var err error
+		packages, err = loadReleases(r.location, r.keyring)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading releases: %v", err)
+		}
+	}
+
 	for _, file := range r.files {
 		_, filename := filepath.Split(file)
 
 		if strings.HasSuffix(filename, ".deb") {
-			r.Archives = append(r.Archives, &Archive{filename: filename, remotePath: file, repoPath: r.location})
+			r.Archives = append(r.Archives, &Archive{filename: filename, remotePath: file, repoPath: r.location, keyring: r.keyring, release: packages[filepath.Clean(file)]})
 		}
 	}
 
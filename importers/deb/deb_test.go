@@ -15,15 +15,25 @@
 package deb
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
 	"github.com/google/go-cmp/cmp"
+	hashrCommon "github.com/google/hashr/common"
+	"pault.ag/go/debian/deb"
 )
 
 func sha256sum(path string) ([32]byte, error) {
@@ -36,7 +46,7 @@ func sha256sum(path string) ([32]byte, error) {
 }
 
 func testImages() ([]*Archive, error) {
-	debRepo := NewRepo("testdata")
+	debRepo := NewRepo("testdata", nil)
 	gotSources, err := debRepo.DiscoverRepo()
 	if err != nil {
 		return nil, fmt.Errorf("unexpected error while discovering repo: %v", err)
@@ -422,7 +432,7 @@ func TestImageFunctions(t *testing.T) {
 
 func TestRepoFunctions(t *testing.T) {
 	repoPath := "/tmp/deb-repo"
-	repo := NewRepo(repoPath)
+	repo := NewRepo(repoPath, nil)
 
 	if repo.RepoName() != RepoName {
 		t.Errorf("RepoName() = %s; want = %s", repo.RepoName(), RepoName)
@@ -432,3 +442,248 @@ func TestRepoFunctions(t *testing.T) {
 		t.Errorf("RepoPath() = %s; want = %s", repo.RepoPath(), repoPath)
 	}
 }
+
+// writeAr writes an ar archive with given members, in the format used by .deb files.
+func writeAr(t *testing.T, path string, names []string, members map[string][]byte) {
+	t.Helper()
+
+	var b bytes.Buffer
+	b.WriteString("!<arch>\n")
+	for _, name := range names {
+		data := members[name]
+		fmt.Fprintf(&b, "%-16s%-12s%-6s%-6s%-8s%-10d`\n", name, "0", "0", "0", "100644", len(data))
+		b.Write(data)
+		if len(data)%2 == 1 {
+			b.WriteByte('\n')
+		}
+	}
+
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write %s: %v", path, err)
+	}
+}
+
+func TestSignatureStatus(t *testing.T) {
+	signer, err := openpgp.NewEntity("Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate OpenPGP key: %v", err)
+	}
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate OpenPGP key: %v", err)
+	}
+
+	f, err := os.Open("testdata/20200106.00.00/ubuntu-desktop.deb")
+	if err != nil {
+		t.Fatalf("could not open test package: %v", err)
+	}
+	defer f.Close()
+	ar, err := deb.LoadAr(f)
+	if err != nil {
+		t.Fatalf("could not parse test package: %v", err)
+	}
+	var names []string
+	members := make(map[string][]byte)
+	for {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("could not parse test package: %v", err)
+		}
+		names = append(names, entry.Name)
+		if members[entry.Name], err = ioutil.ReadAll(entry.Data); err != nil {
+			t.Fatalf("could not read test package: %v", err)
+		}
+	}
+
+	repoPath := t.TempDir()
+	pool := filepath.Join(repoPath, "pool", "main", "u")
+	if err := os.MkdirAll(pool, 0755); err != nil {
+		t.Fatalf("could not create pool directory: %v", err)
+	}
+
+	// Packages with debsig origin signatures.
+	var signed []byte
+	for _, name := range names {
+		signed = append(signed, members[name]...)
+	}
+	for name, key := range map[string]*openpgp.Entity{"debsig-signed.deb": signer, "debsig-other.deb": other} {
+		var sig bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&sig, key, bytes.NewReader(signed), nil); err != nil {
+			t.Fatalf("could not sign test package: %v", err)
+		}
+		members["_gpgorigin"] = sig.Bytes()
+		writeAr(t, filepath.Join(repoPath, name), append(names, "_gpgorigin"), members)
+	}
+
+	// Packages listed in a signed release, modified.deb doesn't match the digest from the index.
+	data, err := ioutil.ReadFile("testdata/20200106.00.00/ubuntu-desktop.deb")
+	if err != nil {
+		t.Fatalf("could not read test package: %v", err)
+	}
+	for _, name := range []string{"listed.deb", "modified.deb", "unlisted.deb"} {
+		if err := ioutil.WriteFile(filepath.Join(pool, name), data, 0644); err != nil {
+			t.Fatalf("could not write test package: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(pool, "modified.deb"), append(data, 0), 0644); err != nil {
+		t.Fatalf("could not write test package: %v", err)
+	}
+
+	var packages bytes.Buffer
+	gz := gzip.NewWriter(&packages)
+	for _, name := range []string{"listed.deb", "modified.deb"} {
+		fmt.Fprintf(gz, "Package: %s\nVersion: 1.0\nFilename: pool/main/u/%s\nSHA256: %x\nDescription: HashR test package\n multiline description\n\n", name, name, sha256.Sum256(data))
+	}
+	gz.Close()
+	indexDir := filepath.Join(repoPath, "dists", "stable", "main", "binary-amd64")
+	if err := os.MkdirAll(indexDir, 0755); err != nil {
+		t.Fatalf("could not create dists directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(indexDir, "Packages.gz"), packages.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write Packages index: %v", err)
+	}
+
+	release := filepath.Join(repoPath, "dists", "stable", "InRelease")
+	var inRelease bytes.Buffer
+	w, err := clearsign.Encode(&inRelease, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatalf("could not create clearsigned writer: %v", err)
+	}
+	fmt.Fprintf(w, "Origin: HashR\nSuite: stable\nSHA256:\n %x %d main/binary-amd64/Packages.gz\n %x %d main/binary-amd64/Packages\n", sha256.Sum256(packages.Bytes()), packages.Len(), sha256.Sum256(nil), 0)
+	w.Close()
+	if err := ioutil.WriteFile(release, inRelease.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write InRelease: %v", err)
+	}
+
+	sources, err := NewRepo(repoPath, openpgp.EntityList{signer}).DiscoverRepo()
+	if err != nil {
+		t.Fatalf("unexpected error while discovering repo: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, source := range sources {
+		if _, err := source.Preprocess(); err != nil {
+			t.Fatalf("unexpected Preprocess() error: %v", err)
+		}
+		got[source.ID()] = source.Description()
+	}
+
+	want := map[string]string{
+		"debsig-signed.deb": "Package: hashr-testdata 1.0 (arm64), Maintainer: Example <noreply@example.com>, Source: hashr-testdata, OpenPGP signature: verified (Signer <signer@example.com>)",
+		"debsig-other.deb":  "Package: hashr-testdata 1.0 (arm64), Maintainer: Example <noreply@example.com>, Source: hashr-testdata, OpenPGP signature: unverified (signed with a key that is not in the keyring)",
+		"listed.deb":        fmt.Sprintf("Package: hashr-testdata 1.0 (arm64), Maintainer: Example <noreply@example.com>, Source: hashr-testdata, OpenPGP signature: verified (listed in %s signed by Signer <signer@example.com>)", release),
+		"modified.deb":      fmt.Sprintf("Package: hashr-testdata 1.0 (arm64), Maintainer: Example <noreply@example.com>, Source: hashr-testdata, OpenPGP signature: unverified (SHA256 digest %x does not match %x listed in %s)", sha256.Sum256(append(data, 0)), sha256.Sum256(data), release),
+		"unlisted.deb":      "Package: hashr-testdata 1.0 (arm64), Maintainer: Example <noreply@example.com>, Source: hashr-testdata, OpenPGP signature: unsigned (no debsig signature found and not listed in a signed release)",
+	}
+	if !cmp.Equal(want, got) {
+		t.Errorf("Description() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+	}
+}
+
+// tarGz returns a gzip compressed tar archive with given regular files.
+func tarGz(t *testing.T, names []string, files map[string]string) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("could not write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatalf("could not write tar entry: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("could not close tar writer: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("could not close gzip writer: %v", err)
+	}
+
+	return b.Bytes()
+}
+
+func TestMetadata(t *testing.T) {
+	copyright := `Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/
+Upstream-Name: hello
+
+Files: *
+Copyright: 2022 Example
+License: GPL-3+
+
+Files: debian/*
+Copyright: 2022 Example
+License: GPL-3+ or Apache-2.0
+
+License: GPL-3+
+ This program is free software.
+`
+	data := map[string]string{
+		"./etc/hello.conf":                "greeting=hello",
+		"./usr/bin/hello":                 "hello",
+		"./usr/share/doc/hello/copyright": copyright,
+	}
+	control := map[string]string{
+		"./control":   "Package: hello\nSource: hello-src (2.10-2)\nVersion: 2.10-2+b1\nArchitecture: amd64\nMaintainer: Example <noreply@example.com>\nDescription: HashR test package\n",
+		"./md5sums":   fmt.Sprintf("%x  usr/bin/hello\n%x  usr/share/doc/hello/copyright\n", md5.Sum([]byte("hello")), md5.Sum([]byte(copyright))),
+		"./conffiles": "/etc/hello.conf\nremove-on-upgrade /etc/hello.d/old.conf\n",
+	}
+
+	repoPath := t.TempDir()
+	names := []string{"debian-binary", "control.tar.gz", "data.tar.gz"}
+	writeAr(t, filepath.Join(repoPath, "hello.deb"), names, map[string][]byte{
+		"debian-binary":  []byte("2.0\n"),
+		"control.tar.gz": tarGz(t, []string{"./control", "./md5sums", "./conffiles"}, control),
+		"data.tar.gz":    tarGz(t, []string{"./etc/hello.conf", "./usr/bin/hello", "./usr/share/doc/hello/copyright"}, data),
+	})
+
+	archive := &Archive{filename: "hello.deb", remotePath: filepath.Join(repoPath, "hello.deb"), repoPath: repoPath}
+	extractionDir, err := archive.Preprocess()
+	if err != nil {
+		t.Fatalf("unexpected Preprocess() error: %v", err)
+	}
+
+	want := &hashrCommon.SourceMetadata{
+		Name:          "hello",
+		Version:       "2.10-2+b1",
+		Architecture:  "amd64",
+		Maintainer:    "Example <noreply@example.com>",
+		SourcePackage: "hello-src",
+		License:       "GPL-3+ AND GPL-3+ or Apache-2.0",
+		Files: []hashrCommon.FileDigest{
+			{Path: "/usr/bin/hello", Algorithm: "md5", Digest: fmt.Sprintf("%x", md5.Sum([]byte("hello")))},
+			{Path: "/usr/share/doc/hello/copyright", Algorithm: "md5", Digest: fmt.Sprintf("%x", md5.Sum([]byte(copyright)))},
+			{Path: "/etc/hello.conf"},
+		},
+	}
+	if diff := cmp.Diff(want, archive.Metadata()); diff != "" {
+		t.Errorf("Metadata() unexpected diff (-want/+got):\n%s", diff)
+	}
+
+	if got, want := archive.Description(), "Package: hello 2.10-2+b1 (amd64), Maintainer: Example <noreply@example.com>, Source: hello-src, License: GPL-3+ AND GPL-3+ or Apache-2.0"; got != want {
+		t.Errorf("Description() = %q, want %q", got, want)
+	}
+
+	var samples []hashrCommon.Sample
+	for name, content := range data {
+		localPath := filepath.Join(extractionDir, name)
+		samples = append(samples, hashrCommon.Sample{
+			Sha256:      fmt.Sprintf("%x", sha256.Sum256([]byte(content))),
+			Paths:       []string{localPath},
+			SourcePaths: []string{strings.TrimPrefix(localPath, "/")},
+		})
+	}
+	if got := archive.CheckSamples(samples); len(got) != 0 {
+		t.Errorf("CheckSamples() = %v, want no warnings", got)
+	}
+
+	samples = append(samples, hashrCommon.Sample{Sha256: "sha256", SourcePaths: []string{filepath.Join(extractionDir, "usr/bin/hello2")}})
+	if got, want := archive.CheckSamples(samples), []string{"/usr/bin/hello2: extracted, but not listed in the package"}; !cmp.Equal(want, got) {
+		t.Errorf("CheckSamples() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"pault.ag/go/debian/deb"
+
+	hashrCommon "github.com/google/hashr/common"
+)
+
+// readMetadata returns package metadata read from the control archive of a given .deb file. The
+// license is read from the machine-readable copyright file of the package, if it was extracted to
+// extractionDir.
+func readMetadata(debPath, extractionDir string) (*hashrCommon.SourceMetadata, error) {
+	fd, err := os.Open(debPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open deb file: %v", err)
+	}
+	defer fd.Close()
+
+	ar, err := deb.LoadAr(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse deb file: %v", err)
+	}
+
+	for {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			return nil, errors.New("control archive not found")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse deb file: %v", err)
+		}
+		if strings.HasPrefix(strings.TrimSuffix(entry.Name, "/"), "control.tar") {
+			m, err := readControlArchive(entry)
+			if err != nil {
+				return nil, err
+			}
+			m.License = readLicense(filepath.Join(extractionDir, "usr", "share", "doc", m.Name, "copyright"))
+			return m, nil
+		}
+	}
+}
+
+// readControlArchive reads the control file, md5sums and conffiles of a package from its control
+// archive.
+func readControlArchive(entry *deb.ArEntry) (*hashrCommon.SourceMetadata, error) {
+	tr, closer, err := entry.Tarfile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control archive: %v", err)
+	}
+	defer closer.Close()
+
+	var m *hashrCommon.SourceMetadata
+	var files, conffiles []hashrCommon.FileDigest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read control archive: %v", err)
+		}
+
+		switch path.Clean(header.Name) {
+		case "control":
+			paragraphs, err := parseControl(tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse control file: %v", err)
+			}
+			if len(paragraphs) == 0 || paragraphs[0]["Package"] == "" {
+				return nil, errors.New("control file does not contain package name")
+			}
+			control := paragraphs[0]
+
+			// Source field holds the version of the source package if it differs from the package version.
+			source := control["Package"]
+			if fields := strings.Fields(control["Source"]); len(fields) > 0 {
+				source = fields[0]
+			}
+
+			m = &hashrCommon.SourceMetadata{
+				Name:          control["Package"],
+				Version:       control["Version"],
+				Architecture:  control["Architecture"],
+				Maintainer:    control["Maintainer"],
+				SourcePackage: source,
+			}
+		case "md5sums":
+			if files, err = readMD5Sums(tr); err != nil {
+				return nil, fmt.Errorf("failed to parse md5sums: %v", err)
+			}
+		case "conffiles":
+			if conffiles, err = readConffiles(tr); err != nil {
+				return nil, fmt.Errorf("failed to parse conffiles: %v", err)
+			}
+		}
+	}
+	if m == nil {
+		return nil, errors.New("control file not found")
+	}
+	// Conffiles are not listed in md5sums, their digests are stored only once they're installed.
+	m.Files = append(files, conffiles...)
+
+	return m, nil
+}
+
+// readMD5Sums parses md5sums file, which lists MD5 digests of regular files in the data archive.
+func readMD5Sums(r io.Reader) ([]hashrCommon.FileDigest, error) {
+	var files []hashrCommon.FileDigest
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// Lines have the md5sum format: digest, two spaces and the path relative to the root.
+		parts := strings.SplitN(line, "  ", 2)
+		if len(parts) != 2 || len(parts[0]) != 32 {
+			return nil, fmt.Errorf("malformed line: %q", line)
+		}
+		files = append(files, hashrCommon.FileDigest{Path: path.Join("/", parts[1]), Algorithm: "md5", Digest: strings.ToLower(parts[0])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// readConffiles parses conffiles file, which lists absolute paths of configuration files shipped in
+// the data archive.
+func readConffiles(r io.Reader) ([]hashrCommon.FileDigest, error) {
+	var files []hashrCommon.FileDigest
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Lines with flags, e.g. remove-on-upgrade, list files that are not shipped in the package.
+		if len(fields) != 1 {
+			continue
+		}
+		files = append(files, hashrCommon.FileDigest{Path: path.Clean(fields[0])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// readLicense returns licenses listed in a machine-readable debian/copyright file. Empty string is
+// returned if the file doesn't exist or uses a different format.
+func readLicense(copyrightPath string) string {
+	data, err := os.ReadFile(copyrightPath)
+	if err != nil || !bytes.HasPrefix(data, []byte("Format:")) {
+		return ""
+	}
+
+	paragraphs, err := parseControl(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+
+	var licenses []string
+	seen := make(map[string]bool)
+	for i, p := range paragraphs {
+		// Standalone License paragraphs hold texts of licenses referenced by Files paragraphs.
+		if _, ok := p["Files"]; !ok && i > 0 {
+			continue
+		}
+		license := strings.TrimSpace(strings.SplitN(p["License"], "\n", 2)[0])
+		if license != "" && !seen[license] {
+			seen[license] = true
+			licenses = append(licenses, license)
+		}
+	}
+
+	return strings.Join(licenses, " AND ")
+}
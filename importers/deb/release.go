@@ -0,0 +1,267 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/golang/glog"
+	"github.com/ulikunitz/xz"
+
+	"github.com/google/hashr/importers/common"
+)
+
+// packageEntry holds data related to a package listed in a Packages index of an APT release.
+type packageEntry struct {
+	sha256  string
+	release string
+	signer  string
+	// err holds the reason the release signature could not be verified.
+	err string
+}
+
+// loadReleases verifies InRelease and Release files found in a given location and returns the
+// packages listed in their Packages indexes, keyed by the package path.
+func loadReleases(location string, keyring openpgp.EntityList) (map[string]*packageEntry, error) {
+	var releases []string
+	err := filepath.Walk(location, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			glog.Errorf("Could not open %s: %v", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch info.Name() {
+		case "InRelease":
+			releases = append(releases, path)
+		case "Release":
+			// InRelease holds the same data, Release is used only by repositories without it.
+			if _, err := os.Stat(filepath.Join(filepath.Dir(path), "InRelease")); os.IsNotExist(err) {
+				releases = append(releases, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	packages := make(map[string]*packageEntry)
+	for _, release := range releases {
+		if err := loadRelease(release, keyring, packages); err != nil {
+			glog.Warningf("Skipping release %s: %v", release, err)
+		}
+	}
+
+	return packages, nil
+}
+
+// loadRelease verifies a given release and adds the packages it lists to the packages map.
+// Packages from releases with verified signatures take precedence.
+func loadRelease(release string, keyring openpgp.EntityList, packages map[string]*packageEntry) error {
+	// Package paths in Packages indexes are relative to the directory holding dists/.
+	releaseDir := filepath.Dir(release)
+	dir := string(filepath.Separator) + releaseDir
+	idx := strings.LastIndex(dir, string(filepath.Separator)+"dists"+string(filepath.Separator))
+	if idx == -1 {
+		return errors.New("release is not stored in dists directory")
+	}
+	root := dir[1 : idx+1]
+
+	content, signer, verificationErr, err := verifyRelease(release, keyring)
+	if err != nil {
+		return err
+	}
+
+	paragraphs, err := parseControl(bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("could not parse release: %v", err)
+	}
+	if len(paragraphs) == 0 {
+		return errors.New("release is empty")
+	}
+
+	for _, line := range strings.Split(paragraphs[0]["SHA256"], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		switch filepath.Base(fields[2]) {
+		case "Packages", "Packages.gz", "Packages.xz":
+		default:
+			continue
+		}
+
+		index := filepath.Join(releaseDir, fields[2])
+		if _, err := os.Stat(index); os.IsNotExist(err) {
+			continue
+		}
+		entries, err := readPackagesIndex(index, fields[0])
+		if err != nil {
+			glog.Warningf("Skipping Packages index %s: %v", index, err)
+			continue
+		}
+		for filename, digest := range entries {
+			path := filepath.Join(root, filename)
+			if existing, ok := packages[path]; ok && (existing.err == "" || verificationErr != "") {
+				continue
+			}
+			packages[path] = &packageEntry{sha256: digest, release: release, signer: signer, err: verificationErr}
+		}
+	}
+
+	return nil
+}
+
+// verifyRelease returns the content of a given InRelease or Release file and the result of its
+// OpenPGP signature verification. Release files without Release.gpg signature are returned as an
+// error.
+func verifyRelease(release string, keyring openpgp.EntityList) ([]byte, string, string, error) {
+	data, err := os.ReadFile(release)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	var signature []byte
+	if filepath.Base(release) != "InRelease" {
+		signature, err = os.ReadFile(release + ".gpg")
+		if os.IsNotExist(err) {
+			return nil, "", "", errors.New("release is not signed")
+		}
+		if err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	return checkRelease(data, signature, keyring)
+}
+
+// checkRelease returns the content of a release and the result of its OpenPGP signature
+// verification. Releases without a detached signature must be clearsigned, as InRelease files are.
+func checkRelease(data, signature []byte, keyring openpgp.EntityList) ([]byte, string, string, error) {
+	if signature == nil {
+		block, _ := clearsign.Decode(data)
+		if block == nil {
+			return nil, "", "", errors.New("InRelease is not clearsigned")
+		}
+		signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil)
+		if err != nil {
+			return block.Plaintext, "", common.SignatureError(err), nil
+		}
+		return block.Plaintext, common.SignerName(signer), "", nil
+	}
+
+	signer, err := common.CheckDetachedSignature(keyring, bytes.NewReader(data), signature)
+	if err != nil {
+		return data, "", common.SignatureError(err), nil
+	}
+	return data, common.SignerName(signer), "", nil
+}
+
+// readPackagesIndex checks the digest of a given, optionally compressed, Packages index and returns
+// SHA256 digests of the packages it lists, keyed by their file names.
+func readPackagesIndex(path, digest string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	paragraphs, err := decodePackagesIndex(path, data, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]string)
+	for _, p := range paragraphs {
+		if p["Filename"] != "" && p["SHA256"] != "" {
+			entries[p["Filename"]] = p["SHA256"]
+		}
+	}
+
+	return entries, nil
+}
+
+// decodePackagesIndex checks the SHA256 digest of a Packages index, decompresses it based on the
+// extension of its name and returns its paragraphs.
+func decodePackagesIndex(name string, data []byte, digest string) ([]map[string]string, error) {
+	if got := fmt.Sprintf("%x", sha256.Sum256(data)); got != digest {
+		return nil, fmt.Errorf("SHA256 digest %s does not match %s listed in the release", got, digest)
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+	var err error
+	switch filepath.Ext(name) {
+	case ".gz":
+		r, err = gzip.NewReader(r)
+	case ".xz":
+		r, err = xz.NewReader(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress index: %v", err)
+	}
+
+	return parseControl(r)
+}
+
+// parseControl parses paragraphs of a deb822 control file. Continuation lines of multiline fields
+// are joined with new lines.
+func parseControl(r io.Reader) ([]map[string]string, error) {
+	var paragraphs []map[string]string
+	var paragraph map[string]string
+	var field string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			paragraph = nil
+		case strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"):
+			if paragraph == nil || field == "" {
+				return nil, fmt.Errorf("unexpected continuation line: %q", line)
+			}
+			paragraph[field] = strings.TrimLeft(paragraph[field]+"\n"+strings.TrimSpace(line), "\n")
+		default:
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("malformed line: %q", line)
+			}
+			if paragraph == nil {
+				paragraph = make(map[string]string)
+				paragraphs = append(paragraphs, paragraph)
+			}
+			field = parts[0]
+			paragraph[field] = strings.TrimSpace(parts[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return paragraphs, nil
+}
@@ -0,0 +1,329 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcr
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/google/hashr/core/hashr"
+)
+
+const (
+	cosignSignatureAnnotation    = "dev.cosignproject.cosign/signature"
+	cosignSimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureType          = "cosign container image signature"
+	dsseEnvelopeMediaType        = "application/vnd.dsse.envelope.v1+json"
+	inTotoPayloadType            = "application/vnd.in-toto+json"
+)
+
+// PublicKey holds a public key used to verify cosign signatures of images.
+type PublicKey struct {
+	Name string
+	Key  crypto.PublicKey
+}
+
+// LoadPublicKeys reads PEM encoded ECDSA, RSA or Ed25519 public keys, e.g. cosign.pub files
+// created by cosign generate-key-pair. Keys are named after their files.
+func LoadPublicKeys(paths ...string) ([]*PublicKey, error) {
+	var keys []*PublicKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read public key %s: %v", path, err)
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data found in %s", path)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse public key %s: %v", path, err)
+		}
+		switch key.(type) {
+		case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T in %s", key, path)
+		}
+
+		keys = append(keys, &PublicKey{Name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), Key: key})
+	}
+
+	return keys, nil
+}
+
+// simpleSigning is the payload signed by cosign, in the Red Hat simple signing format.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// dsseEnvelope holds an attestation signed by cosign attest.
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// inTotoStatement holds the fields of in-toto attestation used to describe image provenance.
+type inTotoStatement struct {
+	PredicateType string `json:"predicateType"`
+	Subject       []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	Predicate struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+	} `json:"predicate"`
+}
+
+// verifyImage verifies cosign signatures of a given image digest against the public keys and
+// returns the signature status and details. Signatures and attestations are fetched from the
+// registry using cosign tag conventions, verification itself doesn't use transparency logs.
+func verifyImage(ref name.Digest, keys []*PublicKey) (string, string) {
+	payloads, err := cosignArtifacts(ref, "sig", cosignSimpleSigningMediaType)
+	if err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			return hashr.SignatureUnsigned, "no cosign signature found"
+		}
+		return hashr.SignatureUnverified, fmt.Sprintf("could not fetch cosign signatures: %v", err)
+	}
+	if len(payloads) == 0 {
+		return hashr.SignatureUnsigned, "no cosign signature found"
+	}
+
+	reason := "no signature matches the configured keys"
+	var signer string
+	for _, p := range payloads {
+		var payload simpleSigning
+		if err := json.Unmarshal(p.data, &payload); err != nil {
+			reason = fmt.Sprintf("could not parse signed payload: %v", err)
+			continue
+		}
+		if payload.Critical.Type != cosignSignatureType {
+			reason = fmt.Sprintf("unexpected signed payload type: %s", payload.Critical.Type)
+			continue
+		}
+		if payload.Critical.Image.DockerManifestDigest != ref.DigestStr() {
+			reason = fmt.Sprintf("signed payload is for a different digest: %s", payload.Critical.Image.DockerManifestDigest)
+			continue
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(p.annotations[cosignSignatureAnnotation])
+		if err != nil {
+			reason = fmt.Sprintf("could not decode signature: %v", err)
+			continue
+		}
+		if key := verifySignature(keys, p.data, signature); key != nil {
+			signer = key.Name
+			break
+		}
+	}
+	if signer == "" {
+		return hashr.SignatureUnverified, reason
+	}
+
+	details := fmt.Sprintf("signed with key %s", signer)
+	if provenance := verifiedProvenance(ref, keys); provenance != "" {
+		details = fmt.Sprintf("%s, provenance: %s", details, provenance)
+	}
+
+	return hashr.SignatureVerified, details
+}
+
+// verifiedProvenance returns the description of in-toto attestations of a given image digest that
+// are signed with one of the public keys.
+func verifiedProvenance(ref name.Digest, keys []*PublicKey) string {
+	payloads, err := cosignArtifacts(ref, "att", dsseEnvelopeMediaType)
+	if err != nil {
+		return ""
+	}
+
+	var provenance []string
+	for _, p := range payloads {
+		var envelope dsseEnvelope
+		if err := json.Unmarshal(p.data, &envelope); err != nil || envelope.PayloadType != inTotoPayloadType {
+			continue
+		}
+		statement, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			continue
+		}
+
+		verified := false
+		for _, s := range envelope.Signatures {
+			signature, err := base64.StdEncoding.DecodeString(s.Sig)
+			if err != nil {
+				continue
+			}
+			if verifySignature(keys, dssePAE(envelope.PayloadType, statement), signature) != nil {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			continue
+		}
+
+		var st inTotoStatement
+		if err := json.Unmarshal(statement, &st); err != nil {
+			continue
+		}
+		for _, subject := range st.Subject {
+			if "sha256:"+subject.Digest["sha256"] != ref.DigestStr() {
+				continue
+			}
+			description := st.PredicateType
+			if st.Predicate.Builder.ID != "" {
+				description = fmt.Sprintf("%s built by %s", description, st.Predicate.Builder.ID)
+			}
+			provenance = append(provenance, description)
+			break
+		}
+	}
+
+	return strings.Join(provenance, ", ")
+}
+
+// cosignPayload holds a layer of a cosign signature or attestation image.
+type cosignPayload struct {
+	data        []byte
+	annotations map[string]string
+}
+
+// cosignArtifacts returns layers of a given media type from the cosign artifact image with a given
+// suffix (sig or att) stored for an image digest.
+func cosignArtifacts(ref name.Digest, suffix, mediaType string) ([]*cosignPayload, error) {
+	tag := ref.Context().Tag(fmt.Sprintf("%s.%s", strings.Replace(ref.DigestStr(), ":", "-", 1), suffix))
+	img, err := remote.Image(tag, remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var payloads []*cosignPayload
+	for _, desc := range manifest.Layers {
+		if string(desc.MediaType) != mediaType {
+			continue
+		}
+		data, err := layerData(img, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, &cosignPayload{data: data, annotations: desc.Annotations})
+	}
+
+	return payloads, nil
+}
+
+func layerData(img v1.Image, digest v1.Hash) ([]byte, error) {
+	layer, err := img.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// verifySignature returns the public key that made the signature of the payload, nil is returned
+// if none of the keys did.
+func verifySignature(keys []*PublicKey, payload, signature []byte) *PublicKey {
+	digest := sha256.Sum256(payload)
+	for _, key := range keys {
+		switch k := key.Key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, digest[:], signature) {
+				return key
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil {
+				return key
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, payload, signature) {
+				return key
+			}
+		}
+	}
+
+	return nil
+}
+
+// dssePAE returns the DSSE pre-authentication encoding of a payload, which is signed instead of
+// the payload itself.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// cosignArtifact checks if given tags belong to a cosign signature, attestation or SBOM image.
+func cosignArtifact(tags []string) bool {
+	if len(tags) == 0 {
+		return false
+	}
+
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "sha256-") {
+			return false
+		}
+		if !strings.HasSuffix(tag, ".sig") && !strings.HasSuffix(tag, ".att") && !strings.HasSuffix(tag, ".sbom") {
+			return false
+		}
+	}
+
+	return true
+}
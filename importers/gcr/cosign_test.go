@@ -0,0 +1,221 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+
+	"github.com/google/hashr/core/hashr"
+)
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, payload []byte) string {
+	t.Helper()
+
+	digest := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("could not sign payload: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+// signatureImage returns a cosign signature image of a given digest signed with a given key.
+func signatureImage(t *testing.T, key *ecdsa.PrivateKey, repo name.Repository, digest string) v1.Image {
+	t.Helper()
+
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"%s"},"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, repo.Name(), digest))
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(payload, cosignSimpleSigningMediaType),
+		Annotations: map[string]string{cosignSignatureAnnotation: sign(t, key, payload)},
+	})
+	if err != nil {
+		t.Fatalf("could not create signature image: %v", err)
+	}
+
+	return img
+}
+
+// attestationImage returns a cosign attestation image with SLSA provenance of a given digest.
+func attestationImage(t *testing.T, key *ecdsa.PrivateKey, repo name.Repository, digest v1.Hash) v1.Image {
+	t.Helper()
+
+	statement := []byte(fmt.Sprintf(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://slsa.dev/provenance/v0.2","subject":[{"name":"%s","digest":{"sha256":"%s"}}],"predicate":{"builder":{"id":"https://cloudbuild.googleapis.com/GoogleHostedWorker"}}}`, repo.Name(), digest.Hex))
+	envelope, err := json.Marshal(map[string]interface{}{
+		"payloadType": inTotoPayloadType,
+		"payload":     base64.StdEncoding.EncodeToString(statement),
+		"signatures":  []map[string]string{{"keyid": "", "sig": sign(t, key, dssePAE(inTotoPayloadType, statement))}},
+	})
+	if err != nil {
+		t.Fatalf("could not marshal attestation: %v", err)
+	}
+
+	img, err := mutate.Append(empty.Image, mutate.Addendum{Layer: static.NewLayer(envelope, dsseEnvelopeMediaType)})
+	if err != nil {
+		t.Fatalf("could not create attestation image: %v", err)
+	}
+
+	return img
+}
+
+func writePublicKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("could not marshal public key: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatalf("could not write public key: %v", err)
+	}
+
+	return path
+}
+
+func TestVerifyImage(t *testing.T) {
+	s, err := newTLSServer("registry.example.com", registry.New())
+	if err != nil {
+		t.Fatalf("could not create test registry: %v", err)
+	}
+	defer s.Close()
+
+	// Route requests to our test registry.
+	defer func(opts []remote.Option) { remoteOpts = opts }(remoteOpts)
+	remoteOpts = []remote.Option{remote.WithTransport(s.Client().Transport)}
+
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	keys, err := LoadPublicKeys(writePublicKey(t, signer))
+	if err != nil {
+		t.Fatalf("unexpected error while running LoadPublicKeys(): %v", err)
+	}
+
+	repo, err := name.NewRepository("registry.example.com/test/hashr/app")
+	if err != nil {
+		t.Fatalf("could not parse repository: %v", err)
+	}
+
+	push := func(ref name.Reference, img v1.Image) {
+		if err := remote.Write(ref, img, remoteOpts...); err != nil {
+			t.Fatalf("could not push %s: %v", ref, err)
+		}
+	}
+
+	digests := make(map[string]v1.Hash)
+	for _, tag := range []string{"signed", "other", "wrong-digest", "unsigned"} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("could not create random image: %v", err)
+		}
+		push(repo.Tag(tag), img)
+		if digests[tag], err = img.Digest(); err != nil {
+			t.Fatalf("could not get image digest: %v", err)
+		}
+	}
+
+	sigTag := func(digest v1.Hash, suffix string) name.Tag {
+		return repo.Tag(fmt.Sprintf("sha256-%s.%s", digest.Hex, suffix))
+	}
+	push(sigTag(digests["signed"], "sig"), signatureImage(t, signer, repo, digests["signed"].String()))
+	push(sigTag(digests["signed"], "att"), attestationImage(t, signer, repo, digests["signed"]))
+	push(sigTag(digests["other"], "sig"), signatureImage(t, other, repo, digests["other"].String()))
+	push(sigTag(digests["wrong-digest"], "sig"), signatureImage(t, signer, repo, digests["signed"].String()))
+
+	for _, tc := range []struct {
+		tag         string
+		wantStatus  string
+		wantDetails string
+	}{
+		{
+			tag:         "signed",
+			wantStatus:  hashr.SignatureVerified,
+			wantDetails: "signed with key cosign, provenance: https://slsa.dev/provenance/v0.2 built by https://cloudbuild.googleapis.com/GoogleHostedWorker",
+		},
+		{
+			tag:         "other",
+			wantStatus:  hashr.SignatureUnverified,
+			wantDetails: "no signature matches the configured keys",
+		},
+		{
+			tag:         "wrong-digest",
+			wantStatus:  hashr.SignatureUnverified,
+			wantDetails: fmt.Sprintf("signed payload is for a different digest: %s", digests["signed"]),
+		},
+		{
+			tag:         "unsigned",
+			wantStatus:  hashr.SignatureUnsigned,
+			wantDetails: "no cosign signature found",
+		},
+	} {
+		t.Run(tc.tag, func(t *testing.T) {
+			img := &image{id: repo.Name(), quickHash: digests[tc.tag].Hex, keys: keys}
+			img.VerifySignature()
+
+			status, details := img.SignatureStatus()
+			if status != tc.wantStatus || details != tc.wantDetails {
+				t.Errorf("SignatureStatus() = %q, %q; want %q, %q", status, details, tc.wantStatus, tc.wantDetails)
+			}
+			if !strings.Contains(img.Description(), fmt.Sprintf("Cosign signature: %s (%s)", tc.wantStatus, tc.wantDetails)) {
+				t.Errorf("Description() = %q, want signature status", img.Description())
+			}
+		})
+	}
+}
+
+func TestCosignArtifact(t *testing.T) {
+	for _, tc := range []struct {
+		tags []string
+		want bool
+	}{
+		{tags: []string{"sha256-a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3.sig"}, want: true},
+		{tags: []string{"sha256-a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3.att", "sha256-a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3.sbom"}, want: true},
+		{tags: []string{"sha256-a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3.sig", "latest"}, want: false},
+		{tags: []string{"latest"}, want: false},
+		{tags: nil, want: false},
+	} {
+		if got := cosignArtifact(tc.tags); got != tc.want {
+			t.Errorf("cosignArtifact(%v) = %v, want %v", tc.tags, got, tc.want)
+		}
+	}
+}
@@ -138,11 +138,37 @@ func (i *image) QuickSHA256Hash() (string, error) {
 
 // Description provides additional description for GCP image.
 func (i *image) Description() string {
-	return i.description
+	if i.signatureStatus == "" {
+		return i.description
+	}
+	return fmt.Sprintf("%s, Cosign signature: %s (%s)", i.description, i.signatureStatus, i.signatureDetails)
+}
+
+// VerifySignature verifies cosign signatures of the image digest, if public keys are set. It's
+// called before Preprocess, so images rejected by the signature policy are not pulled.
+func (i *image) VerifySignature() {
+	if i.keys == nil {
+		return
+	}
+
+	imgID := fmt.Sprintf("%s@sha256:%s", i.id, i.quickHash)
+	ref, err := name.NewDigest(imgID, name.StrictValidation)
+	if err != nil {
+		i.signatureStatus, i.signatureDetails = hashr.SignatureUnverified, fmt.Sprintf("error parsing reference from image %q: %v", imgID, err)
+		return
+	}
+
+	i.signatureStatus, i.signatureDetails = verifyImage(ref, i.keys)
+}
+
+// SignatureStatus returns the result of cosign signature verification.
+func (i *image) SignatureStatus() (string, string) {
+	return i.signatureStatus, i.signatureDetails
 }
 
-// NewRepo returns new instance of a GCR repository.
-func NewRepo(ctx context.Context, oauth2Token oauth2.TokenSource, repositoryPath string) (*Repo, error) {
+// NewRepo returns new instance of a GCR repository. Image signatures are verified against given
+// public keys, nil keys disable the verification.
+func NewRepo(ctx context.Context, oauth2Token oauth2.TokenSource, repositoryPath string, keys []*PublicKey) (*Repo, error) {
 	repo, err := name.NewRepository(repositoryPath)
 	if err != nil {
 		return nil, fmt.Errorf("could not create a new Container Registry repository: %v", err)
@@ -152,13 +178,14 @@ func NewRepo(ctx context.Context, oauth2Token oauth2.TokenSource, repositoryPath
 	opts = google.WithAuth(auth)
 	remoteOpts = append(remoteOpts, remote.WithAuth(auth))
 
-	return &Repo{path: repositoryPath, gcr: repo}, nil
+	return &Repo{path: repositoryPath, gcr: repo, keys: keys}, nil
 }
 
 // Repo holds data related to a GCR repository.
 type Repo struct {
 	path   string
 	gcr    name.Repository
+	keys   []*PublicKey
 	images []*image
 }
 
@@ -174,7 +201,7 @@ func (r *Repo) RepoPath() string {
 
 // DiscoverRepo traverses the GCR repository and return supported images.
 func (r *Repo) DiscoverRepo() ([]hashr.Source, error) {
-	if err := google.Walk(r.gcr, discoverImages(&r.images), opts); err != nil {
+	if err := google.Walk(r.gcr, discoverImages(&r.images, r.keys), opts); err != nil {
 		return nil, fmt.Errorf("error while discovering %s GCR repository: %v", r.path, err)
 	}
 
@@ -187,11 +214,14 @@ func (r *Repo) DiscoverRepo() ([]hashr.Source, error) {
 }
 
 type image struct {
-	id          string
-	localPath   string
-	remotePath  string
-	quickHash   string
-	description string
+	id               string
+	localPath        string
+	remotePath       string
+	quickHash        string
+	description      string
+	keys             []*PublicKey
+	signatureStatus  string
+	signatureDetails string
 }
 
 func supportedMedia(mediaType string) bool {
@@ -210,14 +240,14 @@ func supportedMedia(mediaType string) bool {
 	return true
 }
 
-func discoverImages(images *[]*image) google.WalkFunc {
+func discoverImages(images *[]*image, keys []*PublicKey) google.WalkFunc {
 	return func(repo name.Repository, tags *google.Tags, err error) error {
 		if err != nil {
 			return err
 		}
 
 		for digest, manifest := range tags.Manifests {
-			if !supportedMedia(manifest.MediaType) {
+			if !supportedMedia(manifest.MediaType) || cosignArtifact(manifest.Tags) {
 				continue
 			}
 
@@ -235,6 +265,7 @@ func discoverImages(images *[]*image) google.WalkFunc {
 				quickHash:   parts[1],
 				remotePath:  repo.Name(),
 				description: fmt.Sprintf("Tags: %s, Media Type: %s, Created on: %s, Uploaded on: %s", manifest.Tags, manifest.MediaType, manifest.Created.UTC().String(), manifest.Uploaded.UTC().String()),
+				keys:        keys,
 			})
 		}
 
@@ -190,7 +190,7 @@ func TestDiscoverRepo(t *testing.T) {
 	}
 	defer s.Close()
 
-	repo, err := NewRepo(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{}), "registry.example.com/test/hashr")
+	repo, err := NewRepo(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{}), "registry.example.com/test/hashr", nil)
 	if err != nil {
 		t.Fatalf("could not create new GCR repo: %v", err)
 	}
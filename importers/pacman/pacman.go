@@ -0,0 +1,576 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pacman implements Arch Linux pacman package importer.
+package pacman
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	hashrCommon "github.com/google/hashr/common"
+	"github.com/google/hashr/core/hashr"
+	"github.com/google/hashr/importers/common"
+)
+
+const (
+	// RepoName contains the repository name.
+	RepoName = "pacman"
+)
+
+var (
+	// packageExtensions lists extensions of pacman packages.
+	packageExtensions = []string{".pkg.tar.zst", ".pkg.tar.xz", ".pkg.tar.gz"}
+	// dbExtensions lists extensions of pacman repository databases, <repo>.db is usually a symlink
+	// to <repo>.db.tar.gz or <repo>.db.tar.zst.
+	dbExtensions = []string{".db", ".db.tar.gz", ".db.tar.zst", ".db.tar.xz"}
+)
+
+// dbEntry holds data related to a package listed in a repository database.
+type dbEntry struct {
+	name    string
+	version string
+	sha256  string
+	db      string
+}
+
+// Archive holds data related to pacman archive.
+type Archive struct {
+	filename        string
+	remotePath      string
+	localPath       string
+	quickSha256hash string
+	repoPath        string
+	// entry is set for archives listed in a repository database, the copied archive must match its
+	// SHA256 digest.
+	entry         *dbEntry
+	metadata      *hashrCommon.SourceMetadata
+	extractionDir string
+	// warnings holds differences between the repository database and the package metadata.
+	warnings []string
+}
+
+// hasSuffix returns true if a given name has one of given suffixes.
+func hasSuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMetadata returns true for package metadata files, e.g. .PKGINFO and .MTREE, which are stored
+// in the root of the package.
+func isMetadata(name string) bool {
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	return strings.HasPrefix(name, ".") && !strings.Contains(name, "/")
+}
+
+// openTar returns a tar reader for a tar archive compressed with zstd, xz or gzip, the compression
+// is detected from the content. Uncompressed archives are also supported.
+func openTar(r io.Reader) (*tar.Reader, func(), error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(d), d.Close, nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		d, err := xz.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(d), func() {}, nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		d, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(d), func() { d.Close() }, nil
+	default:
+		return tar.NewReader(br), func() {}, nil
+	}
+}
+
+// extractPackage extracts files of a given package, skipping metadata files.
+func extractPackage(pkgPath, outputFolder string) error {
+	if _, err := os.Stat(outputFolder); os.IsNotExist(err) {
+		if err2 := os.MkdirAll(outputFolder, 0755); err2 != nil {
+			return fmt.Errorf("error while creating target directory: %v", err2)
+		}
+	}
+
+	f, err := os.Open(pkgPath)
+	if err != nil {
+		return fmt.Errorf("failed to open pacman package: %v", err)
+	}
+	defer f.Close()
+
+	tr, closer, err := openTar(f)
+	if err != nil {
+		return fmt.Errorf("failed to decompress pacman package: %v", err)
+	}
+	defer closer()
+
+	err = common.ExtractTar(tr, outputFolder, func(header *tar.Header) bool {
+		return !isMetadata(header.Name)
+	})
+	if err != nil {
+		return fmt.Errorf("error while unpacking pacman package: %v", err)
+	}
+
+	return nil
+}
+
+// readMetadata returns package metadata read from .PKGINFO and SHA256 digests of files listed in
+// .MTREE. Metadata files precede the package files, so the rest of the package is not read.
+func readMetadata(pkgPath string) (*hashrCommon.SourceMetadata, error) {
+	f, err := os.Open(pkgPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pacman package: %v", err)
+	}
+	defer f.Close()
+
+	tr, closer, err := openTar(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress pacman package: %v", err)
+	}
+	defer closer()
+
+	var pkgInfo common.PkgInfo
+	var files []hashrCommon.FileDigest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pacman package: %v", err)
+		}
+		if !isMetadata(header.Name) {
+			break
+		}
+
+		switch path.Clean(header.Name) {
+		case ".PKGINFO":
+			if pkgInfo, err = common.ParsePkgInfo(tr); err != nil {
+				return nil, err
+			}
+		case ".MTREE":
+			if files, err = readMtree(tr); err != nil {
+				return nil, fmt.Errorf("failed to read .MTREE: %v", err)
+			}
+		}
+	}
+	if pkgInfo == nil {
+		return nil, errors.New(".PKGINFO not found")
+	}
+
+	return &hashrCommon.SourceMetadata{
+		Name:          pkgInfo.Get("pkgname"),
+		Version:       pkgInfo.Get("pkgver"),
+		Architecture:  pkgInfo.Get("arch"),
+		Maintainer:    pkgInfo.Get("packager"),
+		SourcePackage: pkgInfo.Get("pkgbase"),
+		License:       strings.Join(pkgInfo["license"], " AND "),
+		Files:         files,
+	}, nil
+}
+
+// readMtree parses gzip compressed .MTREE file and returns SHA256 digests of regular files it
+// lists, metadata files are skipped.
+func readMtree(r io.Reader) ([]hashrCommon.FileDigest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var files []hashrCommon.FileDigest
+	defaults := make(map[string]string)
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		keywords := make(map[string]string)
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 {
+				keywords[kv[0]] = kv[1]
+			}
+		}
+
+		switch fields[0] {
+		case "/set":
+			for k, v := range keywords {
+				defaults[k] = v
+			}
+			continue
+		case "/unset":
+			for _, k := range fields[1:] {
+				delete(defaults, k)
+			}
+			continue
+		}
+
+		name, err := unescapeMtree(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if isMetadata(name) {
+			continue
+		}
+
+		fileType, ok := keywords["type"]
+		if !ok {
+			fileType = defaults["type"]
+		}
+		if fileType != "file" || keywords["sha256digest"] == "" {
+			continue
+		}
+		files = append(files, hashrCommon.FileDigest{Path: path.Join("/", name), Algorithm: "sha256", Digest: keywords["sha256digest"]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// unescapeMtree decodes octal escapes, e.g. \040 for space, used in mtree paths.
+func unescapeMtree(name string) (string, error) {
+	if !strings.Contains(name, `\`) {
+		return name, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '\\' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+3 >= len(name) {
+			return "", fmt.Errorf("truncated escape in %q", name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q: %v", name, err)
+		}
+		b.WriteByte(byte(c))
+		i += 3
+	}
+
+	return b.String(), nil
+}
+
+// Preprocess extracts the contents of a pacman package and reads its metadata.
+func (a *Archive) Preprocess() (string, error) {
+	var err error
+	a.localPath, err = common.CopyToLocal(a.remotePath, a.ID())
+	if err != nil {
+		return "", fmt.Errorf("error while copying %s to local file system: %v", a.remotePath, err)
+	}
+
+	if a.entry != nil {
+		f, err := os.Open(a.localPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to open pacman package: %v", err)
+		}
+		digest, err := common.Digest("sha256", f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read pacman package: %v", err)
+		}
+		if digest != a.entry.sha256 {
+			return "", fmt.Errorf("SHA256 digest %s does not match %s listed in %s", digest, a.entry.sha256, a.entry.db)
+		}
+	}
+
+	if a.metadata, err = readMetadata(a.localPath); err != nil {
+		glog.Warningf("Could not read metadata of %s: %v", a.ID(), err)
+	}
+	a.checkEntry()
+
+	baseDir, _ := filepath.Split(a.localPath)
+	a.extractionDir = filepath.Join(baseDir, "extracted")
+
+	if err := extractPackage(a.localPath, a.extractionDir); err != nil {
+		return "", err
+	}
+
+	return a.extractionDir, nil
+}
+
+// checkEntry compares the name and version listed in the repository database with the package
+// metadata. If the package metadata could not be read, the database entry is used instead.
+func (a *Archive) checkEntry() {
+	if a.entry == nil {
+		return
+	}
+
+	if a.metadata == nil {
+		a.metadata = &hashrCommon.SourceMetadata{Name: a.entry.name, Version: a.entry.version}
+		return
+	}
+
+	for _, field := range []struct{ name, db, pkgInfo string }{
+		{"name", a.entry.name, a.metadata.Name},
+		{"version", a.entry.version, a.metadata.Version},
+	} {
+		if field.db != field.pkgInfo {
+			a.warnings = append(a.warnings, fmt.Sprintf("package %s %q listed in %s does not match %q from .PKGINFO", field.name, field.db, a.entry.db, field.pkgInfo))
+		}
+	}
+}
+
+// ID returns non-unique pacman Archive ID.
+func (a *Archive) ID() string {
+	return a.filename
+}
+
+// RepoName returns repository name.
+func (a *Archive) RepoName() string {
+	return RepoName
+}
+
+// RepoPath returns repository path.
+func (a *Archive) RepoPath() string {
+	return a.repoPath
+}
+
+// LocalPath returns local path to a pacman Archive package file.
+func (a *Archive) LocalPath() string {
+	return a.localPath
+}
+
+// RemotePath returns non-local path to a pacman Archive package file.
+func (a *Archive) RemotePath() string {
+	return a.remotePath
+}
+
+// Description provides additional description for a pacman package.
+func (a *Archive) Description() string {
+	return common.PackageDescription(a.metadata)
+}
+
+// Metadata returns package metadata read from .PKGINFO and .MTREE.
+func (a *Archive) Metadata() *hashrCommon.SourceMetadata {
+	return a.metadata
+}
+
+// CheckSamples compares samples extracted from the package with SHA256 digests listed in .MTREE.
+// Differences between the repository database and .PKGINFO are reported as well.
+func (a *Archive) CheckSamples(samples []hashrCommon.Sample) []string {
+	if a.metadata == nil || len(a.metadata.Files) == 0 {
+		return a.warnings
+	}
+
+	return append(append([]string{}, a.warnings...), common.CheckManifest(a.metadata.Files, samples, a.extractionDir)...)
+}
+
+// QuickSHA256Hash returns SHA256 digest of the package listed in the repository database or
+// calculates sha256 hash of the whole package file, so that quick hashes of packages don't depend
+// on whether they are listed in the database.
+func (a *Archive) QuickSHA256Hash() (string, error) {
+	// Check if the quick hash was already calculated.
+	if a.quickSha256hash != "" {
+		return a.quickSha256hash, nil
+	}
+
+	f, err := os.Open(a.remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	a.quickSha256hash, err = common.Digest("sha256", f)
+	if err != nil {
+		return "", err
+	}
+
+	return a.quickSha256hash, nil
+}
+
+// NewRepo returns new instance of pacman repository. The path can be a local repository or a
+// mirror, e.g. a copy of core/os/x86_64 directory of an Arch Linux mirror.
+func NewRepo(path string) *Repo {
+	return &Repo{location: path}
+}
+
+// Repo holds data related to a pacman repository.
+type Repo struct {
+	location string
+	files    []string
+	dbs      []string
+	Archives []*Archive
+}
+
+// RepoName returns repository name.
+func (r *Repo) RepoName() string {
+	return RepoName
+}
+
+// RepoPath returns repository path.
+func (r *Repo) RepoPath() string {
+	return r.location
+}
+
+// DiscoverRepo traverses the repository and looks for pacman packages. SHA256 digests of packages
+// listed in repository databases are used as quick hashes.
+func (r *Repo) DiscoverRepo() ([]hashr.Source, error) {
+	if err := filepath.Walk(r.location, walk(&r.files, &r.dbs)); err != nil {
+		return nil, err
+	}
+
+	// Package file names in databases are relative to the directory holding the database.
+	entries := make(map[string]*dbEntry)
+	for _, db := range r.dbs {
+		dbEntries, err := readDB(db)
+		if err != nil {
+			glog.Warningf("Skipping database %s: %v", db, err)
+			continue
+		}
+		for filename, entry := range dbEntries {
+			entries[filepath.Join(filepath.Dir(db), filename)] = entry
+		}
+	}
+
+	for _, file := range r.files {
+		archive := &Archive{filename: filepath.Base(file), remotePath: file, repoPath: r.location}
+		if entry, ok := entries[filepath.Clean(file)]; ok {
+			archive.entry = entry
+			archive.quickSha256hash = entry.sha256
+		}
+		r.Archives = append(r.Archives, archive)
+	}
+
+	var sources []hashr.Source
+	for _, Archive := range r.Archives {
+		sources = append(sources, Archive)
+	}
+
+	return sources, nil
+}
+
+// readDB reads a repository database and returns the packages it lists, keyed by their file
+// names. Each package is described by a desc file in its own directory.
+func readDB(db string) (map[string]*dbEntry, error) {
+	f, err := os.Open(db)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr, closer, err := openTar(f)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	entries := make(map[string]*dbEntry)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Base(header.Name) != "desc" {
+			continue
+		}
+
+		desc, err := parseDesc(tr)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", header.Name, err)
+		}
+		if desc["FILENAME"] == "" || desc["SHA256SUM"] == "" {
+			continue
+		}
+		entries[desc["FILENAME"]] = &dbEntry{name: desc["NAME"], version: desc["VERSION"], sha256: desc["SHA256SUM"], db: db}
+	}
+
+	return entries, nil
+}
+
+// parseDesc parses desc file of a repository database, which consists of %FIELD% lines followed by
+// values and separated with blank lines. Only the first value of each field is returned.
+func parseDesc(r io.Reader) (map[string]string, error) {
+	fields := make(map[string]string)
+	var field string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			field = ""
+		case strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") && len(line) > 1:
+			field = strings.Trim(line, "%")
+		case field != "":
+			if _, ok := fields[field]; !ok {
+				fields[field] = line
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+func walk(files, dbs *[]string) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			glog.Errorf("Could not open %s: %v", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch {
+		case hasSuffix(info.Name(), packageExtensions):
+			*files = append(*files, path)
+		case hasSuffix(info.Name(), dbExtensions):
+			*dbs = append(*dbs, path)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pacman
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	hashrCommon "github.com/google/hashr/common"
+)
+
+type tarEntry struct {
+	name    string
+	content string
+}
+
+// writeTar writes a tar archive holding given entries, compressed based on the file extension.
+func writeTar(t *testing.T, path string, entries []tarEntry) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch filepath.Ext(path) {
+	case ".zst":
+		w, err = zstd.NewWriter(&b)
+	case ".xz":
+		w, err = xz.NewWriter(&b)
+	default:
+		w = gzip.NewWriter(&b)
+	}
+	if err != nil {
+		t.Fatalf("could not create compressor: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("could not create directory: %v", err)
+	}
+
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("could not write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("could not write tar entry: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("could not close tar writer: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("could not close compressor: %v", err)
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write %s: %v", path, err)
+	}
+
+	return b.Bytes()
+}
+
+// writePackage writes a pacman package with given files, .PKGINFO and .MTREE listing the files.
+func writePackage(t *testing.T, path, name, version string, files map[string]string) []byte {
+	t.Helper()
+
+	pkgInfo := fmt.Sprintf("# Generated by makepkg\npkgname = %s\npkgbase = %s\npkgver = %s\npkgdesc = HashR test package\narch = x86_64\npackager = Example <noreply@example.com>\nlicense = GPL-3.0-or-later\nlicense = custom\ndepend = glibc\n", name, name, version)
+
+	var mtree bytes.Buffer
+	gz := gzip.NewWriter(&mtree)
+	fmt.Fprint(gz, "#mtree\n/set type=file uid=0 gid=0 mode=644\n./.PKGINFO time=1.0 size=100 sha256digest=00\n./usr time=1.0 mode=755 type=dir\n")
+	entries := []tarEntry{{name: ".PKGINFO", content: pkgInfo}, {name: ".BUILDINFO", content: "format = 2\n"}}
+	for _, file := range []string{"usr/bin/hello", "usr/share/doc/read me", "../escape"} {
+		content, ok := files[file]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(gz, "./%s time=1.0 size=%d sha256digest=%x\n", strings.ReplaceAll(file, " ", `\040`), len(content), sha256.Sum256([]byte(content)))
+	}
+	gz.Close()
+	entries = append(entries, tarEntry{name: ".MTREE", content: mtree.String()})
+
+	for _, file := range []string{"usr/bin/hello", "usr/share/doc/read me", "../escape"} {
+		if content, ok := files[file]; ok {
+			entries = append(entries, tarEntry{name: file, content: content})
+		}
+	}
+
+	return writeTar(t, path, entries)
+}
+
+// writeDB writes a repository database listing given packages with given SHA256 digests.
+func writeDB(t *testing.T, path string, digests map[string]string) {
+	t.Helper()
+
+	var entries []tarEntry
+	for _, filename := range []string{"hello-1.0-1-x86_64.pkg.tar.zst", "hello-2.0-1-x86_64.pkg.tar.xz"} {
+		digest, ok := digests[filename]
+		if !ok {
+			continue
+		}
+		version := strings.Split(filename, "-")[1] + "-1"
+		entries = append(entries, tarEntry{
+			name:    fmt.Sprintf("hello-%s/desc", version),
+			content: fmt.Sprintf("%%FILENAME%%\n%s\n\n%%NAME%%\nhello\n\n%%VERSION%%\n%s\n\n%%ARCH%%\nx86_64\n\n%%SHA256SUM%%\n%s\n\n", filename, version, digest),
+		})
+	}
+
+	writeTar(t, path, entries)
+}
+
+func TestPreprocess(t *testing.T) {
+	files := map[string]string{"usr/bin/hello": "hello", "usr/share/doc/read me": "Read me!", "../escape": "escape"}
+	repoPath := t.TempDir()
+	writePackage(t, filepath.Join(repoPath, "hello-1.0-1-x86_64.pkg.tar.zst"), "hello", "1.0-1", files)
+
+	sources, err := NewRepo(repoPath).DiscoverRepo()
+	if err != nil {
+		t.Fatalf("unexpected error while discovering repo: %v", err)
+	}
+	if len(sources) != 1 {
+		t.Fatalf("DiscoverRepo() returned %d sources, want 1", len(sources))
+	}
+	archive := sources[0].(*Archive)
+
+	extractionDir, err := archive.Preprocess()
+	if err != nil {
+		t.Fatalf("unexpected Preprocess() error: %v", err)
+	}
+
+	var samples []hashrCommon.Sample
+	got := make(map[string]string)
+	err = filepath.Walk(filepath.Dir(extractionDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || path == archive.LocalPath() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(extractionDir, path)
+		if err != nil {
+			return err
+		}
+		got[rel] = string(data)
+		samples = append(samples, hashrCommon.Sample{Sha256: fmt.Sprintf("%x", sha256.Sum256(data)), Paths: []string{path}, SourcePaths: []string{strings.TrimPrefix(path, "/")}})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not walk extraction directory: %v", err)
+	}
+
+	// Metadata files and files with paths leading outside of the extraction directory are not
+	// extracted.
+	want := map[string]string{"usr/bin/hello": "hello", "usr/share/doc/read me": "Read me!"}
+	if !cmp.Equal(want, got) {
+		t.Errorf("Preprocess() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+	}
+
+	wantMetadata := &hashrCommon.SourceMetadata{
+		Name:          "hello",
+		Version:       "1.0-1",
+		Architecture:  "x86_64",
+		Maintainer:    "Example <noreply@example.com>",
+		SourcePackage: "hello",
+		License:       "GPL-3.0-or-later AND custom",
+		Files: []hashrCommon.FileDigest{
+			{Path: "/usr/bin/hello", Algorithm: "sha256", Digest: fmt.Sprintf("%x", sha256.Sum256([]byte("hello")))},
+			{Path: "/usr/share/doc/read me", Algorithm: "sha256", Digest: fmt.Sprintf("%x", sha256.Sum256([]byte("Read me!")))},
+			{Path: "/escape", Algorithm: "sha256", Digest: fmt.Sprintf("%x", sha256.Sum256([]byte("escape")))},
+		},
+	}
+	if diff := cmp.Diff(wantMetadata, archive.Metadata()); diff != "" {
+		t.Errorf("Metadata() unexpected diff (-want/+got):\n%s", diff)
+	}
+
+	if got, want := archive.Description(), "Package: hello 1.0-1 (x86_64), Maintainer: Example <noreply@example.com>, Source: hello, License: GPL-3.0-or-later AND custom"; got != want {
+		t.Errorf("Description() = %q, want %q", got, want)
+	}
+
+	if got, want := archive.CheckSamples(samples), []string{"/escape: listed in the package, but not extracted"}; !cmp.Equal(want, got) {
+		t.Errorf("CheckSamples() = %v, want %v", got, want)
+	}
+}
+
+func TestDB(t *testing.T) {
+	repoPath := t.TempDir()
+	files := map[string]string{"usr/bin/hello": "hello"}
+	data := writePackage(t, filepath.Join(repoPath, "hello-1.0-1-x86_64.pkg.tar.zst"), "hello", "1.0-1", files)
+	writePackage(t, filepath.Join(repoPath, "hello-2.0-1-x86_64.pkg.tar.xz"), "hello", "2.0-1", files)
+	unindexed := writePackage(t, filepath.Join(repoPath, "extra", "hello-3.0-1-x86_64.pkg.tar.zst"), "hello", "3.0-1", files)
+	if err := os.WriteFile(filepath.Join(repoPath, "hello-1.0-1-x86_64.pkg.tar.zst.sig"), []byte("signature"), 0644); err != nil {
+		t.Fatalf("could not write signature: %v", err)
+	}
+
+	// hello 2.0 doesn't match the digest listed in the database.
+	writeDB(t, filepath.Join(repoPath, "core.db.tar.zst"), map[string]string{
+		"hello-1.0-1-x86_64.pkg.tar.zst": fmt.Sprintf("%x", sha256.Sum256(data)),
+		"hello-2.0-1-x86_64.pkg.tar.xz":  fmt.Sprintf("%x", sha256.Sum256(nil)),
+	})
+
+	sources, err := NewRepo(repoPath).DiscoverRepo()
+	if err != nil {
+		t.Fatalf("unexpected error while discovering repo: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, source := range sources {
+		quickHash, err := source.QuickSHA256Hash()
+		if err != nil {
+			t.Fatalf("unexpected QuickSHA256Hash() error: %v", err)
+		}
+		got[source.ID()] = quickHash
+
+		_, err = source.Preprocess()
+		if source.ID() == "hello-2.0-1-x86_64.pkg.tar.xz" {
+			if err == nil || !strings.Contains(err.Error(), "does not match") {
+				t.Errorf("Preprocess() of %s error = %v, want digest mismatch", source.ID(), err)
+			}
+		} else if err != nil {
+			t.Errorf("unexpected Preprocess() error: %v", err)
+		}
+	}
+
+	// Quick hashes of packages that are not listed in the database are also SHA256 digests of the
+	// whole package.
+	want := map[string]string{
+		"hello-1.0-1-x86_64.pkg.tar.zst": fmt.Sprintf("%x", sha256.Sum256(data)),
+		"hello-2.0-1-x86_64.pkg.tar.xz":  fmt.Sprintf("%x", sha256.Sum256(nil)),
+		"hello-3.0-1-x86_64.pkg.tar.zst": fmt.Sprintf("%x", sha256.Sum256(unindexed)),
+	}
+	if !cmp.Equal(want, got) {
+		t.Errorf("DiscoverRepo() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestCheckEntry(t *testing.T) {
+	entry := &dbEntry{name: "hello", version: "1.0-1", db: "core.db.tar.zst"}
+	for _, tc := range []struct {
+		name         string
+		metadata     *hashrCommon.SourceMetadata
+		wantMetadata *hashrCommon.SourceMetadata
+		wantWarnings []string
+	}{
+		{
+			name:         "matching",
+			metadata:     &hashrCommon.SourceMetadata{Name: "hello", Version: "1.0-1", Architecture: "x86_64"},
+			wantMetadata: &hashrCommon.SourceMetadata{Name: "hello", Version: "1.0-1", Architecture: "x86_64"},
+		},
+		{
+			name:         "mismatching",
+			metadata:     &hashrCommon.SourceMetadata{Name: "hello", Version: "2.0-1", Architecture: "x86_64"},
+			wantMetadata: &hashrCommon.SourceMetadata{Name: "hello", Version: "2.0-1", Architecture: "x86_64"},
+			wantWarnings: []string{`package version "1.0-1" listed in core.db.tar.zst does not match "2.0-1" from .PKGINFO`},
+		},
+		{
+			name:         "missing .PKGINFO",
+			wantMetadata: &hashrCommon.SourceMetadata{Name: "hello", Version: "1.0-1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := &Archive{entry: entry, metadata: tc.metadata}
+			archive.checkEntry()
+
+			if diff := cmp.Diff(tc.wantMetadata, archive.Metadata()); diff != "" {
+				t.Errorf("Metadata() unexpected diff (-want/+got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantWarnings, archive.CheckSamples(nil)); diff != "" {
+				t.Errorf("CheckSamples() unexpected diff (-want/+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestQuickSHA256Hash(t *testing.T) {
+	// Large packages that are not listed in a database are hashed as a whole as well.
+	path := filepath.Join(t.TempDir(), "large-1.0-1-x86_64.pkg.tar.zst")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("could not create test package: %v", err)
+	}
+	size := int64(25 * 1024 * 1024)
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("could not resize test package: %v", err)
+	}
+	f.Close()
+
+	archive := &Archive{filename: filepath.Base(path), remotePath: path}
+	got, err := archive.QuickSHA256Hash()
+	if err != nil {
+		t.Fatalf("unexpected QuickSHA256Hash() error: %v", err)
+	}
+
+	if want := fmt.Sprintf("%x", sha256.Sum256(make([]byte, size))); got != want {
+		t.Errorf("QuickSHA256Hash() = %s, want %s", got, want)
+	}
+}
+
+func TestRepoFunctions(t *testing.T) {
+	repoPath := "/tmp/pacman-repo"
+	repo := NewRepo(repoPath)
+
+	if repo.RepoName() != RepoName {
+		t.Errorf("RepoName() = %s; want = %s", repo.RepoName(), RepoName)
+	}
+
+	if repo.RepoPath() != repoPath {
+		t.Errorf("RepoPath() = %s; want = %s", repo.RepoPath(), repoPath)
+	}
+}
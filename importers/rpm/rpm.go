@@ -16,6 +16,7 @@
 package rpm
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -23,12 +24,16 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/golang/glog"
 
+	hashrCommon "github.com/google/hashr/common"
 	"github.com/google/hashr/core/hashr"
 	"github.com/google/hashr/importers/common"
 
 	rpmutils "github.com/sassoftware/go-rpmutils"
+	// go-rpmutils v0.2.0 only accepts keyrings of the deprecated x/crypto package.
+	xopenpgp "golang.org/x/crypto/openpgp"
 )
 
 const (
@@ -39,11 +44,33 @@ const (
 
 // Archive holds data related to rpm archive.
 type Archive struct {
-	filename        string
-	remotePath      string
-	localPath       string
-	quickSha256hash string
-	repoPath        string
+	filename         string
+	remotePath       string
+	localPath        string
+	quickSha256hash  string
+	repoPath         string
+	keyring          openpgp.EntityList
+	signatureStatus  string
+	signatureDetails string
+	metadata         *hashrCommon.SourceMetadata
+	extractionDir    string
+	// repoName and nevra are set for archives discovered in YUM repositories.
+	repoName string
+	nevra    string
+	// indexChecksum is the checksum listed in the primary metadata of a YUM repository, the copied
+	// archive must match it.
+	indexChecksum    string
+	indexChecksumAlg string
+}
+
+// digestAlgorithms maps values of the rpm FILEDIGESTALGO tag to names of the digest algorithms.
+var digestAlgorithms = map[int]string{
+	rpmutils.PGPHASHALGO_MD5:    "md5",
+	rpmutils.PGPHASHALGO_SHA1:   "sha1",
+	rpmutils.PGPHASHALGO_SHA256: "sha256",
+	rpmutils.PGPHASHALGO_SHA384: "sha384",
+	rpmutils.PGPHASHALGO_SHA512: "sha512",
+	rpmutils.PGPHASHALGO_SHA224: "sha224",
 }
 
 func extractRPM(rpmPath, outputFolder string) error {
@@ -72,7 +99,124 @@ func extractRPM(rpmPath, outputFolder string) error {
 	return nil
 }
 
-// Preprocess extracts the contents of a .rpm file.
+// verifyRPM verifies OpenPGP header signatures of a given rpm file and returns the signature
+// status and details.
+func verifyRPM(rpmPath string, keyring openpgp.EntityList) (string, string) {
+	fd, err := os.Open(rpmPath)
+	if err != nil {
+		return hashr.SignatureUnverified, fmt.Sprintf("failed to open rpm file: %v", err)
+	}
+	defer fd.Close()
+
+	rpmKeyring, err := toRPMKeyring(keyring)
+	if err != nil {
+		return hashr.SignatureUnverified, fmt.Sprintf("could not convert keyring: %v", err)
+	}
+
+	_, sigs, err := rpmutils.Verify(fd, rpmKeyring)
+	if err != nil {
+		// rpmutils does not export the error for keys missing from the keyring.
+		if strings.HasPrefix(err.Error(), "keyid ") {
+			return hashr.SignatureUnverified, fmt.Sprintf("signed with a key that is not in the keyring: %v", err)
+		}
+		return hashr.SignatureUnverified, fmt.Sprintf("invalid signature: %v", err)
+	}
+	if len(sigs) == 0 {
+		return hashr.SignatureUnsigned, "no header signature found"
+	}
+
+	signer := sigs[0].Signer
+	if signer == nil {
+		return hashr.SignatureVerified, ""
+	}
+	for _, e := range keyring {
+		if e.PrimaryKey.KeyId == signer.PrimaryKey.KeyId {
+			return hashr.SignatureVerified, common.SignerName(e)
+		}
+	}
+	return hashr.SignatureVerified, fmt.Sprintf("key %X", signer.PrimaryKey.KeyId)
+}
+
+// toRPMKeyring converts public keys of a given keyring to the keyring type accepted by rpmutils.
+func toRPMKeyring(keyring openpgp.EntityList) (xopenpgp.EntityList, error) {
+	var buf bytes.Buffer
+	for _, e := range keyring {
+		if err := e.Serialize(&buf); err != nil {
+			return nil, err
+		}
+	}
+	if buf.Len() == 0 {
+		return xopenpgp.EntityList{}, nil
+	}
+	return xopenpgp.ReadKeyRing(&buf)
+}
+
+// readMetadata returns package metadata and file digests stored in the header of a given rpm file.
+func readMetadata(rpmPath string) (*hashrCommon.SourceMetadata, error) {
+	fd, err := os.Open(rpmPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rpm file: %v", err)
+	}
+	defer fd.Close()
+
+	header, err := rpmutils.ReadHeader(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rpm file: %v", err)
+	}
+
+	nevra, err := header.GetNEVRA()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package name: %v", err)
+	}
+	version := fmt.Sprintf("%s-%s", nevra.Version, nevra.Release)
+	if nevra.Epoch != "0" {
+		version = fmt.Sprintf("%s:%s", nevra.Epoch, version)
+	}
+
+	// Optional tags are left empty if they are missing.
+	tag := func(t int) string {
+		value, _ := header.GetString(t)
+		return value
+	}
+
+	m := &hashrCommon.SourceMetadata{
+		Name:          nevra.Name,
+		Version:       version,
+		Architecture:  nevra.Arch,
+		Maintainer:    tag(rpmutils.VENDOR),
+		SourcePackage: tag(rpmutils.SOURCERPM),
+		License:       tag(rpmutils.LICENSE),
+	}
+	if m.Maintainer == "" {
+		m.Maintainer = tag(rpmutils.PACKAGER)
+	}
+
+	// Packages built by rpm older than 4.6 don't have FILEDIGESTALGO tag and use MD5.
+	algorithm := digestAlgorithms[rpmutils.PGPHASHALGO_MD5]
+	if algos, err := header.GetInts(rpmutils.FILEDIGESTALGO); err == nil && len(algos) > 0 {
+		var ok bool
+		if algorithm, ok = digestAlgorithms[algos[0]]; !ok {
+			return nil, fmt.Errorf("unsupported file digest algorithm: %d", algos[0])
+		}
+	}
+
+	files, err := header.GetFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file list: %v", err)
+	}
+	for _, f := range files {
+		// Only regular files (S_IFREG) have digests.
+		if f.Mode()&0170000 != 0100000 || f.Digest() == "" {
+			continue
+		}
+		m.Files = append(m.Files, hashrCommon.FileDigest{Path: f.Name(), Algorithm: algorithm, Digest: f.Digest()})
+	}
+
+	return m, nil
+}
+
+// Preprocess extracts the contents of a .rpm file and verifies its header signatures, if the
+// keyring is set.
 func (a *Archive) Preprocess() (string, error) {
 	var err error
 	a.localPath, err = common.CopyToLocal(a.remotePath, a.ID())
@@ -80,14 +224,47 @@ func (a *Archive) Preprocess() (string, error) {
 		return "", fmt.Errorf("error while copying %s to local file system: %v", a.remotePath, err)
 	}
 
+	if a.indexChecksum != "" {
+		if err := a.verifyChecksum(); err != nil {
+			return "", err
+		}
+	}
+
+	if a.keyring != nil {
+		a.signatureStatus, a.signatureDetails = verifyRPM(a.localPath, a.keyring)
+	}
+
+	if a.metadata, err = readMetadata(a.localPath); err != nil {
+		glog.Warningf("Could not read metadata of %s: %v", a.ID(), err)
+	}
+
 	baseDir, _ := filepath.Split(a.localPath)
-	extractionDir := filepath.Join(baseDir, "extracted")
+	a.extractionDir = filepath.Join(baseDir, "extracted")
 
-	if err := extractRPM(a.localPath, extractionDir); err != nil {
+	if err := extractRPM(a.localPath, a.extractionDir); err != nil {
 		return "", err
 	}
 
-	return extractionDir, nil
+	return a.extractionDir, nil
+}
+
+// verifyChecksum checks the copied .rpm file against its checksum listed in the primary metadata.
+func (a *Archive) verifyChecksum() error {
+	f, err := os.Open(a.localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open rpm file: %v", err)
+	}
+	defer f.Close()
+
+	digest, err := common.Digest(a.indexChecksumAlg, f)
+	if err != nil {
+		return fmt.Errorf("could not calculate checksum of rpm file: %v", err)
+	}
+	if digest != a.indexChecksum {
+		return fmt.Errorf("%s digest %s does not match %s listed in the primary metadata", a.indexChecksumAlg, digest, a.indexChecksum)
+	}
+
+	return nil
 }
 
 // ID returns non-unique rpm Archive ID.
@@ -97,6 +274,9 @@ func (a *Archive) ID() string {
 
 // RepoName returns repository name.
 func (a *Archive) RepoName() string {
+	if a.repoName != "" {
+		return a.repoName
+	}
 	return RepoName
 }
 
@@ -117,7 +297,31 @@ func (a *Archive) RemotePath() string {
 
 // Description provides additional description for a .rpm file.
 func (a *Archive) Description() string {
-	return ""
+	var nevra string
+	if a.nevra != "" {
+		nevra = fmt.Sprintf("NEVRA: %s", a.nevra)
+	}
+	return common.JoinDescriptions(nevra, common.PackageDescription(a.metadata), common.SignatureDescription(a.signatureStatus, a.signatureDetails))
+}
+
+// Metadata returns package metadata read from the rpm header.
+func (a *Archive) Metadata() *hashrCommon.SourceMetadata {
+	return a.metadata
+}
+
+// CheckSamples compares samples extracted from the .rpm file with file digests stored in the rpm
+// header.
+func (a *Archive) CheckSamples(samples []hashrCommon.Sample) []string {
+	if a.metadata == nil || len(a.metadata.Files) == 0 {
+		return nil
+	}
+
+	return common.CheckManifest(a.metadata.Files, samples, a.extractionDir)
+}
+
+// SignatureStatus returns the result of rpm header signature verification.
+func (a *Archive) SignatureStatus() (string, string) {
+	return a.signatureStatus, a.signatureDetails
 }
 
 // QuickSHA256Hash calculates sha256 hash of .rpm file.
@@ -164,14 +368,16 @@ func (a *Archive) QuickSHA256Hash() (string, error) {
 	return a.quickSha256hash, nil
 }
 
-// NewRepo returns new instance of rpm repository.
-func NewRepo(path string) *Repo {
-	return &Repo{location: path}
+// NewRepo returns new instance of rpm repository. Archives are verified against a given keyring,
+// nil keyring disables the verification.
+func NewRepo(path string, keyring openpgp.EntityList) *Repo {
+	return &Repo{location: path, keyring: keyring}
 }
 
 // Repo holds data related to a rpm repository.
 type Repo struct {
 	location string
+	keyring  openpgp.EntityList
 	files    []string
 	Archives []*Archive
 }
@@ -197,7 +403,7 @@ func (r *Repo) DiscoverRepo() ([]hashr.Source, error) {
 		_, filename := filepath.Split(file)
 
 		if strings.HasSuffix(filename, ".rpm") {
-			r.Archives = append(r.Archives, &Archive{filename: filename, remotePath: file, repoPath: r.location})
+			r.Archives = append(r.Archives, &Archive{filename: filename, remotePath: file, repoPath: r.location, keyring: r.keyring})
 		}
 	}
 
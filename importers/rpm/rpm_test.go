@@ -15,6 +15,7 @@
 package rpm
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -23,7 +24,14 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	hashrCommon "github.com/google/hashr/common"
+	"github.com/google/hashr/core/hashr"
+
+	rpmutils "github.com/sassoftware/go-rpmutils"
+	xopenpgp "golang.org/x/crypto/openpgp"
 )
 
 func sha256sum(path string) ([32]byte, error) {
@@ -36,7 +44,7 @@ func sha256sum(path string) ([32]byte, error) {
 }
 
 func testImages() ([]*Archive, error) {
-	rpmRepo := NewRepo("testdata")
+	rpmRepo := NewRepo("testdata", nil)
 	gotSources, err := rpmRepo.DiscoverRepo()
 	if err != nil {
 		return nil, fmt.Errorf("unexpected error while discovering repo: %v", err)
@@ -422,7 +430,7 @@ func TestImageFunctions(t *testing.T) {
 
 func TestRepoFunctions(t *testing.T) {
 	repoPath := "/tmp/rpm-repo"
-	repo := NewRepo(repoPath)
+	repo := NewRepo(repoPath, nil)
 
 	if repo.RepoName() != RepoName {
 		t.Errorf("RepoName() = %s; want = %s", repo.RepoName(), RepoName)
@@ -432,3 +440,112 @@ func TestRepoFunctions(t *testing.T) {
 		t.Errorf("RepoPath() = %s; want = %s", repo.RepoPath(), repoPath)
 	}
 }
+
+// publicKey returns the public part of a given x/crypto key, as loaded by common.LoadKeyring.
+func publicKey(t *testing.T, e *xopenpgp.Entity) *openpgp.Entity {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := e.Serialize(&buf); err != nil {
+		t.Fatalf("could not serialize OpenPGP key: %v", err)
+	}
+	keys, err := openpgp.ReadKeyRing(&buf)
+	if err != nil {
+		t.Fatalf("could not read OpenPGP key: %v", err)
+	}
+	return keys[0]
+}
+
+func TestSignatureStatus(t *testing.T) {
+	// rpmutils signs packages with keys of the x/crypto package.
+	signingKey, err := xopenpgp.NewEntity("Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate OpenPGP key: %v", err)
+	}
+	signer := publicKey(t, signingKey)
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate OpenPGP key: %v", err)
+	}
+
+	unsigned := "testdata/20200106.00.00/ubuntu-desktop.rpm"
+	f, err := os.Open(unsigned)
+	if err != nil {
+		t.Fatalf("could not open test package: %v", err)
+	}
+	defer f.Close()
+	signed := filepath.Join(t.TempDir(), "ubuntu-desktop.rpm")
+	if _, err := rpmutils.SignRpmFile(f, signed, signingKey.PrivateKey, nil); err != nil {
+		t.Fatalf("could not sign test package: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		path        string
+		keyring     openpgp.EntityList
+		wantStatus  string
+		wantDetails string
+	}{
+		{
+			name:        "signed",
+			path:        signed,
+			keyring:     openpgp.EntityList{other, signer},
+			wantStatus:  hashr.SignatureVerified,
+			wantDetails: "Signer <signer@example.com>",
+		},
+		{
+			name:        "unknown key",
+			path:        signed,
+			keyring:     openpgp.EntityList{other},
+			wantStatus:  hashr.SignatureUnverified,
+			wantDetails: fmt.Sprintf("signed with a key that is not in the keyring: keyid %x not found", signer.PrimaryKey.KeyId),
+		},
+		{
+			name:        "unsigned",
+			path:        unsigned,
+			keyring:     openpgp.EntityList{signer},
+			wantStatus:  hashr.SignatureUnsigned,
+			wantDetails: "no header signature found",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := &Archive{filename: filepath.Base(tc.path), remotePath: tc.path, keyring: tc.keyring}
+			if _, err := archive.Preprocess(); err != nil {
+				t.Fatalf("unexpected Preprocess() error: %v", err)
+			}
+
+			status, details := archive.SignatureStatus()
+			if status != tc.wantStatus || details != tc.wantDetails {
+				t.Errorf("SignatureStatus() = %q, %q; want %q, %q", status, details, tc.wantStatus, tc.wantDetails)
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	archive := &Archive{filename: "ubuntu-desktop.rpm", remotePath: "testdata/20200106.00.00/ubuntu-desktop.rpm", repoPath: "testdata"}
+	if _, err := archive.Preprocess(); err != nil {
+		t.Fatalf("unexpected Preprocess() error: %v", err)
+	}
+
+	got := archive.Metadata()
+	if got == nil {
+		t.Fatal("Metadata() = nil, want package metadata")
+	}
+	want := hashrCommon.SourceMetadata{Name: "testdata", Version: "1.0-1", Architecture: "noarch", SourcePackage: "testdata-1.0-1.src.rpm", License: "Apache 2.0"}
+	if diff := cmp.Diff(want, *got, cmpopts.IgnoreFields(hashrCommon.SourceMetadata{}, "Files")); diff != "" {
+		t.Errorf("Metadata() unexpected diff (-want/+got):\n%s", diff)
+	}
+
+	if len(got.Files) != 10 {
+		t.Fatalf("Metadata() returned %d file digests, want 10", len(got.Files))
+	}
+	wantFile := hashrCommon.FileDigest{Path: "/file.01", Algorithm: "sha256", Digest: "c2e7f7d23b30766c2d55e847b349d0540f4847b263ee15521dc72023846884ea"}
+	if got.Files[0] != wantFile {
+		t.Errorf("Metadata() file digest = %v, want %v", got.Files[0], wantFile)
+	}
+
+	if got, want := archive.Description(), "Package: testdata 1.0-1 (noarch), Source: testdata-1.0-1.src.rpm, License: Apache 2.0"; got != want {
+		t.Errorf("Description() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/google/hashr/core/hashr"
+	"github.com/google/hashr/importers/common"
+)
+
+// YumRepoName contains the YUM repository name.
+const YumRepoName = "yum"
+
+// repomd holds the part of repodata/repomd.xml needed to find the primary metadata.
+type repomd struct {
+	Data []struct {
+		Type     string          `xml:"type,attr"`
+		Checksum checksum        `xml:"checksum"`
+		Location locationElement `xml:"location"`
+	} `xml:"data"`
+}
+
+// primary holds the part of the primary metadata that lists packages of a YUM repository.
+type primary struct {
+	Packages []struct {
+		Type    string `xml:"type,attr"`
+		Name    string `xml:"name"`
+		Arch    string `xml:"arch"`
+		Version struct {
+			Epoch string `xml:"epoch,attr"`
+			Ver   string `xml:"ver,attr"`
+			Rel   string `xml:"rel,attr"`
+		} `xml:"version"`
+		Checksum checksum        `xml:"checksum"`
+		Location locationElement `xml:"location"`
+	} `xml:"package"`
+}
+
+// checksum holds a checksum element of YUM repository metadata.
+type checksum struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// locationElement holds a location element of YUM repository metadata, the base is optional.
+type locationElement struct {
+	Base string `xml:"base,attr"`
+	Href string `xml:"href,attr"`
+}
+
+// nevra returns the name, epoch, version, release and architecture of a package in the format used
+// by rpm, the epoch is omitted if it's not set.
+func nevra(name, epoch, version, release, arch string) string {
+	if epoch != "" && epoch != "0" {
+		version = epoch + ":" + version
+	}
+	return fmt.Sprintf("%s-%s-%s.%s", name, version, release, arch)
+}
+
+// YumRepo holds data related to a YUM/DNF repository mirror.
+type YumRepo struct {
+	location string
+	keyring  openpgp.EntityList
+	Archives []*Archive
+}
+
+// NewYumRepo returns new instance of YUM repository. The location is a local path or a file://,
+// http:// or https:// URL of the directory holding repodata/. Archives are verified against a
+// given keyring, nil keyring disables the verification.
+func NewYumRepo(location string, keyring openpgp.EntityList) *YumRepo {
+	return &YumRepo{location: location, keyring: keyring}
+}
+
+// RepoName returns repository name.
+func (r *YumRepo) RepoName() string {
+	return YumRepoName
+}
+
+// RepoPath returns repository path.
+func (r *YumRepo) RepoPath() string {
+	return r.location
+}
+
+// DiscoverRepo reads the primary metadata of the repository. Quick hashes of the archives are
+// based on their checksums listed in the metadata, so only archives that were not processed yet
+// are downloaded.
+func (r *YumRepo) DiscoverRepo() ([]hashr.Source, error) {
+	data, err := common.ReadLocation(common.JoinLocation(r.location, "repodata", "repomd.xml"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read repomd.xml: %v", err)
+	}
+
+	var md repomd
+	if err := xml.Unmarshal(data, &md); err != nil {
+		return nil, fmt.Errorf("could not parse repomd.xml: %v", err)
+	}
+
+	var packages *primary
+	for _, d := range md.Data {
+		if d.Type != "primary" {
+			continue
+		}
+		if common.ContainsDotDot(d.Location.Href) {
+			return nil, fmt.Errorf("primary metadata path is outside of the repository: %s", d.Location.Href)
+		}
+		if packages, err = r.fetchPrimary(d.Location, d.Checksum); err != nil {
+			return nil, fmt.Errorf("could not read primary metadata: %v", err)
+		}
+		break
+	}
+	if packages == nil {
+		return nil, errors.New("primary metadata is not listed in repomd.xml")
+	}
+
+	archives := make(map[string]*Archive)
+	for _, p := range packages.Packages {
+		if (p.Type != "" && p.Type != "rpm") || p.Location.Href == "" || strings.TrimSpace(p.Checksum.Value) == "" {
+			continue
+		}
+		if common.ContainsDotDot(p.Location.Href) {
+			glog.Warningf("Skipping %s package with path outside of the repository: %s", p.Name, p.Location.Href)
+			continue
+		}
+		id := nevra(p.Name, p.Version.Epoch, p.Version.Ver, p.Version.Rel, p.Arch)
+		if _, ok := archives[id]; ok {
+			continue
+		}
+
+		algorithm := strings.ToLower(p.Checksum.Type)
+		digest := strings.ToLower(strings.TrimSpace(p.Checksum.Value))
+		quickHash := digest
+		// Quick hashes must be SHA256 digests, packages listed with other checksums get a digest of
+		// the checksum.
+		if algorithm != "sha256" {
+			quickHash = fmt.Sprintf("%x", sha256.Sum256([]byte(algorithm+":"+quickHash)))
+		}
+
+		archives[id] = &Archive{
+			filename:         id,
+			remotePath:       r.packageLocation(p.Location),
+			repoPath:         r.location,
+			repoName:         YumRepoName,
+			quickSha256hash:  quickHash,
+			keyring:          r.keyring,
+			nevra:            id,
+			indexChecksum:    digest,
+			indexChecksumAlg: algorithm,
+		}
+	}
+
+	var ids []string
+	for id := range archives {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var sources []hashr.Source
+	for _, id := range ids {
+		r.Archives = append(r.Archives, archives[id])
+		sources = append(sources, archives[id])
+	}
+
+	return sources, nil
+}
+
+// packageLocation returns the location of a package, which is relative to the repository unless
+// the metadata sets a different base.
+func (r *YumRepo) packageLocation(l locationElement) string {
+	if l.Base != "" {
+		return common.JoinLocation(l.Base, l.Href)
+	}
+	return common.JoinLocation(r.location, l.Href)
+}
+
+// fetchPrimary reads the primary metadata, checks it against its checksum listed in repomd.xml and
+// decompresses it based on its extension.
+func (r *YumRepo) fetchPrimary(location locationElement, sum checksum) (*primary, error) {
+	data, err := common.ReadLocation(r.packageLocation(location))
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := common.Digest(strings.ToLower(sum.Type), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(digest, strings.TrimSpace(sum.Value)) {
+		return nil, fmt.Errorf("%s digest %s does not match %s listed in repomd.xml", sum.Type, digest, sum.Value)
+	}
+
+	var rd io.Reader = bytes.NewReader(data)
+	switch path.Ext(location.Href) {
+	case ".gz":
+		rd, err = gzip.NewReader(rd)
+	case ".zst":
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(rd)
+		if err == nil {
+			defer d.Close()
+			rd = d
+		}
+	case ".xz":
+		rd, err = xz.NewReader(rd)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress primary metadata: %v", err)
+	}
+
+	var p primary
+	if err := xml.NewDecoder(rd).Decode(&p); err != nil {
+		return nil, fmt.Errorf("could not parse primary metadata: %v", err)
+	}
+
+	return &p, nil
+}
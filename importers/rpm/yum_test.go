@@ -0,0 +1,222 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeYumRepo writes a YUM repository with the test package listed three times: with a SHA256
+// checksum, with an epoch and a SHA1 checksum, and with a wrong checksum, and a package with a path
+// outside of the repository. The primary metadata is written to a given file and compressed based
+// on its extension.
+func writeYumRepo(t *testing.T, primaryName string) (string, []byte) {
+	t.Helper()
+
+	repo := t.TempDir()
+	data, err := os.ReadFile("testdata/20200106.00.00/ubuntu-desktop.rpm")
+	if err != nil {
+		t.Fatalf("could not read test package: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(repo, "Packages", "t"), 0755); err != nil {
+		t.Fatalf("could not create Packages directory: %v", err)
+	}
+	for _, name := range []string{"testdata-1.0-1.noarch.rpm", "testdata-1.5-1.noarch.rpm", "testdata-2.0-1.noarch.rpm"} {
+		if err := os.WriteFile(filepath.Join(repo, "Packages", "t", name), data, 0644); err != nil {
+			t.Fatalf("could not write test package: %v", err)
+		}
+	}
+
+	var metadata bytes.Buffer
+	fmt.Fprint(&metadata, `<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="4">
+`)
+	for _, p := range []struct{ epoch, version, checksumType, checksum string }{
+		{"0", "1.0", "sha256", fmt.Sprintf("%x", sha256.Sum256(data))},
+		{"1", "1.5", "sha", fmt.Sprintf("%x", sha1.Sum(data))},
+		{"0", "2.0", "sha256", fmt.Sprintf("%x", sha256.Sum256(nil))},
+	} {
+		fmt.Fprintf(&metadata, `<package type="rpm">
+  <name>testdata</name>
+  <arch>noarch</arch>
+  <version epoch="%s" ver="%s" rel="1"/>
+  <checksum type="%s" pkgid="YES">%s</checksum>
+  <location href="Packages/t/testdata-%s-1.noarch.rpm"/>
+</package>
+`, p.epoch, p.version, p.checksumType, p.checksum, p.version)
+	}
+	// Packages with paths outside of the repository are skipped.
+	fmt.Fprintf(&metadata, `<package type="rpm">
+  <name>escape</name>
+  <arch>noarch</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%x</checksum>
+  <location href="Packages/../../escape-1.0-1.noarch.rpm"/>
+</package>
+`, sha256.Sum256(data))
+	fmt.Fprint(&metadata, "</metadata>\n")
+
+	var compressed bytes.Buffer
+	switch filepath.Ext(primaryName) {
+	case ".gz":
+		w := gzip.NewWriter(&compressed)
+		w.Write(metadata.Bytes())
+		w.Close()
+	case ".zst":
+		w, err := zstd.NewWriter(&compressed)
+		if err != nil {
+			t.Fatalf("could not create zstd writer: %v", err)
+		}
+		w.Write(metadata.Bytes())
+		w.Close()
+	default:
+		compressed = metadata
+	}
+
+	if err := os.MkdirAll(filepath.Join(repo, "repodata"), 0755); err != nil {
+		t.Fatalf("could not create repodata directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "repodata", primaryName), compressed.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write primary metadata: %v", err)
+	}
+	repomd := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo" xmlns:rpm="http://linux.duke.edu/metadata/rpm">
+  <revision>1</revision>
+  <data type="filelists">
+    <checksum type="sha256">0000</checksum>
+    <location href="repodata/filelists.xml.gz"/>
+  </data>
+  <data type="primary">
+    <checksum type="sha256">%x</checksum>
+    <location href="repodata/%s"/>
+  </data>
+</repomd>
+`, sha256.Sum256(compressed.Bytes()), primaryName)
+	if err := os.WriteFile(filepath.Join(repo, "repodata", "repomd.xml"), []byte(repomd), 0644); err != nil {
+		t.Fatalf("could not write repomd.xml: %v", err)
+	}
+
+	return repo, data
+}
+
+func TestYumDiscoverRepo(t *testing.T) {
+	for _, primaryName := range []string{"primary.xml.gz", "primary.xml.zst", "primary.xml"} {
+		t.Run(primaryName, func(t *testing.T) {
+			repo, data := writeYumRepo(t, primaryName)
+			server := httptest.NewServer(http.FileServer(http.Dir(repo)))
+			defer server.Close()
+
+			for _, location := range []string{server.URL, repo} {
+				yumRepo := NewYumRepo(location, nil)
+				if yumRepo.RepoName() != YumRepoName {
+					t.Errorf("RepoName() = %s; want = %s", yumRepo.RepoName(), YumRepoName)
+				}
+
+				sources, err := yumRepo.DiscoverRepo()
+				if err != nil {
+					t.Fatalf("unexpected error while discovering repo: %v", err)
+				}
+
+				type discovered struct {
+					RepoName, RemotePath, QuickHash string
+				}
+				got := make(map[string]discovered)
+				for _, source := range sources {
+					quickHash, err := source.QuickSHA256Hash()
+					if err != nil {
+						t.Fatalf("unexpected QuickSHA256Hash() error: %v", err)
+					}
+					got[source.ID()] = discovered{source.RepoName(), source.RemotePath(), quickHash}
+				}
+
+				packageLocation := func(name string) string {
+					if location == repo {
+						return filepath.Join(repo, "Packages", "t", name)
+					}
+					return location + "/Packages/t/" + name
+				}
+				want := map[string]discovered{
+					"testdata-1.0-1.noarch":   {YumRepoName, packageLocation("testdata-1.0-1.noarch.rpm"), fmt.Sprintf("%x", sha256.Sum256(data))},
+					"testdata-1:1.5-1.noarch": {YumRepoName, packageLocation("testdata-1.5-1.noarch.rpm"), fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("sha:%x", sha1.Sum(data)))))},
+					"testdata-2.0-1.noarch":   {YumRepoName, packageLocation("testdata-2.0-1.noarch.rpm"), fmt.Sprintf("%x", sha256.Sum256(nil))},
+				}
+				if !cmp.Equal(want, got) {
+					t.Errorf("DiscoverRepo() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+				}
+			}
+		})
+	}
+}
+
+func TestYumDiscoverRepoModifiedPrimary(t *testing.T) {
+	repo, _ := writeYumRepo(t, "primary.xml.gz")
+	if err := os.WriteFile(filepath.Join(repo, "repodata", "primary.xml.gz"), []byte("modified"), 0644); err != nil {
+		t.Fatalf("could not write primary metadata: %v", err)
+	}
+
+	if _, err := NewYumRepo(repo, nil).DiscoverRepo(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("DiscoverRepo() error = %v, want checksum mismatch", err)
+	}
+}
+
+func TestYumPreprocess(t *testing.T) {
+	repo, _ := writeYumRepo(t, "primary.xml.zst")
+	server := httptest.NewServer(http.FileServer(http.Dir(repo)))
+	defer server.Close()
+
+	sources, err := NewYumRepo(server.URL, nil).DiscoverRepo()
+	if err != nil {
+		t.Fatalf("unexpected error while discovering repo: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, source := range sources {
+		extractionDir, err := source.Preprocess()
+		if source.ID() == "testdata-2.0-1.noarch" {
+			if err == nil || !strings.Contains(err.Error(), "does not match") {
+				t.Errorf("Preprocess() of %s error = %v, want checksum mismatch", source.ID(), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected Preprocess() error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(extractionDir, "file.01")); err != nil {
+			t.Errorf("Preprocess() did not extract %s: %v", source.ID(), err)
+		}
+		got[source.ID()] = source.Description()
+	}
+
+	want := map[string]string{
+		"testdata-1.0-1.noarch":   "NEVRA: testdata-1.0-1.noarch, Package: testdata 1.0-1 (noarch), Source: testdata-1.0-1.src.rpm, License: Apache 2.0",
+		"testdata-1:1.5-1.noarch": "NEVRA: testdata-1:1.5-1.noarch, Package: testdata 1.0-1 (noarch), Source: testdata-1.0-1.src.rpm, License: Apache 2.0",
+	}
+	if !cmp.Equal(want, got) {
+		t.Errorf("Description() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/golang/glog"
 
 	"github.com/google/hashr/core/hashr"
@@ -37,14 +38,19 @@ const (
 
 // Archive holds data related to targz archive.
 type Archive struct {
-	filename        string
-	remotePath      string
-	localPath       string
-	quickSha256hash string
-	repoPath        string
+	filename         string
+	remotePath       string
+	localPath        string
+	quickSha256hash  string
+	repoPath         string
+	sigPath          string
+	keyring          openpgp.EntityList
+	signatureStatus  string
+	signatureDetails string
 }
 
-// Preprocess extracts the contents of a .tar.gz file.
+// Preprocess extracts the contents of a .tar.gz file and verifies its detached signature, if the
+// keyring is set.
 func (a *Archive) Preprocess() (string, error) {
 	var err error
 	a.localPath, err = common.CopyToLocal(a.remotePath, a.ID())
@@ -52,6 +58,10 @@ func (a *Archive) Preprocess() (string, error) {
 		return "", fmt.Errorf("error while copying %s to local file system: %v", a.remotePath, err)
 	}
 
+	if a.keyring != nil {
+		a.signatureStatus, a.signatureDetails = common.VerifyDetachedSignature(a.keyring, a.localPath, a.sigPath)
+	}
+
 	baseDir, _ := filepath.Split(a.localPath)
 	extractionDir := filepath.Join(baseDir, "extracted")
 
@@ -89,7 +99,12 @@ func (a *Archive) RemotePath() string {
 
 // Description provides additional description for a .tar.gz file.
 func (a *Archive) Description() string {
-	return ""
+	return common.SignatureDescription(a.signatureStatus, a.signatureDetails)
+}
+
+// SignatureStatus returns the result of .tar.gz.sig signature verification.
+func (a *Archive) SignatureStatus() (string, string) {
+	return a.signatureStatus, a.signatureDetails
 }
 
 // QuickSHA256Hash calculates sha256 hash of .tar.gz file.
@@ -136,15 +151,17 @@ func (a *Archive) QuickSHA256Hash() (string, error) {
 	return a.quickSha256hash, nil
 }
 
-// NewRepo returns new instance of targz repository.
-func NewRepo(path string) *Repo {
-	return &Repo{location: path}
+// NewRepo returns new instance of targz repository. Archives are verified against a given keyring,
+// nil keyring disables the verification.
+func NewRepo(path string, keyring openpgp.EntityList) *Repo {
+	return &Repo{location: path, keyring: keyring}
 }
 
 // Repo holds data related to a targz repository.
 type Repo struct {
-	location   string
-	files      []string
+	location string
+	keyring  openpgp.EntityList
+	files    []string
 	Archives []*Archive
 }
 
@@ -165,11 +182,22 @@ func (r *Repo) DiscoverRepo() ([]hashr.Source, error) {
 		return nil, err
 	}
 
+	signatures := make(map[string]bool)
+	for _, file := range r.files {
+		if strings.HasSuffix(file, ".tar.gz.sig") {
+			signatures[file] = true
+		}
+	}
+
 	for _, file := range r.files {
 		_, filename := filepath.Split(file)
 
 		if strings.HasSuffix(filename, ".tar.gz") {
-			r.Archives = append(r.Archives, &Archive{filename: filename, remotePath: file, repoPath: r.location})
+			archive := &Archive{filename: filename, remotePath: file, repoPath: r.location, keyring: r.keyring}
+			if signatures[file+".sig"] {
+				archive.sigPath = file + ".sig"
+			}
+			r.Archives = append(r.Archives, archive)
 		}
 	}
 
@@ -15,6 +15,7 @@
 package targz
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -23,6 +24,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -36,7 +38,7 @@ func sha256sum(path string) ([32]byte, error) {
 }
 
 func testImages() ([]*Archive, error) {
-	gLinuxRepo := NewRepo("testdata")
+	gLinuxRepo := NewRepo("testdata", nil)
 	gotSources, err := gLinuxRepo.DiscoverRepo()
 	if err != nil {
 		return nil, fmt.Errorf("unexpected error while discovering repo: %v", err)
@@ -422,7 +424,7 @@ func TestImageFunctions(t *testing.T) {
 
 func TestRepoFunctions(t *testing.T) {
 	repoPath := "/tmp/glinux-repo"
-	repo := NewRepo(repoPath)
+	repo := NewRepo(repoPath, nil)
 
 	if repo.RepoName() != RepoName {
 		t.Errorf("RepoName() = %s; want = %s", repo.RepoName(), RepoName)
@@ -432,3 +434,59 @@ func TestRepoFunctions(t *testing.T) {
 		t.Errorf("RepoPath() = %s; want = %s", repo.RepoPath(), repoPath)
 	}
 }
+
+func TestSignatureStatus(t *testing.T) {
+	signer, err := openpgp.NewEntity("Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate OpenPGP key: %v", err)
+	}
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate OpenPGP key: %v", err)
+	}
+
+	data, err := ioutil.ReadFile("testdata/20200106.00.00/ubuntu-desktop.tar.gz")
+	if err != nil {
+		t.Fatalf("could not read test archive: %v", err)
+	}
+
+	repoPath := t.TempDir()
+	for name, key := range map[string]*openpgp.Entity{"signed.tar.gz": signer, "other.tar.gz": other, "unsigned.tar.gz": nil} {
+		path := filepath.Join(repoPath, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("could not write test archive: %v", err)
+		}
+		if key == nil {
+			continue
+		}
+		var sig bytes.Buffer
+		if err := openpgp.DetachSign(&sig, key, bytes.NewReader(data), nil); err != nil {
+			t.Fatalf("could not sign test archive: %v", err)
+		}
+		if err := ioutil.WriteFile(path+".sig", sig.Bytes(), 0644); err != nil {
+			t.Fatalf("could not write signature: %v", err)
+		}
+	}
+
+	sources, err := NewRepo(repoPath, openpgp.EntityList{signer}).DiscoverRepo()
+	if err != nil {
+		t.Fatalf("unexpected error while discovering repo: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, source := range sources {
+		if _, err := source.Preprocess(); err != nil {
+			t.Fatalf("unexpected Preprocess() error: %v", err)
+		}
+		got[source.ID()] = source.Description()
+	}
+
+	want := map[string]string{
+		"signed.tar.gz":   "OpenPGP signature: verified (Signer <signer@example.com>)",
+		"other.tar.gz":    "OpenPGP signature: unverified (signed with a key that is not in the keyring)",
+		"unsigned.tar.gz": "OpenPGP signature: unsigned (no detached signature found)",
+	}
+	if !cmp.Equal(want, got) {
+		t.Errorf("Description() unexpected diff (-want/+got):\n%s", cmp.Diff(want, got))
+	}
+}
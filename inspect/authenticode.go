@@ -0,0 +1,397 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inspect
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/google/hashr/common"
+	"go.mozilla.org/pkcs7"
+)
+
+// Results of Authenticode signature verification.
+const (
+	// SignatureUnsigned is set for PE files without a signature.
+	SignatureUnsigned = "unsigned"
+	// SignatureValid is set if the signature matches the image and the signer chains up to a
+	// trusted root.
+	SignatureValid = "valid"
+	// SignatureUntrusted is set if the signature matches the image, but the signer certificate
+	// could not be verified, e.g. it's issued by an unknown root.
+	SignatureUntrusted = "untrusted"
+	// SignatureInvalid is set if the signature is malformed or doesn't match the image.
+	SignatureInvalid = "invalid"
+)
+
+var (
+	oidContentType      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidCounterSignature = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 6}
+	oidRSAEncryption    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSpcIndirectData  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcPEImageData   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	oidRFC3161Timestamp = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+	authenticodeDigests = map[string]crypto.Hash{
+		"1.3.14.3.2.26":          crypto.SHA1,
+		"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+		"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+		"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+	}
+	rsaSignatureAlgorithms = map[crypto.Hash]x509.SignatureAlgorithm{
+		crypto.SHA1:   x509.SHA1WithRSA,
+		crypto.SHA256: x509.SHA256WithRSA,
+		crypto.SHA384: x509.SHA384WithRSA,
+		crypto.SHA512: x509.SHA512WithRSA,
+	}
+)
+
+// spcIndirectDataContent is the content signed by Authenticode signatures, it holds the digest
+// of the PE image.
+type spcIndirectDataContent struct {
+	Data struct {
+		Type  asn1.ObjectIdentifier
+		Value asn1.RawValue `asn1:"optional"`
+	}
+	MessageDigest struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}
+}
+
+// tstInfo is the content of RFC 3161 timestamp tokens, trailing optional fields are not needed.
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint struct {
+		HashAlgorithm pkix.AlgorithmIdentifier
+		HashedMessage []byte
+	}
+	SerialNumber *big.Int
+	GenTime      time.Time `asn1:"generalized"`
+}
+
+// counterSignerInfo is SignerInfo of legacy (PKCS #9) countersignatures, in which authenticated
+// attributes are mandatory.
+type counterSignerInfo struct {
+	Version               int
+	IssuerAndSerialNumber struct {
+		IssuerName   asn1.RawValue
+		SerialNumber *big.Int
+	}
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+// verifyAuthenticode verifies a given Authenticode signature of a PE file and records the result
+// in the metadata. Signer certificates are verified against given roots (system roots if nil) at
+// the time of the timestamp, or at the current time if the signature is not timestamped.
+func verifyAuthenticode(m *common.ExecutableMetadata, f *pe.File, r io.ReaderAt, size int64, signature *pkcs7.PKCS7, roots *x509.CertPool) {
+	if err := checkAuthenticodeSignature(f, r, size, signature); err != nil {
+		m.SignatureStatus, m.SignatureError = SignatureInvalid, err.Error()
+		return
+	}
+
+	signingTime, tsa, tsaCertificates, err := authenticodeTimestamp(signature)
+	if err != nil {
+		m.SignatureStatus, m.SignatureError = SignatureInvalid, fmt.Sprintf("invalid timestamp: %v", err)
+		return
+	}
+
+	at := time.Now()
+	if !signingTime.IsZero() {
+		at = signingTime
+		m.SigningTime = &signingTime
+	}
+
+	chain, err := verifyCertificate(signature.GetOnlySigner(), signature.Certificates, roots, at, x509.ExtKeyUsageCodeSigning)
+	if err != nil {
+		m.SignatureStatus, m.SignatureError = SignatureUntrusted, fmt.Sprintf("could not verify signer certificate: %v", err)
+		return
+	}
+	if tsa != nil {
+		if _, err := verifyCertificate(tsa, tsaCertificates, roots, signingTime, x509.ExtKeyUsageTimeStamping); err != nil {
+			m.SignatureStatus, m.SignatureError = SignatureUntrusted, fmt.Sprintf("could not verify timestamping certificate: %v", err)
+			return
+		}
+	}
+
+	m.SignatureStatus = SignatureValid
+	for _, cert := range chain {
+		m.SignerChain = append(m.SignerChain, cert.Subject.String())
+	}
+}
+
+// checkAuthenticodeSignature checks that the signature is made over the digest of the PE image
+// and that the digest matches the image.
+func checkAuthenticodeSignature(f *pe.File, r io.ReaderAt, size int64, signature *pkcs7.PKCS7) error {
+	if len(signature.Signers) != 1 {
+		return fmt.Errorf("signature has %d signers, expected exactly one", len(signature.Signers))
+	}
+
+	var contentType asn1.ObjectIdentifier
+	if err := signature.UnmarshalSignedAttribute(oidContentType, &contentType); err != nil {
+		return fmt.Errorf("could not read content type: %v", err)
+	}
+	if !contentType.Equal(oidSpcIndirectData) {
+		return fmt.Errorf("unexpected content type %v", contentType)
+	}
+
+	// The signed content is stored without the header of its outer SEQUENCE, which is not included
+	// in the digest either.
+	var content spcIndirectDataContent
+	der := append(append([]byte{0x30}, asn1Length(len(signature.Content))...), signature.Content...)
+	if _, err := asn1.Unmarshal(der, &content); err != nil {
+		return fmt.Errorf("could not parse signed content: %v", err)
+	}
+	if !content.Data.Type.Equal(oidSpcPEImageData) {
+		return fmt.Errorf("signed content is not a PE image digest: %v", content.Data.Type)
+	}
+
+	hash, ok := authenticodeDigests[content.MessageDigest.Algorithm.Algorithm.String()]
+	if !ok || !hash.Available() {
+		return fmt.Errorf("unsupported digest algorithm %v", content.MessageDigest.Algorithm.Algorithm)
+	}
+	digest, err := peImageDigest(f, r, size, hash)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, content.MessageDigest.Digest) {
+		return fmt.Errorf("image digest %x does not match signed digest %x", digest, content.MessageDigest.Digest)
+	}
+
+	if err := signature.Verify(); err != nil {
+		return fmt.Errorf("could not verify signature: %v", err)
+	}
+
+	return nil
+}
+
+// asn1Length returns DER encoding of a given length.
+func asn1Length(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// peImageDigest computes the Authenticode digest of a PE file, which covers the whole file except
+// for the checksum, the certificate table entry in the data directory and the certificate table
+// itself.
+func peImageDigest(f *pe.File, r io.ReaderAt, size int64, hash crypto.Hash) ([]byte, error) {
+	var peOffset [4]byte
+	if _, err := r.ReadAt(peOffset[:], 0x3c); err != nil {
+		return nil, fmt.Errorf("could not read PE header offset: %v", err)
+	}
+
+	// The optional header follows the PE signature and the COFF file header, the checksum is at
+	// the same offset in PE32 and PE32+ files, data directories are not.
+	optionalHeader := int64(binary.LittleEndian.Uint32(peOffset[:])) + 4 + 20
+	checksum := optionalHeader + 64
+	security := optionalHeader + 8*pe.IMAGE_DIRECTORY_ENTRY_SECURITY
+	switch f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		security += 96
+	case *pe.OptionalHeader64:
+		security += 112
+	default:
+		return nil, fmt.Errorf("PE file has no optional header")
+	}
+
+	dir := peDataDirectory(f, pe.IMAGE_DIRECTORY_ENTRY_SECURITY)
+	tableStart, tableEnd := int64(dir.VirtualAddress), int64(dir.VirtualAddress)+int64(dir.Size)
+	if security+8 > tableStart || tableEnd > size {
+		return nil, fmt.Errorf("certificate table at 0x%x is out of bounds", tableStart)
+	}
+
+	h := hash.New()
+	for _, part := range [][2]int64{{0, checksum}, {checksum + 4, security}, {security + 8, tableStart}, {tableEnd, size}} {
+		if _, err := io.Copy(h, io.NewSectionReader(r, part[0], part[1]-part[0])); err != nil {
+			return nil, fmt.Errorf("could not compute image digest: %v", err)
+		}
+	}
+
+	return h.Sum(nil), nil
+}
+
+// authenticodeTimestamp returns the verified time of the signature timestamp, together with the
+// certificate of the timestamping authority and certificates that can be used to verify it. Zero
+// time is returned for signatures that are not timestamped.
+func authenticodeTimestamp(signature *pkcs7.PKCS7) (time.Time, *x509.Certificate, []*x509.Certificate, error) {
+	signer := signature.Signers[0]
+	for _, attr := range signer.UnauthenticatedAttributes {
+		switch {
+		case attr.Type.Equal(oidRFC3161Timestamp):
+			return rfc3161Timestamp(attr.Value.Bytes, signer.EncryptedDigest)
+		case attr.Type.Equal(oidCounterSignature):
+			return counterSignatureTimestamp(attr.Value.Bytes, signer.EncryptedDigest, signature.Certificates)
+		}
+	}
+
+	return time.Time{}, nil, nil, nil
+}
+
+// rfc3161Timestamp verifies an RFC 3161 timestamp token of a given signature, which is used by
+// current Authenticode signatures.
+func rfc3161Timestamp(token, signature []byte) (time.Time, *x509.Certificate, []*x509.Certificate, error) {
+	ts, err := pkcs7.Parse(token)
+	if err != nil {
+		return time.Time{}, nil, nil, fmt.Errorf("could not parse timestamp token: %v", err)
+	}
+	if err := ts.Verify(); err != nil {
+		return time.Time{}, nil, nil, fmt.Errorf("could not verify timestamp token: %v", err)
+	}
+
+	var info tstInfo
+	if _, err := asn1.Unmarshal(ts.Content, &info); err != nil {
+		return time.Time{}, nil, nil, fmt.Errorf("could not parse timestamp info: %v", err)
+	}
+	if err := checkDigest(info.MessageImprint.HashAlgorithm, info.MessageImprint.HashedMessage, signature); err != nil {
+		return time.Time{}, nil, nil, err
+	}
+
+	tsa := ts.GetOnlySigner()
+	if tsa == nil {
+		return time.Time{}, nil, nil, fmt.Errorf("timestamp token has no signer certificate")
+	}
+
+	return info.GenTime, tsa, ts.Certificates, nil
+}
+
+// counterSignatureTimestamp verifies a legacy countersignature of a given signature, the
+// certificate of the countersigner is stored among certificates of the signature.
+func counterSignatureTimestamp(counterSignature, signature []byte, certificates []*x509.Certificate) (time.Time, *x509.Certificate, []*x509.Certificate, error) {
+	var info counterSignerInfo
+	if _, err := asn1.Unmarshal(counterSignature, &info); err != nil {
+		return time.Time{}, nil, nil, fmt.Errorf("could not parse countersignature: %v", err)
+	}
+	if info.AuthenticatedAttributes.Class != asn1.ClassContextSpecific || info.AuthenticatedAttributes.Tag != 0 {
+		return time.Time{}, nil, nil, fmt.Errorf("countersignature has no authenticated attributes")
+	}
+
+	// Authenticated attributes are signed as a SET, but stored with an implicit tag.
+	signed := append([]byte{0x31}, info.AuthenticatedAttributes.FullBytes[1:]...)
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+		return time.Time{}, nil, nil, fmt.Errorf("could not parse countersignature attributes: %v", err)
+	}
+
+	var digest []byte
+	var signingTime time.Time
+	for _, attr := range attrs {
+		var err error
+		switch {
+		case attr.Type.Equal(oidMessageDigest):
+			_, err = asn1.Unmarshal(attr.Value.Bytes, &digest)
+		case attr.Type.Equal(oidSigningTime):
+			_, err = asn1.Unmarshal(attr.Value.Bytes, &signingTime)
+		}
+		if err != nil {
+			return time.Time{}, nil, nil, fmt.Errorf("could not parse countersignature attribute %v: %v", attr.Type, err)
+		}
+	}
+	if signingTime.IsZero() {
+		return time.Time{}, nil, nil, fmt.Errorf("countersignature has no signing time")
+	}
+	if err := checkDigest(info.DigestAlgorithm, digest, signature); err != nil {
+		return time.Time{}, nil, nil, err
+	}
+
+	var countersigner *x509.Certificate
+	for _, cert := range certificates {
+		if bytes.Equal(cert.RawIssuer, info.IssuerAndSerialNumber.IssuerName.FullBytes) && cert.SerialNumber.Cmp(info.IssuerAndSerialNumber.SerialNumber) == 0 {
+			countersigner = cert
+			break
+		}
+	}
+	if countersigner == nil {
+		return time.Time{}, nil, nil, fmt.Errorf("no certificate for countersigner")
+	}
+
+	hash := authenticodeDigests[info.DigestAlgorithm.Algorithm.String()]
+	algorithm, ok := rsaSignatureAlgorithms[hash]
+	if !ok || !info.DigestEncryptionAlgorithm.Algorithm.Equal(oidRSAEncryption) {
+		return time.Time{}, nil, nil, fmt.Errorf("unsupported countersignature algorithm %v", info.DigestEncryptionAlgorithm.Algorithm)
+	}
+	if err := countersigner.CheckSignature(algorithm, signed, info.EncryptedDigest); err != nil {
+		return time.Time{}, nil, nil, fmt.Errorf("could not verify countersignature: %v", err)
+	}
+
+	return signingTime, countersigner, certificates, nil
+}
+
+// checkDigest checks that a given digest is the digest of data.
+func checkDigest(algorithm pkix.AlgorithmIdentifier, digest, data []byte) error {
+	hash, ok := authenticodeDigests[algorithm.Algorithm.String()]
+	if !ok || !hash.Available() {
+		return fmt.Errorf("unsupported digest algorithm %v", algorithm.Algorithm)
+	}
+
+	h := hash.New()
+	h.Write(data)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return fmt.Errorf("timestamp is not issued for the signature")
+	}
+
+	return nil
+}
+
+// verifyCertificate verifies a certificate for a given usage at a given time and returns its
+// chain, from the certificate to the root.
+func verifyCertificate(cert *x509.Certificate, certificates []*x509.Certificate, roots *x509.CertPool, at time.Time, usage x509.ExtKeyUsage) ([]*x509.Certificate, error) {
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate for signer")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certificates {
+		intermediates.AddCert(c)
+	}
+
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chains[0], nil
+}
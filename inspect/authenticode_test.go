@@ -0,0 +1,90 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inspect
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticode(t *testing.T) {
+	roots := testRoots(t)
+	signingTime := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name            string
+		file            string
+		roots           *x509.CertPool
+		wantStatus      string
+		wantError       string
+		wantSigningTime bool
+	}{
+		{
+			name:            "RFC 3161 timestamp",
+			file:            "pe_signed.exe",
+			roots:           roots,
+			wantStatus:      SignatureValid,
+			wantSigningTime: true,
+		},
+		{
+			name:            "legacy countersignature",
+			file:            "pe_signed_countersignature.exe",
+			roots:           roots,
+			wantStatus:      SignatureValid,
+			wantSigningTime: true,
+		},
+		{
+			name:            "unknown root",
+			file:            "pe_signed.exe",
+			roots:           x509.NewCertPool(),
+			wantStatus:      SignatureUntrusted,
+			wantError:       "could not verify signer certificate",
+			wantSigningTime: true,
+		},
+		{
+			name:       "modified image",
+			file:       "pe_signed_tampered.exe",
+			roots:      roots,
+			wantStatus: SignatureInvalid,
+			wantError:  "does not match signed digest",
+		},
+		{
+			name:       "unsigned",
+			file:       "pe_unsigned.exe",
+			roots:      roots,
+			wantStatus: SignatureUnsigned,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := ExecutableMetadata(filepath.Join("testdata", tc.file), tc.roots)
+			if err != nil {
+				t.Fatalf("unexpected error while running ExecutableMetadata(%s): %v", tc.file, err)
+			}
+
+			if m.SignatureStatus != tc.wantStatus {
+				t.Errorf("ExecutableMetadata(%s) signature status = %q, want %q (error: %s)", tc.file, m.SignatureStatus, tc.wantStatus, m.SignatureError)
+			}
+			if !strings.Contains(m.SignatureError, tc.wantError) || (tc.wantError == "" && m.SignatureError != "") {
+				t.Errorf("ExecutableMetadata(%s) signature error = %q, want %q", tc.file, m.SignatureError, tc.wantError)
+			}
+			if got := m.SigningTime != nil && m.SigningTime.Equal(signingTime); got != tc.wantSigningTime {
+				t.Errorf("ExecutableMetadata(%s) signing time = %v, want set: %t", tc.file, m.SigningTime, tc.wantSigningTime)
+			}
+		})
+	}
+}
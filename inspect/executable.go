@@ -0,0 +1,344 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inspect
+
+import (
+	"bytes"
+	"crypto/x509"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/hashr/common"
+	"go.mozilla.org/pkcs7"
+)
+
+const (
+	// ntGNUBuildID is the type of the ELF note holding the GNU build ID.
+	ntGNUBuildID = 3
+	// Mach-O load commands that are not defined in debug/macho.
+	lcIDDylib = 0xd
+	lcUUID    = 0x1b
+	// winCertTypePKCSSignedData is the type of WIN_CERTIFICATE holding an Authenticode signature.
+	winCertTypePKCSSignedData = 0x0002
+	// maxPEDataSize limits the size of PE data (e.g. resources) read into memory, so malformed
+	// headers can't cause huge allocations.
+	maxPEDataSize = 16 << 20
+)
+
+// ExecutableMetadata extracts metadata of ELF, PE and Mach-O files. Nil is returned for other
+// files. Authenticode signatures of PE files are verified against given roots, system roots are
+// used if roots is nil.
+func ExecutableMetadata(path string, roots *x509.CertPool) (*common.ExecutableMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 8)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not read file header: %v", err)
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte(elf.ELFMAG)):
+		return elfMetadata(f)
+	case bytes.HasPrefix(header, []byte("MZ")):
+		return peMetadata(f, fi.Size(), roots)
+	case len(header) >= 4 && isMachO(binary.BigEndian.Uint32(header), binary.LittleEndian.Uint32(header)):
+		return machoMetadata(f)
+	case len(header) >= 8 && bytes.HasPrefix(header, []byte{0xca, 0xfe, 0xba, 0xbe}) && binary.BigEndian.Uint16(header[6:]) < 45:
+		return fatMachoMetadata(f)
+	}
+
+	return nil, nil
+}
+
+func elfMetadata(r io.ReaderAt) (*common.ExecutableMetadata, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse ELF file: %v", err)
+	}
+	defer f.Close()
+
+	m := &common.ExecutableMetadata{Format: "ELF", Architecture: elfMachine(f.Machine)}
+	m.BuildID = elfBuildID(f)
+
+	// Both return no values for statically linked files.
+	if sonames, err := f.DynString(elf.DT_SONAME); err == nil && len(sonames) > 0 {
+		m.Soname = sonames[0]
+	}
+	// Malformed dynamic sections are reported in the metadata, the rest of it is still recorded.
+	if m.ImportedLibraries, err = f.ImportedLibraries(); err != nil {
+		m.ParseError = fmt.Sprintf("could not read imported libraries: %v", err)
+	}
+
+	return m, nil
+}
+
+// elfBuildID returns hex encoded GNU build ID, notes are looked up in sections first, as section
+// headers might be stripped, program headers are used as a fallback.
+func elfBuildID(f *elf.File) string {
+	var notes []io.ReaderAt
+	for _, s := range f.Sections {
+		if s.Type == elf.SHT_NOTE {
+			notes = append(notes, s)
+		}
+	}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_NOTE {
+			notes = append(notes, p)
+		}
+	}
+
+	for _, note := range notes {
+		data, err := io.ReadAll(io.NewSectionReader(note, 0, 1<<20))
+		if err != nil {
+			continue
+		}
+		if id := parseBuildIDNote(data, f.ByteOrder); id != "" {
+			return id
+		}
+	}
+
+	return ""
+}
+
+func parseBuildIDNote(data []byte, order binary.ByteOrder) string {
+	// Sizes are read from the file, they are aligned in uint64 so that they can't wrap around.
+	align := func(n uint32) uint64 { return (uint64(n) + 3) &^ 3 }
+
+	for len(data) >= 12 {
+		nameSize, descSize, noteType := order.Uint32(data), order.Uint32(data[4:]), order.Uint32(data[8:])
+		data = data[12:]
+		size := uint64(len(data))
+		if uint64(nameSize) > size || uint64(descSize) > size || align(nameSize)+align(descSize) > size {
+			return ""
+		}
+
+		descStart := align(nameSize)
+		name := data[:nameSize]
+		desc := data[descStart : descStart+uint64(descSize)]
+		if noteType == ntGNUBuildID && string(name) == "GNU\x00" {
+			return hex.EncodeToString(desc)
+		}
+		data = data[descStart+align(descSize):]
+	}
+
+	return ""
+}
+
+func peMetadata(r io.ReaderAt, size int64, roots *x509.CertPool) (*common.ExecutableMetadata, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		// MS-DOS executables don't have a PE header.
+		return nil, nil
+	}
+	defer f.Close()
+
+	m := &common.ExecutableMetadata{Format: "PE", Architecture: peMachine(f.Machine)}
+
+	// Malformed imports and resources are reported in the metadata, the rest of it is still
+	// recorded.
+	var parseErrors []string
+
+	// ImportedLibraries is not implemented for PE files, DLL names are taken from the imported
+	// symbols, which are in the symbol:dll format.
+	symbols, err := f.ImportedSymbols()
+	if err != nil {
+		parseErrors = append(parseErrors, fmt.Sprintf("could not read imported symbols: %v", err))
+	}
+	seen := make(map[string]bool)
+	for _, symbol := range symbols {
+		i := strings.LastIndex(symbol, ":")
+		if i < 0 {
+			continue
+		}
+		dll := symbol[i+1:]
+		if !seen[strings.ToLower(dll)] {
+			seen[strings.ToLower(dll)] = true
+			m.ImportedLibraries = append(m.ImportedLibraries, dll)
+		}
+	}
+
+	strs, err := peVersionStrings(f)
+	if err != nil {
+		parseErrors = append(parseErrors, fmt.Sprintf("could not read version information: %v", err))
+	}
+	m.ParseError = strings.Join(parseErrors, "; ")
+	m.CompanyName = strs["CompanyName"]
+	m.ProductName = strs["ProductName"]
+	m.ProductVersion = strs["ProductVersion"]
+	m.FileVersion = strs["FileVersion"]
+	m.FileDescription = strs["FileDescription"]
+	m.OriginalFilename = strs["OriginalFilename"]
+
+	// Malformed signatures are reported in the metadata, as they don't prevent reading the rest.
+	signature, err := peSignature(f, r)
+	switch {
+	case err != nil:
+		m.SignatureStatus, m.SignatureError = SignatureInvalid, fmt.Sprintf("could not read signature: %v", err)
+	case signature == nil:
+		m.SignatureStatus = SignatureUnsigned
+	default:
+		if signer := signature.GetOnlySigner(); signer != nil {
+			m.Signer = signer.Subject.String()
+		}
+		verifyAuthenticode(m, f, r, size, signature, roots)
+	}
+
+	return m, nil
+}
+
+// peDataDirectory returns a given data directory entry of a PE file.
+func peDataDirectory(f *pe.File, index int) pe.DataDirectory {
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if oh.NumberOfRvaAndSizes > uint32(index) {
+			return oh.DataDirectory[index]
+		}
+	case *pe.OptionalHeader64:
+		if oh.NumberOfRvaAndSizes > uint32(index) {
+			return oh.DataDirectory[index]
+		}
+	}
+
+	return pe.DataDirectory{}
+}
+
+// peSignature returns PKCS #7 signed data of the Authenticode signature, nil is returned for files
+// that are not signed.
+func peSignature(f *pe.File, r io.ReaderAt) (*pkcs7.PKCS7, error) {
+	dir := peDataDirectory(f, pe.IMAGE_DIRECTORY_ENTRY_SECURITY)
+	if dir.VirtualAddress == 0 || dir.Size < 8 {
+		return nil, nil
+	}
+	if dir.Size > maxPEDataSize {
+		return nil, fmt.Errorf("certificate table size %d exceeds the limit", dir.Size)
+	}
+
+	// Unlike other data directories, the certificate table address is a file offset.
+	table := make([]byte, dir.Size)
+	if _, err := r.ReadAt(table, int64(dir.VirtualAddress)); err != nil {
+		return nil, fmt.Errorf("could not read certificate table: %v", err)
+	}
+
+	// The table holds a list of WIN_CERTIFICATE structures, each aligned to 8 bytes.
+	for len(table) >= 8 {
+		length := binary.LittleEndian.Uint32(table)
+		certType := binary.LittleEndian.Uint16(table[6:])
+		if length < 8 || uint64(length) > uint64(len(table)) {
+			return nil, fmt.Errorf("invalid certificate length %d", length)
+		}
+
+		if certType == winCertTypePKCSSignedData {
+			return pkcs7.Parse(table[8:length])
+		}
+
+		next := (uint64(length) + 7) &^ 7
+		if next >= uint64(len(table)) {
+			break
+		}
+		table = table[next:]
+	}
+
+	return nil, nil
+}
+
+func machoMetadata(r io.ReaderAt) (*common.ExecutableMetadata, error) {
+	f, err := macho.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse Mach-O file: %v", err)
+	}
+	defer f.Close()
+
+	return machoFileMetadata(f), nil
+}
+
+func fatMachoMetadata(r io.ReaderAt) (*common.ExecutableMetadata, error) {
+	f, err := macho.NewFatFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse Mach-O universal binary: %v", err)
+	}
+	defer f.Close()
+
+	// Metadata of the first architecture is used, as all the architectures are usually built from
+	// the same source.
+	var m *common.ExecutableMetadata
+	var archs []string
+	for _, arch := range f.Arches {
+		archs = append(archs, machoCPU(arch.Cpu))
+		if m == nil {
+			m = machoFileMetadata(arch.File)
+		}
+	}
+	if m == nil {
+		return nil, nil
+	}
+	m.Architecture = strings.Join(archs, ",")
+
+	return m, nil
+}
+
+func machoFileMetadata(f *macho.File) *common.ExecutableMetadata {
+	m := &common.ExecutableMetadata{Format: "Mach-O", Architecture: machoCPU(f.Cpu)}
+
+	for _, load := range f.Loads {
+		raw := load.Raw()
+		if len(raw) < 8 {
+			continue
+		}
+
+		switch f.ByteOrder.Uint32(raw) {
+		case lcUUID:
+			if len(raw) >= 24 {
+				u := raw[8:24]
+				m.BuildID = fmt.Sprintf("%x-%x-%x-%x-%x", u[:4], u[4:6], u[6:8], u[8:10], u[10:])
+			}
+		case lcIDDylib:
+			if len(raw) >= 24 {
+				if offset := f.ByteOrder.Uint32(raw[8:]); offset < uint32(len(raw)) {
+					name := raw[offset:]
+					if i := bytes.IndexByte(name, 0); i >= 0 {
+						name = name[:i]
+					}
+					m.Soname = string(name)
+				}
+			}
+		}
+	}
+
+	// Malformed load commands are reported in the metadata, the rest of it is still recorded.
+	var err error
+	if m.ImportedLibraries, err = f.ImportedLibraries(); err != nil {
+		m.ParseError = fmt.Sprintf("could not read imported libraries: %v", err)
+	}
+
+	return m
+}
@@ -0,0 +1,197 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inspect
+
+import (
+	"bytes"
+	"crypto/x509"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/hashr/common"
+)
+
+// testRoots returns the root certificate that issued certificates of signed test files.
+func testRoots(t *testing.T) *x509.CertPool {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "authenticode_root.pem"))
+	if err != nil {
+		t.Fatalf("could not read test root certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		t.Fatal("could not parse test root certificate")
+	}
+
+	return roots
+}
+
+func TestExecutableMetadata(t *testing.T) {
+	signingTime := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	pe := &common.ExecutableMetadata{
+		Format:            "PE",
+		Architecture:      "x86-64",
+		ImportedLibraries: []string{"KERNEL32.dll", "USER32.dll"},
+		CompanyName:       "HashR Authors",
+		ProductName:       "HashR",
+		ProductVersion:    "1.2",
+		FileVersion:       "1.2.3.4",
+		FileDescription:   "HashR test executable",
+		OriginalFilename:  "hashrtest.exe",
+		SignatureStatus:   SignatureUnsigned,
+	}
+	signedPE := *pe
+	signedPE.Signer = "CN=HashR Test Signer,O=HashR"
+	signedPE.SignatureStatus = SignatureValid
+	signedPE.SignerChain = []string{"CN=HashR Test Signer,O=HashR", "CN=HashR Test Root,O=HashR"}
+	signedPE.SigningTime = &signingTime
+
+	for _, tc := range []struct {
+		file string
+		want *common.ExecutableMetadata
+	}{
+		{
+			file: "elf_libhashr.so",
+			want: &common.ExecutableMetadata{Format: "ELF", Architecture: "x86-64", BuildID: "4f47148ea1e45370e7819a216dd3c730764c85c2", Soname: "libhashr.so.1"},
+		},
+		{
+			file: "elf_main",
+			want: &common.ExecutableMetadata{Format: "ELF", Architecture: "x86-64", BuildID: "a40e3265a1ad9aada10e4605c3d053ede3ad3a1a", ImportedLibraries: []string{"libhashr.so.1", "libm.so.6", "libc.so.6"}},
+		},
+		{
+			file: "elf_rel_arm",
+			want: &common.ExecutableMetadata{Format: "ELF", Architecture: "ARM"},
+		},
+		{
+			file: "pe_unsigned.exe",
+			want: pe,
+		},
+		{
+			file: "pe_signed.exe",
+			want: &signedPE,
+		},
+		{
+			file: "pe32_console_i386.exe",
+			want: &common.ExecutableMetadata{Format: "PE", Architecture: "Intel 80386", SignatureStatus: SignatureUnsigned},
+		},
+		{
+			file: "macho_libhashr.dylib",
+			want: &common.ExecutableMetadata{Format: "Mach-O", Architecture: "arm64", BuildID: "1f2e3d4c-5b6a-7988-97a6-b5c4d3e2f100", Soname: "@rpath/libhashr.1.dylib", ImportedLibraries: []string{"/usr/lib/libSystem.B.dylib"}},
+		},
+		{
+			file: "macho_universal",
+			want: &common.ExecutableMetadata{Format: "Mach-O", Architecture: "x86_64,arm64"},
+		},
+		{
+			file: "Hello.class",
+			want: nil,
+		},
+		{
+			file: "script.sh",
+			want: nil,
+		},
+		{
+			file: "empty",
+			want: nil,
+		},
+	} {
+		got, err := ExecutableMetadata(filepath.Join("testdata", tc.file), testRoots(t))
+		if err != nil {
+			t.Fatalf("unexpected error while running ExecutableMetadata(%s): %v", tc.file, err)
+		}
+
+		if diff := cmp.Diff(tc.want, got, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("ExecutableMetadata(%s) unexpected diff (-want/+got):\n%s", tc.file, diff)
+		}
+	}
+}
+
+func TestExecutableMetadataCorruptResources(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "pe_unsigned.exe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("could not parse PE file: %v", err)
+	}
+	rsrc := f.Section(".rsrc")
+	if rsrc == nil {
+		t.Fatal("PE file has no .rsrc section")
+	}
+	// Number of named and ID entries of the root resource directory, which doesn't fit the section.
+	binary.LittleEndian.PutUint16(data[rsrc.Offset+12:], 0xffff)
+	binary.LittleEndian.PutUint16(data[rsrc.Offset+14:], 0xffff)
+
+	path := filepath.Join(t.TempDir(), "corrupt.exe")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ExecutableMetadata(path, testRoots(t))
+	if err != nil {
+		t.Fatalf("unexpected error while running ExecutableMetadata(): %v", err)
+	}
+
+	// Version information can't be read, the rest of the metadata is still recorded.
+	want := &common.ExecutableMetadata{
+		Format:            "PE",
+		Architecture:      "x86-64",
+		ImportedLibraries: []string{"KERNEL32.dll", "USER32.dll"},
+		SignatureStatus:   SignatureUnsigned,
+		ParseError:        "could not read version information: resource directory at 0x0 is truncated",
+	}
+	if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("ExecutableMetadata() unexpected diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestParseBuildIDNote(t *testing.T) {
+	note := func(nameSize, descSize, noteType uint32, payload []byte) []byte {
+		data := make([]byte, 12, 12+len(payload))
+		binary.LittleEndian.PutUint32(data, nameSize)
+		binary.LittleEndian.PutUint32(data[4:], descSize)
+		binary.LittleEndian.PutUint32(data[8:], noteType)
+		return append(data, payload...)
+	}
+	payload := append([]byte("GNU\x00"), 0xde, 0xad, 0xbe, 0xef)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "build ID", data: note(4, 4, ntGNUBuildID, payload), want: "deadbeef"},
+		{name: "build ID after other note", data: append(note(4, 4, 1, payload), note(4, 4, ntGNUBuildID, payload)...), want: "deadbeef"},
+		{name: "truncated", data: note(4, 8, ntGNUBuildID, payload)},
+		{name: "oversized name", data: note(0xfffffffe, 4, ntGNUBuildID, payload)},
+		{name: "oversized description", data: note(4, 0xfffffffe, ntGNUBuildID, payload)},
+		{name: "oversized sizes", data: note(0xffffffff, 0xffffffff, ntGNUBuildID, payload)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseBuildIDNote(tc.data, binary.LittleEndian); got != tc.want {
+				t.Errorf("parseBuildIDNote() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,609 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package inspect provides functions to inspect extracted samples in-process, without relying on
+// external tools.
+package inspect
+
+import (
+	"archive/zip"
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// headerSize is the number of bytes at the beginning of a file used for identification.
+const headerSize = 8192
+
+// FileType describes type of a file. Descriptions are modeled after file(1) output, but don't
+// depend on the version of libmagic, so the same file always gets the same description.
+type FileType struct {
+	// Description is a human readable type, e.g. "ELF 64-bit LSB executable, x86-64".
+	Description string
+	// MIMEType is the media type of the file, e.g. "application/x-executable".
+	MIMEType string
+}
+
+// IdentifyFile identifies type of a file at a given path.
+func IdentifyFile(path string) (*FileType, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return Identify(f, fi.Size())
+}
+
+// Identify identifies type of the content of a given reader of a given size.
+func Identify(r io.ReaderAt, size int64) (*FileType, error) {
+	header := make([]byte, headerSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not read file header: %v", err)
+	}
+	header = header[:n]
+
+	if len(header) == 0 {
+		return &FileType{Description: "empty", MIMEType: "inode/x-empty"}, nil
+	}
+
+	for _, identify := range []func(io.ReaderAt, int64, []byte) *FileType{
+		identifyExecutable,
+		identifyArchive,
+		identifyImage,
+		identifyDocument,
+		identifyOther,
+		identifyText,
+	} {
+		if t := identify(r, size, header); t != nil {
+			return t, nil
+		}
+	}
+
+	return &FileType{Description: "data", MIMEType: "application/octet-stream"}, nil
+}
+
+// identifyExecutable identifies ELF, PE, Mach-O and Java class files.
+func identifyExecutable(r io.ReaderAt, size int64, header []byte) *FileType {
+	switch {
+	case bytes.HasPrefix(header, []byte(elf.ELFMAG)):
+		return identifyELF(r)
+	case bytes.HasPrefix(header, []byte("MZ")):
+		return identifyPE(r)
+	case len(header) >= 4 && isMachO(binary.BigEndian.Uint32(header), binary.LittleEndian.Uint32(header)):
+		return identifyMachO(r)
+	case bytes.HasPrefix(header, []byte{0xca, 0xfe, 0xba, 0xbe}) && len(header) >= 8:
+		// Fat Mach-O files and Java class files share the magic, Java major versions start at 45,
+		// while fat files hold only a handful of architectures.
+		if major := binary.BigEndian.Uint16(header[6:]); major >= 45 {
+			return &FileType{Description: fmt.Sprintf("compiled Java class data, version %d.%d", major, binary.BigEndian.Uint16(header[4:])), MIMEType: "application/x-java-applet"}
+		}
+		return identifyFatMachO(r)
+	}
+
+	return nil
+}
+
+func identifyELF(r io.ReaderAt) *FileType {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return &FileType{Description: "ELF, invalid header", MIMEType: "application/octet-stream"}
+	}
+	defer f.Close()
+
+	bits := "32-bit"
+	if f.Class == elf.ELFCLASS64 {
+		bits = "64-bit"
+	}
+	order := "LSB"
+	if f.Data == elf.ELFDATA2MSB {
+		order = "MSB"
+	}
+
+	kind, mimeType := "unknown type", "application/octet-stream"
+	switch f.Type {
+	case elf.ET_EXEC:
+		kind, mimeType = "executable", "application/x-executable"
+	case elf.ET_DYN:
+		kind, mimeType = "shared object", "application/x-sharedlib"
+		for _, prog := range f.Progs {
+			if prog.Type == elf.PT_INTERP {
+				kind, mimeType = "pie executable", "application/x-pie-executable"
+				break
+			}
+		}
+	case elf.ET_REL:
+		kind, mimeType = "relocatable", "application/x-object"
+	case elf.ET_CORE:
+		kind, mimeType = "core file", "application/x-coredump"
+	}
+
+	return &FileType{Description: fmt.Sprintf("ELF %s %s %s, %s", bits, order, kind, elfMachine(f.Machine)), MIMEType: mimeType}
+}
+
+func elfMachine(m elf.Machine) string {
+	switch m {
+	case elf.EM_386:
+		return "Intel 80386"
+	case elf.EM_X86_64:
+		return "x86-64"
+	case elf.EM_ARM:
+		return "ARM"
+	case elf.EM_AARCH64:
+		return "ARM aarch64"
+	case elf.EM_MIPS:
+		return "MIPS"
+	case elf.EM_PPC:
+		return "PowerPC"
+	case elf.EM_PPC64:
+		return "PowerPC64"
+	case elf.EM_RISCV:
+		return "RISC-V"
+	case elf.EM_S390:
+		return "IBM S/390"
+	}
+
+	return strings.TrimPrefix(m.String(), "EM_")
+}
+
+func identifyPE(r io.ReaderAt) *FileType {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return &FileType{Description: "MS-DOS executable", MIMEType: "application/x-dosexec"}
+	}
+	defer f.Close()
+
+	format, subsystem, isDotNet := "PE32", uint16(0), false
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		subsystem = oh.Subsystem
+		isDotNet = oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_COM_DESCRIPTOR && oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_COM_DESCRIPTOR].Size > 0
+	case *pe.OptionalHeader64:
+		format = "PE32+"
+		subsystem = oh.Subsystem
+		isDotNet = oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_COM_DESCRIPTOR && oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_COM_DESCRIPTOR].Size > 0
+	}
+
+	kind := "executable"
+	if f.Characteristics&pe.IMAGE_FILE_DLL != 0 {
+		kind = "executable (DLL)"
+	}
+
+	description := fmt.Sprintf("%s %s (%s), %s", format, kind, peSubsystem(subsystem), peMachine(f.Machine))
+	if isDotNet {
+		description += ", Mono/.Net assembly"
+	}
+
+	return &FileType{Description: description, MIMEType: "application/vnd.microsoft.portable-executable"}
+}
+
+func peSubsystem(s uint16) string {
+	switch s {
+	case pe.IMAGE_SUBSYSTEM_NATIVE:
+		return "native"
+	case pe.IMAGE_SUBSYSTEM_WINDOWS_GUI:
+		return "GUI"
+	case pe.IMAGE_SUBSYSTEM_WINDOWS_CUI:
+		return "console"
+	case pe.IMAGE_SUBSYSTEM_EFI_APPLICATION:
+		return "EFI application"
+	case pe.IMAGE_SUBSYSTEM_EFI_BOOT_SERVICE_DRIVER:
+		return "EFI boot service driver"
+	case pe.IMAGE_SUBSYSTEM_EFI_RUNTIME_DRIVER:
+		return "EFI runtime driver"
+	}
+
+	return fmt.Sprintf("subsystem %d", s)
+}
+
+func peMachine(m uint16) string {
+	switch m {
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return "Intel 80386"
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return "x86-64"
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return "Aarch64"
+	case pe.IMAGE_FILE_MACHINE_ARMNT:
+		return "ARMv7 Thumb"
+	case pe.IMAGE_FILE_MACHINE_IA64:
+		return "Intel Itanium"
+	}
+
+	return fmt.Sprintf("machine 0x%x", m)
+}
+
+func isMachO(be, le uint32) bool {
+	for _, magic := range []uint32{macho.Magic32, macho.Magic64} {
+		if be == magic || le == magic {
+			return true
+		}
+	}
+
+	return false
+}
+
+func identifyMachO(r io.ReaderAt) *FileType {
+	f, err := macho.NewFile(r)
+	if err != nil {
+		return &FileType{Description: "Mach-O, invalid header", MIMEType: "application/octet-stream"}
+	}
+	defer f.Close()
+
+	bits := "32-bit"
+	if f.Magic == macho.Magic64 {
+		bits = "64-bit"
+	}
+
+	return &FileType{Description: fmt.Sprintf("Mach-O %s %s, %s", bits, machoType(f.Type), machoCPU(f.Cpu)), MIMEType: "application/x-mach-binary"}
+}
+
+func identifyFatMachO(r io.ReaderAt) *FileType {
+	f, err := macho.NewFatFile(r)
+	if err != nil {
+		return &FileType{Description: "Mach-O universal binary, invalid header", MIMEType: "application/octet-stream"}
+	}
+	defer f.Close()
+
+	var archs []string
+	for _, arch := range f.Arches {
+		archs = append(archs, machoCPU(arch.Cpu))
+	}
+
+	return &FileType{Description: fmt.Sprintf("Mach-O universal binary with %d architectures: [%s]", len(archs), strings.Join(archs, ", ")), MIMEType: "application/x-mach-binary"}
+}
+
+func machoType(t macho.Type) string {
+	switch t {
+	case macho.TypeObj:
+		return "object"
+	case macho.TypeExec:
+		return "executable"
+	case macho.TypeDylib:
+		return "dynamically linked shared library"
+	case macho.TypeBundle:
+		return "bundle"
+	}
+
+	return fmt.Sprintf("filetype %d", t)
+}
+
+func machoCPU(c macho.Cpu) string {
+	switch c {
+	case macho.Cpu386:
+		return "i386"
+	case macho.CpuAmd64:
+		return "x86_64"
+	case macho.CpuArm:
+		return "arm"
+	case macho.CpuArm64:
+		return "arm64"
+	case macho.CpuPpc:
+		return "ppc"
+	case macho.CpuPpc64:
+		return "ppc64"
+	}
+
+	return fmt.Sprintf("cpu %d", c)
+}
+
+// magic is a file signature at a given offset.
+type magic struct {
+	offset      int
+	signature   []byte
+	description string
+	mimeType    string
+}
+
+var archiveMagics = []magic{
+	{0, []byte{0x1f, 0x8b}, "gzip compressed data", "application/gzip"},
+	{0, []byte("BZh"), "bzip2 compressed data", "application/x-bzip2"},
+	{0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, "XZ compressed data", "application/x-xz"},
+	{0, []byte{0x28, 0xb5, 0x2f, 0xfd}, "Zstandard compressed data", "application/zstd"},
+	{0, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, "7-zip archive data", "application/x-7z-compressed"},
+	{0, []byte("Rar!\x1a\x07"), "RAR archive data", "application/vnd.rar"},
+	{0, []byte("MSCF\x00\x00\x00\x00"), "Microsoft Cabinet archive data", "application/vnd.ms-cab-compressed"},
+	{0, []byte{0xed, 0xab, 0xee, 0xdb}, "RPM package", "application/x-rpm"},
+	{0, []byte("070701"), "ASCII cpio archive (SVR4 with no CRC)", "application/x-cpio"},
+	{0, []byte("070702"), "ASCII cpio archive (SVR4 with CRC)", "application/x-cpio"},
+	{0, []byte("070707"), "ASCII cpio archive (pre-SVR4 or odc)", "application/x-cpio"},
+	{0, []byte("hsqs"), "Squashfs filesystem, little endian", "application/octet-stream"},
+	{257, []byte("ustar"), "POSIX tar archive", "application/x-tar"},
+}
+
+// identifyArchive identifies compressed files, archives and packages.
+func identifyArchive(r io.ReaderAt, size int64, header []byte) *FileType {
+	if bytes.HasPrefix(header, []byte("PK\x03\x04")) {
+		return identifyZip(r, size)
+	}
+
+	if bytes.HasPrefix(header, []byte("!<arch>\n")) {
+		// Debian packages are ar archives starting with the debian-binary member.
+		if bytes.HasPrefix(header[8:], []byte("debian-binary")) {
+			return &FileType{Description: "Debian binary package", MIMEType: "application/vnd.debian.binary-package"}
+		}
+		return &FileType{Description: "current ar archive", MIMEType: "application/x-archive"}
+	}
+
+	if t := matchMagic(archiveMagics, header); t != nil {
+		return t
+	}
+
+	// ISO 9660 volume descriptors start at sector 16.
+	iso := make([]byte, 5)
+	if _, err := r.ReadAt(iso, 0x8001); err == nil && string(iso) == "CD001" {
+		return &FileType{Description: "ISO 9660 CD-ROM filesystem data", MIMEType: "application/x-iso9660-image"}
+	}
+
+	return nil
+}
+
+// identifyZip tells apart plain ZIP archives from formats built on top of ZIP.
+func identifyZip(r io.ReaderAt, size int64) *FileType {
+	zipArchive := &FileType{Description: "Zip archive data", MIMEType: "application/zip"}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil || len(zr.File) == 0 {
+		return zipArchive
+	}
+
+	// OpenDocument files start with an uncompressed mimetype member.
+	if first := zr.File[0]; first.Name == "mimetype" && first.Method == zip.Store && first.UncompressedSize64 < 128 {
+		if rc, err := first.Open(); err == nil {
+			mimeType, err := io.ReadAll(rc)
+			rc.Close()
+			if err == nil && utf8.Valid(mimeType) {
+				return &FileType{Description: "OpenDocument", MIMEType: string(mimeType)}
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, f := range zr.File {
+		names[strings.SplitN(f.Name, "/", 2)[0]] = true
+		if f.Name == "AndroidManifest.xml" {
+			return &FileType{Description: "Android package (APK)", MIMEType: "application/vnd.android.package-archive"}
+		}
+	}
+
+	switch {
+	case names["[Content_Types].xml"] && names["word"]:
+		return &FileType{Description: "Microsoft Word 2007+", MIMEType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"}
+	case names["[Content_Types].xml"] && names["xl"]:
+		return &FileType{Description: "Microsoft Excel 2007+", MIMEType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"}
+	case names["[Content_Types].xml"] && names["ppt"]:
+		return &FileType{Description: "Microsoft PowerPoint 2007+", MIMEType: "application/vnd.openxmlformats-officedocument.presentationml.presentation"}
+	case names["[Content_Types].xml"]:
+		return &FileType{Description: "Microsoft OOXML", MIMEType: "application/octet-stream"}
+	case names["META-INF"] && hasFile(zr, "META-INF/MANIFEST.MF"):
+		return &FileType{Description: "Java archive data (JAR)", MIMEType: "application/java-archive"}
+	}
+
+	return zipArchive
+}
+
+func hasFile(zr *zip.Reader, name string) bool {
+	for _, f := range zr.File {
+		if path.Clean(f.Name) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+var imageMagics = []magic{
+	{0, []byte("\x89PNG\r\n\x1a\n"), "PNG image data", "image/png"},
+	{0, []byte{0xff, 0xd8, 0xff}, "JPEG image data", "image/jpeg"},
+	{0, []byte("GIF87a"), "GIF image data, version 87a", "image/gif"},
+	{0, []byte("GIF89a"), "GIF image data, version 89a", "image/gif"},
+	{0, []byte("BM"), "PC bitmap", "image/bmp"},
+	{0, []byte("II*\x00"), "TIFF image data, little-endian", "image/tiff"},
+	{0, []byte("MM\x00*"), "TIFF image data, big-endian", "image/tiff"},
+	{0, []byte{0x00, 0x00, 0x01, 0x00}, "MS Windows icon resource", "image/vnd.microsoft.icon"},
+}
+
+// identifyImage identifies common image formats.
+func identifyImage(r io.ReaderAt, size int64, header []byte) *FileType {
+	if len(header) >= 12 && bytes.HasPrefix(header, []byte("RIFF")) && string(header[8:12]) == "WEBP" {
+		return &FileType{Description: "RIFF (little-endian) data, Web/P image", MIMEType: "image/webp"}
+	}
+
+	if t := matchMagic(imageMagics, header); t != nil {
+		// BMP and ICO signatures are short, check the rest of their headers to avoid false positives.
+		switch t.MIMEType {
+		case "image/bmp":
+			if len(header) < 18 || binary.LittleEndian.Uint32(header[14:]) == 0 || binary.LittleEndian.Uint32(header[14:]) > 124 {
+				return nil
+			}
+		case "image/vnd.microsoft.icon":
+			if len(header) < 6 || binary.LittleEndian.Uint16(header[4:]) == 0 {
+				return nil
+			}
+		}
+		return t
+	}
+
+	if isText(header) && bytes.Contains(header, []byte("<svg")) {
+		return &FileType{Description: "SVG Scalable Vector Graphics image", MIMEType: "image/svg+xml"}
+	}
+
+	return nil
+}
+
+// identifyDocument identifies documents.
+func identifyDocument(r io.ReaderAt, size int64, header []byte) *FileType {
+	switch {
+	case bytes.HasPrefix(header, []byte("%PDF-")):
+		version := header[5:]
+		if i := bytes.IndexAny(version, "\r\n \t%"); i >= 0 {
+			version = version[:i]
+		}
+		return &FileType{Description: fmt.Sprintf("PDF document, version %s", version), MIMEType: "application/pdf"}
+	case bytes.HasPrefix(header, []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}):
+		return &FileType{Description: "Composite Document File V2 Document", MIMEType: "application/x-ole-storage"}
+	case bytes.HasPrefix(header, []byte(`{\rtf`)):
+		return &FileType{Description: "Rich Text Format data", MIMEType: "text/rtf"}
+	case bytes.HasPrefix(header, []byte("%!PS")):
+		return &FileType{Description: "PostScript document text", MIMEType: "application/postscript"}
+	}
+
+	return nil
+}
+
+var otherMagics = []magic{
+	{0, []byte("SQLite format 3\x00"), "SQLite 3.x database", "application/vnd.sqlite3"},
+	{0, []byte("\x00asm"), "WebAssembly (wasm) binary module", "application/wasm"},
+}
+
+// identifyOther identifies other binary formats commonly found in the sources.
+func identifyOther(r io.ReaderAt, size int64, header []byte) *FileType {
+	return matchMagic(otherMagics, header)
+}
+
+// identifyText identifies scripts, markup and plain text.
+func identifyText(r io.ReaderAt, size int64, header []byte) *FileType {
+	if !isText(header) {
+		return nil
+	}
+
+	if bytes.HasPrefix(header, []byte("#!")) {
+		return identifyScript(header)
+	}
+
+	trimmed := bytes.TrimLeft(header, " \t\r\n\ufeff")
+	lower := bytes.ToLower(trimmed[:min(len(trimmed), 64)])
+	switch {
+	case bytes.HasPrefix(lower, []byte("<!doctype html")) || bytes.HasPrefix(lower, []byte("<html")):
+		return &FileType{Description: "HTML document text", MIMEType: "text/html"}
+	case bytes.HasPrefix(lower, []byte("<?xml")):
+		return &FileType{Description: "XML document text", MIMEType: "text/xml"}
+	}
+
+	for _, c := range header {
+		if c >= 0x80 {
+			return &FileType{Description: "UTF-8 Unicode text", MIMEType: "text/plain; charset=utf-8"}
+		}
+	}
+
+	return &FileType{Description: "ASCII text", MIMEType: "text/plain; charset=us-ascii"}
+}
+
+// identifyScript identifies script type based on the interpreter given in the shebang line.
+func identifyScript(header []byte) *FileType {
+	line := string(header[2:])
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return &FileType{Description: "script text executable", MIMEType: "text/x-script"}
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" {
+		interpreter = ""
+		// Skip env options, e.g. #!/usr/bin/env -S python3 -u.
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") && !strings.Contains(f, "=") {
+				interpreter = path.Base(f)
+				break
+			}
+		}
+	}
+
+	name := strings.TrimRight(interpreter, "0123456789.")
+	switch name {
+	case "sh", "dash", "ash":
+		return &FileType{Description: "POSIX shell script text executable", MIMEType: "text/x-shellscript"}
+	case "bash":
+		return &FileType{Description: "Bourne-Again shell script text executable", MIMEType: "text/x-shellscript"}
+	case "zsh", "ksh", "csh", "tcsh", "fish":
+		return &FileType{Description: fmt.Sprintf("%s script text executable", name), MIMEType: "text/x-shellscript"}
+	case "python":
+		return &FileType{Description: "Python script text executable", MIMEType: "text/x-script.python"}
+	case "perl":
+		return &FileType{Description: "Perl script text executable", MIMEType: "text/x-perl"}
+	case "ruby":
+		return &FileType{Description: "Ruby script text executable", MIMEType: "text/x-ruby"}
+	case "node", "nodejs":
+		return &FileType{Description: "Node.js script text executable", MIMEType: "application/javascript"}
+	case "php":
+		return &FileType{Description: "PHP script text executable", MIMEType: "text/x-php"}
+	case "awk", "gawk", "mawk", "nawk":
+		return &FileType{Description: "awk script text executable", MIMEType: "text/x-awk"}
+	case "tclsh", "wish":
+		return &FileType{Description: "Tcl script text executable", MIMEType: "text/x-tcl"}
+	case "lua":
+		return &FileType{Description: "Lua script text executable", MIMEType: "text/x-lua"}
+	}
+
+	if interpreter == "" {
+		return &FileType{Description: "script text executable", MIMEType: "text/x-script"}
+	}
+
+	return &FileType{Description: fmt.Sprintf("%s script text executable", interpreter), MIMEType: "text/x-script"}
+}
+
+// isText reports whether a given header looks like UTF-8 text. The header might end in the middle
+// of a multi-byte character, so up to 3 trailing bytes are not validated.
+func isText(header []byte) bool {
+	valid := header
+	for i := 0; i < 3 && len(valid) > 0 && !utf8.Valid(valid); i++ {
+		valid = valid[:len(valid)-1]
+	}
+	if !utf8.Valid(valid) {
+		return false
+	}
+
+	for _, c := range header {
+		if c < 0x20 && c != '\n' && c != '\r' && c != '\t' && c != '\f' && c != '\b' && c != 0x1b {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchMagic(magics []magic, header []byte) *FileType {
+	for _, m := range magics {
+		if len(header) >= m.offset+len(m.signature) && bytes.Equal(header[m.offset:m.offset+len(m.signature)], m.signature) {
+			return &FileType{Description: m.description, MIMEType: m.mimeType}
+		}
+	}
+
+	return nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inspect
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIdentifyFile(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		want *FileType
+	}{
+		{file: "Hello.class", want: &FileType{Description: "compiled Java class data, version 52.0", MIMEType: "application/x-java-applet"}},
+		{file: "archive.jar", want: &FileType{Description: "Java archive data (JAR)", MIMEType: "application/java-archive"}},
+		{file: "archive.tar", want: &FileType{Description: "POSIX tar archive", MIMEType: "application/x-tar"}},
+		{file: "archive.tar.gz", want: &FileType{Description: "gzip compressed data", MIMEType: "application/gzip"}},
+		{file: "archive.xz", want: &FileType{Description: "XZ compressed data", MIMEType: "application/x-xz"}},
+		{file: "archive.zip", want: &FileType{Description: "Zip archive data", MIMEType: "application/zip"}},
+		{file: "archive.zst", want: &FileType{Description: "Zstandard compressed data", MIMEType: "application/zstd"}},
+		{file: "data.bin", want: &FileType{Description: "data", MIMEType: "application/octet-stream"}},
+		{file: "document.docx", want: &FileType{Description: "Microsoft Word 2007+", MIMEType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"}},
+		{file: "document.pdf", want: &FileType{Description: "PDF document, version 1.7", MIMEType: "application/pdf"}},
+		{file: "elf_exec_x86_64", want: &FileType{Description: "ELF 64-bit LSB executable, x86-64", MIMEType: "application/x-executable"}},
+		{file: "elf_pie_x86_64", want: &FileType{Description: "ELF 64-bit LSB pie executable, x86-64", MIMEType: "application/x-pie-executable"}},
+		{file: "elf_rel_arm", want: &FileType{Description: "ELF 32-bit LSB relocatable, ARM", MIMEType: "application/x-object"}},
+		{file: "elf_so_aarch64", want: &FileType{Description: "ELF 64-bit LSB shared object, ARM aarch64", MIMEType: "application/x-sharedlib"}},
+		{file: "empty", want: &FileType{Description: "empty", MIMEType: "inode/x-empty"}},
+		{file: "image.gif", want: &FileType{Description: "GIF image data, version 89a", MIMEType: "image/gif"}},
+		{file: "image.jpg", want: &FileType{Description: "JPEG image data", MIMEType: "image/jpeg"}},
+		{file: "image.png", want: &FileType{Description: "PNG image data", MIMEType: "image/png"}},
+		{file: "index.html", want: &FileType{Description: "HTML document text", MIMEType: "text/html"}},
+		{file: "macho_dylib_x86_64", want: &FileType{Description: "Mach-O 64-bit dynamically linked shared library, x86_64", MIMEType: "application/x-mach-binary"}},
+		{file: "macho_exec_arm64", want: &FileType{Description: "Mach-O 64-bit executable, arm64", MIMEType: "application/x-mach-binary"}},
+		{file: "macho_universal", want: &FileType{Description: "Mach-O universal binary with 2 architectures: [x86_64, arm64]", MIMEType: "application/x-mach-binary"}},
+		{file: "package.deb", want: &FileType{Description: "Debian binary package", MIMEType: "application/vnd.debian.binary-package"}},
+		{file: "pe32_console_i386.exe", want: &FileType{Description: "PE32 executable (console), Intel 80386", MIMEType: "application/vnd.microsoft.portable-executable"}},
+		{file: "pe32_dotnet.exe", want: &FileType{Description: "PE32 executable (console), Intel 80386, Mono/.Net assembly", MIMEType: "application/vnd.microsoft.portable-executable"}},
+		{file: "pe32plus_gui_amd64.dll", want: &FileType{Description: "PE32+ executable (DLL) (GUI), x86-64", MIMEType: "application/vnd.microsoft.portable-executable"}},
+		{file: "script.pl", want: &FileType{Description: "Perl script text executable", MIMEType: "text/x-perl"}},
+		{file: "script.py", want: &FileType{Description: "Python script text executable", MIMEType: "text/x-script.python"}},
+		{file: "script.sh", want: &FileType{Description: "POSIX shell script text executable", MIMEType: "text/x-shellscript"}},
+		{file: "script_bash", want: &FileType{Description: "Bourne-Again shell script text executable", MIMEType: "text/x-shellscript"}},
+		{file: "text.txt", want: &FileType{Description: "ASCII text", MIMEType: "text/plain; charset=us-ascii"}},
+		{file: "utf8.txt", want: &FileType{Description: "UTF-8 Unicode text", MIMEType: "text/plain; charset=utf-8"}},
+	} {
+		got, err := IdentifyFile(filepath.Join("testdata", tc.file))
+		if err != nil {
+			t.Fatalf("unexpected error while running IdentifyFile(%s): %v", tc.file, err)
+		}
+
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("IdentifyFile(%s) unexpected diff (-want/+got):\n%s", tc.file, diff)
+		}
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	iso := make([]byte, 0x8800)
+	copy(iso[0x8001:], "CD001")
+
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		want    *FileType
+	}{
+		{
+			name:    "ISO 9660 image",
+			content: iso,
+			want:    &FileType{Description: "ISO 9660 CD-ROM filesystem data", MIMEType: "application/x-iso9660-image"},
+		},
+		{
+			name:    "env with options",
+			content: []byte("#!/usr/bin/env -S node --no-warnings\nconsole.log('hashr')\n"),
+			want:    &FileType{Description: "Node.js script text executable", MIMEType: "application/javascript"},
+		},
+		{
+			name:    "unknown interpreter",
+			content: []byte("#!/opt/hashr/bin/hashrsh\nexit\n"),
+			want:    &FileType{Description: "hashrsh script text executable", MIMEType: "text/x-script"},
+		},
+		{
+			name:    "truncated ELF",
+			content: []byte("\x7fELF\x02\x01\x01"),
+			want:    &FileType{Description: "ELF, invalid header", MIMEType: "application/octet-stream"},
+		},
+		{
+			name:    "MS-DOS executable",
+			content: append([]byte("MZ"), make([]byte, 126)...),
+			want:    &FileType{Description: "MS-DOS executable", MIMEType: "application/x-dosexec"},
+		},
+		{
+			name:    "binary data with text prefix",
+			content: []byte("hashr\x00\x01\x02"),
+			want:    &FileType{Description: "data", MIMEType: "application/octet-stream"},
+		},
+	} {
+		got, err := Identify(bytes.NewReader(tc.content), int64(len(tc.content)))
+		if err != nil {
+			t.Fatalf("unexpected error while running Identify() on %s: %v", tc.name, err)
+		}
+
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Identify() on %s unexpected diff (-want/+got):\n%s", tc.name, diff)
+		}
+	}
+}
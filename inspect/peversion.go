@@ -0,0 +1,229 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inspect
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+const (
+	// rtVersion is the resource type of version information.
+	rtVersion = 16
+	// maxResourceDepth limits nesting of resource directories, the standard layout uses 3 levels:
+	// type, name and language.
+	maxResourceDepth = 3
+	// maxVersionBlockDepth limits nesting of version information blocks.
+	maxVersionBlockDepth = 4
+)
+
+// peVersionStrings returns strings of the first string table in the version information resource
+// (VS_VERSIONINFO) of a PE file, e.g. CompanyName or OriginalFilename. Nil is returned if the file
+// has no version information.
+func peVersionStrings(f *pe.File) (map[string]string, error) {
+	dir := peDataDirectory(f, pe.IMAGE_DIRECTORY_ENTRY_RESOURCE)
+	if dir.VirtualAddress == 0 || dir.Size == 0 {
+		return nil, nil
+	}
+
+	rsrc, err := peReadRVA(f, dir.VirtualAddress, dir.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := findVersionResource(f, rsrc, 0, 0)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	root, _, err := parseVersionBlock(data, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version information: %v", err)
+	}
+
+	for _, child := range root.children {
+		if child.key != "StringFileInfo" {
+			continue
+		}
+		for _, table := range child.children {
+			strs := make(map[string]string)
+			for _, s := range table.children {
+				strs[s.key] = decodeUTF16(s.value)
+			}
+			return strs, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// findVersionResource walks the resource directory tree and returns data of the first version
+// information resource.
+func findVersionResource(f *pe.File, rsrc []byte, offset uint32, depth int) ([]byte, error) {
+	if depth >= maxResourceDepth {
+		return nil, nil
+	}
+	if uint64(offset)+16 > uint64(len(rsrc)) {
+		return nil, fmt.Errorf("resource directory at 0x%x is out of bounds", offset)
+	}
+
+	named := binary.LittleEndian.Uint16(rsrc[offset+12:])
+	ids := binary.LittleEndian.Uint16(rsrc[offset+14:])
+	entries := rsrc[offset+16:]
+	if len(entries) < 8*(int(named)+int(ids)) {
+		return nil, fmt.Errorf("resource directory at 0x%x is truncated", offset)
+	}
+
+	for i := 0; i < int(named)+int(ids); i++ {
+		id := binary.LittleEndian.Uint32(entries[8*i:])
+		target := binary.LittleEndian.Uint32(entries[8*i+4:])
+
+		// Only the first level is filtered, names and languages of version resources don't matter.
+		if depth == 0 && (i < int(named) || id != rtVersion) {
+			continue
+		}
+
+		// The high bit marks subdirectories, other entries point to IMAGE_RESOURCE_DATA_ENTRY.
+		if target&0x80000000 != 0 {
+			data, err := findVersionResource(f, rsrc, target&0x7fffffff, depth+1)
+			if err != nil || data != nil {
+				return data, err
+			}
+			continue
+		}
+
+		if uint64(target)+8 > uint64(len(rsrc)) {
+			return nil, fmt.Errorf("resource data entry at 0x%x is out of bounds", target)
+		}
+
+		return peReadRVA(f, binary.LittleEndian.Uint32(rsrc[target:]), binary.LittleEndian.Uint32(rsrc[target+4:]))
+	}
+
+	return nil, nil
+}
+
+// peReadRVA reads data at a given relative virtual address.
+func peReadRVA(f *pe.File, rva, size uint32) ([]byte, error) {
+	for _, s := range f.Sections {
+		if rva < s.VirtualAddress || rva >= s.VirtualAddress+s.Size {
+			continue
+		}
+
+		offset := rva - s.VirtualAddress
+		if size > maxPEDataSize {
+			return nil, fmt.Errorf("data at RVA 0x%x with size %d exceeds the limit", rva, size)
+		}
+		if uint64(offset)+uint64(size) > uint64(s.Size) {
+			return nil, fmt.Errorf("data at RVA 0x%x with size %d exceeds section %s", rva, size, s.Name)
+		}
+
+		data := make([]byte, size)
+		if _, err := s.ReadAt(data, int64(offset)); err != nil {
+			return nil, fmt.Errorf("could not read data at RVA 0x%x: %v", rva, err)
+		}
+
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("RVA 0x%x is not in any section", rva)
+}
+
+// versionBlock is a generic block of version information: VS_VERSIONINFO, StringFileInfo,
+// StringTable or String.
+type versionBlock struct {
+	key      string
+	value    []byte
+	children []*versionBlock
+}
+
+// parseVersionBlock parses a block starting at a given offset and returns it together with its
+// length. Blocks and their members are aligned to 4 bytes from the start of the resource data.
+func parseVersionBlock(data []byte, offset, depth int) (*versionBlock, int, error) {
+	if depth > maxVersionBlockDepth {
+		return nil, 0, fmt.Errorf("blocks are nested too deep")
+	}
+	if offset+6 > len(data) {
+		return nil, 0, fmt.Errorf("block at 0x%x is out of bounds", offset)
+	}
+
+	length := int(binary.LittleEndian.Uint16(data[offset:]))
+	valueLength := int(binary.LittleEndian.Uint16(data[offset+2:]))
+	isText := binary.LittleEndian.Uint16(data[offset+4:]) == 1
+	end := offset + length
+	if length < 6 || end > len(data) {
+		return nil, 0, fmt.Errorf("block at 0x%x has invalid length %d", offset, length)
+	}
+
+	block := &versionBlock{}
+	pos := offset + 6
+	var key []uint16
+	for ; pos+2 <= end; pos += 2 {
+		c := binary.LittleEndian.Uint16(data[pos:])
+		if c == 0 {
+			pos += 2
+			break
+		}
+		key = append(key, c)
+	}
+	block.key = string(utf16.Decode(key))
+	pos = align4(pos)
+
+	// Length of text values is given in UTF-16 code units.
+	if isText {
+		valueLength *= 2
+	}
+	if valueLength > 0 {
+		valueEnd := pos + valueLength
+		if valueEnd > end {
+			valueEnd = end
+		}
+		if pos < valueEnd {
+			block.value = data[pos:valueEnd]
+		}
+		pos = align4(valueEnd)
+	}
+
+	// Some files pad blocks with zeros, which can't hold another child.
+	for pos+6 <= end && binary.LittleEndian.Uint16(data[pos:]) != 0 {
+		child, childLength, err := parseVersionBlock(data[:end], pos, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		block.children = append(block.children, child)
+		pos = align4(pos + childLength)
+	}
+
+	return block, length, nil
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// decodeUTF16 decodes a null terminated little-endian UTF-16 string.
+func decodeUTF16(b []byte) string {
+	var s []uint16
+	for i := 0; i+2 <= len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		s = append(s, c)
+	}
+
+	return string(utf16.Decode(s))
+}
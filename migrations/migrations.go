@@ -0,0 +1,271 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migrations provides versioned schema migrations for PostgreSQL and Cloud Spanner.
+package migrations
+
+// Migration holds a single schema change. Statements should be idempotent, so that migrations can
+// be safely applied to databases created before the schema was versioned.
+type Migration struct {
+	Version     int
+	Description string
+	// Postgres holds statements applied to PostgreSQL.
+	Postgres []string
+	// Spanner holds DDL statements applied to Cloud Spanner, each of them must use IF NOT EXISTS.
+	Spanner []string
+}
+
+// Migrations holds all the schema migrations ordered by version. New migrations must be appended
+// to the end with the next version number, existing migrations must not be changed.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create jobs table",
+		Postgres: []string{`CREATE TABLE IF NOT EXISTS jobs (
+	quick_sha256 VARCHAR(100) PRIMARY KEY,
+	imported_at INT NOT NULL,
+	id text,
+	repo text,
+	repo_path text,
+	location text,
+	sha256 VARCHAR(100),
+	status VARCHAR(50),
+	error text,
+	preprocessing_duration INT,
+	processing_duration INT,
+	export_duration INT,
+	files_extracted INT,
+	files_exported INT
+)`},
+		Spanner: []string{`CREATE TABLE IF NOT EXISTS jobs (
+	imported_at TIMESTAMP NOT NULL,
+	id STRING(500),
+	repo STRING(200),
+	repo_path STRING(500),
+	quick_sha256 STRING(100) NOT NULL,
+	location STRING(1000),
+	sha256 STRING(100),
+	status STRING(50),
+	error STRING(10000),
+	preprocessing_duration INT64,
+	processing_duration INT64,
+	export_duration INT64,
+	files_extracted INT64,
+	files_exported INT64,
+) PRIMARY KEY(quick_sha256)`},
+	},
+	{
+		Version:     2,
+		Description: "Create job_events table",
+		Postgres: []string{`CREATE TABLE IF NOT EXISTS job_events (
+	id BIGSERIAL PRIMARY KEY,
+	quick_sha256 VARCHAR(100) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	status VARCHAR(50),
+	error text,
+	version text,
+	host text
+)`,
+			`CREATE INDEX IF NOT EXISTS job_events_quick_sha256_idx ON job_events (quick_sha256)`,
+		},
+		Spanner: []string{`CREATE TABLE IF NOT EXISTS job_events (
+	quick_sha256 STRING(100) NOT NULL,
+	created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+	status STRING(50),
+	error STRING(10000),
+	version STRING(100),
+	host STRING(500),
+) PRIMARY KEY(quick_sha256, created_at)`},
+	},
+	{
+		Version:     3,
+		Description: "Create samples table",
+		Postgres: []string{`CREATE TABLE IF NOT EXISTS samples (
+	sha256 VARCHAR(100) PRIMARY KEY,
+	mimetype text,
+	file_output text,
+	size INT
+)`},
+		Spanner: []string{`CREATE TABLE IF NOT EXISTS samples (
+	sha256 STRING(100),
+	mimetype STRING(MAX),
+	file_output STRING(MAX),
+	size INT64
+) PRIMARY KEY(sha256)`},
+	},
+	{
+		Version:     4,
+		Description: "Create payloads table",
+		Postgres: []string{`CREATE TABLE IF NOT EXISTS payloads (
+	sha256 VARCHAR(100) PRIMARY KEY,
+	payload bytea
+)`},
+		Spanner: []string{`CREATE TABLE IF NOT EXISTS payloads (
+	sha256 STRING(100),
+	gcs_path STRING(200)
+) PRIMARY KEY(sha256)`},
+	},
+	{
+		Version:     5,
+		Description: "Create sources table",
+		Postgres: []string{`CREATE TABLE IF NOT EXISTS sources (
+	sha256 VARCHAR(100) PRIMARY KEY,
+	sourceID text[],
+	sourcePath text,
+	sourceDescription text,
+	repoName text,
+	repoPath text
+)`},
+		Spanner: []string{`CREATE TABLE IF NOT EXISTS sources (
+	sha256 STRING(100),
+	source_id ARRAY<STRING(MAX)>,
+	source_path STRING(MAX),
+	source_description STRING(MAX),
+	repo_name STRING(MAX),
+	repo_path STRING(MAX),
+) PRIMARY KEY(sha256)`},
+	},
+	{
+		Version:     6,
+		Description: "Create samples_sources table",
+		Postgres: []string{`CREATE TABLE IF NOT EXISTS samples_sources (
+	sample_sha256 VARCHAR(100) REFERENCES samples(sha256) NOT NULL,
+	source_sha256 VARCHAR(100) REFERENCES sources(sha256) NOT NULL,
+	sample_paths text[],
+	PRIMARY KEY (sample_sha256, source_sha256)
+)`},
+		Spanner: []string{`CREATE TABLE IF NOT EXISTS samples_sources (
+	sample_sha256 STRING(100),
+	source_sha256 STRING(100),
+	sample_paths ARRAY<STRING(MAX)>,
+	CONSTRAINT FK_Sample FOREIGN KEY (sample_sha256) REFERENCES samples (sha256),
+	CONSTRAINT FK_Source FOREIGN KEY (source_sha256) REFERENCES sources (sha256),
+) PRIMARY KEY (sample_sha256, source_sha256)`},
+	},
+	{
+		Version:     7,
+		Description: "Add location column to payloads table",
+		Postgres:    []string{`ALTER TABLE payloads ADD COLUMN IF NOT EXISTS location text`},
+		Spanner:     []string{`ALTER TABLE payloads ADD COLUMN IF NOT EXISTS location STRING(MAX)`},
+	},
+	{
+		Version:     8,
+		Description: "Create executables table",
+		Postgres: []string{`CREATE TABLE IF NOT EXISTS executables (
+	sha256 VARCHAR(100) PRIMARY KEY REFERENCES samples(sha256),
+	format text,
+	architecture text,
+	build_id text,
+	soname text,
+	imported_libraries text[],
+	company_name text,
+	product_name text,
+	product_version text,
+	file_version text,
+	file_description text,
+	original_filename text,
+	signer text
+)`,
+			`CREATE INDEX IF NOT EXISTS executables_build_id_idx ON executables (build_id)`,
+		},
+		Spanner: []string{`CREATE TABLE IF NOT EXISTS executables (
+	sha256 STRING(100),
+	format STRING(50),
+	architecture STRING(100),
+	build_id STRING(100),
+	soname STRING(MAX),
+	imported_libraries ARRAY<STRING(MAX)>,
+	company_name STRING(MAX),
+	product_name STRING(MAX),
+	product_version STRING(MAX),
+	file_version STRING(MAX),
+	file_description STRING(MAX),
+	original_filename STRING(MAX),
+	signer STRING(MAX),
+	CONSTRAINT FK_ExecutableSample FOREIGN KEY (sha256) REFERENCES samples (sha256),
+) PRIMARY KEY(sha256)`,
+			`CREATE INDEX IF NOT EXISTS executables_build_id_idx ON executables (build_id)`,
+		},
+	},
+	{
+		Version:     9,
+		Description: "Add Authenticode verification results to executables table",
+		Postgres: []string{`ALTER TABLE executables
+	ADD COLUMN IF NOT EXISTS signature_status text,
+	ADD COLUMN IF NOT EXISTS signature_error text,
+	ADD COLUMN IF NOT EXISTS signer_chain text[],
+	ADD COLUMN IF NOT EXISTS signing_time TIMESTAMPTZ`,
+			`CREATE INDEX IF NOT EXISTS executables_signature_status_idx ON executables (signature_status)`,
+		},
+		Spanner: []string{
+			`ALTER TABLE executables ADD COLUMN IF NOT EXISTS signature_status STRING(20)`,
+			`ALTER TABLE executables ADD COLUMN IF NOT EXISTS signature_error STRING(MAX)`,
+			`ALTER TABLE executables ADD COLUMN IF NOT EXISTS signer_chain ARRAY<STRING(MAX)>`,
+			`ALTER TABLE executables ADD COLUMN IF NOT EXISTS signing_time TIMESTAMP`,
+			`CREATE INDEX IF NOT EXISTS executables_signature_status_idx ON executables (signature_status)`,
+		},
+	},
+	{
+		Version:     10,
+		Description: "Add source signature verification results to jobs table",
+		Postgres: []string{`ALTER TABLE jobs
+	ADD COLUMN IF NOT EXISTS signature_status VARCHAR(50),
+	ADD COLUMN IF NOT EXISTS signature_details text`,
+		},
+		Spanner: []string{
+			`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS signature_status STRING(50)`,
+			`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS signature_details STRING(MAX)`,
+		},
+	},
+	{
+		Version:     11,
+		Description: "Add package metadata column to sources table",
+		Postgres: []string{`ALTER TABLE sources ADD COLUMN IF NOT EXISTS metadata jsonb`,
+			`CREATE INDEX IF NOT EXISTS sources_metadata_name_idx ON sources ((metadata->>'name'), (metadata->>'version'))`,
+		},
+		// Metadata is stored as JSON string, which can be queried with JSON_VALUE.
+		Spanner: []string{`ALTER TABLE sources ADD COLUMN IF NOT EXISTS metadata STRING(MAX)`},
+	},
+	{
+		Version:     12,
+		Description: "Add warnings column to jobs table",
+		Postgres:    []string{`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS warnings text[]`},
+		Spanner:     []string{`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS warnings ARRAY<STRING(MAX)>`},
+	},
+	{
+		Version:     13,
+		Description: "Add parse_error column to executables table",
+		Postgres:    []string{`ALTER TABLE executables ADD COLUMN IF NOT EXISTS parse_error text`},
+		Spanner:     []string{`ALTER TABLE executables ADD COLUMN IF NOT EXISTS parse_error STRING(MAX)`},
+	},
+}
+
+// LatestVersion returns the version of the latest migration.
+func LatestVersion() int {
+	if len(Migrations) == 0 {
+		return 0
+	}
+	return Migrations[len(Migrations)-1].Version
+}
+
+// pending returns migrations with version higher than a given one.
+func pending(migrations []Migration, version int) []Migration {
+	var result []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			result = append(result, m)
+		}
+	}
+	return result
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrations
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	for i, m := range Migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.Description, m.Version, i+1)
+		}
+		if m.Description == "" {
+			t.Errorf("migration %d has no description", m.Version)
+		}
+		if len(m.Postgres) == 0 && len(m.Spanner) == 0 {
+			t.Errorf("migration %d has no statements", m.Version)
+		}
+		// Spanner DDL is not transactional, so each statement must be safe to apply again.
+		for _, statement := range m.Spanner {
+			if !strings.Contains(statement, "IF NOT EXISTS") || strings.Count(statement, "ADD COLUMN") != strings.Count(statement, "ADD COLUMN IF NOT EXISTS") {
+				t.Errorf("migration %d has Spanner statement without IF NOT EXISTS: %s", m.Version, statement)
+			}
+		}
+	}
+
+	if got, want := LatestVersion(), len(Migrations); got != want {
+		t.Errorf("LatestVersion() = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+const postgresSchemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INT PRIMARY KEY,
+	description text,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+// MigratePostgres applies pending migrations to a given PostgreSQL database and returns the
+// resulting schema version.
+func MigratePostgres(ctx context.Context, db *sql.DB) (int, error) {
+	return migratePostgres(ctx, db, Migrations)
+}
+
+func migratePostgres(ctx context.Context, db *sql.DB, migrations []Migration) (int, error) {
+	if _, err := db.ExecContext(ctx, postgresSchemaMigrationsTable); err != nil {
+		return 0, fmt.Errorf("error while creating schema_migrations table: %v", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The lock prevents concurrently started hashR instances from applying the same migrations.
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE schema_migrations IN EXCLUSIVE MODE`); err != nil {
+		return 0, fmt.Errorf("error while locking schema_migrations table: %v", err)
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("error while fetching schema version: %v", err)
+	}
+
+	for _, m := range pending(migrations, version) {
+		glog.Infof("Applying PostgreSQL schema migration %d: %s", m.Version, m.Description)
+		for _, stmt := range m.Postgres {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return 0, fmt.Errorf("error while applying migration %d: %v", m.Version, err)
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, description) VALUES ($1, $2)`, m.Version, m.Description); err != nil {
+			return 0, fmt.Errorf("error while recording migration %d: %v", m.Version, err)
+		}
+		version = m.Version
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
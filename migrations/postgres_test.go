@@ -0,0 +1,114 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrations
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMigratePostgres(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("could not open a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(postgresSchemaMigrationsTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).WillReturnRows(mock.NewRows([]string{"version"}).AddRow(0))
+	for _, m := range Migrations {
+		for _, stmt := range m.Postgres {
+			mock.ExpectExec(stmt).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec(`INSERT INTO schema_migrations (version, description) VALUES ($1, $2)`).WithArgs(m.Version, m.Description).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	version, err := MigratePostgres(context.Background(), db)
+	if err != nil {
+		t.Fatalf("unexpected error while running MigratePostgres(): %v", err)
+	}
+
+	if version != LatestVersion() {
+		t.Errorf("MigratePostgres() = %d, want %d", version, LatestVersion())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigratePostgresPending(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("could not open a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	migrations := []Migration{
+		{Version: 1, Description: "Create foo table", Postgres: []string{`CREATE TABLE IF NOT EXISTS foo (id INT)`}},
+		{Version: 2, Description: "Add bar column", Postgres: []string{`ALTER TABLE foo ADD COLUMN IF NOT EXISTS bar text`}},
+		{Version: 3, Description: "Add baz column", Postgres: []string{`ALTER TABLE foo ADD COLUMN IF NOT EXISTS baz text`}},
+	}
+
+	mock.ExpectExec(postgresSchemaMigrationsTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).WillReturnRows(mock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectExec(`ALTER TABLE foo ADD COLUMN IF NOT EXISTS bar text`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations (version, description) VALUES ($1, $2)`).WithArgs(2, "Add bar column").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`ALTER TABLE foo ADD COLUMN IF NOT EXISTS baz text`).WillReturnError(errors.New("column baz already exists"))
+	mock.ExpectRollback()
+
+	if _, err := migratePostgres(context.Background(), db, migrations); err == nil {
+		t.Error("expected error while applying failing migration")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigratePostgresUpToDate(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("could not open a stub database connection: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(postgresSchemaMigrationsTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).WillReturnRows(mock.NewRows([]string{"version"}).AddRow(LatestVersion()))
+	mock.ExpectCommit()
+
+	version, err := MigratePostgres(context.Background(), db)
+	if err != nil {
+		t.Fatalf("unexpected error while running MigratePostgres(): %v", err)
+	}
+
+	if version != LatestVersion() {
+		t.Errorf("MigratePostgres() = %d, want %d", version, LatestVersion())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
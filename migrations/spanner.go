@@ -0,0 +1,121 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	"github.com/golang/glog"
+)
+
+const spannerSchemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INT64 NOT NULL,
+	description STRING(MAX),
+	applied_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(version)`
+
+// SpannerDatabase is the subset of Cloud Spanner operations needed to migrate a database.
+type SpannerDatabase interface {
+	// UpdateDDL applies given DDL statements and waits until they are completed.
+	UpdateDDL(ctx context.Context, statements []string) error
+	// Version returns the version of the latest applied migration.
+	Version(ctx context.Context) (int, error)
+	// SetVersion records a given migration as applied.
+	SetVersion(ctx context.Context, m Migration) error
+}
+
+type spannerDatabase struct {
+	client      *spanner.Client
+	adminClient *database.DatabaseAdminClient
+	dbPath      string
+}
+
+// NewSpannerDatabase returns SpannerDatabase backed by a given Cloud Spanner database.
+func NewSpannerDatabase(client *spanner.Client, adminClient *database.DatabaseAdminClient, dbPath string) SpannerDatabase {
+	return &spannerDatabase{client: client, adminClient: adminClient, dbPath: dbPath}
+}
+
+func (d *spannerDatabase) UpdateDDL(ctx context.Context, statements []string) error {
+	op, err := d.adminClient.UpdateDatabaseDdl(ctx, &databasepb.UpdateDatabaseDdlRequest{
+		Database:   d.dbPath,
+		Statements: statements,
+	})
+	if err != nil {
+		return err
+	}
+
+	return op.Wait(ctx)
+}
+
+func (d *spannerDatabase) Version(ctx context.Context) (int, error) {
+	var version int64
+	iter := d.client.Single().Query(ctx, spanner.Statement{SQL: `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`})
+	err := iter.Do(func(row *spanner.Row) error {
+		return row.Columns(&version)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(version), nil
+}
+
+func (d *spannerDatabase) SetVersion(ctx context.Context, m Migration) error {
+	_, err := d.client.Apply(ctx, []*spanner.Mutation{
+		spanner.InsertOrUpdate("schema_migrations",
+			[]string{"version", "description", "applied_at"},
+			[]interface{}{int64(m.Version), m.Description, spanner.CommitTimestamp}),
+	})
+
+	return err
+}
+
+// MigrateSpanner applies pending migrations to a given Cloud Spanner database and returns the
+// resulting schema version. Spanner DDL is not transactional, statements rely on IF NOT EXISTS
+// so that an interrupted migration can be safely applied again.
+func MigrateSpanner(ctx context.Context, db SpannerDatabase) (int, error) {
+	return migrateSpanner(ctx, db, Migrations)
+}
+
+func migrateSpanner(ctx context.Context, db SpannerDatabase, migrations []Migration) (int, error) {
+	if err := db.UpdateDDL(ctx, []string{spannerSchemaMigrationsTable}); err != nil {
+		return 0, fmt.Errorf("error while creating schema_migrations table: %v", err)
+	}
+
+	version, err := db.Version(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error while fetching schema version: %v", err)
+	}
+
+	for _, m := range pending(migrations, version) {
+		glog.Infof("Applying Cloud Spanner schema migration %d: %s", m.Version, m.Description)
+		if len(m.Spanner) > 0 {
+			if err := db.UpdateDDL(ctx, m.Spanner); err != nil {
+				return 0, fmt.Errorf("error while applying migration %d: %v", m.Version, err)
+			}
+		}
+
+		if err := db.SetVersion(ctx, m); err != nil {
+			return 0, fmt.Errorf("error while recording migration %d: %v", m.Version, err)
+		}
+		version = m.Version
+	}
+
+	return version, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrations
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeSpannerDatabase keeps the schema in memory, so that migrations can be tested without the
+// Cloud Spanner emulator.
+type fakeSpannerDatabase struct {
+	statements []string
+	versions   []int
+	failOn     string
+}
+
+func (d *fakeSpannerDatabase) UpdateDDL(ctx context.Context, statements []string) error {
+	for _, stmt := range statements {
+		if stmt == d.failOn {
+			return errors.New("failed to apply DDL statement")
+		}
+	}
+	d.statements = append(d.statements, statements...)
+	return nil
+}
+
+func (d *fakeSpannerDatabase) Version(ctx context.Context) (int, error) {
+	var version int
+	for _, v := range d.versions {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+func (d *fakeSpannerDatabase) SetVersion(ctx context.Context, m Migration) error {
+	d.versions = append(d.versions, m.Version)
+	return nil
+}
+
+func TestMigrateSpanner(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeSpannerDatabase{}
+
+	version, err := MigrateSpanner(ctx, db)
+	if err != nil {
+		t.Fatalf("unexpected error while running MigrateSpanner(): %v", err)
+	}
+
+	if version != LatestVersion() {
+		t.Errorf("MigrateSpanner() = %d, want %d", version, LatestVersion())
+	}
+
+	wantStatements := []string{spannerSchemaMigrationsTable}
+	var wantVersions []int
+	for _, m := range Migrations {
+		wantStatements = append(wantStatements, m.Spanner...)
+		wantVersions = append(wantVersions, m.Version)
+	}
+
+	if diff := cmp.Diff(wantStatements, db.statements); diff != "" {
+		t.Errorf("MigrateSpanner() unexpected statements diff (-want/+got):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantVersions, db.versions); diff != "" {
+		t.Errorf("MigrateSpanner() unexpected versions diff (-want/+got):\n%s", diff)
+	}
+
+	// Running migrations again should only ensure that the schema_migrations table exists.
+	if _, err := MigrateSpanner(ctx, db); err != nil {
+		t.Fatalf("unexpected error while running MigrateSpanner(): %v", err)
+	}
+
+	wantStatements = append(wantStatements, spannerSchemaMigrationsTable)
+	if diff := cmp.Diff(wantStatements, db.statements); diff != "" {
+		t.Errorf("MigrateSpanner() unexpected statements diff (-want/+got):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantVersions, db.versions); diff != "" {
+		t.Errorf("MigrateSpanner() unexpected versions diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestMigrateSpannerFailure(t *testing.T) {
+	ctx := context.Background()
+	migrations := []Migration{
+		{Version: 1, Description: "Create foo table", Spanner: []string{`CREATE TABLE IF NOT EXISTS foo (id INT64) PRIMARY KEY(id)`}},
+		{Version: 2, Description: "Add bar column", Spanner: []string{`ALTER TABLE foo ADD COLUMN IF NOT EXISTS bar STRING(MAX)`}},
+		{Version: 3, Description: "Add baz column", Spanner: []string{`ALTER TABLE foo ADD COLUMN IF NOT EXISTS baz STRING(MAX)`}},
+	}
+	db := &fakeSpannerDatabase{failOn: `ALTER TABLE foo ADD COLUMN IF NOT EXISTS bar STRING(MAX)`}
+
+	if _, err := migrateSpanner(ctx, db, migrations); err == nil {
+		t.Fatal("expected error while applying failing migration")
+	}
+
+	// Only the migrations applied before the failure should be recorded.
+	if diff := cmp.Diff([]int{1}, db.versions); diff != "" {
+		t.Errorf("migrateSpanner() unexpected versions diff (-want/+got):\n%s", diff)
+	}
+
+	db.failOn = ""
+	version, err := migrateSpanner(ctx, db, migrations)
+	if err != nil {
+		t.Fatalf("unexpected error while running migrateSpanner(): %v", err)
+	}
+	if version != 3 {
+		t.Errorf("migrateSpanner() = %d, want 3", version)
+	}
+	if diff := cmp.Diff([]int{1, 2, 3}, db.versions); diff != "" {
+		t.Errorf("migrateSpanner() unexpected versions diff (-want/+got):\n%s", diff)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package payloads
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"google.golang.org/api/storage/v1"
+)
+
+// GCSStoreName contains name of the GCS store.
+const GCSStoreName = "gcs"
+
+// GCSStore stores payloads in a GCS bucket.
+type GCSStore struct {
+	storageClient *storage.Service
+	bucket        string
+}
+
+// NewGCSStore creates new store that keeps payloads in a given GCS bucket.
+func NewGCSStore(storageClient *storage.Service, bucket string) (*GCSStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("GCS bucket is not set")
+	}
+
+	return &GCSStore{storageClient: storageClient, bucket: bucket}, nil
+}
+
+// Name returns store name.
+func (s *GCSStore) Name() string {
+	return GCSStoreName
+}
+
+// Put uploads a given file to GCS.
+func (s *GCSStore) Put(ctx context.Context, sha256, path string) (string, error) {
+	name, err := ObjectName(sha256)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	object := &storage.Object{
+		Name: name,
+	}
+
+	_, err = s.storageClient.Objects.Insert(s.bucket, object).Media(file).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("error uploading data to GCS: %v", err)
+	}
+
+	return fmt.Sprintf("gs://%s/%s", s.bucket, name), nil
+}
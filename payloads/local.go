@@ -0,0 +1,97 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package payloads
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// LocalStoreName contains name of the local filesystem store.
+const LocalStoreName = "local"
+
+// LocalStore stores payloads in a local directory.
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore creates new store that keeps payloads in a given directory.
+func NewLocalStore(root string) (*LocalStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("could not create payload directory: %v", err)
+	}
+
+	return &LocalStore{root: root}, nil
+}
+
+// Name returns store name.
+func (s *LocalStore) Name() string {
+	return LocalStoreName
+}
+
+// Put copies a given file into the store, unless a payload with the same SHA-256 is already
+// present. Files are written to a temporary file first, so the store never contains partially
+// written payloads.
+func (s *LocalStore) Put(ctx context.Context, sha256, path string) (string, error) {
+	name, err := ObjectName(sha256)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(s.root, filepath.FromSlash(name))
+	location := (&url.URL{Scheme: "file", Path: filepath.ToSlash(dst)}).String()
+
+	if _, err := os.Stat(dst); err == nil {
+		return location, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("could not copy %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", err
+	}
+
+	return location, nil
+}
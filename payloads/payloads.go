@@ -0,0 +1,41 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package payloads implements stores for the content of exported samples.
+package payloads
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Store stores the content of exported samples, addressed by their SHA-256.
+type Store interface {
+	// Name returns store name.
+	Name() string
+	// Put stores the content of a local file under a given SHA-256 and returns its location.
+	Put(ctx context.Context, sha256, path string) (string, error)
+}
+
+// ObjectName returns the name of the object holding a payload with a given SHA-256. Payloads are
+// sharded by the first two characters of the hash, e.g. A6/A665A459...
+func ObjectName(sha256 string) (string, error) {
+	if len(sha256) < 2 || strings.ContainsAny(sha256, `/\.`) {
+		return "", fmt.Errorf("invalid sha256 %q", sha256)
+	}
+	sha256 = strings.ToUpper(sha256)
+
+	return fmt.Sprintf("%s/%s", sha256[0:2], sha256), nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package payloads
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const sampleSha256 = "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3"
+
+func TestObjectName(t *testing.T) {
+	for _, tc := range []struct {
+		sha256  string
+		want    string
+		wantErr bool
+	}{
+		{sha256: sampleSha256, want: "A6/A665A45920422F9D417E4867EFDC4FB8A04A1F3FFF1FA07E998E86F7F7A27AE3"},
+		{sha256: "a", wantErr: true},
+		{sha256: "../../etc/passwd", wantErr: true},
+	} {
+		got, err := ObjectName(tc.sha256)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("ObjectName(%q) = %v, want error: %v", tc.sha256, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("ObjectName(%q) = %s, want %s", tc.sha256, got, tc.want)
+		}
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewLocalStore(root)
+	if err != nil {
+		t.Fatalf("could not create local store: %v", err)
+	}
+
+	src := filepath.Join("testdata", "extraction", "file.01")
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing the same payload again is a no-op.
+	for i := 0; i < 2; i++ {
+		location, err := s.Put(context.Background(), sampleSha256, src)
+		if err != nil {
+			t.Fatalf("unexpected error while running Put(): %v", err)
+		}
+
+		dst := filepath.Join(root, "A6", strings.ToUpper(sampleSha256))
+		if wantLocation := "file://" + filepath.ToSlash(dst); location != wantLocation {
+			t.Errorf("Put() = %s, want %s", location, wantLocation)
+		}
+
+		got, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Put() stored unexpected content")
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, "A6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Put() left %d files in the shard directory, want 1", len(entries))
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mu.Lock()
+		objects[r.URL.Path] = data
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	cfg := aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "minioadmin", SecretAccessKey: "minioadmin"}, nil
+		}),
+		HTTPClient: server.Client(),
+	}
+	s, err := NewS3Store(NewS3Client(cfg, server.URL), "hashr")
+	if err != nil {
+		t.Fatalf("could not create S3 store: %v", err)
+	}
+
+	src := filepath.Join("testdata", "extraction", "file.01")
+	location, err := s.Put(context.Background(), sampleSha256, src)
+	if err != nil {
+		t.Fatalf("unexpected error while running Put(): %v", err)
+	}
+
+	name := "A6/" + strings.ToUpper(sampleSha256)
+	if want := "s3://hashr/" + name; location != want {
+		t.Errorf("Put() = %s, want %s", location, want)
+	}
+
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Path-style addressing puts the bucket name in the path.
+	if got := objects["/hashr/"+name]; !bytes.Equal(got, want) {
+		t.Errorf("Put() uploaded %d bytes to /hashr/%s, want %d", len(got), name, len(want))
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package payloads
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3StoreName contains name of the S3 store.
+const S3StoreName = "s3"
+
+type s3PutObjectAPI interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// S3Store stores payloads in a bucket of an S3 compatible service (e.g. AWS S3 or MinIO).
+type S3Store struct {
+	s3Client s3PutObjectAPI
+	bucket   string
+}
+
+// NewS3Store creates new store that keeps payloads in a given S3 bucket.
+func NewS3Store(s3Client *s3.Client, bucket string) (*S3Store, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is not set")
+	}
+
+	return &S3Store{s3Client: s3Client, bucket: bucket}, nil
+}
+
+// NewS3Client creates S3 client from a given config. If endpoint is set, requests are sent to it
+// using path-style addressing, as expected by S3 compatible services such as MinIO.
+func NewS3Client(cfg aws.Config, endpoint string) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+}
+
+// Name returns store name.
+func (s *S3Store) Name() string {
+	return S3StoreName
+}
+
+// Put uploads a given file to S3.
+func (s *S3Store) Put(ctx context.Context, sha256, path string) (string, error) {
+	name, err := ObjectName(sha256)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(name),
+		Body:          file,
+		ContentLength: aws.Int64(fi.Size()),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error uploading data to S3: %v", err)
+	}
+
+	return fmt.Sprintf("s3://%s/%s", s.bucket, name), nil
+}
@@ -0,0 +1,333 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package samplestore implements content-addressed local storage of extracted samples. Every
+// sample is stored once, regardless of the number of sources it was found in, and each processed
+// source gets a manifest that references the stored samples.
+package samplestore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/hashr/common"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	blobsDir     = "blobs"
+	manifestsDir = "manifests"
+	// zstdExt is the extension of compressed blobs.
+	zstdExt = ".zst"
+	// tmpPrefix is the prefix of temporary files, it allows to clean up files left behind by
+	// interrupted writes.
+	tmpPrefix = ".tmp-"
+)
+
+// Store is a content-addressed sample store in a local directory. Samples are kept in
+// blobs/<first two characters of SHA-256>/<SHA-256>[.zst], manifests in manifests/.
+type Store struct {
+	root     string
+	compress bool
+}
+
+// Manifest describes samples extracted from a single source.
+type Manifest struct {
+	SourceImporter string    `json:"source_importer"`
+	SourceID       string    `json:"source_id"`
+	SourceSHA256   string    `json:"source_sha256"`
+	CreatedAt      time.Time `json:"created_at"`
+	// Samples holds all the samples of the source. Paths of the uploaded samples point to the
+	// blobs in the store, samples that are not uploaded were stored while processing other sources.
+	Samples []common.Sample `json:"samples"`
+}
+
+// GCStats holds results of the garbage collection.
+type GCStats struct {
+	// Referenced is the number of samples referenced by the manifests.
+	Referenced int
+	// Removed is the number of removed blobs and TempFiles the number of removed temporary files.
+	Removed   int
+	TempFiles int
+	// Freed is the number of bytes taken by the removed blobs and temporary files.
+	Freed int64
+}
+
+// New creates new sample store in a given directory. If compress is true, new blobs are
+// compressed with zstd.
+func New(root string, compress bool) (*Store, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range []string{blobsDir, manifestsDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, fmt.Errorf("could not create sample store directory: %v", err)
+		}
+	}
+
+	return &Store{root: root, compress: compress}, nil
+}
+
+// Path returns path to a stored sample with a given SHA-256, compressed blobs have the .zst
+// extension. An error is returned if the sample is not in the store.
+func (s *Store) Path(sha256 string) (string, error) {
+	path, err := s.blobPath(sha256)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range []string{path, path + zstdExt} {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("sample %s not found in the store", sha256)
+}
+
+// Open returns reader of the decompressed content of a stored sample.
+func (s *Store) Open(sha256 string) (io.ReadCloser, error) {
+	path, err := s.Path(sha256)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, zstdExt) {
+		return f, nil
+	}
+
+	dec, err := zstd.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &zstdReadCloser{dec: dec, f: f}, nil
+}
+
+type zstdReadCloser struct {
+	dec *zstd.Decoder
+	f   *os.File
+}
+
+func (r *zstdReadCloser) Read(p []byte) (int, error) {
+	return r.dec.Read(p)
+}
+
+func (r *zstdReadCloser) Close() error {
+	r.dec.Close()
+	return r.f.Close()
+}
+
+// Put stores a file with a given SHA-256 and returns the path of the blob. Samples already in the
+// store are not written again. The file is streamed into a temporary file that is renamed once its
+// digest is verified, so the store never contains partially written or mismatched blobs.
+func (s *Store) Put(sha256Hash, path string) (string, error) {
+	if existing, err := s.Path(sha256Hash); err == nil {
+		return existing, nil
+	}
+
+	dst, err := s.blobPath(sha256Hash)
+	if err != nil {
+		return "", err
+	}
+	if s.compress {
+		dst += zstdExt
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+
+	err = writeFile(dst, func(w io.Writer) error {
+		h := sha256.New()
+		if !s.compress {
+			if _, err := io.Copy(io.MultiWriter(w, h), src); err != nil {
+				return err
+			}
+			return checkDigest(sha256Hash, h.Sum(nil))
+		}
+
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.MultiWriter(enc, h), src); err != nil {
+			enc.Close()
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		return checkDigest(sha256Hash, h.Sum(nil))
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not store %s: %v", path, err)
+	}
+
+	return dst, nil
+}
+
+// WriteManifest writes manifest of a given source, replacing the previous one if the source was
+// already stored.
+func (s *Store) WriteManifest(m *Manifest) error {
+	path := filepath.Join(s.root, manifestsDir, manifestName(m))
+
+	return writeFile(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	})
+}
+
+// Manifests returns all manifests in the store.
+func (s *Store) Manifests() ([]*Manifest, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, manifestsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []*Manifest
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tmpPrefix) || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.root, manifestsDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m := &Manifest{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("could not parse manifest %s: %v", entry.Name(), err)
+		}
+		manifests = append(manifests, m)
+	}
+
+	return manifests, nil
+}
+
+// GC removes blobs that are not referenced by any manifest, together with temporary files left
+// behind by interrupted writes. If dryRun is true, nothing is removed. GC must not run
+// concurrently with hashR processing that writes to the same store.
+func (s *Store) GC(dryRun bool) (*GCStats, error) {
+	manifests, err := s.Manifests()
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifests: %v", err)
+	}
+
+	referenced := make(map[string]bool)
+	for _, m := range manifests {
+		for _, sample := range m.Samples {
+			referenced[strings.ToLower(sample.Sha256)] = true
+		}
+	}
+
+	stats := &GCStats{Referenced: len(referenced)}
+	err = filepath.Walk(filepath.Join(s.root, blobsDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		name := info.Name()
+		switch {
+		case strings.HasPrefix(name, tmpPrefix):
+			stats.TempFiles++
+		case referenced[strings.TrimSuffix(name, zstdExt)]:
+			return nil
+		default:
+			stats.Removed++
+		}
+
+		stats.Freed += info.Size()
+		if dryRun {
+			return nil
+		}
+
+		return os.Remove(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	glog.Infof("Sample store GC removed %d blobs and %d temporary files (%d bytes), %d samples are referenced", stats.Removed, stats.TempFiles, stats.Freed, stats.Referenced)
+
+	return stats, nil
+}
+
+func (s *Store) blobPath(sha256Hash string) (string, error) {
+	sha256Hash = strings.ToLower(sha256Hash)
+	if _, err := hex.DecodeString(sha256Hash); err != nil || len(sha256Hash) != 2*sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 %q", sha256Hash)
+	}
+
+	return filepath.Join(s.root, blobsDir, sha256Hash[:2], sha256Hash), nil
+}
+
+func manifestName(m *Manifest) string {
+	name := fmt.Sprintf("%s___%s___%s.json", m.SourceImporter, m.SourceID, m.SourceSHA256)
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+}
+
+func checkDigest(want string, got []byte) error {
+	if !strings.EqualFold(want, hex.EncodeToString(got)) {
+		return fmt.Errorf("SHA-256 mismatch, expected %s, got %x", want, got)
+	}
+
+	return nil
+}
+
+// writeFile writes a file using a temporary file in the same directory, so readers never see a
+// partially written one.
+func writeFile(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), tmpPrefix+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,206 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samplestore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/hashr/common"
+)
+
+func writeSample(t *testing.T, content string) (string, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sample")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+
+	return hex.EncodeToString(sum[:]), path
+}
+
+func TestPut(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		store, err := New(t.TempDir(), compress)
+		if err != nil {
+			t.Fatalf("unexpected error while running New(): %v", err)
+		}
+
+		hash, path := writeSample(t, "hashr sample content")
+		blobPath, err := store.Put(hash, path)
+		if err != nil {
+			t.Fatalf("unexpected error while running Put(): %v", err)
+		}
+
+		wantPath := filepath.Join(store.root, blobsDir, hash[:2], hash)
+		if compress {
+			wantPath += zstdExt
+		}
+		if blobPath != wantPath {
+			t.Errorf("Put() = %s, want %s", blobPath, wantPath)
+		}
+
+		// Storing the same sample again returns the existing blob.
+		if again, err := store.Put(strings.ToUpper(hash), path); err != nil || again != blobPath {
+			t.Errorf("Put() of an already stored sample = %s, %v, want %s, nil", again, err, blobPath)
+		}
+
+		r, err := store.Open(hash)
+		if err != nil {
+			t.Fatalf("unexpected error while running Open(): %v", err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "hashr sample content" {
+			t.Errorf("Open() content = %q, want %q", got, "hashr sample content")
+		}
+	}
+}
+
+func TestPutErrors(t *testing.T) {
+	store, err := New(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("unexpected error while running New(): %v", err)
+	}
+
+	hash, path := writeSample(t, "hashr sample content")
+	otherHash, _ := writeSample(t, "other content")
+
+	for _, tc := range []struct {
+		name string
+		hash string
+	}{
+		{name: "invalid hash", hash: "../../etc/passwd"},
+		{name: "short hash", hash: hash[:32]},
+		{name: "digest mismatch", hash: otherHash},
+	} {
+		if _, err := store.Put(tc.hash, path); err == nil {
+			t.Errorf("Put() with %s succeeded, want error", tc.name)
+		}
+	}
+
+	// Failed writes leave nothing behind.
+	if _, err := store.Path(otherHash); err == nil {
+		t.Errorf("Path() of a sample with mismatched digest succeeded, want error")
+	}
+	if entries, err := os.ReadDir(filepath.Join(store.root, blobsDir, otherHash[:2])); err == nil && len(entries) > 0 {
+		t.Errorf("blob directory contains %d files after failed write, want 0", len(entries))
+	}
+}
+
+func TestManifests(t *testing.T) {
+	store, err := New(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("unexpected error while running New(): %v", err)
+	}
+
+	hash, path := writeSample(t, "hashr sample content")
+	blobPath, err := store.Put(hash, path)
+	if err != nil {
+		t.Fatalf("unexpected error while running Put(): %v", err)
+	}
+
+	want := &Manifest{
+		SourceImporter: "targz",
+		SourceID:       "dir/archive.tar.gz",
+		SourceSHA256:   "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc",
+		CreatedAt:      time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		Samples: []common.Sample{
+			{Sha256: hash, Paths: []string{blobPath}, Upload: true, SourcePaths: []string{"/bin/ls"}, Size: 20},
+		},
+	}
+	if err := store.WriteManifest(want); err != nil {
+		t.Fatalf("unexpected error while running WriteManifest(): %v", err)
+	}
+	// Writing manifest of the same source replaces the previous one.
+	if err := store.WriteManifest(want); err != nil {
+		t.Fatalf("unexpected error while running WriteManifest(): %v", err)
+	}
+
+	got, err := store.Manifests()
+	if err != nil {
+		t.Fatalf("unexpected error while running Manifests(): %v", err)
+	}
+	if diff := cmp.Diff([]*Manifest{want}, got); diff != "" {
+		t.Errorf("Manifests() unexpected diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestGC(t *testing.T) {
+	store, err := New(t.TempDir(), true)
+	if err != nil {
+		t.Fatalf("unexpected error while running New(): %v", err)
+	}
+
+	keptHash, keptPath := writeSample(t, "referenced sample")
+	removedHash, removedPath := writeSample(t, "unreferenced sample")
+	for hash, path := range map[string]string{keptHash: keptPath, removedHash: removedPath} {
+		if _, err := store.Put(hash, path); err != nil {
+			t.Fatalf("unexpected error while running Put(): %v", err)
+		}
+	}
+
+	// Leftover of an interrupted write.
+	tmp := filepath.Join(store.root, blobsDir, keptHash[:2], tmpPrefix+keptHash+".123")
+	if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.WriteManifest(&Manifest{
+		SourceImporter: "targz",
+		SourceID:       "archive.tar.gz",
+		SourceSHA256:   "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc",
+		Samples:        []common.Sample{{Sha256: strings.ToUpper(keptHash), Upload: false}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while running WriteManifest(): %v", err)
+	}
+
+	stats, err := store.GC(true)
+	if err != nil {
+		t.Fatalf("unexpected error while running GC(): %v", err)
+	}
+	if stats.Removed != 1 || stats.TempFiles != 1 || stats.Referenced != 1 {
+		t.Errorf("GC(true) removed %d blobs and %d temporary files and referenced %d, want 1, 1 and 1", stats.Removed, stats.TempFiles, stats.Referenced)
+	}
+	if _, err := store.Path(removedHash); err != nil {
+		t.Errorf("GC(true) removed blob %s", removedHash)
+	}
+
+	if _, err := store.GC(false); err != nil {
+		t.Fatalf("unexpected error while running GC(): %v", err)
+	}
+	if _, err := store.Path(keptHash); err != nil {
+		t.Errorf("GC(false) removed referenced blob %s", keptHash)
+	}
+	if _, err := store.Path(removedHash); err == nil {
+		t.Errorf("GC(false) did not remove unreferenced blob %s", removedHash)
+	}
+	if _, err := os.Stat(tmp); err == nil {
+		t.Errorf("GC(false) did not remove temporary file %s", tmp)
+	}
+}
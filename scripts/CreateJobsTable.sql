@@ -27,4 +27,16 @@ CREATE TABLE jobs (
           export_duration INT,
           files_extracted INT,
           files_exported INT
-);
\ No newline at end of file
+);
+
+CREATE TABLE job_events (
+          id BIGSERIAL PRIMARY KEY,
+          quick_sha256 VARCHAR(100) NOT NULL,
+          created_at TIMESTAMPTZ NOT NULL,
+          status VARCHAR(50),
+          error text,
+          version text,
+          host text
+);
+
+CREATE INDEX job_events_quick_sha256_idx ON job_events (quick_sha256);
\ No newline at end of file
@@ -18,6 +18,8 @@ package cloudspanner
 import (
 	"context"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/google/hashr/core/hashr"
@@ -25,6 +27,7 @@ import (
 	"cloud.google.com/go/spanner"
 
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
 )
 
 // Storage allows to interact with cloud spanner.
@@ -37,8 +40,9 @@ func NewStorage(ctx context.Context, spannerClient *spanner.Client) (*Storage, e
 	return &Storage{spannerClient: spannerClient}, nil
 }
 
-// UpdateJobs updates cloud spanner table.
+// UpdateJobs updates jobs table and appends the job event to job_events table.
 func (s *Storage) UpdateJobs(ctx context.Context, qHash string, p *hashr.ProcessingSource) error {
+	e := hashr.NewJobEvent(qHash, p)
 	_, err := s.spannerClient.Apply(ctx, []*spanner.Mutation{
 		spanner.InsertOrUpdate("jobs",
 			[]string{
@@ -55,7 +59,10 @@ func (s *Storage) UpdateJobs(ctx context.Context, qHash string, p *hashr.Process
 				"processing_duration",
 				"export_duration",
 				"files_extracted",
-				"files_exported"},
+				"files_exported",
+				"signature_status",
+				"signature_details",
+				"warnings"},
 			[]interface{}{
 				qHash,
 				time.Unix(p.ImportedAt, 0),
@@ -71,7 +78,11 @@ func (s *Storage) UpdateJobs(ctx context.Context, qHash string, p *hashr.Process
 				int64(p.ExportDuration.Seconds()),
 				p.SampleCount,
 				p.ExportCount,
-			})})
+				p.SignatureStatus,
+				p.SignatureDetails,
+				p.Warnings,
+			}),
+		jobEventMutation(e)})
 	if err != nil {
 		return fmt.Errorf("failed to insert data %v", err)
 	}
@@ -79,6 +90,27 @@ func (s *Storage) UpdateJobs(ctx context.Context, qHash string, p *hashr.Process
 	return nil
 }
 
+// jobEventMutation returns a mutation that appends a given event to job_events table. Commit
+// timestamp guarantees unique and ordered keys for the events of a given job.
+func jobEventMutation(e *hashr.JobEvent) *spanner.Mutation {
+	return spanner.Insert("job_events",
+		[]string{
+			"quick_sha256",
+			"created_at",
+			"status",
+			"error",
+			"version",
+			"host"},
+		[]interface{}{
+			e.QuickSha256,
+			spanner.CommitTimestamp,
+			e.Status,
+			e.Error,
+			e.Version,
+			e.Host,
+		})
+}
+
 // FetchJobs fetches processing jobs from cloud spanner.
 func (s *Storage) FetchJobs(ctx context.Context) (map[string]string, error) {
 	processed := make(map[string]string)
@@ -106,3 +138,142 @@ func (s *Storage) FetchJobs(ctx context.Context) (map[string]string, error) {
 	}
 	return processed, nil
 }
+
+// FetchJobHistory fetches events of a given processing job from cloud spanner.
+func (s *Storage) FetchJobHistory(ctx context.Context, qHash string) ([]*hashr.JobEvent, error) {
+	var events []*hashr.JobEvent
+	stmt := spanner.Statement{
+		SQL: `SELECT quick_sha256, created_at, status, error, version, host FROM job_events
+WHERE quick_sha256 = @quick_sha256 ORDER BY created_at`,
+		Params: map[string]interface{}{
+			"quick_sha256": qHash,
+		},
+	}
+
+	iter := s.spannerClient.Single().Query(ctx, stmt)
+	defer iter.Stop()
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := &hashr.JobEvent{}
+		var status, errText, version, host spanner.NullString
+		if err := row.Columns(&e.QuickSha256, &e.Timestamp, &status, &errText, &version, &host); err != nil {
+			return nil, err
+		}
+		e.Status, e.Error, e.Version, e.Host = status.StringVal, errText.StringVal, version.StringVal, host.StringVal
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// QueryJobs fetches processing jobs matching a given filter from cloud spanner.
+func (s *Storage) QueryJobs(ctx context.Context, filter *hashr.JobFilter) ([]*hashr.Job, error) {
+	var jobs []*hashr.Job
+	iter := s.spannerClient.Single().Query(ctx, queryJobsStatement(filter))
+	defer iter.Stop()
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var importedAt time.Time
+		var id, repo, repoPath, location, sha256, status, errText, signatureStatus, signatureDetails spanner.NullString
+		var preprocessingDuration, processingDuration, exportDuration, filesExtracted, filesExported spanner.NullInt64
+		var warnings []spanner.NullString
+		j := &hashr.Job{}
+		if err := row.Columns(&j.QuickSha256, &importedAt, &id, &repo, &repoPath, &location, &sha256, &status, &errText, &preprocessingDuration, &processingDuration, &exportDuration, &filesExtracted, &filesExported, &signatureStatus, &signatureDetails, &warnings); err != nil {
+			return nil, err
+		}
+		j.ImportedAt = importedAt.Unix()
+		j.ID, j.Repo, j.RepoPath, j.RemoteSourcePath = id.StringVal, repo.StringVal, repoPath.StringVal, location.StringVal
+		j.Sha256, j.Status, j.Error = sha256.StringVal, status.StringVal, errText.StringVal
+		j.PreprocessingDuration = time.Duration(preprocessingDuration.Int64) * time.Second
+		j.ProcessingDuration = time.Duration(processingDuration.Int64) * time.Second
+		j.ExportDuration = time.Duration(exportDuration.Int64) * time.Second
+		j.SampleCount, j.ExportCount = int(filesExtracted.Int64), int(filesExported.Int64)
+		j.SignatureStatus, j.SignatureDetails = signatureStatus.StringVal, signatureDetails.StringVal
+		for _, w := range warnings {
+			j.Warnings = append(j.Warnings, w.StringVal)
+		}
+		jobs = append(jobs, j)
+	}
+
+	return jobs, nil
+}
+
+// queryJobsStatement returns the statement selecting processing jobs matching a given filter.
+func queryJobsStatement(filter *hashr.JobFilter) spanner.Statement {
+	var conditions []string
+	params := make(map[string]interface{})
+	addCondition := func(condition, param string, value interface{}) {
+		params[param] = value
+		conditions = append(conditions, condition)
+	}
+
+	if filter.QuickSha256 != "" {
+		addCondition("quick_sha256 = @quick_sha256", "quick_sha256", filter.QuickSha256)
+	}
+	if filter.Repo != "" {
+		addCondition("repo = @repo", "repo", filter.Repo)
+	}
+	if filter.Status != "" {
+		addCondition("status = @status", "status", filter.Status)
+	}
+	if !filter.ImportedAfter.IsZero() {
+		addCondition("imported_at >= @imported_after", "imported_after", filter.ImportedAfter)
+	}
+	if !filter.ImportedBefore.IsZero() {
+		addCondition("imported_at < @imported_before", "imported_before", filter.ImportedBefore)
+	}
+	if filter.ErrorContains != "" {
+		addCondition("STRPOS(error, @error_contains) > 0", "error_contains", filter.ErrorContains)
+	}
+
+	sql := `SELECT quick_sha256, imported_at, id, repo, repo_path, location, sha256, status, error, preprocessing_duration, processing_duration, export_duration, files_extracted, files_exported, signature_status, signature_details, warnings FROM jobs`
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += " ORDER BY imported_at DESC, quick_sha256"
+	if filter.Limit > 0 || filter.Offset > 0 {
+		// Spanner requires LIMIT to be present when OFFSET is used.
+		limit := int64(math.MaxInt64)
+		if filter.Limit > 0 {
+			limit = int64(filter.Limit)
+		}
+		params["limit"] = limit
+		params["offset"] = int64(filter.Offset)
+		sql += " LIMIT @limit OFFSET @offset"
+	}
+
+	return spanner.Statement{SQL: sql, Params: params}
+}
+
+// MarkForReprocessing sets the status of a given processing job to reprocess and records it in
+// the job history.
+func (s *Storage) MarkForReprocessing(ctx context.Context, qHash string) error {
+	_, err := s.spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if _, err := txn.ReadRow(ctx, "jobs", spanner.Key{qHash}, []string{"quick_sha256"}); err != nil {
+			if spanner.ErrCode(err) == codes.NotFound {
+				return fmt.Errorf("job %s not found", qHash)
+			}
+			return err
+		}
+
+		e := hashr.NewJobEvent(qHash, &hashr.ProcessingSource{Status: hashr.Reprocess})
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Update("jobs", []string{"quick_sha256", "status"}, []interface{}{qHash, hashr.Reprocess}),
+			jobEventMutation(e),
+		})
+	})
+
+	return err
+}
@@ -0,0 +1,286 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudspanner
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"cloud.google.com/go/spanner/spannertest"
+	"cloud.google.com/go/spanner/spansql"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/hashr/core/hashr"
+)
+
+// testSchema holds the parts of the jobs and job_events tables supported by the in-memory
+// Spanner server.
+const testSchema = `CREATE TABLE jobs (
+	imported_at TIMESTAMP NOT NULL,
+	id STRING(500),
+	repo STRING(200),
+	repo_path STRING(500),
+	quick_sha256 STRING(100) NOT NULL,
+	location STRING(1000),
+	sha256 STRING(100),
+	status STRING(50),
+	error STRING(10000),
+	preprocessing_duration INT64,
+	processing_duration INT64,
+	export_duration INT64,
+	files_extracted INT64,
+	files_exported INT64,
+	signature_status STRING(50),
+	signature_details STRING(MAX),
+	warnings ARRAY<STRING(MAX)>,
+) PRIMARY KEY(quick_sha256);
+CREATE TABLE job_events (
+	quick_sha256 STRING(100) NOT NULL,
+	created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+	status STRING(50),
+	error STRING(10000),
+	version STRING(100),
+	host STRING(500),
+) PRIMARY KEY(quick_sha256, created_at)`
+
+// testStorage returns Storage backed by an in-memory Spanner server.
+func testStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	server, err := spannertest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatalf("could not start in-memory spanner server: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	ddl, err := spansql.ParseDDL("schema", testSchema)
+	if err != nil {
+		t.Fatalf("could not parse schema: %v", err)
+	}
+	if err := server.UpdateDDL(ddl); err != nil {
+		t.Fatalf("could not create schema: %v", err)
+	}
+
+	ctx := context.Background()
+	conn, err := grpc.Dial(server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("could not connect to in-memory spanner server: %v", err)
+	}
+	client, err := spanner.NewClient(ctx, "projects/hashr/instances/hashr/databases/hashr", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("could not create spanner client: %v", err)
+	}
+	t.Cleanup(client.Close)
+
+	s, err := NewStorage(ctx, client)
+	if err != nil {
+		t.Fatalf("could not create storage: %v", err)
+	}
+
+	return s
+}
+
+func TestUpdateJobsAndFetchJobHistory(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	qHash := "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+
+	for _, p := range []*hashr.ProcessingSource{
+		{ImportedAt: 1586286139, ID: "ubuntu-1604-lts", Repo: "GCP", Status: "discovered"},
+		{ImportedAt: 1586286139, ID: "ubuntu-1604-lts", Repo: "GCP", Status: "failed", Error: "export failed", SampleCount: 3, Warnings: []string{"/etc/motd: digest mismatch"}},
+	} {
+		if err := s.UpdateJobs(ctx, qHash, p); err != nil {
+			t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+		}
+	}
+	if err := s.UpdateJobs(ctx, "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", &hashr.ProcessingSource{ImportedAt: 1586286139, Status: "discovered"}); err != nil {
+		t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+	}
+
+	jobs, err := s.FetchJobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error while running FetchJobs(): %v", err)
+	}
+	wantJobs := map[string]string{
+		qHash: "failed",
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb": "discovered",
+	}
+	if diff := cmp.Diff(wantJobs, jobs); diff != "" {
+		t.Errorf("FetchJobs() unexpected diff (-want/+got):\n%s", diff)
+	}
+
+	events, err := s.FetchJobHistory(ctx, qHash)
+	if err != nil {
+		t.Fatalf("unexpected error while running FetchJobHistory(): %v", err)
+	}
+
+	// Events are ordered by their commit timestamps, which are set by the server.
+	want := []*hashr.JobEvent{
+		{QuickSha256: qHash, Status: "discovered", Version: hashr.Version},
+		{QuickSha256: qHash, Status: "failed", Error: "export failed", Version: hashr.Version},
+	}
+	if diff := cmp.Diff(want, events, cmpopts.IgnoreFields(hashr.JobEvent{}, "Timestamp", "Host")); diff != "" {
+		t.Errorf("FetchJobHistory() unexpected diff (-want/+got):\n%s", diff)
+	}
+	for _, e := range events {
+		if e.Timestamp.IsZero() || time.Since(e.Timestamp) > time.Hour {
+			t.Errorf("FetchJobHistory() returned event with unexpected timestamp %v", e.Timestamp)
+		}
+	}
+}
+
+func TestQueryJobsStatement(t *testing.T) {
+	const columns = `SELECT quick_sha256, imported_at, id, repo, repo_path, location, sha256, status, error, preprocessing_duration, processing_duration, export_duration, files_extracted, files_exported, signature_status, signature_details, warnings FROM jobs`
+	after := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name   string
+		filter *hashr.JobFilter
+		want   spanner.Statement
+	}{
+		{
+			name:   "no filter",
+			filter: &hashr.JobFilter{},
+			want:   spanner.Statement{SQL: columns + " ORDER BY imported_at DESC, quick_sha256", Params: map[string]interface{}{}},
+		},
+		{
+			name:   "all conditions",
+			filter: &hashr.JobFilter{QuickSha256: "07123e1f", Repo: "GCP", Status: "failed", ImportedAfter: after, ImportedBefore: before, ErrorContains: "timeout"},
+			want: spanner.Statement{
+				SQL: columns + " WHERE quick_sha256 = @quick_sha256 AND repo = @repo AND status = @status AND imported_at >= @imported_after AND imported_at < @imported_before AND STRPOS(error, @error_contains) > 0 ORDER BY imported_at DESC, quick_sha256",
+				Params: map[string]interface{}{
+					"quick_sha256":    "07123e1f",
+					"repo":            "GCP",
+					"status":          "failed",
+					"imported_after":  after,
+					"imported_before": before,
+					"error_contains":  "timeout",
+				},
+			},
+		},
+		{
+			name:   "limit",
+			filter: &hashr.JobFilter{Status: "failed", Limit: 10},
+			want: spanner.Statement{
+				SQL:    columns + " WHERE status = @status ORDER BY imported_at DESC, quick_sha256 LIMIT @limit OFFSET @offset",
+				Params: map[string]interface{}{"status": "failed", "limit": int64(10), "offset": int64(0)},
+			},
+		},
+		{
+			name:   "offset without limit",
+			filter: &hashr.JobFilter{Offset: 20},
+			want: spanner.Statement{
+				SQL:    columns + " ORDER BY imported_at DESC, quick_sha256 LIMIT @limit OFFSET @offset",
+				Params: map[string]interface{}{"limit": int64(math.MaxInt64), "offset": int64(20)},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, queryJobsStatement(tc.filter)); diff != "" {
+				t.Errorf("queryJobsStatement() unexpected diff (-want/+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestQueryJobs(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+
+	for qHash, p := range map[string]*hashr.ProcessingSource{
+		"07123e1f": {ImportedAt: 1641000000, ID: "ubuntu-1604-lts", Repo: "GCP", Status: "failed", Error: "export failed", SampleCount: 3, Warnings: []string{"/etc/motd: digest mismatch"}},
+		"5c7a0f6e": {ImportedAt: 1642000000, ID: "ubuntu-1804-lts", Repo: "GCP", Status: "exported"},
+		"9ad2027c": {ImportedAt: 1643000000, ID: "windows-2019", Repo: "windows", Status: "exported"},
+	} {
+		if err := s.UpdateJobs(ctx, qHash, p); err != nil {
+			t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter *hashr.JobFilter
+		want   []string
+	}{
+		{name: "all", filter: &hashr.JobFilter{}, want: []string{"9ad2027c", "5c7a0f6e", "07123e1f"}},
+		{name: "repo and status", filter: &hashr.JobFilter{Repo: "GCP", Status: "exported"}, want: []string{"5c7a0f6e"}},
+		{name: "imported", filter: &hashr.JobFilter{ImportedAfter: time.Unix(1641500000, 0), ImportedBefore: time.Unix(1642500000, 0)}, want: []string{"5c7a0f6e"}},
+		{name: "page", filter: &hashr.JobFilter{Limit: 1, Offset: 1}, want: []string{"5c7a0f6e"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			jobs, err := s.QueryJobs(ctx, tc.filter)
+			if err != nil {
+				t.Fatalf("unexpected error while running QueryJobs(): %v", err)
+			}
+			var got []string
+			for _, j := range jobs {
+				got = append(got, j.QuickSha256)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("QueryJobs() unexpected diff (-want/+got):\n%s", diff)
+			}
+		})
+	}
+
+	jobs, err := s.QueryJobs(ctx, &hashr.JobFilter{QuickSha256: "07123e1f"})
+	if err != nil {
+		t.Fatalf("unexpected error while running QueryJobs(): %v", err)
+	}
+	want := []*hashr.Job{{QuickSha256: "07123e1f", ImportedAt: 1641000000, ID: "ubuntu-1604-lts", Repo: "GCP", Status: "failed", Error: "export failed", SampleCount: 3, Warnings: []string{"/etc/motd: digest mismatch"}}}
+	if diff := cmp.Diff(want, jobs); diff != "" {
+		t.Errorf("QueryJobs() unexpected diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestMarkForReprocessing(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+
+	if err := s.UpdateJobs(ctx, "07123e1f", &hashr.ProcessingSource{ImportedAt: 1641000000, Status: "failed"}); err != nil {
+		t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+	}
+	if err := s.MarkForReprocessing(ctx, "07123e1f"); err != nil {
+		t.Fatalf("unexpected error while running MarkForReprocessing(): %v", err)
+	}
+
+	jobs, err := s.FetchJobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error while running FetchJobs(): %v", err)
+	}
+	if got := jobs["07123e1f"]; got != hashr.Reprocess {
+		t.Errorf("MarkForReprocessing() set status %q, want %q", got, hashr.Reprocess)
+	}
+
+	events, err := s.FetchJobHistory(ctx, "07123e1f")
+	if err != nil {
+		t.Fatalf("unexpected error while running FetchJobHistory(): %v", err)
+	}
+	if len(events) != 2 || events[1].Status != hashr.Reprocess {
+		t.Errorf("MarkForReprocessing() did not record a %s event: %+v", hashr.Reprocess, events)
+	}
+
+	if err := s.MarkForReprocessing(ctx, "5c7a0f6e"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("MarkForReprocessing() of unknown job error = %v, want not found", err)
+	}
+}
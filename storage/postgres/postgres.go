@@ -19,11 +19,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/google/hashr/core/hashr"
+	"github.com/google/hashr/migrations"
 
-	// Blank import below is needed for the SQL driver.
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // Storage allows to interact with PostgreSQL instance.
@@ -31,35 +33,10 @@ type Storage struct {
 	sqlDB *sql.DB
 }
 
-// NewStorage creates new Storage struct that allows to interact with PostgreSQL instance and all the necessary tables, if they don't exist.
+// NewStorage creates new Storage struct that allows to interact with PostgreSQL instance and migrates the database schema to the latest version.
 func NewStorage(sqlDB *sql.DB) (*Storage, error) {
-	// Check if the "jobs" table exists.
-	exists, err := tableExists(sqlDB, "jobs")
-	if err != nil {
-		return nil, fmt.Errorf("error while checking if jobs table exists: %v", err)
-	}
-
-	if !exists {
-		sql := `CREATE TABLE jobs (
-		quick_sha256 VARCHAR(100) PRIMARY KEY,
-		imported_at INT NOT NULL,
-		id text,
-		repo text,
-		repo_path text,
-		location text,
-		sha256 VARCHAR(100),
-		status VARCHAR(50),
-		error text,
-		preprocessing_duration INT,
-		processing_duration INT,
-		export_duration INT,
-		files_extracted INT,
-		files_exported INT
-	  )`
-		_, err = sqlDB.Exec(sql)
-		if err != nil {
-			return nil, fmt.Errorf("error while creating jobs table: %v", err)
-		}
+	if _, err := migrations.MigratePostgres(context.Background(), sqlDB); err != nil {
+		return nil, fmt.Errorf("error while migrating database schema: %v", err)
 	}
 
 	return &Storage{sqlDB: sqlDB}, nil
@@ -79,29 +56,74 @@ func (s *Storage) rowExists(qHash string) (bool, error) {
 	}
 }
 
-// UpdateJobs updates cloud spanner table.
+// UpdateJobs updates jobs table and appends the job event to job_events table.
 func (s *Storage) UpdateJobs(ctx context.Context, qHash string, p *hashr.ProcessingSource) error {
 	exists, err := s.rowExists(qHash)
 	if err != nil {
 		return err
 	}
 
+	tx, err := s.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	var sql string
 	if exists {
 		sql = `
-UPDATE jobs SET imported_at = $2, id = $3, repo = $4, repo_path = $5, location = $6, sha256 = $7, status = $8, error = $9, preprocessing_duration = $10, processing_duration = $11, export_duration = $12, files_extracted = $13, files_exported = $14
+UPDATE jobs SET imported_at = $2, id = $3, repo = $4, repo_path = $5, location = $6, sha256 = $7, status = $8, error = $9, preprocessing_duration = $10, processing_duration = $11, export_duration = $12, files_extracted = $13, files_exported = $14, signature_status = $15, signature_details = $16, warnings = $17
 WHERE quick_sha256 = $1`
 	} else {
 		sql = `
-INSERT INTO jobs (quick_sha256,  imported_at, id, repo, repo_path, location, sha256, status, error, preprocessing_duration, processing_duration, export_duration, files_extracted, files_exported)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+INSERT INTO jobs (quick_sha256,  imported_at, id, repo, repo_path, location, sha256, status, error, preprocessing_duration, processing_duration, export_duration, files_extracted, files_exported, signature_status, signature_details, warnings)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`
 	}
 
-	_, err = s.sqlDB.Exec(sql, qHash, p.ImportedAt, p.ID, p.Repo, p.RepoPath, p.RemoteSourcePath, p.Sha256, p.Status, p.Error, int(p.PreprocessingDuration.Seconds()), int(p.ProcessingDuration.Seconds()), int(p.ExportDuration.Seconds()), p.SampleCount, p.ExportCount)
+	_, err = tx.ExecContext(ctx, sql, qHash, p.ImportedAt, p.ID, p.Repo, p.RepoPath, p.RemoteSourcePath, p.Sha256, p.Status, p.Error, int(p.PreprocessingDuration.Seconds()), int(p.ProcessingDuration.Seconds()), int(p.ExportDuration.Seconds()), p.SampleCount, p.ExportCount, p.SignatureStatus, p.SignatureDetails, pq.Array(p.Warnings))
 	if err != nil {
 		return err
 	}
-	return nil
+
+	if err := insertJobEvent(ctx, tx, hashr.NewJobEvent(qHash, p)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertJobEvent(ctx context.Context, tx *sql.Tx, e *hashr.JobEvent) error {
+	_, err := tx.ExecContext(ctx, `
+INSERT INTO job_events (quick_sha256, created_at, status, error, version, host)
+VALUES ($1, $2, $3, $4, $5, $6)`, e.QuickSha256, e.Timestamp, e.Status, e.Error, e.Version, e.Host)
+	return err
+}
+
+// FetchJobHistory fetches events of a given processing job from PostgreSQL.
+func (s *Storage) FetchJobHistory(ctx context.Context, qHash string) ([]*hashr.JobEvent, error) {
+	var events []*hashr.JobEvent
+
+	rows, err := s.sqlDB.QueryContext(ctx, `
+SELECT quick_sha256, created_at, status, error, version, host FROM job_events
+WHERE quick_sha256 = $1 ORDER BY created_at, id`, qHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &hashr.JobEvent{}
+		var status, errText, version, host sql.NullString
+		if err := rows.Scan(&e.QuickSha256, &e.Timestamp, &status, &errText, &version, &host); err != nil {
+			return nil, err
+		}
+		e.Status, e.Error, e.Version, e.Host = status.String, errText.String, version.String, host.String
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
 }
 
 // FetchJobs fetches processing jobs from cloud spanner.
@@ -129,21 +151,105 @@ func (s *Storage) FetchJobs(ctx context.Context) (map[string]string, error) {
 	return processed, nil
 }
 
-func tableExists(db *sql.DB, tableName string) (bool, error) {
-	// Query to check if the table exists in PostgreSQL
-	query := `
-        SELECT EXISTS (
-            SELECT 1
-            FROM   information_schema.tables
-            WHERE  table_name = $1
-        )
-    `
-
-	var exists bool
-	err := db.QueryRow(query, tableName).Scan(&exists)
+// QueryJobs fetches processing jobs matching a given filter from PostgreSQL.
+func (s *Storage) QueryJobs(ctx context.Context, filter *hashr.JobFilter) ([]*hashr.Job, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.QuickSha256 != "" {
+		addCondition("quick_sha256 = $%d", filter.QuickSha256)
+	}
+	if filter.Repo != "" {
+		addCondition("repo = $%d", filter.Repo)
+	}
+	if filter.Status != "" {
+		addCondition("status = $%d", filter.Status)
+	}
+	if !filter.ImportedAfter.IsZero() {
+		addCondition("imported_at >= $%d", filter.ImportedAfter.Unix())
+	}
+	if !filter.ImportedBefore.IsZero() {
+		addCondition("imported_at < $%d", filter.ImportedBefore.Unix())
+	}
+	if filter.ErrorContains != "" {
+		addCondition("strpos(error, $%d) > 0", filter.ErrorContains)
+	}
+
+	query := `SELECT quick_sha256, imported_at, id, repo, repo_path, location, sha256, status, error, preprocessing_duration, processing_duration, export_duration, files_extracted, files_exported, signature_status, signature_details, warnings FROM jobs`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY imported_at DESC, quick_sha256"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if filter.Offset > 0 {
+		args = append(args, filter.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	rows, err := s.sqlDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*hashr.Job
+	for rows.Next() {
+		var id, repo, repoPath, location, sha256, status, errText, signatureStatus, signatureDetails sql.NullString
+		var preprocessingDuration, processingDuration, exportDuration, filesExtracted, filesExported sql.NullInt64
+		var warnings []string
+		j := &hashr.Job{}
+		if err := rows.Scan(&j.QuickSha256, &j.ImportedAt, &id, &repo, &repoPath, &location, &sha256, &status, &errText, &preprocessingDuration, &processingDuration, &exportDuration, &filesExtracted, &filesExported, &signatureStatus, &signatureDetails, pq.Array(&warnings)); err != nil {
+			return nil, err
+		}
+		j.ID, j.Repo, j.RepoPath, j.RemoteSourcePath = id.String, repo.String, repoPath.String, location.String
+		j.Sha256, j.Status, j.Error = sha256.String, status.String, errText.String
+		j.PreprocessingDuration = time.Duration(preprocessingDuration.Int64) * time.Second
+		j.ProcessingDuration = time.Duration(processingDuration.Int64) * time.Second
+		j.ExportDuration = time.Duration(exportDuration.Int64) * time.Second
+		j.SampleCount, j.ExportCount = int(filesExtracted.Int64), int(filesExported.Int64)
+		j.SignatureStatus, j.SignatureDetails = signatureStatus.String, signatureDetails.String
+		j.Warnings = warnings
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// MarkForReprocessing sets the status of a given processing job to reprocess and records it in
+// the job history.
+func (s *Storage) MarkForReprocessing(ctx context.Context, qHash string) error {
+	tx, err := s.sqlDB.BeginTx(ctx, nil)
 	if err != nil {
-		return false, err
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE jobs SET status = $1 WHERE quick_sha256 = $2`, hashr.Reprocess, qHash)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("job %s not found", qHash)
+	}
+
+	if err := insertJobEvent(ctx, tx, hashr.NewJobEvent(qHash, &hashr.ProcessingSource{Status: hashr.Reprocess})); err != nil {
+		return err
 	}
 
-	return exists, nil
+	return tx.Commit()
 }
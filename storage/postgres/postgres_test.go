@@ -0,0 +1,240 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/hashr/core/hashr"
+)
+
+func testStorage(t *testing.T) (*Storage, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("could not open a stub database connection: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &Storage{sqlDB: db}, mock
+}
+
+const (
+	insertJobSQL = `
+INSERT INTO jobs (quick_sha256,  imported_at, id, repo, repo_path, location, sha256, status, error, preprocessing_duration, processing_duration, export_duration, files_extracted, files_exported, signature_status, signature_details, warnings)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`
+	updateJobSQL = `
+UPDATE jobs SET imported_at = $2, id = $3, repo = $4, repo_path = $5, location = $6, sha256 = $7, status = $8, error = $9, preprocessing_duration = $10, processing_duration = $11, export_duration = $12, files_extracted = $13, files_exported = $14, signature_status = $15, signature_details = $16, warnings = $17
+WHERE quick_sha256 = $1`
+	insertJobEventSQL = `
+INSERT INTO job_events (quick_sha256, created_at, status, error, version, host)
+VALUES ($1, $2, $3, $4, $5, $6)`
+)
+
+func TestUpdateJobs(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		exists bool
+		sql    string
+	}{
+		{name: "insert", exists: false, sql: insertJobSQL},
+		{name: "update", exists: true, sql: updateJobSQL},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, mock := testStorage(t)
+			qHash := "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+			p := &hashr.ProcessingSource{
+				ImportedAt:         1586286139,
+				ID:                 "ubuntu-1604-lts",
+				Repo:               "GCP",
+				Status:             "failed",
+				Error:              "export failed",
+				ProcessingDuration: 2 * time.Second,
+				SampleCount:        3,
+				Warnings:           []string{"/etc/motd: digest mismatch"},
+			}
+
+			rows := mock.NewRows([]string{"quick_sha256"})
+			if tc.exists {
+				rows.AddRow(qHash)
+			}
+			mock.ExpectQuery(`SELECT quick_sha256 FROM jobs WHERE quick_sha256=$1;`).WithArgs(qHash).WillReturnRows(rows)
+			mock.ExpectBegin()
+			mock.ExpectExec(tc.sql).WithArgs(qHash, p.ImportedAt, p.ID, p.Repo, "", "", "", "failed", p.Error, 0, 2, 0, 3, 0, "", "", `{"/etc/motd: digest mismatch"}`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(insertJobEventSQL).WithArgs(qHash, sqlmock.AnyArg(), "failed", p.Error, hashr.Version, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			if err := s.UpdateJobs(context.Background(), qHash, p); err != nil {
+				t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("UpdateJobs() unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateJobsEventFailure(t *testing.T) {
+	s, mock := testStorage(t)
+	qHash := "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+
+	mock.ExpectQuery(`SELECT quick_sha256 FROM jobs WHERE quick_sha256=$1;`).WithArgs(qHash).WillReturnRows(mock.NewRows([]string{"quick_sha256"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(insertJobSQL).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertJobEventSQL).WillReturnError(context.DeadlineExceeded)
+	mock.ExpectRollback()
+
+	if err := s.UpdateJobs(context.Background(), qHash, &hashr.ProcessingSource{Status: "discovered"}); err == nil {
+		t.Error("UpdateJobs() did not return an error when the job event could not be stored")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("UpdateJobs() unfulfilled expectations: %v", err)
+	}
+}
+
+func TestFetchJobHistory(t *testing.T) {
+	s, mock := testStorage(t)
+	qHash := "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+	created := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mock.ExpectQuery(`
+SELECT quick_sha256, created_at, status, error, version, host FROM job_events
+WHERE quick_sha256 = $1 ORDER BY created_at, id`).WithArgs(qHash).WillReturnRows(
+		mock.NewRows([]string{"quick_sha256", "created_at", "status", "error", "version", "host"}).
+			AddRow(qHash, created, "discovered", nil, "1.0", "worker-1").
+			AddRow(qHash, created.Add(time.Minute), "failed", "export failed", "1.0", nil))
+
+	got, err := s.FetchJobHistory(context.Background(), qHash)
+	if err != nil {
+		t.Fatalf("unexpected error while running FetchJobHistory(): %v", err)
+	}
+
+	want := []*hashr.JobEvent{
+		{QuickSha256: qHash, Timestamp: created, Status: "discovered", Version: "1.0", Host: "worker-1"},
+		{QuickSha256: qHash, Timestamp: created.Add(time.Minute), Status: "failed", Error: "export failed", Version: "1.0"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("FetchJobHistory() unexpected diff (-want/+got):\n%s", diff)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("FetchJobHistory() unfulfilled expectations: %v", err)
+	}
+}
+
+func TestQueryJobs(t *testing.T) {
+	const query = `SELECT quick_sha256, imported_at, id, repo, repo_path, location, sha256, status, error, preprocessing_duration, processing_duration, export_duration, files_extracted, files_exported, signature_status, signature_details, warnings FROM jobs`
+	columns := []string{"quick_sha256", "imported_at", "id", "repo", "repo_path", "location", "sha256", "status", "error", "preprocessing_duration", "processing_duration", "export_duration", "files_extracted", "files_exported", "signature_status", "signature_details", "warnings"}
+	after := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name   string
+		filter *hashr.JobFilter
+		sql    string
+		args   []driver.Value
+	}{
+		{
+			name:   "no filter",
+			filter: &hashr.JobFilter{},
+			sql:    query + " ORDER BY imported_at DESC, quick_sha256",
+		},
+		{
+			name:   "all conditions",
+			filter: &hashr.JobFilter{QuickSha256: "07123e1f", Repo: "GCP", Status: "failed", ImportedAfter: after, ImportedBefore: before, ErrorContains: "timeout"},
+			sql:    query + " WHERE quick_sha256 = $1 AND repo = $2 AND status = $3 AND imported_at >= $4 AND imported_at < $5 AND strpos(error, $6) > 0 ORDER BY imported_at DESC, quick_sha256",
+			args:   []driver.Value{"07123e1f", "GCP", "failed", after.Unix(), before.Unix(), "timeout"},
+		},
+		{
+			name:   "limit and offset",
+			filter: &hashr.JobFilter{Status: "failed", Limit: 10, Offset: 20},
+			sql:    query + " WHERE status = $1 ORDER BY imported_at DESC, quick_sha256 LIMIT $2 OFFSET $3",
+			args:   []driver.Value{"failed", 10, 20},
+		},
+		{
+			name:   "offset",
+			filter: &hashr.JobFilter{Offset: 20},
+			sql:    query + " ORDER BY imported_at DESC, quick_sha256 OFFSET $1",
+			args:   []driver.Value{20},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, mock := testStorage(t)
+			mock.ExpectQuery(tc.sql).WithArgs(tc.args...).WillReturnRows(
+				mock.NewRows(columns).AddRow("07123e1f", 1641000000, "ubuntu-1604-lts", "GCP", nil, nil, nil, "failed", "timeout", 1, 2, 3, 4, 0, nil, nil, `{"/etc/motd: digest mismatch"}`))
+
+			got, err := s.QueryJobs(context.Background(), tc.filter)
+			if err != nil {
+				t.Fatalf("unexpected error while running QueryJobs(): %v", err)
+			}
+
+			want := []*hashr.Job{{
+				QuickSha256:           "07123e1f",
+				ImportedAt:            1641000000,
+				ID:                    "ubuntu-1604-lts",
+				Repo:                  "GCP",
+				Status:                "failed",
+				Error:                 "timeout",
+				PreprocessingDuration: time.Second,
+				ProcessingDuration:    2 * time.Second,
+				ExportDuration:        3 * time.Second,
+				SampleCount:           4,
+				Warnings:              []string{"/etc/motd: digest mismatch"},
+			}}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("QueryJobs() unexpected diff (-want/+got):\n%s", diff)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("QueryJobs() unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestMarkForReprocessing(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		updated int64
+		wantErr bool
+	}{
+		{name: "existing job", updated: 1},
+		{name: "unknown job", updated: 0, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, mock := testStorage(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(`UPDATE jobs SET status = $1 WHERE quick_sha256 = $2`).WithArgs(hashr.Reprocess, "07123e1f").WillReturnResult(sqlmock.NewResult(0, tc.updated))
+			if tc.wantErr {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectExec(insertJobEventSQL).WithArgs("07123e1f", sqlmock.AnyArg(), hashr.Reprocess, "", hashr.Version, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			}
+
+			err := s.MarkForReprocessing(context.Background(), "07123e1f")
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("MarkForReprocessing() error = %v, want error %v", err, tc.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("MarkForReprocessing() unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite implements SQLite as a hashR storage.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/hashr/core/hashr"
+
+	// Blank import below is needed for the SQL driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Storage allows to interact with SQLite database.
+type Storage struct {
+	sqlDB *sql.DB
+}
+
+// NewStorage creates new Storage struct that allows to interact with SQLite database and all the necessary tables, if they don't exist.
+func NewStorage(sqlDB *sql.DB) (*Storage, error) {
+	// SQLite allows only a single writer, processing workers will wait for each other instead of
+	// failing with "database is locked" errors.
+	sqlDB.SetMaxOpenConns(1)
+
+	sql := `CREATE TABLE IF NOT EXISTS jobs (
+		quick_sha256 VARCHAR(100) PRIMARY KEY,
+		imported_at INT NOT NULL,
+		id TEXT,
+		repo TEXT,
+		repo_path TEXT,
+		location TEXT,
+		sha256 VARCHAR(100),
+		status VARCHAR(50),
+		error TEXT,
+		preprocessing_duration INT,
+		processing_duration INT,
+		export_duration INT,
+		files_extracted INT,
+		files_exported INT,
+		signature_status VARCHAR(50),
+		signature_details TEXT,
+		warnings TEXT
+	)`
+	if _, err := sqlDB.Exec(sql); err != nil {
+		return nil, fmt.Errorf("error while creating jobs table: %v", err)
+	}
+
+	sql = `CREATE TABLE IF NOT EXISTS job_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		quick_sha256 VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		status VARCHAR(50),
+		error TEXT,
+		version TEXT,
+		host TEXT
+	);
+	CREATE INDEX IF NOT EXISTS job_events_quick_sha256_idx ON job_events (quick_sha256)`
+	if _, err := sqlDB.Exec(sql); err != nil {
+		return nil, fmt.Errorf("error while creating job_events table: %v", err)
+	}
+
+	return &Storage{sqlDB: sqlDB}, nil
+}
+
+// UpdateJobs updates jobs table and appends the job event to job_events table.
+func (s *Storage) UpdateJobs(ctx context.Context, qHash string, p *hashr.ProcessingSource) error {
+	tx, err := s.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Warnings are stored as a JSON array, SQLite doesn't have an array type.
+	var warnings sql.NullString
+	if len(p.Warnings) > 0 {
+		warningsJSON, err := json.Marshal(p.Warnings)
+		if err != nil {
+			return err
+		}
+		warnings = sql.NullString{String: string(warningsJSON), Valid: true}
+	}
+
+	sql := `
+INSERT INTO jobs (quick_sha256, imported_at, id, repo, repo_path, location, sha256, status, error, preprocessing_duration, processing_duration, export_duration, files_extracted, files_exported, signature_status, signature_details, warnings)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+ON CONFLICT (quick_sha256) DO UPDATE SET imported_at = excluded.imported_at, id = excluded.id, repo = excluded.repo, repo_path = excluded.repo_path, location = excluded.location, sha256 = excluded.sha256, status = excluded.status, error = excluded.error, preprocessing_duration = excluded.preprocessing_duration, processing_duration = excluded.processing_duration, export_duration = excluded.export_duration, files_extracted = excluded.files_extracted, files_exported = excluded.files_exported, signature_status = excluded.signature_status, signature_details = excluded.signature_details, warnings = excluded.warnings`
+
+	_, err = tx.ExecContext(ctx, sql, qHash, p.ImportedAt, p.ID, p.Repo, p.RepoPath, p.RemoteSourcePath, p.Sha256, p.Status, p.Error, int(p.PreprocessingDuration.Seconds()), int(p.ProcessingDuration.Seconds()), int(p.ExportDuration.Seconds()), p.SampleCount, p.ExportCount, p.SignatureStatus, p.SignatureDetails, warnings)
+	if err != nil {
+		return err
+	}
+
+	if err := insertJobEvent(ctx, tx, hashr.NewJobEvent(qHash, p)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertJobEvent(ctx context.Context, tx *sql.Tx, e *hashr.JobEvent) error {
+	_, err := tx.ExecContext(ctx, `
+INSERT INTO job_events (quick_sha256, created_at, status, error, version, host)
+VALUES ($1, $2, $3, $4, $5, $6)`, e.QuickSha256, e.Timestamp, e.Status, e.Error, e.Version, e.Host)
+	return err
+}
+
+// FetchJobHistory fetches events of a given processing job from SQLite.
+func (s *Storage) FetchJobHistory(ctx context.Context, qHash string) ([]*hashr.JobEvent, error) {
+	var events []*hashr.JobEvent
+
+	rows, err := s.sqlDB.QueryContext(ctx, `
+SELECT quick_sha256, created_at, status, error, version, host FROM job_events
+WHERE quick_sha256 = $1 ORDER BY created_at, id`, qHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &hashr.JobEvent{}
+		if err := rows.Scan(&e.QuickSha256, &e.Timestamp, &e.Status, &e.Error, &e.Version, &e.Host); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// FetchJobs fetches processing jobs from SQLite.
+func (s *Storage) FetchJobs(ctx context.Context) (map[string]string, error) {
+	processed := make(map[string]string)
+
+	rows, err := s.sqlDB.QueryContext(ctx, "SELECT quick_sha256, status FROM jobs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var quickSha256, status string
+		err = rows.Scan(&quickSha256, &status)
+		if err != nil {
+			return nil, err
+		}
+		processed[quickSha256] = status
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return processed, nil
+}
+
+// QueryJobs fetches processing jobs matching a given filter from SQLite.
+func (s *Storage) QueryJobs(ctx context.Context, filter *hashr.JobFilter) ([]*hashr.Job, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.QuickSha256 != "" {
+		addCondition("quick_sha256 = $%d", filter.QuickSha256)
+	}
+	if filter.Repo != "" {
+		addCondition("repo = $%d", filter.Repo)
+	}
+	if filter.Status != "" {
+		addCondition("status = $%d", filter.Status)
+	}
+	if !filter.ImportedAfter.IsZero() {
+		addCondition("imported_at >= $%d", filter.ImportedAfter.Unix())
+	}
+	if !filter.ImportedBefore.IsZero() {
+		addCondition("imported_at < $%d", filter.ImportedBefore.Unix())
+	}
+	if filter.ErrorContains != "" {
+		addCondition("instr(error, $%d) > 0", filter.ErrorContains)
+	}
+
+	query := `SELECT quick_sha256, imported_at, id, repo, repo_path, location, sha256, status, error, preprocessing_duration, processing_duration, export_duration, files_extracted, files_exported, signature_status, signature_details, warnings FROM jobs`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY imported_at DESC, quick_sha256"
+	// SQLite does not support OFFSET without LIMIT, negative LIMIT means no limit.
+	if filter.Limit > 0 || filter.Offset > 0 {
+		limit := -1
+		if filter.Limit > 0 {
+			limit = filter.Limit
+		}
+		args = append(args, limit, filter.Offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+
+	rows, err := s.sqlDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*hashr.Job
+	for rows.Next() {
+		var id, repo, repoPath, location, sha256, status, errText, signatureStatus, signatureDetails, warnings sql.NullString
+		var preprocessingDuration, processingDuration, exportDuration, filesExtracted, filesExported sql.NullInt64
+		j := &hashr.Job{}
+		if err := rows.Scan(&j.QuickSha256, &j.ImportedAt, &id, &repo, &repoPath, &location, &sha256, &status, &errText, &preprocessingDuration, &processingDuration, &exportDuration, &filesExtracted, &filesExported, &signatureStatus, &signatureDetails, &warnings); err != nil {
+			return nil, err
+		}
+		j.ID, j.Repo, j.RepoPath, j.RemoteSourcePath = id.String, repo.String, repoPath.String, location.String
+		j.Sha256, j.Status, j.Error = sha256.String, status.String, errText.String
+		j.PreprocessingDuration = time.Duration(preprocessingDuration.Int64) * time.Second
+		j.ProcessingDuration = time.Duration(processingDuration.Int64) * time.Second
+		j.ExportDuration = time.Duration(exportDuration.Int64) * time.Second
+		j.SampleCount, j.ExportCount = int(filesExtracted.Int64), int(filesExported.Int64)
+		j.SignatureStatus, j.SignatureDetails = signatureStatus.String, signatureDetails.String
+		if warnings.Valid {
+			if err := json.Unmarshal([]byte(warnings.String), &j.Warnings); err != nil {
+				return nil, fmt.Errorf("could not parse warnings of %s: %v", j.QuickSha256, err)
+			}
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// MarkForReprocessing sets the status of a given processing job to reprocess and records it in
+// the job history.
+func (s *Storage) MarkForReprocessing(ctx context.Context, qHash string) error {
+	tx, err := s.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE jobs SET status = $1 WHERE quick_sha256 = $2`, hashr.Reprocess, qHash)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("job %s not found", qHash)
+	}
+
+	if err := insertJobEvent(ctx, tx, hashr.NewJobEvent(qHash, &hashr.ProcessingSource{Status: hashr.Reprocess})); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
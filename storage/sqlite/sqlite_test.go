@@ -0,0 +1,305 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/hashr/core/hashr"
+)
+
+func testStorage(t *testing.T) (*Storage, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "hashr.db"))
+	if err != nil {
+		t.Fatalf("could not open SQLite database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s, err := NewStorage(db)
+	if err != nil {
+		t.Fatalf("could not create SQLite storage: %v", err)
+	}
+
+	return s, db
+}
+
+func TestNewStorage(t *testing.T) {
+	_, db := testStorage(t)
+
+	// Creating the storage a second time should not fail on the existing schema.
+	if _, err := NewStorage(db); err != nil {
+		t.Fatalf("unexpected error while re-creating SQLite storage: %v", err)
+	}
+}
+
+func TestUpdateJobs(t *testing.T) {
+	ctx := context.Background()
+	s, db := testStorage(t)
+
+	p := &hashr.ProcessingSource{
+		ID:               "ubuntu-1604-lts",
+		Repo:             "GCP",
+		RepoPath:         "ubuntu-os-cloud",
+		RemoteSourcePath: "gs://hashr/ubuntu-1604-lts.tar.gz",
+		ImportedAt:       1586286139,
+		Status:           "discovered",
+	}
+
+	if err := s.UpdateJobs(ctx, "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", p); err != nil {
+		t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+	}
+
+	p.Status = "exported"
+	p.Sha256 = "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3"
+	p.ExportDuration = 90 * time.Second
+	p.SampleCount = 10
+	p.ExportCount = 3
+	if err := s.UpdateJobs(ctx, "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc", p); err != nil {
+		t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+	}
+
+	var sha256, status string
+	var exportDuration, filesExtracted, filesExported int
+	row := db.QueryRow("SELECT sha256, status, export_duration, files_extracted, files_exported FROM jobs WHERE quick_sha256 = $1", "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc")
+	if err := row.Scan(&sha256, &status, &exportDuration, &filesExtracted, &filesExported); err != nil {
+		t.Fatalf("could not read job: %v", err)
+	}
+
+	if status != "exported" || sha256 != p.Sha256 || exportDuration != 90 || filesExtracted != 10 || filesExported != 3 {
+		t.Errorf("UpdateJobs() stored unexpected job: sha256=%s status=%s export_duration=%d files_extracted=%d files_exported=%d", sha256, status, exportDuration, filesExtracted, filesExported)
+	}
+}
+
+func TestFetchJobs(t *testing.T) {
+	ctx := context.Background()
+	s, _ := testStorage(t)
+
+	jobs := map[string]*hashr.ProcessingSource{
+		"07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc": {ImportedAt: time.Now().Unix(), Status: "exported"},
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb": {ImportedAt: time.Now().Unix(), Status: "failed"},
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7": {ImportedAt: time.Now().Unix(), Status: "reprocess"},
+	}
+
+	want := make(map[string]string)
+	for qHash, p := range jobs {
+		if err := s.UpdateJobs(ctx, qHash, p); err != nil {
+			t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+		}
+		want[qHash] = string(p.Status)
+	}
+
+	got, err := s.FetchJobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error while running FetchJobs(): %v", err)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("FetchJobs() unexpected diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestFetchJobHistory(t *testing.T) {
+	ctx := context.Background()
+	s, _ := testStorage(t)
+
+	qHash := "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+	for _, p := range []*hashr.ProcessingSource{
+		{Status: "discovered"},
+		{Status: "failed", Error: "error while preprocessing"},
+		{Status: "discovered"},
+		{Status: "processed"},
+		{Status: "exported"},
+	} {
+		if err := s.UpdateJobs(ctx, qHash, p); err != nil {
+			t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+		}
+	}
+
+	// Events of other jobs should not be returned.
+	if err := s.UpdateJobs(ctx, "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb", &hashr.ProcessingSource{Status: "discovered"}); err != nil {
+		t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+	}
+
+	events, err := s.FetchJobHistory(ctx, qHash)
+	if err != nil {
+		t.Fatalf("unexpected error while running FetchJobHistory(): %v", err)
+	}
+
+	var gotStatuses, gotErrors []string
+	for _, e := range events {
+		gotStatuses = append(gotStatuses, e.Status)
+		gotErrors = append(gotErrors, e.Error)
+		if e.QuickSha256 != qHash || e.Version != hashr.Version || e.Timestamp.IsZero() {
+			t.Errorf("FetchJobHistory() returned unexpected event: %+v", e)
+		}
+	}
+
+	wantStatuses := []string{"discovered", "failed", "discovered", "processed", "exported"}
+	if diff := cmp.Diff(wantStatuses, gotStatuses); diff != "" {
+		t.Errorf("FetchJobHistory() unexpected status diff (-want/+got):\n%s", diff)
+	}
+
+	wantErrors := []string{"", "error while preprocessing", "", "", ""}
+	if diff := cmp.Diff(wantErrors, gotErrors); diff != "" {
+		t.Errorf("FetchJobHistory() unexpected error diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestQueryJobs(t *testing.T) {
+	ctx := context.Background()
+	s, _ := testStorage(t)
+
+	for qHash, p := range map[string]*hashr.ProcessingSource{
+		"07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc": {ID: "ubuntu-1604-lts", Repo: "GCP", ImportedAt: 1586286139, Status: "exported", SampleCount: 10, ExportCount: 10},
+		"5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb": {ID: "ubuntu-1804-lts", Repo: "GCP", ImportedAt: 1586286140, Status: "failed", Error: "error while preprocessing: no space left on device"},
+		"9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7": {ID: "archive.tar.gz", Repo: "targz", ImportedAt: 1586286141, Status: "failed", Error: "error while exporting"},
+		"b2b4e1f3c69e1ab3a2f0e3a5fd22e2e40b6c2e0a52b0adab4cdfe2c2f9d6c3e1": {ID: "archive.zip", Repo: "zip", ImportedAt: 1586286142, Status: "exported", PreprocessingDuration: 5 * time.Second},
+	} {
+		if err := s.UpdateJobs(ctx, qHash, p); err != nil {
+			t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter *hashr.JobFilter
+		want   []string
+	}{
+		{
+			name:   "all",
+			filter: &hashr.JobFilter{},
+			want:   []string{"archive.zip", "archive.tar.gz", "ubuntu-1804-lts", "ubuntu-1604-lts"},
+		},
+		{
+			name:   "repo",
+			filter: &hashr.JobFilter{Repo: "GCP"},
+			want:   []string{"ubuntu-1804-lts", "ubuntu-1604-lts"},
+		},
+		{
+			name:   "status",
+			filter: &hashr.JobFilter{Status: "failed"},
+			want:   []string{"archive.tar.gz", "ubuntu-1804-lts"},
+		},
+		{
+			name:   "time range",
+			filter: &hashr.JobFilter{ImportedAfter: time.Unix(1586286140, 0), ImportedBefore: time.Unix(1586286142, 0)},
+			want:   []string{"archive.tar.gz", "ubuntu-1804-lts"},
+		},
+		{
+			name:   "error substring",
+			filter: &hashr.JobFilter{ErrorContains: "no space left"},
+			want:   []string{"ubuntu-1804-lts"},
+		},
+		{
+			name:   "quick sha256",
+			filter: &hashr.JobFilter{QuickSha256: "9ad2027cae0d7b0f041a6fc1e3124ad4046b2665068c44c74546ad9811e81ec7"},
+			want:   []string{"archive.tar.gz"},
+		},
+		{
+			name:   "limit",
+			filter: &hashr.JobFilter{Limit: 2},
+			want:   []string{"archive.zip", "archive.tar.gz"},
+		},
+		{
+			name:   "offset",
+			filter: &hashr.JobFilter{Offset: 3},
+			want:   []string{"ubuntu-1604-lts"},
+		},
+		{
+			name:   "limit and offset",
+			filter: &hashr.JobFilter{Limit: 2, Offset: 1},
+			want:   []string{"archive.tar.gz", "ubuntu-1804-lts"},
+		},
+		{
+			name:   "no match",
+			filter: &hashr.JobFilter{Repo: "GCP", Status: "reprocess"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			jobs, err := s.QueryJobs(ctx, tc.filter)
+			if err != nil {
+				t.Fatalf("unexpected error while running QueryJobs(): %v", err)
+			}
+
+			var got []string
+			for _, j := range jobs {
+				got = append(got, j.ID)
+			}
+
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("QueryJobs() unexpected diff (-want/+got):\n%s", diff)
+			}
+		})
+	}
+
+	jobs, err := s.QueryJobs(ctx, &hashr.JobFilter{QuickSha256: "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"})
+	if err != nil {
+		t.Fatalf("unexpected error while running QueryJobs(): %v", err)
+	}
+
+	want := []*hashr.Job{{
+		QuickSha256: "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc",
+		ImportedAt:  1586286139,
+		ID:          "ubuntu-1604-lts",
+		Repo:        "GCP",
+		Status:      "exported",
+		SampleCount: 10,
+		ExportCount: 10,
+	}}
+	if diff := cmp.Diff(want, jobs); diff != "" {
+		t.Errorf("QueryJobs() unexpected job diff (-want/+got):\n%s", diff)
+	}
+}
+
+func TestMarkForReprocessing(t *testing.T) {
+	ctx := context.Background()
+	s, _ := testStorage(t)
+
+	qHash := "07123e1f482356c415f684407a3b8723e10b2cbbc0b8fcd6282c49d37c9c1abc"
+	if err := s.UpdateJobs(ctx, qHash, &hashr.ProcessingSource{Status: "failed", Error: "error while exporting"}); err != nil {
+		t.Fatalf("unexpected error while running UpdateJobs(): %v", err)
+	}
+
+	if err := s.MarkForReprocessing(ctx, qHash); err != nil {
+		t.Fatalf("unexpected error while running MarkForReprocessing(): %v", err)
+	}
+
+	jobs, err := s.FetchJobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error while running FetchJobs(): %v", err)
+	}
+	if jobs[qHash] != hashr.Reprocess {
+		t.Errorf("MarkForReprocessing() did not update the job status, got %q, want %q", jobs[qHash], hashr.Reprocess)
+	}
+
+	events, err := s.FetchJobHistory(ctx, qHash)
+	if err != nil {
+		t.Fatalf("unexpected error while running FetchJobHistory(): %v", err)
+	}
+	if len(events) != 2 || events[1].Status != hashr.Reprocess {
+		t.Errorf("MarkForReprocessing() did not record the job event, got %+v", events)
+	}
+
+	if err := s.MarkForReprocessing(ctx, "5c7a0f6e38f86f4db12130e5ca9f734f4def519b9a884ee8ea9fc45f9626c6fb"); err == nil {
+		t.Error("expected error while marking unknown job for reprocessing")
+	}
+}